@@ -0,0 +1,109 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+
+	"github.com/3xpluto/go-api-gateway/internal/config"
+	"github.com/3xpluto/go-api-gateway/internal/mw"
+	"github.com/3xpluto/go-api-gateway/internal/proxy"
+)
+
+// connCheck is one --check-connectivity probe; Err is nil when it passed.
+type connCheck struct {
+	Name string
+	Err  error
+}
+
+// checkConnectivity probes the external dependencies cfg points at: the JWKS
+// URLs (global or per-route auth.mode jwks), Redis (rate_limit.backend redis) and a DNS lookup of
+// every upstream host. Each probe gets its own timeout.
+func checkConnectivity(cfg *config.Config, timeout time.Duration) []connCheck {
+	var out []connCheck
+	run := func(name string, fn func(ctx context.Context) error) {
+		ctx, cancel := context.WithTimeout(context.Background(), timeout)
+		defer cancel()
+		out = append(out, connCheck{Name: name, Err: fn(ctx)})
+	}
+
+	jwks := []config.AuthConfig{cfg.Auth}
+	for _, rc := range cfg.Routes {
+		if ac, ok := cfg.RouteAuth(rc); ok {
+			jwks = append(jwks, ac)
+		}
+	}
+	probed := map[string]bool{}
+	for _, ac := range jwks {
+		if !strings.EqualFold(ac.Mode, "jwks") || probed[ac.JWKS.URL] {
+			continue
+		}
+		probed[ac.JWKS.URL] = true
+		run("jwks "+ac.JWKS.URL, func(ctx context.Context) error {
+			v, err := mw.NewJWKSValidator(ac.JWKS.URL, mw.JWKSValidatorOptions{
+				HTTPTimeout: timeout,
+				Issuers:     ac.JWKS.Issuers,
+				Audiences:   ac.JWKS.Audiences,
+				ValidAlgs:   []string{"RS256"},
+			})
+			if err != nil {
+				return err
+			}
+			return v.Prefetch(ctx)
+		})
+	}
+
+	if strings.EqualFold(cfg.RateLimit.Backend, "redis") {
+		run("redis "+cfg.RateLimit.Redis.Addr, func(ctx context.Context) error {
+			rdb := redis.NewClient(&redis.Options{
+				Addr:     cfg.RateLimit.Redis.Addr,
+				Password: cfg.RateLimit.Redis.Password,
+				DB:       cfg.RateLimit.Redis.DB,
+			})
+			defer rdb.Close()
+			return rdb.Ping(ctx).Err()
+		})
+	}
+
+	seen := map[string]bool{}
+	upstreams := []string{cfg.Server.DefaultHostUpstream, cfg.Server.DefaultUpstream}
+	for _, rc := range cfg.Routes {
+		upstreams = append(upstreams, rc.Upstream, rc.Canary.Upstream)
+	}
+	for _, raw := range upstreams {
+		u, err := url.Parse(raw)
+		if raw == "" || err != nil {
+			continue
+		}
+		if socket, ok := proxy.UnixSocket(u); ok && !seen[socket] {
+			seen[socket] = true
+			run("unix "+socket, func(ctx context.Context) error {
+				var d net.Dialer
+				c, err := d.DialContext(ctx, "unix", socket)
+				if err == nil {
+					c.Close()
+				}
+				return err
+			})
+			continue
+		}
+		host := u.Hostname()
+		if host == "" || seen[host] || net.ParseIP(host) != nil {
+			continue
+		}
+		seen[host] = true
+		run("dns "+host, func(ctx context.Context) error {
+			addrs, err := net.DefaultResolver.LookupHost(ctx, host)
+			if err == nil && len(addrs) == 0 {
+				err = fmt.Errorf("no addresses")
+			}
+			return err
+		})
+	}
+	return out
+}
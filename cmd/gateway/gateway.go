@@ -0,0 +1,882 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"os"
+	"runtime/debug"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/metric"
+	"gopkg.in/yaml.v3"
+
+	"github.com/3xpluto/go-api-gateway/internal/config"
+	"github.com/3xpluto/go-api-gateway/internal/httpx"
+	"github.com/3xpluto/go-api-gateway/internal/mw"
+	"github.com/3xpluto/go-api-gateway/internal/netx"
+	"github.com/3xpluto/go-api-gateway/internal/proxy"
+	"github.com/3xpluto/go-api-gateway/internal/ratelimit"
+)
+
+// upstreamPinHeader lets trusted callers force a route's stable or canary backend by host.
+const upstreamPinHeader = "X-Upstream-Pin"
+
+// gatewayDeps are the long-lived dependencies main constructs before the
+// handler tree (limiter backend, auth, upstream transport).
+type gatewayDeps struct {
+	Log       *slog.Logger
+	Limiter   ratelimit.Limiter
+	Quota     ratelimit.QuotaLimiter
+	Auth      mw.AuthHandler
+	JWKS      *mw.JWKSValidator // nil unless auth.mode is jwks
+	Transport http.RoundTripper
+	AdminKey  string
+	Meter     metric.Meter // nil unless metrics.otlp is enabled
+
+	AccessLog *slog.Logger // access log lines (logging.access.format); nil uses Log
+
+	RedisPing func(context.Context) error // nil unless rate_limit.backend is redis
+}
+
+// gateway is the wired-up request handling state built from config.
+// It lives outside main() so tests can drive the real wiring.
+type gateway struct {
+	cfg *config.Config
+	gatewayDeps
+
+	reg     *prometheus.Registry
+	metrics *mw.Metrics
+	ipr     mw.IPResolver
+
+	precedence []string // reorderable outer stages, first runs first
+	httpVer    mw.HTTPVersionConfig
+	rid        mw.RequestIDConfig
+	timing     *mw.TimingConfig // nil unless server.timing_debug.enabled
+
+	// routes is swapped whole by the admin route endpoints; routesMu serializes writers.
+	routes   atomic.Pointer[routeTable]
+	routesMu sync.Mutex
+
+	unixTransports map[string]http.RoundTripper // by socket path; guarded by routesMu
+	h2cTransports  map[string]http.RoundTripper // by socket path, "" for TCP; guarded by routesMu
+
+	authMu    sync.Mutex
+	routeAuth map[string]*routeAuth // route-level auth handlers by auth block; guarded by authMu
+
+	defaultHost *httputil.ReverseProxy // nil unless server.default_host_upstream is set
+	proxyErrors proxy.ErrorConfig
+	identity    proxy.Identity // upstream.identity
+
+	defaultRoute *proxy.Route // nil unless server.default_upstream is set
+
+	startedAt time.Time
+
+	redisCheck redisCheck // cached /-/status ping
+
+	maintenance atomic.Pointer[maintenanceMode] // nil unless POST /-/maintenance turned it on
+}
+
+func newGateway(cfg *config.Config, deps gatewayDeps) (*gateway, error) {
+	trusted, err := netx.ParseCIDRSet(cfg.Server.TrustedProxies)
+	if err != nil {
+		return nil, fmt.Errorf("server.trusted_proxies: %w", err)
+	}
+
+	if err := config.ValidatePrecedence(cfg.Server.Precedence); err != nil {
+		return nil, err
+	}
+	precedence := cfg.Server.Precedence
+	if len(precedence) == 0 {
+		precedence = config.DefaultPrecedence
+	}
+
+	httpx.SetErrorFieldMap(cfg.Errors.FieldMap)
+	httpx.SetRequestIDHeader(cfg.Server.RequestID.Header)
+	if cfg.Server.ChaosEnabled {
+		deps.Log.Warn("chaos injection enabled; route chaos blocks are active")
+	}
+	var timing *mw.TimingConfig
+	if cfg.Server.TimingDebug.Enabled {
+		timing = &mw.TimingConfig{Header: cfg.Server.TimingDebug.Header}
+		deps.Log.Warn("timing debug enabled; every request logs a request_timing line")
+	}
+
+	httpVer := mw.HTTPVersionConfig{HTTP10: cfg.Server.HTTP10Behavior}
+	switch cfg.Server.MinHTTPVersion {
+	case "1.0":
+		httpVer.MinMajor, httpVer.MinMinor = 1, 0
+	case "1.1":
+		httpVer.MinMajor, httpVer.MinMinor = 1, 1
+	case "2":
+		httpVer.MinMajor = 2
+	}
+
+	// ---- Metrics
+	reg := prometheus.NewRegistry()
+	metrics := mw.NewMetricsWith(reg, mw.MetricsOptions{StatusLabel: cfg.Metrics.StatusLabel})
+	if deps.Meter != nil {
+		if err := metrics.EnableOTel(deps.Meter); err != nil {
+			return nil, fmt.Errorf("otel metrics: %w", err)
+		}
+	}
+
+	if cfg.Upstream.Errors.Detailed {
+		deps.Log.Warn("detailed upstream errors enabled; error bodies expose upstream addresses")
+	}
+	log := deps.Log
+	proxyErrors := proxy.ErrorConfig{
+		Detailed:      cfg.Upstream.Errors.Detailed,
+		TimeoutStatus: cfg.Upstream.Errors.TimeoutStatus,
+		DialStatus:    cfg.Upstream.Errors.DialStatus,
+		Log: func(r *http.Request, status int, err error) {
+			log.Warn("upstream_error",
+				slog.String("rid", mw.RID(r.Context())),
+				slog.String("route", mw.RouteName(r.Context())),
+				slog.Int("status", status),
+				slog.String("error", err.Error()),
+			)
+		},
+	}
+
+	identity := proxy.Identity{UserAgentSuffix: cfg.Upstream.Identity.UserAgentSuffix}
+	if !cfg.Upstream.Identity.DisableVia {
+		identity.Via = cmp.Or(cfg.Upstream.Identity.ViaName, "apigw")
+	}
+	if cfg.Upstream.Identity.InstanceHeader {
+		host, _ := os.Hostname()
+		identity.Instance = cmp.Or(cfg.Upstream.Identity.InstanceID, host)
+	}
+
+	ipr := mw.IPResolver{Trusted: trusted}
+	var defaultHost *httputil.ReverseProxy
+	if cfg.Server.DefaultHostUpstream != "" {
+		u, err := url.Parse(cfg.Server.DefaultHostUpstream)
+		if err != nil {
+			return nil, fmt.Errorf("invalid server.default_host_upstream: %w", err)
+		}
+		defaultHost = proxy.BuildProxyWith(u, deps.Transport, proxy.ProxyOptions{
+			Errors:               proxyErrors,
+			StripResponseHeaders: cfg.Upstream.StripResponseHeaders,
+			TrustedProxies:       trusted,
+			Identity:             identity,
+			RequestStart:         cfg.Upstream.Timing.RequestStart,
+			ServerTiming:         cfg.Upstream.Timing.ServerTiming,
+		})
+	}
+
+	g := &gateway{
+		cfg:         cfg,
+		gatewayDeps: deps,
+		reg:         reg,
+		metrics:     metrics,
+		ipr:         ipr,
+		precedence:  precedence,
+		httpVer:     httpVer,
+		rid:         mw.RequestIDConfig{Header: cfg.Server.RequestID.Header, Fallbacks: cfg.Server.RequestID.FallbackHeaders},
+		timing:      timing,
+		defaultHost: defaultHost,
+		proxyErrors: proxyErrors,
+		identity:    identity,
+		startedAt:   time.Now(),
+
+		unixTransports: map[string]http.RoundTripper{},
+		h2cTransports:  map[string]http.RoundTripper{},
+		routeAuth:      map[string]*routeAuth{},
+	}
+	if cfg.Server.DefaultUpstream != "" {
+		u, err := url.Parse(cfg.Server.DefaultUpstream)
+		if err != nil {
+			return nil, fmt.Errorf("invalid server.default_upstream: %w", err)
+		}
+		g.defaultRoute = &proxy.Route{
+			Name:         config.DefaultRouteName,
+			Upstream:     u,
+			MaxBodyBytes: cfg.Server.MaxBodyBytes,
+			Proxy: g.upstreamProxy(u, false, func(rt http.RoundTripper) http.RoundTripper { return rt }, proxy.ProxyOptions{
+				Errors:               proxyErrors,
+				StripResponseHeaders: cfg.Upstream.StripResponseHeaders,
+				TrustedProxies:       trusted,
+				Identity:             identity,
+				RequestStart:         cfg.Upstream.Timing.RequestStart,
+				ServerTiming:         cfg.Upstream.Timing.ServerTiming,
+			}),
+		}
+	}
+	table, err := g.buildRoutes(cfg.Routes, nil)
+	if err != nil {
+		return nil, err
+	}
+	g.routes.Store(table)
+	return g, nil
+}
+
+// canaryKey is the sticky canary key: the subject when authenticated, else client IP.
+func (g *gateway) canaryKey(r *http.Request) string {
+	if sub, ok := mw.Subject(r.Context()); ok {
+		return "u:" + sub
+	}
+	return "ip:" + g.ipr.ClientIP(r)
+}
+
+// upstreamPin returns the X-Upstream-Pin host when the request may force a
+// backend: it comes from a trusted proxy or carries the admin key. The pin
+// headers are stripped either way so they never reach the upstream.
+func (g *gateway) upstreamPin(r *http.Request) string {
+	pin := r.Header.Get(upstreamPinHeader)
+	if pin == "" {
+		return ""
+	}
+	trusted := g.ipr.FromTrustedProxy(r) ||
+		(g.AdminKey != "" && r.Header.Get(mw.AdminKeyHeader) == g.AdminKey)
+	r.Header.Del(upstreamPinHeader)
+	r.Header.Del(mw.AdminKeyHeader)
+	if !trusted {
+		return ""
+	}
+	return pin
+}
+
+// writeJSON writes v as a JSON response with the given status code.
+func writeJSON(w http.ResponseWriter, code int, v map[string]any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	_ = json.NewEncoder(w).Encode(v)
+}
+
+// writeError is writeJSON for error bodies, honoring errors.field_map.
+func writeError(w http.ResponseWriter, code int, errCode string, fields map[string]any) {
+	w.Header().Set("Content-Type", "application/json")
+	httpx.WriteError(w, code, errCode, fields)
+}
+
+// limitKey resolves the rate-limit key addressed by /-/limits/{route}?scope=ip|user&id=...[&method=],
+// writing a 404/400 and returning ok=false when the route or query is invalid.
+func (g *gateway) limitKey(w http.ResponseWriter, r *http.Request) (key string, ok bool) {
+	route := r.PathValue("route")
+	scope := r.URL.Query().Get("scope")
+	id := r.URL.Query().Get("id")
+	method := r.URL.Query().Get("method") // per_method routes only
+
+	rc, known := g.table().config(route)
+	if !known {
+		writeError(w, http.StatusNotFound, "unknown_route", map[string]any{"route": route})
+		return "", false
+	}
+	if (scope != "ip" && scope != "user") || id == "" {
+		writeError(w, http.StatusBadRequest, "scope must be ip or user and id is required", nil)
+		return "", false
+	}
+	if method != "" {
+		if m := (mw.RateLimitConfig{Methods: rateLimitTiers(rc.RateLimit.Methods)}).MethodBucket(strings.ToUpper(method)); m != "" {
+			route += ":" + m
+		}
+	}
+	return mw.RateLimitKey(route, scope, id), true
+}
+
+// limitsMetrics are the gauges in the /-/limits prometheus snapshot, in output order.
+var limitsMetrics = []struct{ name, help string }{
+	{"apigw_route_concurrency_in_flight", "Requests currently in flight on the route."},
+	{"apigw_route_concurrency_max_in_flight", "Configured max_in_flight for the route."},
+	{"apigw_route_breaker_state", "Circuit breaker state of the route (1 for the current state)."},
+	{"apigw_route_breaker_failures", "Consecutive failures counted by the route's circuit breaker."},
+}
+
+// limits reports per-route concurrency and breaker state:
+// GET /-/limits[?route=prefix][&state=open|half_open|closed][&format=prometheus]
+func (g *gateway) limits(w http.ResponseWriter, r *http.Request) {
+	prefix := r.URL.Query().Get("route")
+	state := mw.BreakerState(r.URL.Query().Get("state"))
+	switch state {
+	case "", mw.BreakerClosed, mw.BreakerOpen, mw.BreakerHalfOpen:
+	default:
+		writeError(w, http.StatusBadRequest, "state must be open, half_open or closed", nil)
+		return
+	}
+	promFormat := r.URL.Query().Get("format") == "prometheus"
+
+	t := g.table()
+	rows := make([]map[string]any, 0, len(t.configs))
+	// The text format wants each metric's samples in one group under its
+	// HELP/TYPE lines, so collect them per metric and write them at the end.
+	prom := make([][]string, len(limitsMetrics))
+	for _, rc := range t.configs {
+		if !strings.HasPrefix(rc.Name, prefix) {
+			continue
+		}
+		br := t.breakers[rc.Name]
+		if state != "" && (br == nil || br.Stats().State != state) {
+			continue
+		}
+		sem := t.sems[rc.Name]
+		if sem != nil && !sem.Enabled() {
+			sem = nil
+		}
+
+		if promFormat {
+			if sem != nil {
+				prom[0] = append(prom[0], fmt.Sprintf("{route=%q} %d", rc.Name, sem.InUse()))
+				prom[1] = append(prom[1], fmt.Sprintf("{route=%q} %d", rc.Name, sem.Cap()))
+			}
+			if br != nil {
+				st := br.Stats()
+				for _, s := range []mw.BreakerState{mw.BreakerClosed, mw.BreakerOpen, mw.BreakerHalfOpen} {
+					v := 0
+					if st.State == s {
+						v = 1
+					}
+					prom[2] = append(prom[2], fmt.Sprintf("{route=%q,state=%q} %d", rc.Name, s, v))
+				}
+				prom[3] = append(prom[3], fmt.Sprintf("{route=%q} %d", rc.Name, st.Failures))
+			}
+			continue
+		}
+
+		row := map[string]any{"route": rc.Name}
+		if sem != nil {
+			row["concurrency"] = map[string]any{
+				"max_in_flight": sem.Cap(),
+				"in_flight":     sem.InUse(),
+			}
+		}
+		if br != nil {
+			row["circuit_breaker"] = br.Stats()
+		}
+		rows = append(rows, row)
+	}
+
+	if promFormat {
+		var b strings.Builder
+		for i, m := range limitsMetrics {
+			if len(prom[i]) == 0 {
+				continue
+			}
+			fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s gauge\n", m.name, m.help, m.name)
+			for _, sample := range prom[i] {
+				b.WriteString(m.name + sample + "\n")
+			}
+		}
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		_, _ = w.Write([]byte(b.String()))
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(rows)
+}
+
+// resetLimit clears one actor's rate-limit bucket for a route:
+// DELETE /-/limits/{route}?scope=ip|user&id=...
+func (g *gateway) resetLimit(w http.ResponseWriter, r *http.Request) {
+	key, ok := g.limitKey(w, r)
+	if !ok {
+		return
+	}
+
+	found, err := g.Limiter.Reset(r.Context(), key)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, "limiter_unavailable", nil)
+		return
+	}
+	// Clear the soft bucket too so the actor starts from a clean slate.
+	if soft, err := g.Limiter.Reset(r.Context(), key+":soft"); err == nil && soft {
+		found = true
+	}
+
+	g.Log.Info("admin_rate_limit_reset",
+		slog.String("rid", mw.RID(r.Context())),
+		slog.String("route", r.PathValue("route")),
+		slog.String("scope", r.URL.Query().Get("scope")),
+		slog.String("id", r.URL.Query().Get("id")),
+		slog.Bool("found", found),
+	)
+
+	if !found {
+		writeError(w, http.StatusNotFound, "not_found", map[string]any{"key": key})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{"reset": true, "key": key})
+}
+
+// peekLimit reports one actor's rate-limit bucket without consuming a token:
+// GET /-/limits/{route}/peek?scope=ip|user&id=...
+func (g *gateway) peekLimit(w http.ResponseWriter, r *http.Request) {
+	key, ok := g.limitKey(w, r)
+	if !ok {
+		return
+	}
+
+	st, found, err := g.Limiter.Peek(r.Context(), key)
+	if err != nil {
+		writeError(w, http.StatusBadGateway, "limiter_unavailable", nil)
+		return
+	}
+	if !found {
+		writeError(w, http.StatusNotFound, "not_found", map[string]any{"key": key})
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]any{
+		"key":       key,
+		"tokens":    st.Tokens,
+		"limit_rps": st.LimitRPS,
+		"burst":     st.Burst,
+		"reset_at":  st.ResetAt.UTC().Format(time.RFC3339),
+	})
+}
+
+// accessLog returns the logger and settings shared by every access-logged handler.
+func (g *gateway) accessLog() (*slog.Logger, mw.AccessLogConfig) {
+	cfg := g.cfg
+	accessLogger := g.AccessLog
+	if accessLogger == nil {
+		accessLogger = g.Log
+	}
+	accessLog := mw.AccessLogConfig{
+		Headers:       cfg.Logging.Access.Headers,
+		RedactHeaders: cfg.Logging.Access.RedactHeaders,
+		Query:         cfg.Logging.Access.Query,
+		RedactQuery:   cfg.Logging.Access.RedactQueryParams,
+		SampleEvery:   cfg.Logging.Access.SampleEvery,
+	}
+	if p := cfg.Auth.TokenSources.QueryParam; p != "" {
+		accessLog.RedactQuery = append([]string{p}, accessLog.RedactQuery...)
+	}
+	return accessLogger, accessLog
+}
+
+func healthz(w http.ResponseWriter, _ *http.Request) {
+	if _, err := w.Write([]byte("ok")); err != nil {
+		return
+	}
+}
+
+// readyz answers 200 once every JWKS key set in use has loaded, 503 before.
+// It is public, so the body is only {"ready": bool}; the per-key-set fetch
+// state is in the admin /-/status.
+func (g *gateway) readyz(w http.ResponseWriter, _ *http.Request) {
+	ready := true
+	for _, v := range g.jwksValidators() {
+		if !v.Ready() {
+			ready = false
+		}
+	}
+	status := http.StatusOK
+	if !ready {
+		status = http.StatusServiceUnavailable
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(map[string]any{"ready": ready})
+}
+
+// jwksValidators returns the global JWKS validator and any route overrides' ones.
+func (g *gateway) jwksValidators() []*mw.JWKSValidator {
+	var out []*mw.JWKSValidator
+	seen := map[*mw.JWKSValidator]bool{}
+	add := func(v *mw.JWKSValidator) {
+		if v != nil && !seen[v] {
+			seen[v] = true
+			out = append(out, v)
+		}
+	}
+	add(g.JWKS)
+	t := g.table()
+	for _, rc := range t.configs {
+		if a, ok := t.auth[rc.Name].(jwksAuthAdapter); ok {
+			add(a.v)
+		}
+	}
+	return out
+}
+
+// configDump serves the effective config (defaults applied, env expanded,
+// current routes) as JSON under the config file's field names, with secrets
+// redacted by config.Redacted.
+func (g *gateway) configDump(w http.ResponseWriter, _ *http.Request) {
+	cfg := *g.cfg
+	cfg.Routes = g.table().configs
+	raw, err := yaml.Marshal(cfg.Redacted())
+	var out map[string]any
+	if err == nil {
+		err = yaml.Unmarshal(raw, &out)
+	}
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "config_dump_failed", map[string]any{"message": err.Error()})
+		return
+	}
+	writeJSON(w, http.StatusOK, out)
+}
+
+// adminHandler serves health, metrics and the admin endpoints on admin.addr.
+func (g *gateway) adminHandler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", healthz)
+	mux.HandleFunc("/readyz", g.readyz)
+	g.registerAdmin(mux)
+	return mux
+}
+
+// registerAdmin adds /metrics and the key-guarded /-/* endpoints to mux.
+func (g *gateway) registerAdmin(mux *http.ServeMux) {
+	cfg := g.cfg
+	accessLogger, accessLog := g.accessLog()
+
+	if !cfg.Metrics.DisablePrometheus {
+		mux.Handle("/metrics", promhttp.HandlerFor(g.reg, promhttp.HandlerOpts{}))
+	}
+
+	// ---- Admin endpoints (guarded)
+	wrapAdmin := func(routeName string, h http.Handler) http.Handler {
+		h = mw.RequireAdminKey(g.AdminKey, h)
+		h = mw.AccessLogWith(accessLogger, accessLog, h)
+		h = mw.Instrument(g.metrics, h)
+		h = mw.WithRoute(h, routeName)
+		h = mw.RequestIDWith(g.rid, h)
+		return h
+	}
+
+	mux.Handle("/-/status", wrapAdmin("admin_status", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		info, _ := debug.ReadBuildInfo()
+		goVer := ""
+		if info != nil {
+			goVer = info.GoVersion
+		}
+
+		out := map[string]any{
+			"time_utc":          time.Now().UTC().Format(time.RFC3339),
+			"uptime_seconds":    int(time.Since(g.startedAt).Seconds()),
+			"listen_addr":       cfg.Server.Addr,
+			"admin_addr":        cfg.Admin.Addr,
+			"go_version":        goVer,
+			"auth_mode":         cfg.Auth.Mode,
+			"rate_backend":      cfg.RateLimit.Backend,
+			"routes_configured": len(g.table().configs),
+		}
+		healthy, redis, jwks := g.dependencyStatus(r.Context())
+		out["healthy"] = healthy
+		if redis != nil {
+			out["redis"] = redis
+		}
+		if jwks != nil {
+			out["jwks"] = jwks
+		}
+		if vs := g.jwksValidators(); len(vs) > 0 {
+			sets := make([]mw.JWKSStats, 0, len(vs))
+			for _, v := range vs {
+				sets = append(sets, v.Stats())
+			}
+			out["jwks_key_sets"] = sets
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(out)
+	})))
+
+	mux.Handle("GET /-/config", wrapAdmin("admin_config", http.HandlerFunc(g.configDump)))
+	mux.Handle("GET /-/metrics-summary", wrapAdmin("admin_metrics_summary", http.HandlerFunc(g.metricsSummaryHandler)))
+
+	mux.Handle("GET /-/maintenance", wrapAdmin("admin_maintenance", http.HandlerFunc(g.maintenanceState)))
+	mux.Handle("POST /-/maintenance", wrapAdmin("admin_maintenance_set", http.HandlerFunc(g.setMaintenance)))
+
+	mux.Handle("GET /-/routes", wrapAdmin("admin_routes", http.HandlerFunc(g.listRoutes)))
+	mux.Handle("POST /-/routes", wrapAdmin("admin_routes_create", http.HandlerFunc(g.createRoute)))
+	mux.Handle("PUT /-/routes/{name}", wrapAdmin("admin_routes_update", http.HandlerFunc(g.updateRoute)))
+	mux.Handle("DELETE /-/routes/{name}", wrapAdmin("admin_routes_delete", http.HandlerFunc(g.deleteRoute)))
+
+	mux.Handle("/-/auth", wrapAdmin("admin_auth", http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		out := map[string]any{
+			"mode": cfg.Auth.Mode,
+		}
+		if g.JWKS != nil {
+			out["jwks"] = g.JWKS.Stats()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(out)
+	})))
+
+	mux.Handle("/-/limits", wrapAdmin("admin_limits", http.HandlerFunc(g.limits)))
+
+	mux.Handle("DELETE /-/limits/{route}", wrapAdmin("admin_limits_reset", http.HandlerFunc(g.resetLimit)))
+	mux.Handle("GET /-/limits/{route}/peek", wrapAdmin("admin_limits_peek", http.HandlerFunc(g.peekLimit)))
+}
+
+// handler returns the top-level mux: health, the proxy catch-all and, unless
+// admin.addr moves them to their own listener, metrics and admin endpoints.
+func (g *gateway) handler() http.Handler {
+	log := g.Log
+	accessLogger, accessLog := g.accessLog()
+
+	// ---- HTTP server / mux
+	mux := http.NewServeMux()
+	mux.HandleFunc("/healthz", healthz)
+	mux.HandleFunc("/readyz", g.readyz)
+	if g.cfg.Admin.Addr == "" {
+		g.registerAdmin(mux)
+	}
+
+	// Requests for hosts no route knows about, when a fallback is configured.
+	var defaultHost http.Handler
+	if g.defaultHost != nil {
+		// The catch-all service sees the original host in X-Forwarded-Host.
+		defaultHost = g.defaultHost
+		defaultHost = mw.MaxBodyBytes(g.cfg.Server.MaxBodyBytes, defaultHost)
+		defaultHost = mw.AccessLogWith(accessLogger, accessLog, defaultHost)
+		defaultHost = mw.Instrument(g.metrics, defaultHost)
+		defaultHost = mw.WithRoute(defaultHost, "default_host")
+		defaultHost = mw.RequestIDWith(g.rid, defaultHost)
+	}
+
+	// A path some route serves, with a method none of them accepts: OPTIONS
+	// is answered with the Allow list, anything else gets 405.
+	methodNotAllowed := func(allow []string) http.Handler {
+		var h http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Allow", strings.Join(allow, ", "))
+			if r.Method == http.MethodOptions {
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			writeError(w, http.StatusMethodNotAllowed, "method_not_allowed", nil)
+		})
+		h = mw.AccessLogWith(accessLogger, accessLog, h)
+		h = mw.Instrument(g.metrics, h)
+		h = mw.WithRoute(h, "method_not_allowed")
+		return mw.RequestIDWith(g.rid, h)
+	}
+
+	// Maintenance mode answers all proxy traffic; health, metrics and admin
+	// endpoints have their own mux entries and keep working.
+	maintenance := func(m *maintenanceMode) http.Handler {
+		h := maintenanceResponse(m)
+		h = mw.AccessLogWith(accessLogger, accessLog, h)
+		h = mw.Instrument(g.metrics, h)
+		h = mw.WithRoute(h, "maintenance")
+		return mw.RequestIDWith(g.rid, h)
+	}
+
+	// A matched route switched off with disabled: true; nothing past the
+	// route match runs.
+	routeDisabled := func(name string) http.Handler {
+		var h http.Handler = http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			writeError(w, http.StatusServiceUnavailable, "route_disabled", map[string]any{"route": name})
+		})
+		h = mw.AccessLogWith(accessLogger, accessLog, h)
+		h = mw.Instrument(g.metrics, h)
+		h = mw.WithRoute(h, name)
+		return mw.RequestIDWith(g.rid, h)
+	}
+
+	// Nothing matched and no default upstream took it.
+	var noRoute http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		writeError(w, http.StatusNotFound, "no_route", map[string]any{"path": r.URL.Path})
+	})
+	noRoute = mw.AccessLogWith(accessLogger, accessLog, noRoute)
+	noRoute = mw.Instrument(g.metrics, noRoute)
+	noRoute = mw.WithRoute(noRoute, "no_route")
+	noRoute = mw.RequestIDWith(g.rid, noRoute)
+
+	// phase attributes a stage's own time in the server.timing_debug breakdown.
+	phase := func(name string, h http.Handler) http.Handler {
+		if g.timing == nil {
+			return h
+		}
+		return mw.TimePhase(name, h)
+	}
+
+	// ---- Main gateway handler (catch-all)
+	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if m := g.maintenance.Load(); m != nil {
+			maintenance(m).ServeHTTP(w, r)
+			return
+		}
+		t := g.table()
+		route, redirectTo, allow := t.rtr.LookupMethod(r.Method, r.Host, r.URL.Path, r.URL.Query())
+		if route == nil {
+			if len(allow) > 0 {
+				methodNotAllowed(allow).ServeHTTP(w, r)
+				return
+			}
+			if defaultHost != nil && !t.rtr.HostKnown(r.Host) {
+				defaultHost.ServeHTTP(w, r)
+				return
+			}
+			if g.defaultRoute == nil {
+				noRoute.ServeHTTP(w, r)
+				return
+			}
+			// Everything else unmatched gets the full chain as route "default".
+			route = g.defaultRoute
+		}
+		if redirectTo != "" {
+			u := *r.URL
+			u.Path, u.RawPath = redirectTo, ""
+			http.Redirect(w, r, u.RequestURI(), http.StatusPermanentRedirect)
+			return
+		}
+		if route.Disabled {
+			routeDisabled(route.Name).ServeHTTP(w, r)
+			return
+		}
+
+		// Base proxy handler
+		var h http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.URL.Path = proxy.AddPath(proxy.StripPath(r.URL.Path, route.StripPrefix), route.AddPrefix)
+			target, label := route.Proxy, "stable"
+			c := route.Canary
+			switch pin := g.upstreamPin(r); {
+			case pin != "" && pin == route.Upstream.Host:
+			case pin != "" && c != nil && pin == c.Upstream.Host:
+				target, label = c.Proxy, "canary"
+			case c != nil && c.Use(g.canaryKey(r)):
+				target, label = c.Proxy, "canary"
+			}
+			if label == "canary" && c.Header {
+				w.Header().Set("X-Canary", "true")
+			}
+			g.metrics.UpstreamTarget.WithLabelValues(route.Name, label).Inc()
+			target.ServeHTTP(w, mw.TraceUpstream(r))
+		})
+		h = phase("upstream", h)
+
+		// Chaos stands in for a slow/failing upstream, so the breaker counts its errors.
+		h = mw.Chaos(mw.ChaosConfig{
+			Delay:        route.Chaos.Delay,
+			ErrorPercent: route.Chaos.ErrorPercent,
+			ErrorStatus:  route.Chaos.ErrorStatus,
+		}, h)
+		h = phase("chaos", h)
+
+		// Circuit breaker should see upstream status codes.
+		if br := t.breakers[route.Name]; br != nil {
+			h = phase("circuit_breaker", mw.CircuitBreak(br, h))
+		}
+
+		// Concurrency should NOT count as breaker failure (including queue timeouts); keep it outside breaker.
+		if sem := t.sems[route.Name]; sem != nil && sem.Enabled() {
+			h = mw.ConcurrencyLimitWait(sem, mw.ConcurrencyConfig{
+				Mode:         route.ConcurrencyMode,
+				MaxWait:      route.MaxWait,
+				RetryAfter:   route.BusyRetry,
+				Metrics:      g.metrics,
+				IgnoreCancel: route.QueueIgnoresCancel,
+			}, h)
+			h = phase("concurrency", h)
+		}
+		// Per-subject cap sits outside the route semaphore so one subject can't occupy its slots.
+		h = phase("concurrency_per_subject", mw.ConcurrencyPerSubject(t.subjectSems[route.Name], route.BusyRetry, h))
+
+		// Coalesced requests share one trip through concurrency and the breaker,
+		// but each is still authenticated, rate limited and counted in quota.
+		if fl := t.flights[route.Name]; fl != nil {
+			h = phase("single_flight", mw.SingleFlight(mw.SingleFlightConfig{
+				Group:         fl,
+				Metrics:       g.metrics,
+				IgnoreHeaders: g.rid.Headers(),
+			}, h))
+		}
+
+		// Quota keys on the subject, so it sits inside auth.
+		h = mw.Quota(g.Quota, g.ipr, mw.QuotaConfig{
+			Daily:     route.QuotaDaily,
+			RouteName: route.Name,
+		}, h)
+		h = phase("quota", h)
+
+		// Malformed requests are rejected before they count against the quota.
+		if len(route.RequiredHeaders) > 0 {
+			reqs := make([]mw.HeaderRequirement, 0, len(route.RequiredHeaders))
+			for _, rh := range route.RequiredHeaders {
+				reqs = append(reqs, mw.HeaderRequirement{Name: rh.Name, Values: rh.Values})
+			}
+			h = phase("required_headers", mw.RequireHeaders(reqs, h))
+		}
+
+		// Auth + RL should run outside breaker/concurrency so 401/429 don't affect breaker.
+		// Their relative order is configurable via server.precedence.
+		stages := map[string]func(http.Handler) http.Handler{
+			config.StageAuth: func(next http.Handler) http.Handler {
+				auth := g.Auth
+				if a := t.auth[route.Name]; a != nil {
+					auth = a
+				}
+				var h http.Handler
+				switch {
+				case route.AuthRequired:
+					h = mw.RequireAuth(auth, next)
+				case route.RejectInvalidToken:
+					h = mw.OptionalAuthRejectInvalid(auth, next)
+				default:
+					h = next
+				}
+				if route.ClientCertAuth {
+					h = mw.ClientCertAuth(h, next)
+				}
+				return h
+			},
+			config.StageRateLimit: func(next http.Handler) http.Handler {
+				return mw.RateLimit(g.Limiter, g.ipr, mw.RateLimitConfig{
+					Enabled:   route.RateLimit.Enabled,
+					RPS:       route.RateLimit.RPS,
+					Burst:     route.RateLimit.Burst,
+					Scope:     route.RateLimit.Scope,
+					RouteName: route.Name,
+					SoftRPS:   route.RateLimit.SoftRPS,
+					Metrics:   g.metrics,
+					DryRun:    route.RateLimit.DryRun,
+					Log:       log,
+
+					Tiers:       t.rateTiers[route.Name],
+					DefaultTier: route.RateLimit.DefaultTier,
+					PerMethod:   route.RateLimit.PerMethod,
+					Methods:     t.rateMethods[route.Name],
+				}, next)
+			},
+		}
+		for i := len(g.precedence) - 1; i >= 0; i-- {
+			h = phase(g.precedence[i], stages[g.precedence[i]](h))
+		}
+
+		// Oversized bodies are turned away before auth or rate limiting spend anything on them.
+		h = phase("max_body", mw.MaxBodyBytes(route.MaxBodyBytes, h))
+
+		// Client cert allowlisting is a connection-level check; run it before any stage.
+		if len(route.ClientSubjects) > 0 {
+			h = phase("client_cert", mw.RequireClientSubject(route.ClientSubjects, h))
+		}
+
+		// Cross-cutting middleware (outermost -> innermost)
+		routeLog := accessLog
+		if route.AccessLogSample > 0 {
+			routeLog.SampleEvery = route.AccessLogSample
+		}
+		routeLog.HeadAsGet = route.HeadAsGet
+		routeLog.UpstreamAttempts = route.Hedged
+		h = phase("access_log", mw.AccessLogWith(accessLogger, routeLog, h))
+		h = phase("metrics", mw.Instrument(g.metrics, h))
+		if g.timing != nil {
+			h = mw.Timing(log, *g.timing, h)
+		}
+		h = mw.WithRoute(h, route.Name)
+		h = mw.RequestIDWith(g.rid, h)
+		if route.RequireRequestID {
+			h = mw.RequireRequestID(g.rid, h)
+		}
+
+		h.ServeHTTP(w, r)
+	}))
+
+	h := mw.HTTPVersion(g.httpVer, mux)
+	if g.cfg.Upstream.Timing.RequestStart {
+		// Outermost, so X-Request-Start covers everything the gateway does.
+		h = httpx.StampReceived(h)
+	}
+	return h
+}
@@ -0,0 +1,2435 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/prometheus/client_golang/prometheus/testutil/promlint"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+
+	"github.com/3xpluto/go-api-gateway/internal/config"
+	"github.com/3xpluto/go-api-gateway/internal/httpx"
+	"github.com/3xpluto/go-api-gateway/internal/mw"
+	"github.com/3xpluto/go-api-gateway/internal/ratelimit"
+)
+
+// newTestGateway wires cfg through newGateway exactly as main does, using a
+// memory limiter and HMAC auth.
+func newTestGateway(t *testing.T, cfg *config.Config) *gateway {
+	t.Helper()
+	limiter := ratelimit.NewMemoryLimiter(time.Minute, time.Minute)
+	t.Cleanup(func() { _ = limiter.Close() })
+
+	gw, err := newGateway(cfg, gatewayDeps{
+		Log:       slog.New(slog.NewJSONHandler(io.Discard, nil)),
+		Limiter:   limiter,
+		Quota:     ratelimit.NewMemoryQuota(),
+		Auth:      mw.Authenticator{Mode: "hmac", HMACSecret: []byte("test-secret")},
+		Transport: http.DefaultTransport,
+		AdminKey:  "test-admin-key",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return gw
+}
+
+func okUpstream(t *testing.T) *httptest.Server {
+	t.Helper()
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(up.Close)
+	return up
+}
+
+func TestGateway_TrustedProxiesHonorXFF(t *testing.T) {
+	up := okUpstream(t)
+
+	newCfg := func(trusted []string) *config.Config {
+		return &config.Config{
+			Server: config.ServerConfig{TrustedProxies: trusted},
+			Routes: []config.RouteConfig{{
+				Name:     "ip",
+				Match:    config.MatchConfig{PathPrefix: "/ip/"},
+				Upstream: up.URL,
+				RateLimit: config.RouteRLConfig{
+					Enabled: true, RPS: 0.001, Burst: 1, Scope: "ip",
+				},
+			}},
+		}
+	}
+
+	// get sends a request from the loopback test client claiming to forward for clientIP.
+	get := func(t *testing.T, gwURL, clientIP string) int {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, gwURL+"/ip/x", nil)
+		req.Header.Set("X-Forwarded-For", clientIP)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	t.Run("trusted", func(t *testing.T) {
+		srv := httptest.NewServer(newTestGateway(t, newCfg([]string{"127.0.0.1/32", "::1"})).handler())
+		defer srv.Close()
+
+		if code := get(t, srv.URL, "203.0.113.1"); code != http.StatusOK {
+			t.Fatalf("expected first client allowed, got %d", code)
+		}
+		if code := get(t, srv.URL, "203.0.113.1"); code != http.StatusTooManyRequests {
+			t.Fatalf("expected same client limited, got %d", code)
+		}
+		// A different forwarded client gets its own bucket.
+		if code := get(t, srv.URL, "203.0.113.2"); code != http.StatusOK {
+			t.Fatalf("expected second client allowed via XFF, got %d", code)
+		}
+	})
+
+	t.Run("untrusted", func(t *testing.T) {
+		srv := httptest.NewServer(newTestGateway(t, newCfg(nil)).handler())
+		defer srv.Close()
+
+		if code := get(t, srv.URL, "203.0.113.1"); code != http.StatusOK {
+			t.Fatalf("expected first request allowed, got %d", code)
+		}
+		// XFF is ignored, so both "clients" share the peer's bucket.
+		if code := get(t, srv.URL, "203.0.113.2"); code != http.StatusTooManyRequests {
+			t.Fatalf("expected spoofed XFF to be ignored, got %d", code)
+		}
+	})
+}
+
+// The X-Forwarded-For sent upstream follows the same trust decision as the
+// client IP used for rate limiting.
+func TestGateway_TrustedProxiesGovernUpstreamXFF(t *testing.T) {
+	seen := make(chan string, 1)
+	up := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		seen <- r.Header.Get("X-Forwarded-For")
+	}))
+	t.Cleanup(up.Close)
+
+	for _, tc := range []struct {
+		name    string
+		trusted []string
+		want    string
+	}{
+		{"trusted", []string{"127.0.0.1"}, "203.0.113.1, 127.0.0.1"},
+		{"untrusted", nil, "127.0.0.1"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(newTestGateway(t, &config.Config{
+				Server: config.ServerConfig{TrustedProxies: tc.trusted},
+				Routes: []config.RouteConfig{{Name: "xff", Match: config.MatchConfig{PathPrefix: "/"}, Upstream: up.URL}},
+			}).handler())
+			defer srv.Close()
+
+			req, _ := http.NewRequest(http.MethodGet, srv.URL+"/x", nil)
+			req.Header.Set("X-Forwarded-For", "203.0.113.1")
+			resp, err := http.DefaultClient.Do(req)
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if got := <-seen; got != tc.want {
+				t.Fatalf("expected upstream X-Forwarded-For %q, got %q", tc.want, got)
+			}
+		})
+	}
+}
+
+func TestNewGateway_RejectsInvalidTrustedProxy(t *testing.T) {
+	_, err := newGateway(&config.Config{
+		Server: config.ServerConfig{TrustedProxies: []string{"not-a-cidr"}},
+		Routes: []config.RouteConfig{{Name: "a", Match: config.MatchConfig{PathPrefix: "/"}, Upstream: "http://127.0.0.1:1"}},
+	}, gatewayDeps{Transport: http.DefaultTransport})
+	if err == nil {
+		t.Fatal("expected invalid trusted proxy to fail startup")
+	}
+}
+
+// countingAuth accepts "Bearer <sub>" and counts how often it was consulted.
+type countingAuth struct{ calls atomic.Int32 }
+
+func (a *countingAuth) ValidateBearer(r *http.Request) (string, error) {
+	a.calls.Add(1)
+	sub, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok || sub == "" {
+		return "", errors.New("missing bearer token")
+	}
+	return sub, nil
+}
+
+func TestGateway_Precedence(t *testing.T) {
+	up := okUpstream(t)
+
+	newCfg := func(precedence []string) *config.Config {
+		return &config.Config{
+			Server: config.ServerConfig{Precedence: precedence},
+			Routes: []config.RouteConfig{{
+				Name:         "users",
+				Match:        config.MatchConfig{PathPrefix: "/users/"},
+				Upstream:     up.URL,
+				AuthRequired: true,
+				RateLimit: config.RouteRLConfig{
+					Enabled: true, RPS: 0.001, Burst: 1, Scope: "user",
+				},
+			}},
+		}
+	}
+	get := func(t *testing.T, gwURL, sub string) int {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, gwURL+"/users/me", nil)
+		req.Header.Set("Authorization", "Bearer "+sub)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	t.Run("default authenticates first so user scope keys on subject", func(t *testing.T) {
+		gw := newTestGateway(t, newCfg(nil))
+		gw.Auth = &countingAuth{}
+		srv := httptest.NewServer(gw.handler())
+		defer srv.Close()
+
+		if code := get(t, srv.URL, "alice"); code != http.StatusOK {
+			t.Fatalf("expected alice allowed, got %d", code)
+		}
+		if code := get(t, srv.URL, "bob"); code != http.StatusOK {
+			t.Fatalf("expected bob to have his own bucket, got %d", code)
+		}
+	})
+
+	t.Run("rate_limit first short-circuits before auth", func(t *testing.T) {
+		auth := &countingAuth{}
+		gw := newTestGateway(t, newCfg([]string{config.StageRateLimit, config.StageAuth}))
+		gw.Auth = auth
+		srv := httptest.NewServer(gw.handler())
+		defer srv.Close()
+
+		if code := get(t, srv.URL, "alice"); code != http.StatusOK {
+			t.Fatalf("expected first request allowed, got %d", code)
+		}
+		if code := get(t, srv.URL, "alice"); code != http.StatusTooManyRequests {
+			t.Fatalf("expected second request limited, got %d", code)
+		}
+		if n := auth.calls.Load(); n != 1 {
+			t.Fatalf("expected the limited request to skip auth, auth calls=%d", n)
+		}
+	})
+}
+
+func TestGateway_TrailingSlash(t *testing.T) {
+	var gotPath atomic.Value
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath.Store(r.URL.Path)
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(up.Close)
+
+	newCfg := func(mode, strip string) *config.Config {
+		return &config.Config{
+			Server: config.ServerConfig{TrailingSlash: mode},
+			Routes: []config.RouteConfig{{
+				Name:        "users",
+				Match:       config.MatchConfig{PathPrefix: "/api/users/"},
+				Upstream:    up.URL,
+				StripPrefix: strip,
+			}},
+		}
+	}
+
+	noFollow := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error {
+		return http.ErrUseLastResponse
+	}}
+
+	t.Run("strict", func(t *testing.T) {
+		srv := httptest.NewServer(newTestGateway(t, newCfg("", "")).handler())
+		defer srv.Close()
+		resp, err := noFollow.Get(srv.URL + "/api/users")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusNotFound {
+			t.Fatalf("expected 404, got %d", resp.StatusCode)
+		}
+	})
+
+	t.Run("normalize keeps upstream path", func(t *testing.T) {
+		for _, c := range []struct{ strip, want string }{
+			{"", "/api/users"},
+			{"/api", "/users"},
+			{"/api/users/", "/"},
+		} {
+			srv := httptest.NewServer(newTestGateway(t, newCfg("normalize", c.strip)).handler())
+			resp, err := noFollow.Get(srv.URL + "/api/users")
+			srv.Close()
+			if err != nil {
+				t.Fatal(err)
+			}
+			resp.Body.Close()
+			if resp.StatusCode != http.StatusOK {
+				t.Fatalf("strip %q: expected 200, got %d", c.strip, resp.StatusCode)
+			}
+			if got := gotPath.Load(); got != c.want {
+				t.Fatalf("strip %q: expected upstream path %q, got %q", c.strip, c.want, got)
+			}
+		}
+	})
+
+	t.Run("redirect", func(t *testing.T) {
+		srv := httptest.NewServer(newTestGateway(t, newCfg("redirect", "/api")).handler())
+		defer srv.Close()
+
+		resp, err := noFollow.Get(srv.URL + "/api/users?page=2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusPermanentRedirect {
+			t.Fatalf("expected 308, got %d", resp.StatusCode)
+		}
+		if loc := resp.Header.Get("Location"); loc != "/api/users/?page=2" {
+			t.Fatalf("unexpected Location %q", loc)
+		}
+
+		resp, err = http.Get(srv.URL + "/api/users")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK || gotPath.Load() != "/users/" {
+			t.Fatalf("expected followed redirect to reach /users/, got %d %v", resp.StatusCode, gotPath.Load())
+		}
+	})
+}
+
+func TestGateway_ConcurrencyTimeoutDoesNotOpenBreaker(t *testing.T) {
+	release := make(chan struct{})
+	var slow atomic.Bool
+	slow.Store(true)
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if slow.Load() {
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(up.Close)
+
+	gw := newTestGateway(t, &config.Config{
+		Routes: []config.RouteConfig{{
+			Name:        "busy",
+			Match:       config.MatchConfig{PathPrefix: "/busy/"},
+			Upstream:    up.URL,
+			Concurrency: config.RouteConcurrency{MaxInFlight: 1, MaxWaitMs: 20},
+			CircuitBreaker: config.RouteCircuitBreaker{
+				Enabled: true, FailureThreshold: 1, OpenSeconds: 60, HalfOpenMaxInFlight: 1,
+			},
+		}},
+	})
+	srv := httptest.NewServer(gw.handler())
+	defer srv.Close()
+
+	// Occupy the only slot.
+	held := make(chan struct{})
+	go func() {
+		defer close(held)
+		resp, err := http.Get(srv.URL + "/busy/hold")
+		if err == nil {
+			resp.Body.Close()
+		}
+	}()
+	deadline := time.Now().Add(2 * time.Second)
+	for gw.table().sems["busy"].InUse() == 0 {
+		if time.Now().After(deadline) {
+			t.Fatal("slot was never taken")
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Queued requests time out with 503 too_busy.
+	for i := 0; i < 3; i++ {
+		resp, err := http.Get(srv.URL + "/busy/x")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusServiceUnavailable {
+			t.Fatalf("expected 503 from the concurrency queue, got %d", resp.StatusCode)
+		}
+	}
+
+	slow.Store(false)
+	close(release)
+	<-held
+
+	if st := gw.table().breakers["busy"].Stats(); st.State != mw.BreakerClosed || st.Failures != 0 {
+		t.Fatalf("expected breaker closed with no failures, got %+v", st)
+	}
+	resp, err := http.Get(srv.URL + "/busy/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected 200 after the slot freed, got %d", resp.StatusCode)
+	}
+}
+
+func TestGateway_CanaryRoutesShareToCanaryUpstream(t *testing.T) {
+	stable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("stable"))
+	}))
+	t.Cleanup(stable.Close)
+	canary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("canary"))
+	}))
+	t.Cleanup(canary.Close)
+
+	gw := newTestGateway(t, &config.Config{
+		Routes: []config.RouteConfig{{
+			Name:     "svc",
+			Match:    config.MatchConfig{PathPrefix: "/svc/"},
+			Upstream: stable.URL,
+			Canary:   config.RouteCanaryConfig{Upstream: canary.URL, Percent: 100, Header: true},
+		}},
+	})
+	srv := httptest.NewServer(gw.handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/svc/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "canary" || resp.Header.Get("X-Canary") != "true" {
+		t.Fatalf("expected canary response with X-Canary, got %q header=%q", body, resp.Header.Get("X-Canary"))
+	}
+	if got := testutil.ToFloat64(gw.metrics.UpstreamTarget.WithLabelValues("svc", "canary")); got != 1 {
+		t.Fatalf("expected canary target metric 1, got %v", got)
+	}
+}
+
+func TestGateway_UpstreamPin(t *testing.T) {
+	var stableHdr atomic.Value
+	stable := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		stableHdr.Store(r.Header.Get(upstreamPinHeader) + r.Header.Get(mw.AdminKeyHeader))
+		_, _ = w.Write([]byte("stable"))
+	}))
+	t.Cleanup(stable.Close)
+	canary := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write([]byte("canary"))
+	}))
+	t.Cleanup(canary.Close)
+
+	newCfg := func(trusted []string) *config.Config {
+		return &config.Config{
+			Server: config.ServerConfig{TrustedProxies: trusted},
+			Routes: []config.RouteConfig{{
+				Name:     "svc",
+				Match:    config.MatchConfig{PathPrefix: "/svc/"},
+				Upstream: stable.URL,
+				// Everything goes to canary unless the pin is honored.
+				Canary: config.RouteCanaryConfig{Upstream: canary.URL, Percent: 100},
+			}},
+		}
+	}
+	stableHost := strings.TrimPrefix(stable.URL, "http://")
+
+	get := func(t *testing.T, gwURL string, hdr map[string]string) string {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, gwURL+"/svc/x", nil)
+		for k, v := range hdr {
+			req.Header.Set(k, v)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return string(b)
+	}
+
+	t.Run("untrusted pin ignored", func(t *testing.T) {
+		srv := httptest.NewServer(newTestGateway(t, newCfg(nil)).handler())
+		defer srv.Close()
+		if got := get(t, srv.URL, map[string]string{upstreamPinHeader: stableHost}); got != "canary" {
+			t.Fatalf("expected pin to be ignored, got %s", got)
+		}
+	})
+
+	t.Run("admin key", func(t *testing.T) {
+		srv := httptest.NewServer(newTestGateway(t, newCfg(nil)).handler())
+		defer srv.Close()
+		got := get(t, srv.URL, map[string]string{upstreamPinHeader: stableHost, mw.AdminKeyHeader: "test-admin-key"})
+		if got != "stable" {
+			t.Fatalf("expected pinned stable backend, got %s", got)
+		}
+		if h := stableHdr.Load(); h != "" {
+			t.Fatalf("expected pin headers stripped before the upstream, got %q", h)
+		}
+	})
+
+	t.Run("trusted proxy", func(t *testing.T) {
+		srv := httptest.NewServer(newTestGateway(t, newCfg([]string{"127.0.0.1/32", "::1"})).handler())
+		defer srv.Close()
+		if got := get(t, srv.URL, map[string]string{upstreamPinHeader: stableHost}); got != "stable" {
+			t.Fatalf("expected pinned stable backend, got %s", got)
+		}
+	})
+}
+
+func TestGateway_AdminResetLimit(t *testing.T) {
+	up := okUpstream(t)
+	gw := newTestGateway(t, &config.Config{
+		Routes: []config.RouteConfig{{
+			Name:     "ip",
+			Match:    config.MatchConfig{PathPrefix: "/ip/"},
+			Upstream: up.URL,
+			RateLimit: config.RouteRLConfig{
+				Enabled: true, RPS: 0.001, Burst: 1, Scope: "ip",
+			},
+		}},
+	})
+	srv := httptest.NewServer(gw.handler())
+	defer srv.Close()
+
+	get := func() int {
+		resp, err := http.Get(srv.URL + "/ip/x")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	reset := func(query string) int {
+		req, _ := http.NewRequest(http.MethodDelete, srv.URL+"/-/limits/ip?"+query, nil)
+		req.Header.Set(mw.AdminKeyHeader, "test-admin-key")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if get() != http.StatusOK || get() != http.StatusTooManyRequests {
+		t.Fatal("expected the second request to be rate limited")
+	}
+
+	if code := reset("scope=ip&id=127.0.0.1"); code != http.StatusOK {
+		t.Fatalf("expected reset 200, got %d", code)
+	}
+	if code := get(); code != http.StatusOK {
+		t.Fatalf("expected request allowed after reset, got %d", code)
+	}
+
+	if code := reset("scope=ip&id=203.0.113.1"); code != http.StatusNotFound {
+		t.Fatalf("expected 404 for unknown key, got %d", code)
+	}
+	if code := reset("scope=bogus&id=x"); code != http.StatusBadRequest {
+		t.Fatalf("expected 400 for bad scope, got %d", code)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, srv.URL+"/-/limits/ip?scope=ip&id=127.0.0.1", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without admin key, got %d", resp.StatusCode)
+	}
+}
+
+func TestGateway_AdminPeekLimit(t *testing.T) {
+	up := okUpstream(t)
+	gw := newTestGateway(t, &config.Config{
+		Routes: []config.RouteConfig{{
+			Name:     "ip",
+			Match:    config.MatchConfig{PathPrefix: "/ip/"},
+			Upstream: up.URL,
+			RateLimit: config.RouteRLConfig{
+				Enabled: true, RPS: 0.001, Burst: 3, Scope: "ip",
+			},
+		}},
+	})
+	srv := httptest.NewServer(gw.handler())
+	defer srv.Close()
+
+	peek := func(query string) (int, map[string]any) {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/-/limits/ip/peek?"+query, nil)
+		req.Header.Set(mw.AdminKeyHeader, "test-admin-key")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body map[string]any
+		_ = json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body
+	}
+
+	if code, _ := peek("scope=ip&id=127.0.0.1"); code != http.StatusNotFound {
+		t.Fatalf("expected 404 before any traffic, got %d", code)
+	}
+
+	resp, err := http.Get(srv.URL + "/ip/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+
+	// Peeking twice must not consume tokens.
+	for i := 0; i < 2; i++ {
+		code, body := peek("scope=ip&id=127.0.0.1")
+		if code != http.StatusOK {
+			t.Fatalf("expected peek 200, got %d", code)
+		}
+		if tokens := body["tokens"].(float64); tokens < 1.99 || tokens > 2.01 {
+			t.Fatalf("expected ~2 tokens left, got %v", tokens)
+		}
+		if body["burst"].(float64) != 3 || body["reset_at"] == "" {
+			t.Fatalf("unexpected peek body: %v", body)
+		}
+	}
+}
+
+func TestGateway_ErrorFieldMap(t *testing.T) {
+	up := okUpstream(t)
+	gw := newTestGateway(t, &config.Config{
+		Errors: config.ErrorsConfig{FieldMap: map[string]string{"error": "code", "retry_after_seconds": "retry_after"}},
+		Routes: []config.RouteConfig{{
+			Name:     "ip",
+			Match:    config.MatchConfig{PathPrefix: "/ip/"},
+			Upstream: up.URL,
+			RateLimit: config.RouteRLConfig{
+				Enabled: true, RPS: 0.001, Burst: 1, Scope: "ip",
+			},
+		}},
+	})
+	t.Cleanup(func() { httpx.SetErrorFieldMap(nil) })
+	srv := httptest.NewServer(gw.handler())
+	defer srv.Close()
+
+	var resp *http.Response
+	for i := 0; i < 2; i++ {
+		var err error
+		if resp, err = http.Get(srv.URL + "/ip/x"); err != nil {
+			t.Fatal(err)
+		}
+		if i == 0 {
+			resp.Body.Close()
+		}
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusTooManyRequests {
+		t.Fatalf("expected 429, got %d", resp.StatusCode)
+	}
+
+	var body map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body["code"] != "rate_limited" {
+		t.Fatalf("expected mapped code field, got %v", body)
+	}
+	if _, ok := body["retry_after"]; !ok {
+		t.Fatalf("expected mapped retry_after field, got %v", body)
+	}
+	if _, ok := body["error"]; ok {
+		t.Fatalf("expected default error field to be renamed, got %v", body)
+	}
+	if body["route"] != "ip" {
+		t.Fatalf("expected unmapped fields to keep their names, got %v", body)
+	}
+}
+
+func TestGateway_HedgedAttemptsAreNumberedAndLogged(t *testing.T) {
+	var mu sync.Mutex
+	var seen []string
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		attempt := r.Header.Get("X-Upstream-Attempt")
+		mu.Lock()
+		seen = append(seen, attempt)
+		mu.Unlock()
+		if attempt == "1" {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(up.Close)
+
+	limiter := ratelimit.NewMemoryLimiter(time.Minute, time.Minute)
+	t.Cleanup(func() { _ = limiter.Close() })
+
+	var logs safeBuffer
+	gw, err := newGateway(&config.Config{
+		Routes: []config.RouteConfig{{
+			Name:     "slow",
+			Match:    config.MatchConfig{PathPrefix: "/slow/"},
+			Upstream: up.URL,
+			Hedge:    config.RouteHedgeConfig{DelayMs: 20, MaxAttempts: 2},
+		}},
+	}, gatewayDeps{
+		Log:       slog.New(slog.NewJSONHandler(&logs, nil)),
+		Limiter:   limiter,
+		Quota:     ratelimit.NewMemoryQuota(),
+		Auth:      mw.Authenticator{Mode: "hmac", HMACSecret: []byte("test-secret")},
+		Transport: http.DefaultTransport,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(gw.handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/slow/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected hedged 200, got %d", resp.StatusCode)
+	}
+
+	mu.Lock()
+	got := strings.Join(seen, ",")
+	mu.Unlock()
+	if got != "1,2" {
+		t.Fatalf("expected upstream to see attempts 1,2, got %q", got)
+	}
+	if !strings.Contains(logs.String(), `"upstream_attempts":2`) {
+		t.Fatalf("expected the access log to record 2 upstream attempts, got:\n%s", logs.String())
+	}
+	if strings.Contains(logs.String(), `"msg":"upstream_attempt"`) {
+		t.Fatalf("expected per-attempt lines only at debug level, got:\n%s", logs.String())
+	}
+}
+
+// safeBuffer is a bytes.Buffer safe for concurrent log writes and reads.
+type safeBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *safeBuffer) Write(p []byte) (int, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *safeBuffer) String() string {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.buf.String()
+}
+
+func TestGateway_AccessLogScrubsTokenQueryParam(t *testing.T) {
+	limiter := ratelimit.NewMemoryLimiter(time.Minute, time.Minute)
+	t.Cleanup(func() { _ = limiter.Close() })
+
+	var logs safeBuffer
+	gw, err := newGateway(&config.Config{
+		Auth:    config.AuthConfig{TokenSources: config.TokenSourcesConfig{QueryParam: "sse_token"}},
+		Logging: config.LoggingConfig{Access: config.AccessLogConfig{Query: true}},
+		Routes: []config.RouteConfig{{
+			Name: "events", Match: config.MatchConfig{PathPrefix: "/events/"}, Upstream: okUpstream(t).URL,
+		}},
+	}, gatewayDeps{
+		Log:       slog.New(slog.NewJSONHandler(&logs, nil)),
+		Limiter:   limiter,
+		Quota:     ratelimit.NewMemoryQuota(),
+		Auth:      mw.Authenticator{Mode: "hmac", HMACSecret: []byte("test-secret")},
+		Transport: http.DefaultTransport,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	rr := httptest.NewRecorder()
+	gw.handler().ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/events/x?sse_token=s3cret-token&topic=a", nil))
+	if !strings.Contains(logs.String(), `"query":"sse_token=%2A%2A%2A&topic=a"`) {
+		t.Fatalf("expected the scrubbed query in the access log, got:\n%s", logs.String())
+	}
+	if strings.Contains(logs.String(), "s3cret-token") {
+		t.Fatalf("token query param leaked into the logs:\n%s", logs.String())
+	}
+}
+
+func TestGateway_AdminLimitsFilterByBreakerState(t *testing.T) {
+	up := okUpstream(t)
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(down.Close)
+
+	breaker := config.RouteCircuitBreaker{Enabled: true, FailureThreshold: 1, OpenSeconds: 60, HalfOpenMaxInFlight: 1}
+	gw := newTestGateway(t, &config.Config{
+		Routes: []config.RouteConfig{
+			{Name: "api-ok", Match: config.MatchConfig{PathPrefix: "/ok/"}, Upstream: up.URL, CircuitBreaker: breaker},
+			{Name: "api-down", Match: config.MatchConfig{PathPrefix: "/down/"}, Upstream: down.URL, CircuitBreaker: breaker},
+			{Name: "other-down", Match: config.MatchConfig{PathPrefix: "/other/"}, Upstream: down.URL, CircuitBreaker: breaker},
+		},
+	})
+	srv := httptest.NewServer(gw.handler())
+	defer srv.Close()
+
+	for _, p := range []string{"/ok/x", "/down/x", "/other/x"} {
+		resp, err := http.Get(srv.URL + p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	get := func(query string) string {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/-/limits?"+query, nil)
+		req.Header.Set(mw.AdminKeyHeader, "test-admin-key")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return string(b)
+	}
+
+	var rows []map[string]any
+	if err := json.Unmarshal([]byte(get("state=open")), &rows); err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 2 || rows[0]["route"] != "api-down" || rows[1]["route"] != "other-down" {
+		t.Fatalf("expected only the open routes, got %v", rows)
+	}
+
+	if err := json.Unmarshal([]byte(get("state=open&route=api-")), &rows); err != nil {
+		t.Fatal(err)
+	}
+	if len(rows) != 1 || rows[0]["route"] != "api-down" {
+		t.Fatalf("expected route prefix and state filters to combine, got %v", rows)
+	}
+
+	prom := get("format=prometheus&route=api-ok")
+	if !strings.Contains(prom, `apigw_route_breaker_state{route="api-ok",state="closed"} 1`) ||
+		strings.Contains(prom, "api-down") {
+		t.Fatalf("unexpected prometheus snapshot:\n%s", prom)
+	}
+	if !strings.Contains(prom, "# TYPE apigw_route_breaker_state gauge\n") ||
+		!strings.Contains(prom, "# HELP apigw_route_breaker_failures ") {
+		t.Fatalf("expected HELP and TYPE lines in the prometheus snapshot:\n%s", prom)
+	}
+	if _, err := promlint.New(strings.NewReader(get("format=prometheus"))).Lint(); err != nil {
+		t.Fatalf("prometheus snapshot doesn't parse: %v", err)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/-/limits?state=opn", nil)
+	req.Header.Set(mw.AdminKeyHeader, "test-admin-key")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an unknown state, got %d", resp.StatusCode)
+	}
+}
+
+func TestGateway_RequireRequestID(t *testing.T) {
+	up := okUpstream(t)
+	gw := newTestGateway(t, &config.Config{
+		Routes: []config.RouteConfig{
+			{Name: "strict", Match: config.MatchConfig{PathPrefix: "/strict/"}, Upstream: up.URL, RequireRequestID: true},
+			{Name: "normal", Match: config.MatchConfig{PathPrefix: "/normal/"}, Upstream: up.URL},
+		},
+	})
+	srv := httptest.NewServer(gw.handler())
+	defer srv.Close()
+
+	get := func(path, rid string) *http.Response {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		if rid != "" {
+			req.Header.Set("X-Request-Id", rid)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	if resp := get("/strict/x", ""); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 without a request id on a strict route, got %d", resp.StatusCode)
+	}
+	if resp := get("/strict/x", "bad id!"); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected 400 for an invalid request id, got %d", resp.StatusCode)
+	}
+	if resp := get("/strict/x", "corr-123"); resp.StatusCode != http.StatusOK || resp.Header.Get("X-Request-Id") != "corr-123" {
+		t.Fatalf("expected caller id to pass on a strict route, got %d %q", resp.StatusCode, resp.Header.Get("X-Request-Id"))
+	}
+	if resp := get("/normal/x", ""); resp.StatusCode != http.StatusOK || resp.Header.Get("X-Request-Id") == "" {
+		t.Fatalf("expected a generated id on a normal route, got %d %q", resp.StatusCode, resp.Header.Get("X-Request-Id"))
+	}
+}
+
+func TestGateway_DefaultHostUpstream(t *testing.T) {
+	up := okUpstream(t)
+	var fwdHost atomic.Value
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fwdHost.Store(r.Header.Get("X-Forwarded-Host"))
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer fallback.Close()
+
+	newCfg := func(defaultHost string) *config.Config {
+		return &config.Config{
+			Server: config.ServerConfig{DefaultHostUpstream: defaultHost},
+			Routes: []config.RouteConfig{{
+				Name:     "api",
+				Match:    config.MatchConfig{Host: "api.example.com", PathPrefix: "/"},
+				Upstream: up.URL,
+			}},
+		}
+	}
+	get := func(t *testing.T, gwURL, host, path string) int {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, gwURL+path, nil)
+		req.Host = host
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	t.Run("unset", func(t *testing.T) {
+		srv := httptest.NewServer(newTestGateway(t, newCfg("")).handler())
+		defer srv.Close()
+		if code := get(t, srv.URL, "unknown.example.com", "/x"); code != http.StatusNotFound {
+			t.Fatalf("expected 404 for an unmatched host, got %d", code)
+		}
+	})
+
+	t.Run("set", func(t *testing.T) {
+		srv := httptest.NewServer(newTestGateway(t, newCfg(fallback.URL)).handler())
+		defer srv.Close()
+		if code := get(t, srv.URL, "unknown.example.com", "/x"); code != http.StatusTeapot {
+			t.Fatalf("expected the default upstream for an unmatched host, got %d", code)
+		}
+		if got := fwdHost.Load(); got != "unknown.example.com" {
+			t.Fatalf("expected X-Forwarded-Host to carry the original host, got %v", got)
+		}
+		if code := get(t, srv.URL, "api.example.com", "/x"); code != http.StatusOK {
+			t.Fatalf("expected a known host to keep its route, got %d", code)
+		}
+	})
+}
+
+func TestGateway_DefaultUpstream(t *testing.T) {
+	up := okUpstream(t)
+	var gotPath atomic.Value
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath.Store(r.URL.Path)
+		w.WriteHeader(http.StatusTeapot)
+	}))
+	defer fallback.Close()
+
+	newCfg := func(defaultUpstream string) *config.Config {
+		return &config.Config{
+			Server: config.ServerConfig{DefaultUpstream: defaultUpstream},
+			Routes: []config.RouteConfig{{Name: "api", Match: config.MatchConfig{PathPrefix: "/api/"}, Upstream: up.URL}},
+		}
+	}
+	get := func(t *testing.T, url string) int {
+		t.Helper()
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	t.Run("unset", func(t *testing.T) {
+		srv := httptest.NewServer(newTestGateway(t, newCfg("")).handler())
+		defer srv.Close()
+		if code := get(t, srv.URL+"/other"); code != http.StatusNotFound {
+			t.Fatalf("expected 404 for an unmatched path, got %d", code)
+		}
+	})
+
+	t.Run("set", func(t *testing.T) {
+		gw := newTestGateway(t, newCfg(fallback.URL))
+		srv := httptest.NewServer(gw.handler())
+		defer srv.Close()
+		if code := get(t, srv.URL+"/other/page"); code != http.StatusTeapot {
+			t.Fatalf("expected the default upstream for an unmatched path, got %d", code)
+		}
+		if got := gotPath.Load(); got != "/other/page" {
+			t.Fatalf("expected the path passed through unchanged, got %v", got)
+		}
+		if code := get(t, srv.URL+"/api/x"); code != http.StatusOK {
+			t.Fatalf("expected a matched path to keep its route, got %d", code)
+		}
+		// It went through the normal chain under the synthetic route name.
+		if got := testutil.ToFloat64(gw.metrics.Requests.WithLabelValues(config.DefaultRouteName, http.MethodGet, "418")); got != 1 {
+			t.Fatalf("expected the request counted under route %q, got %v", config.DefaultRouteName, got)
+		}
+	})
+}
+
+func TestGateway_NoRouteIsJSON404(t *testing.T) {
+	gw := newTestGateway(t, &config.Config{
+		Routes: []config.RouteConfig{{Name: "api", Match: config.MatchConfig{PathPrefix: "/api/"}, Upstream: okUpstream(t).URL}},
+	})
+	srv := httptest.NewServer(gw.handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/nope")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("expected a JSON 404, got %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	var body map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	rid := resp.Header.Get(mw.DefaultRequestIDHeader)
+	if body["error"] != "no_route" || body["path"] != "/nope" || rid == "" || body["request_id"] != rid {
+		t.Fatalf("unexpected body %v (request id %q)", body, rid)
+	}
+	if got := testutil.ToFloat64(gw.metrics.Requests.WithLabelValues("no_route", http.MethodGet, "404")); got != 1 {
+		t.Fatalf("expected the request counted under route no_route, got %v", got)
+	}
+}
+
+func TestGateway_RequestIDHeaderIsPropagated(t *testing.T) {
+	var upstreamRID atomic.Value
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		upstreamRID.Store(r.Header.Get("X-Correlation-Id"))
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer up.Close()
+
+	gw := newTestGateway(t, &config.Config{
+		Server: config.ServerConfig{RequestID: config.RequestIDConfig{Header: "X-Correlation-Id"}},
+		Routes: []config.RouteConfig{{
+			Name:      "api",
+			Match:     config.MatchConfig{PathPrefix: "/api/"},
+			Upstream:  up.URL,
+			RateLimit: config.RouteRLConfig{Enabled: true, RPS: 0.001, Burst: 1, Scope: "ip"},
+		}},
+	})
+	t.Cleanup(func() { httpx.SetRequestIDHeader("") })
+	srv := httptest.NewServer(gw.handler())
+	defer srv.Close()
+
+	// A fallback header on input is forwarded and echoed under the configured name.
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/api/x", nil)
+	req.Header.Set("X-Request-Id", "legacy-123")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if got := upstreamRID.Load(); got != "legacy-123" {
+		t.Fatalf("expected upstream to get X-Correlation-Id legacy-123, got %v", got)
+	}
+	if got := resp.Header.Get("X-Correlation-Id"); got != "legacy-123" {
+		t.Fatalf("expected response X-Correlation-Id legacy-123, got %q", got)
+	}
+
+	// Error bodies carry the (generated) id.
+	resp, err = http.Get(srv.URL + "/api/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body map[string]any
+	_ = json.NewDecoder(resp.Body).Decode(&body)
+	rid := resp.Header.Get("X-Correlation-Id")
+	if resp.StatusCode != http.StatusTooManyRequests || rid == "" || body["request_id"] != rid {
+		t.Fatalf("expected 429 with request_id %q, got %d %v", rid, resp.StatusCode, body)
+	}
+}
+
+func TestGateway_StripAndAddPrefix(t *testing.T) {
+	var gotPath atomic.Value
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		gotPath.Store(r.URL.Path)
+	}))
+	t.Cleanup(up.Close)
+
+	for _, c := range []struct{ strip, add, path, want string }{
+		{"/api", "/api/v2", "/api/users/me", "/api/v2/users/me"},
+		{"/api", "/api/v2/", "/api/users/me", "/api/v2/users/me"},
+		{"", "/v2", "/api/users/me", "/v2/api/users/me"},
+		{"/api/users/", "/v2/", "/api/users", "/v2/"},
+	} {
+		gw := newTestGateway(t, &config.Config{
+			Routes: []config.RouteConfig{{
+				Name:        "users",
+				Match:       config.MatchConfig{PathPrefix: "/api/users"},
+				Upstream:    up.URL,
+				StripPrefix: c.strip,
+				AddPrefix:   c.add,
+			}},
+		})
+		srv := httptest.NewServer(gw.handler())
+		resp, err := http.Get(srv.URL + c.path)
+		srv.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if got := gotPath.Load(); got != c.want {
+			t.Fatalf("strip %q add %q: expected upstream path %q, got %q", c.strip, c.add, c.want, got)
+		}
+	}
+}
+
+func TestGateway_AdminRouteCRUD(t *testing.T) {
+	up := okUpstream(t)
+	gw := newTestGateway(t, &config.Config{
+		RateLimit: config.RateLimitBackend{Backend: "memory"},
+		Routes: []config.RouteConfig{{
+			Name: "users", Match: config.MatchConfig{PathPrefix: "/users/"}, Upstream: up.URL,
+		}},
+	})
+	srv := httptest.NewServer(gw.handler())
+	defer srv.Close()
+
+	admin := func(method, path, body string) (int, []map[string]any) {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		req.Header.Set(mw.AdminKeyHeader, "test-admin-key")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var routes []map[string]any
+		if resp.StatusCode < 300 {
+			if err := json.NewDecoder(resp.Body).Decode(&routes); err != nil {
+				t.Fatal(err)
+			}
+		}
+		return resp.StatusCode, routes
+	}
+	status := func(path string) int {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if status("/orders/1") != http.StatusNotFound {
+		t.Fatal("expected 404 before the route exists")
+	}
+	usersBreaker := gw.table().breakers["users"]
+
+	code, routes := admin(http.MethodPost, "/-/routes",
+		`{"name": "orders", "match": {"path_prefix": "/orders/"}, "upstream": "`+up.URL+`"}`)
+	if code != http.StatusCreated || len(routes) != 2 || routes[1]["name"] != "orders" {
+		t.Fatalf("create: got %d %v", code, routes)
+	}
+	if status("/orders/1") != http.StatusOK {
+		t.Fatal("expected the new route to serve traffic")
+	}
+	if gw.table().breakers["users"] != usersBreaker {
+		t.Fatal("unchanged routes should keep their breaker")
+	}
+
+	if code, _ := admin(http.MethodPost, "/-/routes", `{"name": "orders", "match": {"path_prefix": "/o2/"}, "upstream": "`+up.URL+`"}`); code != http.StatusConflict {
+		t.Fatalf("duplicate create: expected 409, got %d", code)
+	}
+	if code, _ := admin(http.MethodPost, "/-/routes", `{"name": "bad", "match": {"path_prefix": "nope"}, "upstream": "`+up.URL+`"}`); code != http.StatusBadRequest {
+		t.Fatalf("invalid create: expected 400, got %d", code)
+	}
+
+	code, routes = admin(http.MethodPut, "/-/routes/orders",
+		`{"match": {"path_prefix": "/v2/orders/"}, "upstream": "`+up.URL+`"}`)
+	if code != http.StatusOK || len(routes) != 2 || routes[1]["path_prefix"] != "/v2/orders/" {
+		t.Fatalf("update: got %d %v", code, routes)
+	}
+	if status("/orders/1") != http.StatusNotFound || status("/v2/orders/1") != http.StatusOK {
+		t.Fatal("expected the updated match to replace the old one")
+	}
+	if code, _ := admin(http.MethodPut, "/-/routes/missing", `{"upstream": "`+up.URL+`"}`); code != http.StatusNotFound {
+		t.Fatalf("update of unknown route: expected 404, got %d", code)
+	}
+
+	code, routes = admin(http.MethodDelete, "/-/routes/orders", "")
+	if code != http.StatusOK || len(routes) != 1 {
+		t.Fatalf("delete: got %d %v", code, routes)
+	}
+	if status("/v2/orders/1") != http.StatusNotFound {
+		t.Fatal("expected the deleted route to stop matching")
+	}
+	if code, _ := admin(http.MethodDelete, "/-/routes/orders", ""); code != http.StatusNotFound {
+		t.Fatalf("second delete: expected 404, got %d", code)
+	}
+
+	req, _ := http.NewRequest(http.MethodDelete, srv.URL+"/-/routes/users", nil)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without the admin key, got %d", resp.StatusCode)
+	}
+}
+
+func TestGateway_AdminRouteEditsShareJWKSValidators(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fetches atomic.Int32
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		fetches.Add(1)
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": []any{map[string]any{
+			"kty": "RSA", "kid": "k1",
+			"n": base64.RawURLEncoding.EncodeToString(priv.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString([]byte{1, 0, 1}),
+		}}})
+	}))
+	defer jwks.Close()
+
+	up := okUpstream(t)
+	gw := newTestGateway(t, &config.Config{
+		Server:    config.ServerConfig{StartupTimeoutSeconds: 5},
+		RateLimit: config.RateLimitBackend{Backend: "memory"},
+		Routes:    []config.RouteConfig{{Name: "users", Match: config.MatchConfig{PathPrefix: "/users/"}, Upstream: up.URL}},
+	})
+	srv := httptest.NewServer(gw.handler())
+	defer srv.Close()
+
+	admin := func(method, path, body string) int {
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		req.Header.Set(mw.AdminKeyHeader, "test-admin-key")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	route := func(prefix string) string {
+		return `{"name": "partner", "match": {"path_prefix": "` + prefix + `"}, "upstream": "` + up.URL +
+			`", "auth": {"mode": "jwks", "jwks": {"url": "` + jwks.URL + `"}}}`
+	}
+
+	if code := admin(http.MethodPost, "/-/routes", route("/partner/")); code != http.StatusCreated {
+		t.Fatalf("create: expected 201, got %d", code)
+	}
+	if code := admin(http.MethodPut, "/-/routes/partner", route("/v2/partner/")); code != http.StatusOK {
+		t.Fatalf("update: expected 200, got %d", code)
+	}
+	if got := fetches.Load(); got != 1 {
+		t.Fatalf("expected the update to reuse the route's validator, got %d key fetches", got)
+	}
+
+	if code := admin(http.MethodDelete, "/-/routes/partner", ""); code != http.StatusOK {
+		t.Fatalf("delete: expected 200, got %d", code)
+	}
+	gw.authMu.Lock()
+	defer gw.authMu.Unlock()
+	if len(gw.routeAuth) != 0 {
+		t.Fatalf("expected the deleted route's validator to be released, got %d", len(gw.routeAuth))
+	}
+}
+
+func TestGateway_PreparedRouteAuthIsPinnedUntilItsSwap(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": []any{map[string]any{
+			"kty": "RSA", "kid": "k1",
+			"n": base64.RawURLEncoding.EncodeToString(priv.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString([]byte{1, 0, 1}),
+		}}})
+	}))
+	defer jwks.Close()
+
+	up := okUpstream(t)
+	gw := newTestGateway(t, &config.Config{
+		Server:    config.ServerConfig{StartupTimeoutSeconds: 5},
+		RateLimit: config.RateLimitBackend{Backend: "memory"},
+		Routes: []config.RouteConfig{{
+			Name: "users", Match: config.MatchConfig{PathPrefix: "/users/"}, Upstream: up.URL,
+			Auth: config.RouteAuthConfig{Mode: "hmac", HMACSecret: "hmac-s3cr3t"},
+		}},
+	})
+	gw.authMu.Lock()
+	for block := range gw.routeAuth {
+		if strings.Contains(block, "hmac-s3cr3t") {
+			t.Fatalf("expected auth blocks to be keyed without their secrets, got %q", block)
+		}
+	}
+	gw.authMu.Unlock()
+
+	rc := config.RouteConfig{
+		Name: "partner", Match: config.MatchConfig{PathPrefix: "/partner/"}, Upstream: up.URL,
+		Auth: config.RouteAuthConfig{Mode: "jwks", JWKS: config.JWKSAuthConfig{URL: jwks.URL}},
+	}
+	release, ok := gw.prepareRouteAuth(httptest.NewRecorder(), rc)
+	if !ok {
+		t.Fatal("expected the route's auth to be prepared")
+	}
+	count := func() int {
+		gw.authMu.Lock()
+		defer gw.authMu.Unlock()
+		return len(gw.routeAuth)
+	}
+	// Another admin write swapping its table in the meantime keeps it.
+	gw.pruneRouteAuth(gw.table())
+	if got := count(); got != 2 {
+		t.Fatalf("expected the prepared handler to survive another write's prune, got %d handlers", got)
+	}
+	gw.routesMu.Lock()
+	release()
+	gw.routesMu.Unlock()
+	if got := count(); got != 1 {
+		t.Fatalf("expected the unused handler to go once released, got %d handlers", got)
+	}
+}
+
+func TestGateway_PerRouteAuthOverride(t *testing.T) {
+	up := okUpstream(t)
+	gw := newTestGateway(t, &config.Config{
+		Routes: []config.RouteConfig{
+			{Name: "internal", Match: config.MatchConfig{PathPrefix: "/internal/"}, Upstream: up.URL, AuthRequired: true},
+			{
+				Name: "partner", Match: config.MatchConfig{PathPrefix: "/partner/"}, Upstream: up.URL, AuthRequired: true,
+				Auth: config.RouteAuthConfig{Mode: "hmac", HMACSecret: "partner-secret"},
+			},
+		},
+	})
+	srv := httptest.NewServer(gw.handler())
+	defer srv.Close()
+
+	token := func(secret string) string {
+		s, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "svc"}).SignedString([]byte(secret))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	status := func(path, tok string) int {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		req.Header.Set("Authorization", "Bearer "+tok)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	global, partner := token("test-secret"), token("partner-secret")
+	for _, c := range []struct {
+		path, tok string
+		want      int
+	}{
+		{"/internal/x", global, http.StatusOK},
+		{"/internal/x", partner, http.StatusUnauthorized},
+		{"/partner/x", partner, http.StatusOK},
+		{"/partner/x", global, http.StatusUnauthorized},
+	} {
+		if got := status(c.path, c.tok); got != c.want {
+			t.Fatalf("%s: expected %d, got %d", c.path, c.want, got)
+		}
+	}
+}
+
+func TestGateway_PerRouteJWKSAudiences(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": []any{map[string]any{
+			"kty": "RSA", "kid": "k1",
+			"n": base64.RawURLEncoding.EncodeToString(priv.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString([]byte{1, 0, 1}),
+		}}})
+	}))
+	defer jwks.Close()
+	// The validation cache is on so the second route also checks cached tokens.
+	v, err := mw.NewJWKSValidator(jwks.URL, mw.JWKSValidatorOptions{ValidationCacheSize: 16})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	up := okUpstream(t)
+	cfg := &config.Config{
+		Auth: config.AuthConfig{Mode: "jwks", JWKS: config.JWKSAuthConfig{URL: jwks.URL}},
+		Routes: []config.RouteConfig{
+			{
+				Name: "a", Match: config.MatchConfig{PathPrefix: "/a/"}, Upstream: up.URL, AuthRequired: true,
+				Auth: config.RouteAuthConfig{Audiences: []string{"serviceA"}},
+			},
+			{
+				Name: "b", Match: config.MatchConfig{PathPrefix: "/b/"}, Upstream: up.URL, AuthRequired: true,
+				Auth: config.RouteAuthConfig{Audiences: []string{"serviceB"}},
+			},
+		},
+	}
+	limiter := ratelimit.NewMemoryLimiter(time.Minute, time.Minute)
+	t.Cleanup(func() { _ = limiter.Close() })
+	gw, err := newGateway(cfg, gatewayDeps{
+		Log:       slog.New(slog.NewJSONHandler(io.Discard, nil)),
+		Limiter:   limiter,
+		Quota:     ratelimit.NewMemoryQuota(),
+		Auth:      jwksAuthAdapter{v: v},
+		JWKS:      v,
+		Transport: http.DefaultTransport,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(gw.handler())
+	defer srv.Close()
+
+	tok := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"sub": "svc", "aud": "serviceA", "exp": time.Now().Add(time.Hour).Unix(),
+	})
+	tok.Header["kid"] = "k1"
+	signed, err := tok.SignedString(priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range []struct {
+		path string
+		want int
+	}{
+		{"/a/x", http.StatusOK},
+		{"/b/x", http.StatusUnauthorized},
+		{"/a/x", http.StatusOK},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+c.path, nil)
+		req.Header.Set("Authorization", "Bearer "+signed)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != c.want {
+			t.Fatalf("%s: expected %d, got %d", c.path, c.want, resp.StatusCode)
+		}
+	}
+}
+
+func TestGateway_MethodsAndHeadAsGet(t *testing.T) {
+	var upstreamMethods []string
+	var mu sync.Mutex
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		upstreamMethods = append(upstreamMethods, r.Method)
+		mu.Unlock()
+		if r.Method == http.MethodHead {
+			w.WriteHeader(http.StatusNotImplemented)
+			return
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		_, _ = io.WriteString(w, "hello world")
+	}))
+	t.Cleanup(up.Close)
+
+	gw := newTestGateway(t, &config.Config{
+		Routes: []config.RouteConfig{{
+			Name:      "files",
+			Match:     config.MatchConfig{PathPrefix: "/files/", Methods: []string{"get"}},
+			Upstream:  up.URL,
+			HeadAsGet: true,
+		}},
+	})
+	srv := httptest.NewServer(gw.handler())
+	defer srv.Close()
+
+	do := func(method string) *http.Response {
+		req, _ := http.NewRequest(method, srv.URL+"/files/a.txt", nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp
+	}
+
+	resp := do(http.MethodHead)
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != int64(len("hello world")) {
+		t.Fatalf("expected 200 with the GET Content-Length, got %d, %d", resp.StatusCode, resp.ContentLength)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "text/plain" {
+		t.Fatalf("expected upstream headers to pass through, got %q", ct)
+	}
+	mu.Lock()
+	if len(upstreamMethods) != 1 || upstreamMethods[0] != http.MethodGet {
+		t.Fatalf("expected HEAD to reach the upstream as GET, got %v", upstreamMethods)
+	}
+	mu.Unlock()
+
+	resp = do(http.MethodDelete)
+	if resp.StatusCode != http.StatusMethodNotAllowed || resp.Header.Get("Allow") != "GET, HEAD" {
+		t.Fatalf("expected 405 with Allow: GET, HEAD; got %d %q", resp.StatusCode, resp.Header.Get("Allow"))
+	}
+	resp = do(http.MethodOptions)
+	if resp.StatusCode != http.StatusNoContent || resp.Header.Get("Allow") != "GET, HEAD" {
+		t.Fatalf("expected 204 with Allow for OPTIONS, got %d %q", resp.StatusCode, resp.Header.Get("Allow"))
+	}
+	if got := testutil.ToFloat64(gw.metrics.Requests.WithLabelValues("method_not_allowed", http.MethodDelete, "405")); got != 1 {
+		t.Fatalf("expected the 405 to be counted under its method, got %v", got)
+	}
+}
+
+func TestGateway_ClientCancelReachesUpstreamNotBreaker(t *testing.T) {
+	started, cancelled := make(chan struct{}), make(chan struct{})
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		close(started)
+		select {
+		case <-r.Context().Done():
+			close(cancelled)
+		case <-time.After(5 * time.Second):
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	t.Cleanup(up.Close)
+
+	gw := newTestGateway(t, &config.Config{
+		Routes: []config.RouteConfig{{
+			Name: "slow", Match: config.MatchConfig{PathPrefix: "/slow/"}, Upstream: up.URL,
+			CircuitBreaker: config.RouteCircuitBreaker{
+				Enabled: true, FailureThreshold: 1, OpenSeconds: 60, HalfOpenMaxInFlight: 1,
+			},
+		}},
+	})
+	srv := httptest.NewServer(gw.handler())
+	defer srv.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, srv.URL+"/slow/x", nil)
+	errc := make(chan error, 1)
+	go func() {
+		resp, err := http.DefaultClient.Do(req)
+		if err == nil {
+			resp.Body.Close()
+		}
+		errc <- err
+	}()
+	<-started
+	cancel()
+	if err := <-errc; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the client request to be cancelled, got %v", err)
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("upstream never saw the cancellation")
+	}
+
+	// Metrics wrap the breaker, so once the request is counted the breaker is done with it.
+	counted := gw.metrics.Requests.WithLabelValues("slow", http.MethodGet, "499")
+	deadline := time.Now().Add(2 * time.Second)
+	for testutil.ToFloat64(counted) != 1 {
+		if time.Now().After(deadline) {
+			t.Fatal("cancelled request was never recorded as 499")
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if st := gw.table().breakers["slow"].Stats(); st.State != mw.BreakerClosed || st.Failures != 0 {
+		t.Fatalf("expected the breaker untouched by a client cancel, got %+v", st)
+	}
+}
+
+func TestGateway_StripResponseHeaders(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Server", "nginx/1.2.3")
+		w.Header().Set("X-Powered-By", "PHP/5.6")
+		w.Header().Set("X-Debug-Node", "10.0.0.7")
+		w.Header().Set("Alt-Svc", `h3=":443"`)
+		w.Header().Set("X-Kept", "yes")
+		w.WriteHeader(http.StatusOK)
+	}))
+	t.Cleanup(up.Close)
+
+	gw := newTestGateway(t, &config.Config{
+		Upstream: config.UpstreamConfig{StripResponseHeaders: []string{"Server", "x-powered-by"}},
+		Routes: []config.RouteConfig{{
+			Name: "svc", Match: config.MatchConfig{PathPrefix: "/svc/"}, Upstream: up.URL,
+			StripResponseHeaders: []string{"X-Debug-Node"},
+		}},
+	})
+	srv := httptest.NewServer(gw.handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/svc/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	for _, h := range []string{"Server", "X-Powered-By", "X-Debug-Node", "Alt-Svc"} {
+		if v := resp.Header.Get(h); v != "" {
+			t.Fatalf("expected %s to be stripped, got %q", h, v)
+		}
+	}
+	if resp.Header.Get("X-Kept") != "yes" {
+		t.Fatal("expected other upstream headers to pass through")
+	}
+}
+
+func TestGateway_UnixSocketUpstream(t *testing.T) {
+	socket := filepath.Join(t.TempDir(), "app.sock")
+	ln, err := net.Listen("unix", socket)
+	if err != nil {
+		t.Skipf("unix sockets unavailable: %v", err)
+	}
+	up := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Seen-Host", r.Host)
+		_, _ = io.WriteString(w, r.URL.Path)
+	})}
+	go func() { _ = up.Serve(ln) }()
+	t.Cleanup(func() { _ = up.Close() })
+
+	gw := newTestGateway(t, &config.Config{
+		Routes: []config.RouteConfig{{
+			Name: "sidecar", Match: config.MatchConfig{PathPrefix: "/sidecar/"}, Upstream: "unix://" + socket,
+			StripPrefix: "/sidecar",
+		}},
+	})
+	srv := httptest.NewServer(gw.handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/sidecar/status")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || string(body) != "/status" {
+		t.Fatalf("expected the socket upstream to serve /status, got %d %q", resp.StatusCode, body)
+	}
+	if h := resp.Header.Get("X-Seen-Host"); h != "localhost" {
+		t.Fatalf("expected Host localhost upstream, got %q", h)
+	}
+}
+
+func TestGateway_ConfigDumpIsRedacted(t *testing.T) {
+	srv := httptest.NewServer(newTestGateway(t, &config.Config{
+		Auth:      config.AuthConfig{Mode: "hmac", HMACSecret: "super-secret"},
+		RateLimit: config.RateLimitBackend{Backend: "memory", Redis: config.RedisConfig{Password: "redis-pw"}},
+		Routes:    []config.RouteConfig{{Name: "api", Match: config.MatchConfig{PathPrefix: "/api/"}, Upstream: okUpstream(t).URL}},
+	}).handler())
+	defer srv.Close()
+
+	get := func(key string) (*http.Response, string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/-/config", nil)
+		if key != "" {
+			req.Header.Set(mw.AdminKeyHeader, key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp, string(b)
+	}
+
+	if resp, _ := get(""); resp.StatusCode == http.StatusOK {
+		t.Fatal("expected /-/config to need the admin key")
+	}
+	resp, body := get("test-admin-key")
+	if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != "application/json" {
+		t.Fatalf("expected JSON 200, got %d %q", resp.StatusCode, resp.Header.Get("Content-Type"))
+	}
+	if strings.Contains(body, "super-secret") || strings.Contains(body, "redis-pw") {
+		t.Fatalf("expected secrets redacted, got %s", body)
+	}
+	var out struct {
+		Auth      map[string]any `json:"auth"`
+		RateLimit struct {
+			Backend string         `json:"backend"`
+			Redis   map[string]any `json:"redis"`
+		} `json:"rate_limit"`
+		Routes []map[string]any `json:"routes"`
+	}
+	if err := json.Unmarshal([]byte(body), &out); err != nil {
+		t.Fatal(err)
+	}
+	if out.Auth["hmac_secret"] != config.RedactedValue || out.RateLimit.Redis["password"] != config.RedactedValue {
+		t.Fatalf("expected *** in place of secrets, got %s", body)
+	}
+	if out.RateLimit.Backend != "memory" || len(out.Routes) != 1 || out.Routes[0]["name"] != "api" {
+		t.Fatalf("expected the effective config under its file field names, got %s", body)
+	}
+}
+
+func TestGateway_StatusReportsDependencyHealth(t *testing.T) {
+	gw := newTestGateway(t, &config.Config{
+		Routes: []config.RouteConfig{{Name: "api", Match: config.MatchConfig{PathPrefix: "/api/"}, Upstream: okUpstream(t).URL}},
+	})
+	var pings atomic.Int32
+	var down atomic.Bool
+	down.Store(true)
+	gw.RedisPing = func(context.Context) error {
+		pings.Add(1)
+		if down.Load() {
+			return errors.New("connection refused")
+		}
+		return nil
+	}
+	srv := httptest.NewServer(gw.handler())
+	defer srv.Close()
+
+	type status struct {
+		Healthy bool `json:"healthy"`
+		Redis   *struct {
+			Reachable bool   `json:"reachable"`
+			Error     string `json:"error"`
+		} `json:"redis"`
+	}
+	get := func() status {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/-/status", nil)
+		req.Header.Set(mw.AdminKeyHeader, "test-admin-key")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var st status
+		if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+			t.Fatal(err)
+		}
+		return st
+	}
+
+	st := get()
+	if st.Healthy || st.Redis == nil || st.Redis.Reachable || st.Redis.Error != "connection refused" {
+		t.Fatalf("expected unhealthy with an unreachable redis, got %+v %+v", st, st.Redis)
+	}
+
+	// Redis recovers, but the cached result stands until it expires.
+	down.Store(false)
+	if st = get(); st.Healthy || pings.Load() != 1 {
+		t.Fatalf("expected the cached check without another ping, got %+v after %d pings", st, pings.Load())
+	}
+	gw.redisCheck.mu.Lock()
+	gw.redisCheck.checked = time.Time{}
+	gw.redisCheck.mu.Unlock()
+	if st = get(); !st.Healthy || !st.Redis.Reachable {
+		t.Fatalf("expected healthy once redis answers, got %+v %+v", st, st.Redis)
+	}
+}
+
+func TestGateway_MetricsSummary(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(down.Close)
+	srv := httptest.NewServer(newTestGateway(t, &config.Config{
+		Routes: []config.RouteConfig{
+			{
+				Name: "limited", Match: config.MatchConfig{PathPrefix: "/limited/"}, Upstream: okUpstream(t).URL,
+				RateLimit: config.RouteRLConfig{Enabled: true, RPS: 0.001, Burst: 1, Scope: "ip"},
+			},
+			{
+				Name: "down", Match: config.MatchConfig{PathPrefix: "/down/"}, Upstream: down.URL,
+				CircuitBreaker: config.RouteCircuitBreaker{Enabled: true, FailureThreshold: 1, OpenSeconds: 60, HalfOpenMaxInFlight: 1},
+			},
+		},
+	}).handler())
+	defer srv.Close()
+
+	for _, path := range []string{"/limited/a", "/limited/b", "/limited/c", "/down/x"} {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/-/metrics-summary", nil)
+	req.Header.Set(mw.AdminKeyHeader, "test-admin-key")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var sum metricsSummary
+	if err := json.NewDecoder(resp.Body).Decode(&sum); err != nil {
+		t.Fatal(err)
+	}
+
+	if sum.Requests != 4 || sum.ByClass["2xx"] != 1 || sum.ByClass["4xx"] != 2 || sum.ByClass["5xx"] != 1 {
+		t.Fatalf("unexpected totals %+v", sum)
+	}
+	if sum.RateLimited != 2 {
+		t.Fatalf("expected 2 rate-limit blocks, got %d", sum.RateLimited)
+	}
+	limited, downRoute := sum.Routes["limited"], sum.Routes["down"]
+	if limited == nil || limited.Requests != 3 || limited.RateLimited != 2 || limited.Breaker != "" {
+		t.Fatalf("unexpected limited route summary %+v", limited)
+	}
+	if downRoute == nil || downRoute.ByClass["5xx"] != 1 || downRoute.Breaker != mw.BreakerOpen {
+		t.Fatalf("unexpected down route summary %+v", downRoute)
+	}
+}
+
+func TestGateway_DisabledRoute(t *testing.T) {
+	var hits atomic.Int32
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		hits.Add(1)
+	}))
+	t.Cleanup(up.Close)
+
+	gw := newTestGateway(t, &config.Config{
+		Routes: []config.RouteConfig{{
+			Name: "off", Match: config.MatchConfig{PathPrefix: "/off/"}, Upstream: up.URL, Disabled: true,
+			AuthRequired: true, // the kill switch answers before auth
+		}},
+	})
+	srv := httptest.NewServer(gw.handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/off/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body map[string]any
+	_ = json.NewDecoder(resp.Body).Decode(&body)
+	if resp.StatusCode != http.StatusServiceUnavailable || body["error"] != "route_disabled" || body["route"] != "off" {
+		t.Fatalf("expected 503 route_disabled, got %d %v", resp.StatusCode, body)
+	}
+	if n := hits.Load(); n != 0 {
+		t.Fatalf("expected the upstream never called, got %d hits", n)
+	}
+	if got := testutil.ToFloat64(gw.metrics.Requests.WithLabelValues("off", http.MethodGet, "503")); got != 1 {
+		t.Fatalf("expected the request counted under the route, got %v", got)
+	}
+
+	// It stays listed.
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/-/routes", nil)
+	req.Header.Set(mw.AdminKeyHeader, "test-admin-key")
+	resp, err = http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	b, _ := io.ReadAll(resp.Body)
+	if !strings.Contains(string(b), `"disabled":true`) {
+		t.Fatalf("expected the route listed as disabled, got %s", b)
+	}
+}
+
+func TestGateway_SingleFlightSurvivesRouteEdits(t *testing.T) {
+	var calls atomic.Int32
+	release := make(chan struct{})
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		calls.Add(1)
+		<-release
+		_, _ = w.Write([]byte("items"))
+	}))
+	defer up.Close()
+
+	srv := httptest.NewServer(newTestGateway(t, &config.Config{
+		RateLimit: config.RateLimitBackend{Backend: "memory"},
+		Routes:    []config.RouteConfig{{Name: "items", Match: config.MatchConfig{PathPrefix: "/items/"}, Upstream: up.URL, SingleFlight: true}},
+	}).handler())
+	defer srv.Close()
+
+	// Adding another route swaps the table; the unchanged route keeps coalescing.
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/-/routes",
+		strings.NewReader(`{"name": "other", "match": {"path_prefix": "/other/"}, "upstream": "`+up.URL+`"}`))
+	req.Header.Set(mw.AdminKeyHeader, "test-admin-key")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("expected route created, got %d", resp.StatusCode)
+	}
+
+	const n = 10
+	var wg sync.WaitGroup
+	bodies := make([]string, n)
+	for i := range bodies {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			resp, err := http.Get(srv.URL + "/items/1")
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			defer resp.Body.Close()
+			b, _ := io.ReadAll(resp.Body)
+			bodies[i] = string(b)
+		}(i)
+	}
+	time.Sleep(100 * time.Millisecond) // let every request join the flight
+	close(release)
+	wg.Wait()
+
+	if got := calls.Load(); got != 1 {
+		t.Fatalf("expected one upstream call for %d identical GETs, got %d", n, got)
+	}
+	for _, b := range bodies {
+		if b != "items" {
+			t.Fatalf("expected every caller to get the upstream body, got %q", b)
+		}
+	}
+}
+
+func TestGateway_MaintenanceMode(t *testing.T) {
+	srv := httptest.NewServer(newTestGateway(t, &config.Config{
+		Routes: []config.RouteConfig{{Name: "api", Match: config.MatchConfig{PathPrefix: "/api/"}, Upstream: okUpstream(t).URL}},
+	}).handler())
+	defer srv.Close()
+
+	do := func(method, path, body string) (*http.Response, map[string]any) {
+		t.Helper()
+		req, _ := http.NewRequest(method, srv.URL+path, strings.NewReader(body))
+		if strings.HasPrefix(path, "/-/") {
+			req.Header.Set(mw.AdminKeyHeader, "test-admin-key")
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var out map[string]any
+		_ = json.NewDecoder(resp.Body).Decode(&out)
+		return resp, out
+	}
+
+	resp, _ := do(http.MethodPost, "/-/maintenance", `{"on": true, "retry_after": 120, "message": "back soon"}`)
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected maintenance to switch on, got %d", resp.StatusCode)
+	}
+	resp, body := do(http.MethodGet, "/api/x", "")
+	if resp.StatusCode != http.StatusServiceUnavailable || resp.Header.Get("Retry-After") != "120" ||
+		body["error"] != "maintenance" || body["message"] != "back soon" {
+		t.Fatalf("expected the maintenance 503, got %d %v %v", resp.StatusCode, resp.Header, body)
+	}
+	if resp, _ = do(http.MethodGet, "/nope", ""); resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected unmatched paths in maintenance too, got %d", resp.StatusCode)
+	}
+	for _, path := range []string{"/healthz", "/metrics", "/-/maintenance"} {
+		if resp, _ = do(http.MethodGet, path, ""); resp.StatusCode != http.StatusOK {
+			t.Fatalf("expected %s to stay up during maintenance, got %d", path, resp.StatusCode)
+		}
+	}
+
+	if resp, _ = do(http.MethodPost, "/-/maintenance", `{"on": false}`); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected maintenance to switch off, got %d", resp.StatusCode)
+	}
+	if resp, _ = do(http.MethodGet, "/api/x", ""); resp.StatusCode != http.StatusOK {
+		t.Fatalf("expected traffic back after maintenance, got %d", resp.StatusCode)
+	}
+	if resp, _ = do(http.MethodPost, "/-/maintenance", `{"on": true, "retry_after": -1}`); resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected a negative retry_after rejected, got %d", resp.StatusCode)
+	}
+}
+
+func TestGateway_AdminListenerTakesAdminEndpoints(t *testing.T) {
+	up := okUpstream(t)
+	gw := newTestGateway(t, &config.Config{
+		Admin: config.AdminConfig{Addr: "127.0.0.1:9090"},
+		Routes: []config.RouteConfig{{
+			Name: "api", Match: config.MatchConfig{PathPrefix: "/api/"}, Upstream: up.URL,
+		}},
+	})
+	public := httptest.NewServer(gw.handler())
+	defer public.Close()
+	admin := httptest.NewServer(gw.adminHandler())
+	defer admin.Close()
+
+	status := func(base, path, key string) int {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, base+path, nil)
+		if key != "" {
+			req.Header.Set(mw.AdminKeyHeader, key)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if got := status(public.URL, "/api/x", ""); got != http.StatusOK {
+		t.Fatalf("expected the public listener to proxy, got %d", got)
+	}
+	for _, path := range []string{"/metrics", "/-/status"} {
+		if got := status(public.URL, path, "test-admin-key"); got != http.StatusNotFound {
+			t.Fatalf("expected %s to be gone from the public listener, got %d", path, got)
+		}
+	}
+	if got := status(admin.URL, "/metrics", ""); got != http.StatusOK {
+		t.Fatalf("expected open /metrics on the admin listener, got %d", got)
+	}
+	if got := status(admin.URL, "/-/status", ""); got != http.StatusUnauthorized {
+		t.Fatalf("expected /-/status to still need the admin key, got %d", got)
+	}
+	if got := status(admin.URL, "/-/status", "test-admin-key"); got != http.StatusOK {
+		t.Fatalf("expected /-/status with the key to succeed, got %d", got)
+	}
+	if got := status(admin.URL, "/api/x", ""); got != http.StatusNotFound {
+		t.Fatalf("expected the admin listener not to proxy, got %d", got)
+	}
+}
+
+func TestGateway_MaxBodyBytes(t *testing.T) {
+	var calls atomic.Int32
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		_, _ = io.Copy(io.Discard, r.Body)
+	}))
+	defer up.Close()
+
+	srv := httptest.NewServer(newTestGateway(t, &config.Config{
+		Server:    config.ServerConfig{MaxBodyBytes: 8},
+		RateLimit: config.RateLimitBackend{Backend: "memory"},
+		Routes:    []config.RouteConfig{{Name: "items", Match: config.MatchConfig{PathPrefix: "/items/"}, Upstream: up.URL}},
+	}).handler())
+	defer srv.Close()
+
+	post := func(body string) int {
+		resp, err := http.Post(srv.URL+"/items/1", "text/plain", strings.NewReader(body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	if got := post("small"); got != http.StatusOK {
+		t.Fatalf("expected a body under the cap through, got %d", got)
+	}
+	if got := post("much too large"); got != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413 over the cap, got %d", got)
+	}
+	if got := calls.Load(); got != 1 {
+		t.Fatalf("expected the oversized body not to reach the upstream, got %d calls", got)
+	}
+}
+
+func TestGateway_GRPCRouteUsesH2CAndForwardsTrailers(t *testing.T) {
+	up := httptest.NewServer(h2c.NewHandler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", r.Header.Get("Content-Type"))
+		w.Header().Set("X-Upstream-Proto", r.Proto)
+		w.Header().Set("Trailer", "Grpc-Status")
+		_, _ = w.Write([]byte("reply"))
+		w.Header().Set("Grpc-Status", "0")
+	}), &http2.Server{}))
+	defer up.Close()
+
+	gw := newTestGateway(t, &config.Config{
+		Server: config.ServerConfig{MaxBodyBytes: 2}, // gRPC streams aren't capped
+		Routes: []config.RouteConfig{{
+			Name: "echo", Match: config.MatchConfig{PathPrefix: "/echo.Echo/"}, Upstream: up.URL, Protocol: "grpc",
+		}},
+	})
+	srv := httptest.NewServer(h2c.NewHandler(gw.handler(), &http2.Server{}))
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, network, addr)
+		},
+	}}
+	req, _ := http.NewRequest(http.MethodPost, srv.URL+"/echo.Echo/Say", strings.NewReader("hello"))
+	req.Header.Set("Content-Type", "application/grpc")
+	resp, err := client.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK || string(body) != "reply" {
+		t.Fatalf("expected the upstream reply, got %d %q", resp.StatusCode, body)
+	}
+	if p := resp.Header.Get("X-Upstream-Proto"); p != "HTTP/2.0" {
+		t.Fatalf("expected HTTP/2 to the upstream, got %q", p)
+	}
+	if ct := resp.Header.Get("Content-Type"); ct != "application/grpc" {
+		t.Fatalf("expected content-type to be preserved, got %q", ct)
+	}
+	if gs := resp.Trailer.Get("Grpc-Status"); gs != "0" {
+		t.Fatalf("expected the grpc-status trailer, got %v", resp.Trailer)
+	}
+}
+
+func TestGateway_ReadyzWaitsForJWKS(t *testing.T) {
+	priv, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var idpUp atomic.Bool
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if !idpUp.Load() {
+			http.Error(w, "down", http.StatusServiceUnavailable)
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]any{"keys": []any{map[string]any{
+			"kty": "RSA", "kid": "k1",
+			"n": base64.RawURLEncoding.EncodeToString(priv.N.Bytes()),
+			"e": base64.RawURLEncoding.EncodeToString([]byte{1, 0, 1}),
+		}}})
+	}))
+	defer jwks.Close()
+	v, err := mw.NewJWKSValidator(jwks.URL, mw.JWKSValidatorOptions{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := v.Prefetch(context.Background()); err == nil {
+		t.Fatal("expected the initial fetch to fail while the IdP is down")
+	}
+
+	limiter := ratelimit.NewMemoryLimiter(time.Minute, time.Minute)
+	t.Cleanup(func() { _ = limiter.Close() })
+	gw, err := newGateway(&config.Config{
+		Auth: config.AuthConfig{Mode: "jwks", JWKS: config.JWKSAuthConfig{URL: jwks.URL}},
+		Routes: []config.RouteConfig{{
+			Name: "api", Match: config.MatchConfig{PathPrefix: "/api/"}, Upstream: okUpstream(t).URL,
+		}},
+	}, gatewayDeps{
+		Log:       slog.New(slog.NewJSONHandler(io.Discard, nil)),
+		Limiter:   limiter,
+		Quota:     ratelimit.NewMemoryQuota(),
+		Auth:      jwksAuthAdapter{v: v},
+		JWKS:      v,
+		Transport: http.DefaultTransport,
+		AdminKey:  "test-admin-key",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(gw.handler())
+	defer srv.Close()
+
+	readyz := func() (int, map[string]any) {
+		t.Helper()
+		resp, err := http.Get(srv.URL + "/readyz")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var body map[string]any
+		_ = json.NewDecoder(resp.Body).Decode(&body)
+		return resp.StatusCode, body
+	}
+
+	code, body := readyz()
+	if code != http.StatusServiceUnavailable || body["ready"] != false || len(body) != 1 {
+		t.Fatalf("expected only ready=false before the first fetch, got %d %v", code, body)
+	}
+
+	req, _ := http.NewRequest(http.MethodGet, srv.URL+"/-/status", nil)
+	req.Header.Set(mw.AdminKeyHeader, "test-admin-key")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var status map[string]any
+	_ = json.NewDecoder(resp.Body).Decode(&status)
+	resp.Body.Close()
+	sets, _ := status["jwks_key_sets"].([]any)
+	if len(sets) != 1 || !strings.Contains(fmt.Sprint(sets[0]), "jwks http 503") {
+		t.Fatalf("expected the fetch error in /-/status, got %v", status["jwks_key_sets"])
+	}
+
+	idpUp.Store(true)
+	if err := v.Prefetch(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if code, body := readyz(); code != http.StatusOK || body["ready"] != true {
+		t.Fatalf("expected ready once keys loaded, got %d %v", code, body)
+	}
+}
+
+func TestGateway_RouteUpstreamTimeoutIs504AndTripsBreaker(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		select {
+		case <-r.Context().Done():
+		case <-time.After(5 * time.Second):
+			w.WriteHeader(http.StatusOK)
+		}
+	}))
+	t.Cleanup(up.Close)
+
+	gw := newTestGateway(t, &config.Config{
+		Routes: []config.RouteConfig{{
+			Name: "slow", Match: config.MatchConfig{PathPrefix: "/slow/"}, Upstream: up.URL,
+			UpstreamTimeoutSeconds: 1,
+			CircuitBreaker: config.RouteCircuitBreaker{
+				Enabled: true, FailureThreshold: 1, OpenSeconds: 60, HalfOpenMaxInFlight: 1,
+			},
+		}},
+	})
+	srv := httptest.NewServer(gw.handler())
+	defer srv.Close()
+
+	start := time.Now()
+	resp, err := http.Get(srv.URL + "/slow/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body map[string]any
+	_ = json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusGatewayTimeout || body["error"] != "upstream_timeout" {
+		t.Fatalf("expected 504 upstream_timeout, got %d %v", resp.StatusCode, body)
+	}
+	if elapsed := time.Since(start); elapsed > 3*time.Second {
+		t.Fatalf("expected the route timeout to cut the wait short, took %s", elapsed)
+	}
+	if st := gw.table().breakers["slow"].Stats(); st.State != mw.BreakerOpen {
+		t.Fatalf("expected the timeout to count as a breaker failure, got %+v", st)
+	}
+}
+
+func TestGateway_MaxResponseBytes(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = w.Write(bytes.Repeat([]byte("x"), 2048))
+	}))
+	t.Cleanup(up.Close)
+
+	gw := newTestGateway(t, &config.Config{
+		Routes: []config.RouteConfig{
+			{Name: "capped", Match: config.MatchConfig{PathPrefix: "/capped/"}, Upstream: up.URL, MaxResponseBytes: 1024},
+			{Name: "open", Match: config.MatchConfig{PathPrefix: "/open/"}, Upstream: up.URL},
+		},
+	})
+	srv := httptest.NewServer(gw.handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/capped/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var body map[string]any
+	_ = json.NewDecoder(resp.Body).Decode(&body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway || body["error"] != "upstream_response_too_large" {
+		t.Fatalf("expected 502 upstream_response_too_large, got %d %v", resp.StatusCode, body)
+	}
+	if n := testutil.ToFloat64(gw.metrics.ResponseTooLarge.WithLabelValues("capped")); n != 1 {
+		t.Fatalf("expected one capped response counted, got %v", n)
+	}
+
+	resp, err = http.Get(srv.URL + "/open/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	n, _ := io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || n != 2048 {
+		t.Fatalf("expected the uncapped route to pass the full body, got %d with %d bytes", resp.StatusCode, n)
+	}
+}
+
+func TestGateway_ForwardHeadersAllowList(t *testing.T) {
+	seen := make(chan http.Header, 2)
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen <- r.Header.Clone()
+	}))
+	t.Cleanup(up.Close)
+
+	gw := newTestGateway(t, &config.Config{
+		Routes: []config.RouteConfig{
+			{
+				Name: "untrusted", Match: config.MatchConfig{PathPrefix: "/u/"}, Upstream: up.URL,
+				ForwardHeaders: []string{"accept", "X-Tenant"},
+			},
+			{Name: "trusted", Match: config.MatchConfig{PathPrefix: "/t/"}, Upstream: up.URL},
+		},
+	})
+	srv := httptest.NewServer(gw.handler())
+	defer srv.Close()
+
+	send := func(path string) http.Header {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+path, nil)
+		req.Header.Set("Accept", "application/json")
+		req.Header.Set("X-Tenant", "acme")
+		req.Header.Set("Cookie", "session=secret")
+		req.Header.Set("X-Auth-User", "admin")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return <-seen
+	}
+
+	h := send("/u/x")
+	if h.Get("Accept") != "application/json" || h.Get("X-Tenant") != "acme" {
+		t.Fatalf("expected listed headers upstream, got %v", h)
+	}
+	if h.Get("Cookie") != "" || h.Get("X-Auth-User") != "" {
+		t.Fatalf("expected unlisted and X-Auth-* headers dropped, got %v", h)
+	}
+	if h.Get(mw.DefaultRequestIDHeader) == "" || h.Get("X-Forwarded-For") == "" {
+		t.Fatalf("expected gateway-set headers to survive the allow-list, got %v", h)
+	}
+
+	h = send("/t/x")
+	if h.Get("Cookie") == "" || h.Get("X-Tenant") == "" {
+		t.Fatalf("expected all headers without an allow-list, got %v", h)
+	}
+	if h.Get("X-Auth-User") != "" {
+		t.Fatalf("expected spoofed X-Auth-* dropped on every route, got %v", h)
+	}
+}
+
+func TestGateway_CircuitBreakerFallback(t *testing.T) {
+	down := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+	t.Cleanup(down.Close)
+	backup := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, "backup "+r.URL.Path)
+	}))
+	t.Cleanup(backup.Close)
+
+	breaker := func(fb config.BreakerFallbackConfig) config.RouteCircuitBreaker {
+		return config.RouteCircuitBreaker{Enabled: true, FailureThreshold: 1, OpenSeconds: 60, HalfOpenMaxInFlight: 1, Fallback: fb}
+	}
+	gw := newTestGateway(t, &config.Config{
+		Routes: []config.RouteConfig{
+			{
+				Name: "static", Match: config.MatchConfig{PathPrefix: "/static/"}, Upstream: down.URL,
+				CircuitBreaker: breaker(config.BreakerFallbackConfig{Body: `{"status":"maintenance"}`}),
+			},
+			{
+				Name: "secondary", Match: config.MatchConfig{PathPrefix: "/secondary/"}, Upstream: down.URL,
+				StripPrefix:    "/secondary",
+				CircuitBreaker: breaker(config.BreakerFallbackConfig{Upstream: backup.URL}),
+			},
+			{
+				Name: "plain", Match: config.MatchConfig{PathPrefix: "/plain/"}, Upstream: down.URL,
+				CircuitBreaker: breaker(config.BreakerFallbackConfig{}),
+			},
+		},
+	})
+	srv := httptest.NewServer(gw.handler())
+	defer srv.Close()
+
+	get := func(path string) (int, string, string) {
+		t.Helper()
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		b, _ := io.ReadAll(resp.Body)
+		return resp.StatusCode, resp.Header.Get("Content-Type"), string(b)
+	}
+
+	for _, route := range []string{"static", "secondary", "plain"} {
+		// The first failure opens the breaker.
+		if code, _, _ := get("/" + route + "/x"); code != http.StatusInternalServerError {
+			t.Fatalf("%s: expected the upstream 500 first, got %d", route, code)
+		}
+	}
+
+	code, ct, body := get("/static/x")
+	if code != http.StatusOK || ct != "application/json" || body != `{"status":"maintenance"}` {
+		t.Fatalf("static: expected the fallback body, got %d %q %q", code, ct, body)
+	}
+	if code, _, body = get("/secondary/x"); code != http.StatusOK || body != "backup /x" {
+		t.Fatalf("secondary: expected the backup upstream with the path rewritten, got %d %q", code, body)
+	}
+	if code, _, body = get("/plain/x"); code != http.StatusServiceUnavailable || !strings.Contains(body, "circuit_open") {
+		t.Fatalf("plain: expected the default 503, got %d %q", code, body)
+	}
+}
+
+func TestGateway_Upstream503RetryAfterPassesThrough(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Retry-After", "30")
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}))
+	t.Cleanup(up.Close)
+
+	// Run through every per-route stage that touches the response.
+	gw := newTestGateway(t, &config.Config{
+		Routes: []config.RouteConfig{{
+			Name:        "svc",
+			Match:       config.MatchConfig{PathPrefix: "/svc/"},
+			Upstream:    up.URL,
+			RateLimit:   config.RouteRLConfig{Enabled: true, RPS: 100, Burst: 100, Scope: "ip"},
+			Concurrency: config.RouteConcurrency{MaxInFlight: 10},
+			CircuitBreaker: config.RouteCircuitBreaker{
+				Enabled: true, FailureThreshold: 100, OpenSeconds: 10, HalfOpenMaxInFlight: 1,
+			},
+		}},
+	})
+	srv := httptest.NewServer(gw.handler())
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/svc/x")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusServiceUnavailable {
+		t.Fatalf("expected upstream 503, got %d", resp.StatusCode)
+	}
+	if got := resp.Header.Get("Retry-After"); got != "30" {
+		t.Fatalf("expected upstream Retry-After 30, got %q", got)
+	}
+}
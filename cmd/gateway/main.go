@@ -2,52 +2,167 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/tls"
+	"crypto/x509"
 	"errors"
 	"flag"
+	"fmt"
+	"io/fs"
 	"log/slog"
 	"net"
 	"net/http"
 	"net/url"
 	"os"
 	"os/signal"
-	"runtime/debug"
 	"strings"
+	"sync"
 	"syscall"
 	"time"
 
-	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/redis/go-redis/v9"
+	"go.opentelemetry.io/otel/metric"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
 
 	"github.com/3xpluto/go-api-gateway/internal/config"
 	"github.com/3xpluto/go-api-gateway/internal/logging"
 	"github.com/3xpluto/go-api-gateway/internal/mw"
 	"github.com/3xpluto/go-api-gateway/internal/proxy"
 	"github.com/3xpluto/go-api-gateway/internal/ratelimit"
+	"github.com/3xpluto/go-api-gateway/internal/telemetry"
 )
 
 type jwksAuthAdapter struct {
-	v *mw.JWKSValidator
+	v      *mw.JWKSValidator
+	tokens mw.TokenSources
+	claims *mw.ClaimRequirements // per-route issuers/audiences; nil uses the validator's
 }
 
 func (a jwksAuthAdapter) ValidateBearer(r *http.Request) (string, error) {
-	authz := r.Header.Get("Authorization")
-	if authz == "" || !strings.HasPrefix(authz, "Bearer ") {
-		return "", errors.New("missing bearer token")
+	tokStr, err := a.tokens.BearerToken(r)
+	if err != nil {
+		return "", err
+	}
+	p, err := a.v.ValidatePrincipalFor(r.Context(), tokStr, a.claims)
+	return p.Subject, err
+}
+
+func (a jwksAuthAdapter) Authenticate(r *http.Request) (mw.Principal, error) {
+	tokStr, err := a.tokens.BearerToken(r)
+	if err != nil {
+		return mw.Principal{}, err
+	}
+	return a.v.ValidatePrincipalFor(r.Context(), tokStr, a.claims)
+}
+
+// newAuthHandler builds the auth handler for one auth block. JWKS keys are
+// fetched within startupTimeout; on failure that is an error with
+// jwks.fail_fast, and otherwise retried in the background until it succeeds
+// or ctx is done.
+func newAuthHandler(ctx context.Context, log *slog.Logger, ac config.AuthConfig, startupTimeout time.Duration) (mw.AuthHandler, *mw.JWKSValidator, error) {
+	tokens := mw.TokenSources{
+		Cookie: ac.TokenSources.Cookie,
+		Query:  ac.TokenSources.QueryParam,
+	}
+
+	switch strings.ToLower(ac.Mode) {
+	case "jwks":
+		v, err := mw.NewJWKSValidator(ac.JWKS.URL, mw.JWKSValidatorOptions{
+			HTTPTimeout: time.Duration(ac.JWKS.HTTPTimeoutSeconds) * time.Second,
+			CacheTTL:    time.Duration(ac.JWKS.CacheTTLSeconds) * time.Second,
+			Leeway:      time.Duration(ac.JWKS.LeewaySeconds) * time.Second,
+			Issuers:     ac.JWKS.Issuers,
+			Audiences:   ac.JWKS.Audiences,
+			ValidAlgs:   []string{"RS256"},
+
+			ValidationCacheSize: ac.JWKS.ValidationCacheSize,
+			TierClaim:           ac.TierClaim,
+			Log:                 log,
+		})
+		if err != nil {
+			return nil, nil, fmt.Errorf("jwks validator: %w", err)
+		}
+		// Load keys before serving; /readyz reports 503 until this succeeds.
+		if err := checkDependency(log, "jwks", startupTimeout, v.Prefetch); err != nil {
+			if ac.JWKS.FailFast {
+				return nil, nil, fmt.Errorf("jwks initial fetch: %w", err)
+			}
+			log.Warn("jwks initial fetch failed; starting not ready and retrying in the background",
+				slog.String("url", ac.JWKS.URL), slog.String("error", err.Error()))
+			go retryJWKS(ctx, log, ac.JWKS.URL, v, startupTimeout)
+		}
+		return jwksAuthAdapter{v: v, tokens: tokens}, v, nil
+
+	case "hmac", "":
+		return mw.Authenticator{
+			Mode:        "hmac",
+			HMACSecret:  []byte(ac.HMACSecret),
+			Tokens:      tokens,
+			TierClaim:   ac.TierClaim,
+			HMACAlgs:    ac.HMACAlgs,
+			HMACSecrets: hmacSecrets(ac.HMACSecrets),
+		}, nil, nil
+
+	case "mtls":
+		return mw.ClientCertAuthenticator{
+			SAN:     ac.MTLS.Subject == "san",
+			Allowed: ac.MTLS.AllowedSubjects,
+		}, nil, nil
+
+	default:
+		return nil, nil, fmt.Errorf("unknown auth.mode %q", ac.Mode)
+	}
+}
+
+// transportConfig maps the upstream block onto proxy.TransportConfig.
+func transportConfig(uc config.UpstreamConfig) proxy.TransportConfig {
+	return proxy.TransportConfig{
+		DialTimeout:           time.Duration(uc.DialTimeoutSeconds) * time.Second,
+		TLSHandshakeTimeout:   time.Duration(uc.TLSHandshakeTimeoutSeconds) * time.Second,
+		ResponseHeaderTimeout: time.Duration(uc.ResponseHeaderTimeoutSeconds) * time.Second,
+		IdleConnTimeout:       time.Duration(uc.IdleConnTimeoutSeconds) * time.Second,
+		MaxIdleConns:          uc.MaxIdleConns,
+		MaxIdleConnsPerHost:   uc.MaxIdleConnsPerHost,
+	}
+}
+
+// upstreamTransport builds the upstream round tripper from the upstream
+// block; with a socket path every connection goes to that Unix socket.
+func upstreamTransport(uc config.UpstreamConfig, socket string) http.RoundTripper {
+	tc := transportConfig(uc)
+	newTransport := func() *http.Transport {
+		if socket != "" {
+			return proxy.NewUnixTransport(tc, socket)
+		}
+		return proxy.NewTransport(tc)
+	}
+	var rt http.RoundTripper
+	if uc.CloseOn5xx {
+		rt = proxy.CloseOn5xx(newTransport)
+	} else {
+		rt = newTransport()
 	}
-	tokStr := strings.TrimSpace(strings.TrimPrefix(authz, "Bearer "))
-	return a.v.Validate(r.Context(), tokStr)
+	return proxy.TotalTimeout(rt, time.Duration(uc.TotalTimeoutSeconds)*time.Second)
+}
+
+func hmacSecrets(ss []string) [][]byte {
+	out := make([][]byte, 0, len(ss))
+	for _, s := range ss {
+		out = append(out, []byte(s))
+	}
+	return out
 }
 
 func main() {
 	var configPath string
-	var validateOnly bool
-	flag.StringVar(&configPath, "config", "./config/config.example.yaml", "path to yaml config")
+	var validateOnly, checkConn bool
+	flag.StringVar(&configPath, "config", "./config/config.example.yaml", "path to yaml/json config, or a directory/glob of a base config plus route fragments")
 	flag.BoolVar(&validateOnly, "validate-config", false, "validate config and exit")
+	flag.BoolVar(&checkConn, "check-connectivity", false, "with -validate-config, also probe JWKS, Redis and upstream DNS")
 	flag.Parse()
 
-	log := logging.New()
+	// Bootstrap logger for config errors; replaced once logging.* is known.
+	log, _, _ := logging.New(logging.Options{})
 
 	cfg, err := config.Load(configPath)
 	if err != nil {
@@ -55,17 +170,60 @@ func main() {
 		os.Exit(1)
 	}
 
+	cfgLog, logCloser, err := logging.New(logging.Options{
+		Output:     cfg.Logging.Output,
+		FilePath:   cfg.Logging.FilePath,
+		MaxSizeMB:  cfg.Logging.MaxSizeMB,
+		MaxAgeDays: cfg.Logging.MaxAgeDays,
+		MaxBackups: cfg.Logging.MaxBackups,
+		Compress:   cfg.Logging.Compress,
+	})
+	if err != nil {
+		log.Error("failed to init logging", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
+	defer logCloser.Close()
+	log = cfgLog
+
+	// Access lines share the output but may use another format.
+	accessLog := log
+	if f := cfg.Logging.Access.Format; f != "" && f != logging.FormatJSON {
+		if accessLog, err = logging.NewFormat(logCloser, f); err != nil {
+			log.Error("failed to init access log", slog.String("error", err.Error()))
+			os.Exit(1)
+		}
+	}
+
 	if err := validateConfig(cfg); err != nil {
 		log.Error("config validation failed", slog.String("error", err.Error()))
 		os.Exit(1)
 	}
 	if validateOnly {
+		if checkConn {
+			failed := false
+			for _, c := range checkConnectivity(cfg, time.Duration(cfg.Server.StartupTimeoutSeconds)*time.Second) {
+				if c.Err != nil {
+					failed = true
+					log.Error("connectivity check failed", slog.String("check", c.Name), slog.String("error", c.Err.Error()))
+					continue
+				}
+				log.Info("connectivity check passed", slog.String("check", c.Name))
+			}
+			if failed {
+				os.Exit(1)
+			}
+		}
 		log.Info("config ok")
 		return
 	}
 
+	startupTimeout := time.Duration(cfg.Server.StartupTimeoutSeconds) * time.Second
+
 	// ---- Rate limiter backend
 	var limiter ratelimit.Limiter
+	var quota ratelimit.QuotaLimiter
+	var memState *ratelimit.MemoryLimiter // non-nil when rate_limit.memory.state_file is set
+	var redisPing func(context.Context) error
 	backend := strings.ToLower(cfg.RateLimit.Backend)
 
 	switch backend {
@@ -75,317 +233,282 @@ func main() {
 			Password: cfg.RateLimit.Redis.Password,
 			DB:       cfg.RateLimit.Redis.DB,
 		})
-		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
-		defer cancel()
-
-		if err := rdb.Ping(ctx).Err(); err != nil {
+		// Reported by /-/status even when startup fell back to memory.
+		redisPing = func(ctx context.Context) error { return rdb.Ping(ctx).Err() }
+		err := checkDependency(log, "redis", startupTimeout, redisPing)
+		if err != nil {
 			log.Warn("redis unreachable; falling back to memory limiter", slog.String("error", err.Error()))
 			limiter = ratelimit.NewMemoryLimiter(5*time.Minute, time.Minute)
+			quota = ratelimit.NewMemoryQuota()
 		} else {
 			limiter = ratelimit.NewRedisLimiter(rdb)
+			quota = ratelimit.NewRedisQuota(rdb)
 		}
 
 	case "memory":
-		limiter = ratelimit.NewMemoryLimiter(
+		ml := ratelimit.NewMemoryLimiter(
 			time.Duration(cfg.RateLimit.Memory.TTLSeconds)*time.Second,
 			time.Duration(cfg.RateLimit.Memory.CleanupSeconds)*time.Second,
 		)
+		if path := cfg.RateLimit.Memory.StateFile; path != "" {
+			if err := ml.Restore(path); err != nil && !errors.Is(err, fs.ErrNotExist) {
+				log.Warn("failed to restore limiter state", slog.String("file", path), slog.String("error", err.Error()))
+			}
+			memState = ml
+		}
+		limiter = ml
+		quota = ratelimit.NewMemoryQuota()
 
 	default:
 		log.Error("unknown rate_limit.backend", slog.String("backend", cfg.RateLimit.Backend))
 		os.Exit(1)
 	}
 	defer limiter.Close()
+	defer quota.Close()
 
-	// ---- Transport for upstream calls (hardened defaults)
-	transport := &http.Transport{
-		Proxy: http.ProxyFromEnvironment,
-		DialContext: (&net.Dialer{
-			Timeout:   3 * time.Second,
-			KeepAlive: 30 * time.Second,
-		}).DialContext,
-		ForceAttemptHTTP2:     true,
-		MaxIdleConns:          256,
-		MaxIdleConnsPerHost:   64,
-		IdleConnTimeout:       90 * time.Second,
-		TLSHandshakeTimeout:   5 * time.Second,
-		ExpectContinueTimeout: 1 * time.Second,
-		ResponseHeaderTimeout: 10 * time.Second,
-	}
-
-	// ---- Auth handler (HS256 or JWKS)
-	var authHandler mw.AuthHandler
-	var jwksValidator *mw.JWKSValidator
-
-	switch strings.ToLower(cfg.Auth.Mode) {
-	case "jwks":
-		// Assumes your config has cfg.Auth.JWKS.{URL,CacheTTLSeconds,HTTPTimeoutSeconds,LeewaySeconds,Issuers,Audiences}
-		v, err := mw.NewJWKSValidator(cfg.Auth.JWKS.URL, mw.JWKSValidatorOptions{
-			HTTPTimeout: time.Duration(cfg.Auth.JWKS.HTTPTimeoutSeconds) * time.Second,
-			CacheTTL:    time.Duration(cfg.Auth.JWKS.CacheTTLSeconds) * time.Second,
-			Leeway:      time.Duration(cfg.Auth.JWKS.LeewaySeconds) * time.Second,
-			Issuers:     cfg.Auth.JWKS.Issuers,
-			Audiences:   cfg.Auth.JWKS.Audiences,
-			ValidAlgs:   []string{"RS256"},
-		})
-		if err != nil {
-			log.Error("failed to init jwks validator", slog.String("error", err.Error()))
-			os.Exit(1)
-		}
-		jwksValidator = v
-		authHandler = jwksAuthAdapter{v: v}
-
-	case "hmac", "":
-		a := mw.Authenticator{
-			Mode:       "hmac",
-			HMACSecret: []byte(cfg.Auth.HMACSecret),
-		}
-		authHandler = a
+	// ---- Transport for upstream calls (zero fields fall back to hardened defaults)
+	upstreamRT := upstreamTransport(cfg.Upstream, "")
 
-	default:
-		log.Error("unknown auth.mode", slog.String("mode", cfg.Auth.Mode))
+	// ---- Auth handler (HS256 or JWKS); routes may override it (see gateway.buildRoutes)
+	authHandler, jwksValidator, err := newAuthHandler(context.Background(), log, cfg.Auth, startupTimeout)
+	if err != nil {
+		log.Error("failed to init auth", slog.String("error", err.Error()))
 		os.Exit(1)
 	}
 
-	// ---- Build route table + per-route semaphores/breakers
-	routes := make([]proxy.Route, 0, len(cfg.Routes))
-	sems := map[string]*mw.Semaphore{}
-	breakers := map[string]*mw.CircuitBreaker{}
-
-	for _, rc := range cfg.Routes {
-		u, err := url.Parse(rc.Upstream)
+	// ---- Optional OTLP metrics export (alongside or instead of /metrics)
+	var meter metric.Meter
+	if cfg.Metrics.OTLP.Enabled {
+		mp, err := telemetry.NewOTLPMeterProvider(context.Background(), telemetry.OTLPOptions{
+			Endpoint: cfg.Metrics.OTLP.Endpoint,
+			URLPath:  cfg.Metrics.OTLP.URLPath,
+			Insecure: cfg.Metrics.OTLP.Insecure,
+			Headers:  cfg.Metrics.OTLP.Headers,
+			Interval: time.Duration(cfg.Metrics.OTLP.IntervalSeconds) * time.Second,
+		})
 		if err != nil {
-			log.Error("invalid upstream url", slog.String("route", rc.Name), slog.String("error", err.Error()))
+			log.Error("failed to init otlp metrics", slog.String("error", err.Error()))
 			os.Exit(1)
 		}
-
-		r := proxy.Route{
-			Name:         rc.Name,
-			PathPrefix:   rc.Match.PathPrefix,
-			Upstream:     u,
-			StripPrefix:  rc.StripPrefix,
-			AuthRequired: rc.AuthRequired,
-			RateLimit: proxy.RouteRateLimit{
-				Enabled: rc.RateLimit.Enabled,
-				RPS:     rc.RateLimit.RPS,
-				Burst:   rc.RateLimit.Burst,
-				Scope:   rc.RateLimit.Scope,
-			},
-			Proxy: proxy.BuildProxy(u, transport),
-		}
-		routes = append(routes, r)
-
-		// Concurrency per route
-		sems[rc.Name] = mw.NewSemaphore(rc.Concurrency.MaxInFlight)
-
-		// Circuit breaker per route
-		breakers[rc.Name] = mw.NewCircuitBreaker(mw.BreakerConfig{
-			Enabled:             rc.CircuitBreaker.Enabled,
-			FailureThreshold:    rc.CircuitBreaker.FailureThreshold,
-			OpenDuration:        time.Duration(rc.CircuitBreaker.OpenSeconds) * time.Second,
-			HalfOpenMaxInFlight: rc.CircuitBreaker.HalfOpenMaxInFlight,
-		})
+		defer func() {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+			_ = mp.Shutdown(ctx)
+		}()
+		meter = mp.Meter("github.com/3xpluto/go-api-gateway")
 	}
 
-	rtr, err := proxy.New(routes)
+	gw, err := newGateway(cfg, gatewayDeps{
+		Log:       log,
+		Limiter:   limiter,
+		Quota:     quota,
+		Auth:      authHandler,
+		JWKS:      jwksValidator,
+		Transport: upstreamRT,
+		AdminKey:  os.Getenv("APIGW_ADMIN_KEY"),
+		Meter:     meter,
+		AccessLog: accessLog,
+		RedisPing: redisPing,
+	})
 	if err != nil {
-		log.Error("failed to create router", slog.String("error", err.Error()))
+		log.Error("failed to build gateway", slog.String("error", err.Error()))
 		os.Exit(1)
 	}
 
-	// ---- Metrics
-	reg := prometheus.NewRegistry()
-	metrics := mw.NewMetrics(reg)
-
-	// ---- HTTP server / mux
-	mux := http.NewServeMux()
-	mux.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{}))
-	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) {
-		if _, err := w.Write([]byte("ok")); err != nil {
-			return
-		}
-	})
-
-	ipr := mw.IPResolver{}
-	startedAt := time.Now()
-	adminKey := os.Getenv("APIGW_ADMIN_KEY")
-
-	// ---- Admin endpoints (guarded)
-	wrapAdmin := func(routeName string, h http.Handler) http.Handler {
-		h = mw.RequireAdminKey(adminKey, h)
-		h = mw.AccessLog(log, h)
-		h = mw.Instrument(metrics, h)
-		h = mw.WithRoute(h, routeName)
-		h = mw.RequestID(h)
-		return h
-	}
-
-	mux.Handle("/-/status", wrapAdmin("admin_status", http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
-		info, _ := debug.ReadBuildInfo()
-		goVer := ""
-		if info != nil {
-			goVer = info.GoVersion
-		}
-
-		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(map[string]any{
-			"time_utc":          time.Now().UTC().Format(time.RFC3339),
-			"uptime_seconds":    int(time.Since(startedAt).Seconds()),
-			"listen_addr":       cfg.Server.Addr,
-			"go_version":        goVer,
-			"auth_mode":         cfg.Auth.Mode,
-			"rate_backend":      cfg.RateLimit.Backend,
-			"routes_configured": len(cfg.Routes),
-		})
-	})))
-
-	mux.Handle("/-/routes", wrapAdmin("admin_routes", http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
-		type outRoute struct {
-			Name           string `json:"name"`
-			PathPrefix     string `json:"path_prefix"`
-			Upstream       string `json:"upstream"`
-			StripPrefix    string `json:"strip_prefix"`
-			AuthRequired   bool   `json:"auth_required"`
-			RateLimit      any    `json:"rate_limit"`
-			Concurrency    any    `json:"concurrency"`
-			CircuitBreaker any    `json:"circuit_breaker"`
-		}
+	// ---- Server
+	tlsCfg, err := serverTLSConfig(cfg.Server.TLS)
+	if err != nil {
+		log.Error("failed to init server tls", slog.String("error", err.Error()))
+		os.Exit(1)
+	}
 
-		out := make([]outRoute, 0, len(cfg.Routes))
+	if tlsCfg == nil && !cfg.Server.H2C {
 		for _, rc := range cfg.Routes {
-			out = append(out, outRoute{
-				Name:         rc.Name,
-				PathPrefix:   rc.Match.PathPrefix,
-				Upstream:     rc.Upstream,
-				StripPrefix:  rc.StripPrefix,
-				AuthRequired: rc.AuthRequired,
-				RateLimit: map[string]any{
-					"enabled": rc.RateLimit.Enabled,
-					"rps":     rc.RateLimit.RPS,
-					"burst":   rc.RateLimit.Burst,
-					"scope":   rc.RateLimit.Scope,
-				},
-				Concurrency: map[string]any{
-					"max_in_flight": rc.Concurrency.MaxInFlight,
-				},
-				CircuitBreaker: map[string]any{
-					"enabled":                 rc.CircuitBreaker.Enabled,
-					"failure_threshold":       rc.CircuitBreaker.FailureThreshold,
-					"open_seconds":            rc.CircuitBreaker.OpenSeconds,
-					"half_open_max_in_flight": rc.CircuitBreaker.HalfOpenMaxInFlight,
-				},
-			})
+			if rc.Protocol == "grpc" {
+				log.Warn("grpc route without server.tls or server.h2c; clients cannot reach it over HTTP/2",
+					slog.String("route", rc.Name))
+			}
 		}
+	}
 
-		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(out)
-	})))
-
-	mux.Handle("/-/auth", wrapAdmin("admin_auth", http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
-		out := map[string]any{
-			"mode": cfg.Auth.Mode,
+	// Every listener is bound before any serves, so a bad address fails startup.
+	type listener struct {
+		config.ListenerConfig
+		handler http.Handler
+		admin   bool
+	}
+	handler := gw.handler()
+	listeners := []listener{{ListenerConfig: config.ListenerConfig{Network: "tcp", Addr: cfg.Server.Addr}, handler: handler}}
+	for _, lc := range cfg.Server.Listeners {
+		listeners = append(listeners, listener{ListenerConfig: lc, handler: handler})
+	}
+	if cfg.Admin.Addr != "" {
+		// The admin listener is meant to be private, so it serves plain HTTP.
+		lc := config.ListenerConfig{Network: cfg.Admin.Network, Addr: cfg.Admin.Addr}
+		listeners = append(listeners, listener{ListenerConfig: lc, handler: gw.adminHandler(), admin: true})
+	}
+	var servers []*http.Server
+	for _, lc := range listeners {
+		ln, err := listen(lc.ListenerConfig)
+		if err != nil {
+			log.Error("failed to listen", slog.String("addr", lc.Addr), slog.String("error", err.Error()))
+			os.Exit(1)
 		}
-		if jwksValidator != nil {
-			out["jwks"] = jwksValidator.Stats()
+		srv := newHTTPServer(cfg.Server, lc.handler)
+		if lc.Network != "unix" && !lc.admin {
+			srv.TLSConfig = tlsCfg
 		}
-		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(out)
-	})))
-
-	mux.Handle("/-/limits", wrapAdmin("admin_limits", http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
-		rows := make([]map[string]any, 0, len(cfg.Routes))
-		for _, rc := range cfg.Routes {
-			row := map[string]any{"route": rc.Name}
-
-			if sem := sems[rc.Name]; sem != nil && sem.Enabled() {
-				row["concurrency"] = map[string]any{
-					"max_in_flight": sem.Cap(),
-					"in_flight":     sem.InUse(),
-				}
+		if srv.TLSConfig == nil && cfg.Server.H2C && !lc.admin {
+			srv.Handler = h2c.NewHandler(lc.handler, &http2.Server{})
+		}
+		servers = append(servers, srv)
+
+		go func() {
+			log.Info("apigw listening",
+				slog.String("network", ln.Addr().Network()),
+				slog.String("addr", lc.Addr),
+				slog.Bool("tls", srv.TLSConfig != nil),
+				slog.Bool("admin", lc.admin))
+			var err error
+			if srv.TLSConfig != nil {
+				err = srv.ServeTLS(ln, cfg.Server.TLS.CertFile, cfg.Server.TLS.KeyFile)
+			} else {
+				err = srv.Serve(ln)
 			}
-			if br := breakers[rc.Name]; br != nil {
-				row["circuit_breaker"] = br.Stats()
+			if err != nil && err != http.ErrServerClosed {
+				log.Error("server error", slog.String("addr", lc.Addr), slog.String("error", err.Error()))
 			}
-			rows = append(rows, row)
-		}
+		}()
+	}
 
-		w.Header().Set("Content-Type", "application/json")
-		_ = json.NewEncoder(w).Encode(rows)
-	})))
+	// Graceful shutdown
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
+	<-stop
 
-	// ---- Main gateway handler (catch-all)
-	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		route := rtr.Match(r.URL.Path)
-		if route == nil {
-			http.NotFound(w, r)
-			return
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var wg sync.WaitGroup
+	for _, srv := range servers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_ = srv.Shutdown(ctx)
+		}()
+	}
+	wg.Wait()
+	if memState != nil {
+		if err := memState.Snapshot(cfg.RateLimit.Memory.StateFile); err != nil {
+			log.Warn("failed to save limiter state", slog.String("error", err.Error()))
 		}
+	}
+	log.Info("shutdown complete")
+}
 
-		// Base proxy handler
-		var h http.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-			r.URL.Path = proxy.StripPath(r.URL.Path, route.StripPrefix)
-			route.Proxy.ServeHTTP(w, r)
-		})
-
-		// Circuit breaker should see upstream status codes.
-		if br := breakers[route.Name]; br != nil {
-			h = mw.CircuitBreak(br, h)
+// retryJWKS fetches v's key set with capped exponential backoff until one
+// attempt succeeds (or a request-driven refresh got there first), or until
+// ctx is done.
+func retryJWKS(ctx context.Context, log *slog.Logger, url string, v *mw.JWKSValidator, timeout time.Duration) {
+	backoff := time.Second
+	for !v.Ready() {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(backoff):
 		}
-
-		// Concurrency should NOT count as breaker failure; keep it outside breaker.
-		if sem := sems[route.Name]; sem != nil && sem.Enabled() {
-			h = mw.ConcurrencyLimit(sem, h)
+		fetchCtx, cancel := context.WithTimeout(ctx, timeout)
+		err := v.Prefetch(fetchCtx)
+		cancel()
+		if err == nil {
+			log.Info("jwks keys loaded", slog.String("url", url))
+			return
 		}
-
-		// Auth + RL should run outside breaker/concurrency so 401/429 don't affect breaker.
-		if route.AuthRequired {
-			h = mw.RequireAuth(authHandler, h)
+		if ctx.Err() != nil {
+			return
 		}
+		log.Warn("jwks fetch retry failed", slog.String("url", url), slog.String("error", err.Error()))
+		backoff = min(backoff*2, 30*time.Second)
+	}
+}
 
-		h = mw.RateLimit(limiter, ipr, mw.RateLimitConfig{
-			Enabled:   route.RateLimit.Enabled,
-			RPS:       route.RateLimit.RPS,
-			Burst:     route.RateLimit.Burst,
-			Scope:     route.RateLimit.Scope,
-			RouteName: route.Name,
-		}, h)
+// checkDependency runs a startup check bounded by timeout, so a slow
+// dependency degrades to the caller's fallback instead of hanging startup.
+// The returned error says whether the dependency timed out or failed.
+func checkDependency(log *slog.Logger, name string, timeout time.Duration, check func(context.Context) error) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-		// Cross-cutting middleware (outermost -> innermost)
-		h = mw.AccessLog(log, h)
-		h = mw.Instrument(metrics, h)
-		h = mw.WithRoute(h, route.Name)
-		h = mw.RequestID(h)
+	err := check(ctx)
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, context.DeadlineExceeded) || ctx.Err() != nil:
+		log.Warn("startup dependency timed out",
+			slog.String("dependency", name),
+			slog.Duration("timeout", timeout))
+		return fmt.Errorf("%s: timed out after %s: %w", name, timeout, err)
+	default:
+		return fmt.Errorf("%s: %w", name, err)
+	}
+}
 
-		h.ServeHTTP(w, r)
-	}))
+// serverTLSConfig returns nil when server.tls.cert_file is unset (plain HTTP).
+// The certificate itself is loaded by ListenAndServeTLS.
+func serverTLSConfig(tc config.ServerTLSConfig) (*tls.Config, error) {
+	if tc.CertFile == "" {
+		return nil, nil
+	}
+	out := &tls.Config{MinVersion: tls.VersionTLS12}
+	switch tc.ClientAuth {
+	case "", "none":
+		return out, nil
+	case "verify_if_given":
+		out.ClientAuth = tls.VerifyClientCertIfGiven
+	case "require_and_verify":
+		out.ClientAuth = tls.RequireAndVerifyClientCert
+	default:
+		return nil, fmt.Errorf("unknown server.tls.client_auth %q", tc.ClientAuth)
+	}
+	pem, err := os.ReadFile(tc.ClientCAFile)
+	if err != nil {
+		return nil, fmt.Errorf("server.tls.client_ca_file: %w", err)
+	}
+	out.ClientCAs = x509.NewCertPool()
+	if !out.ClientCAs.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("server.tls.client_ca_file: no PEM certificates found")
+	}
+	return out, nil
+}
 
-	// ---- Server
-	srv := &http.Server{
-		Addr:              cfg.Server.Addr,
-		Handler:           mux,
-		ReadHeaderTimeout: 5 * time.Second,
-		ReadTimeout:       15 * time.Second,
-		WriteTimeout:      30 * time.Second,
-		IdleTimeout:       60 * time.Second,
-		MaxHeaderBytes:    1 << 20, // 1MB
-	}
-
-	go func() {
-		log.Info("apigw listening", slog.String("addr", cfg.Server.Addr))
-		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
-			log.Error("server error", slog.String("error", err.Error()))
+// listen binds one server listener. A stale unix socket left by a previous
+// run is removed first; anything else at that path is an error.
+func listen(lc config.ListenerConfig) (net.Listener, error) {
+	if lc.Network != "unix" {
+		return net.Listen("tcp", lc.Addr)
+	}
+	if fi, err := os.Lstat(lc.Addr); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", lc.Addr)
 		}
-	}()
-
-	// Graceful shutdown
-	stop := make(chan os.Signal, 1)
-	signal.Notify(stop, syscall.SIGINT, syscall.SIGTERM)
-	<-stop
+		if err := os.Remove(lc.Addr); err != nil {
+			return nil, err
+		}
+	}
+	return net.Listen("unix", lc.Addr)
+}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
-	defer cancel()
-	_ = srv.Shutdown(ctx)
-	log.Info("shutdown complete")
+// newHTTPServer applies the server.* limits; zero values were already
+// replaced with defaults by config.Load.
+func newHTTPServer(sc config.ServerConfig, h http.Handler) *http.Server {
+	return &http.Server{
+		Addr:              sc.Addr,
+		Handler:           h,
+		ReadHeaderTimeout: time.Duration(sc.ReadHeaderTimeoutSeconds) * time.Second,
+		ReadTimeout:       time.Duration(sc.ReadTimeoutSeconds) * time.Second,
+		WriteTimeout:      time.Duration(sc.WriteTimeoutSeconds) * time.Second,
+		IdleTimeout:       time.Duration(sc.IdleTimeoutSeconds) * time.Second,
+		MaxHeaderBytes:    sc.MaxHeaderBytes,
+	}
 }
 
 func validateConfig(cfg *config.Config) error {
@@ -409,7 +532,14 @@ func validateConfig(cfg *config.Config) error {
 		}
 		seenNames[r.Name] = struct{}{}
 
-		if r.Match.PathPrefix == "" || !strings.HasPrefix(r.Match.PathPrefix, "/") {
+		if r.Match.PathExact != "" {
+			if r.Match.PathPrefix != "" {
+				return errors.New("route.match.path_prefix and path_exact are mutually exclusive for route: " + r.Name)
+			}
+			if !strings.HasPrefix(r.Match.PathExact, "/") {
+				return errors.New("route.match.path_exact must start with / for route: " + r.Name)
+			}
+		} else if r.Match.PathPrefix == "" || !strings.HasPrefix(r.Match.PathPrefix, "/") {
 			return errors.New("route.match.path_prefix must start with / for route: " + r.Name)
 		}
 		if r.Upstream == "" {
@@ -0,0 +1,265 @@
+package main
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"io"
+	stdlog "log"
+	"log/slog"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/3xpluto/go-api-gateway/internal/config"
+	"github.com/3xpluto/go-api-gateway/internal/mw"
+)
+
+func TestCheckDependency_TimesOutInsteadOfHanging(t *testing.T) {
+	log := slog.New(slog.NewJSONHandler(io.Discard, nil))
+
+	start := time.Now()
+	err := checkDependency(log, "slow", 50*time.Millisecond, func(ctx context.Context) error {
+		<-ctx.Done()
+		return ctx.Err()
+	})
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected check to stop near the timeout, took %s", elapsed)
+	}
+}
+
+func TestCheckDependency_SlowJWKSPrefetch(t *testing.T) {
+	release := make(chan struct{})
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		<-release
+		http.Error(w, "too late", http.StatusServiceUnavailable)
+	}))
+	defer jwks.Close()
+	defer close(release)
+
+	v, err := mw.NewJWKSValidator(jwks.URL, mw.JWKSValidatorOptions{HTTPTimeout: time.Minute})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	start := time.Now()
+	err = checkDependency(log, "jwks", 50*time.Millisecond, v.Prefetch)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected jwks prefetch to hit the startup timeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected prefetch to stop near the timeout, took %s", elapsed)
+	}
+}
+
+func TestNewAuthHandler_JWKSFailFast(t *testing.T) {
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer jwks.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel() // stops the background retry
+	log := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	ac := config.AuthConfig{Mode: "jwks", JWKS: config.JWKSAuthConfig{URL: jwks.URL, FailFast: true}}
+	if _, _, err := newAuthHandler(ctx, log, ac, time.Second); err == nil {
+		t.Fatal("expected fail_fast to turn a failed initial fetch into an error")
+	}
+
+	ac.JWKS.FailFast = false
+	_, v, err := newAuthHandler(ctx, log, ac, time.Second)
+	if err != nil {
+		t.Fatalf("expected a degraded start without fail_fast, got %v", err)
+	}
+	if v.Ready() || v.Stats().LastError == "" {
+		t.Fatalf("expected a not-ready validator recording the error, got %+v", v.Stats())
+	}
+}
+
+// testCert issues a certificate for cn signed by parent (self-signed when parent is nil).
+func testCert(t *testing.T, cn string, parent *tls.Certificate, isCA bool) tls.Certificate {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tmpl := &x509.Certificate{
+		SerialNumber: big.NewInt(time.Now().UnixNano()),
+		Subject:      pkix.Name{CommonName: cn},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+		KeyUsage:     x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+	}
+	signer, signerKey := tmpl, any(key)
+	if parent != nil {
+		signer, signerKey = parent.Leaf, parent.PrivateKey
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tmpl, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	leaf, _ := x509.ParseCertificate(der)
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key, Leaf: leaf}
+}
+
+func TestServerTLSConfig_RequireClientCert(t *testing.T) {
+	ca := testCert(t, "test-ca", nil, true)
+	otherCA := testCert(t, "other-ca", nil, true)
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	if err := os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: ca.Certificate[0]}), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	tlsCfg, err := serverTLSConfig(config.ServerTLSConfig{
+		CertFile: "unused-by-test", KeyFile: "unused-by-test",
+		ClientCAFile: caFile, ClientAuth: "require_and_verify",
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var gotSubject string
+	srv := httptest.NewUnstartedServer(mw.RequireClientSubject([]string{"svc-orders"}, mw.ClientCertAuth(
+		http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) { w.WriteHeader(http.StatusUnauthorized) }),
+		http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			gotSubject, _ = mw.Subject(r.Context())
+			w.WriteHeader(http.StatusOK)
+		}),
+	)))
+	srv.Config.ErrorLog = stdlog.New(io.Discard, "", 0)
+	srv.TLS = tlsCfg
+	srv.TLS.Certificates = []tls.Certificate{testCert(t, "127.0.0.1", &ca, false)}
+	srv.StartTLS()
+	defer srv.Close()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.Leaf)
+	client := func(cert tls.Certificate) *http.Client {
+		return &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{
+			RootCAs:      roots,
+			Certificates: []tls.Certificate{cert},
+		}}}
+	}
+
+	resp, err := client(testCert(t, "svc-orders", &ca, false)).Get(srv.URL)
+	if err != nil {
+		t.Fatalf("expected a cert from the trusted CA to be accepted: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || gotSubject != "svc-orders" {
+		t.Fatalf("expected 200 with subject svc-orders, got %d %q", resp.StatusCode, gotSubject)
+	}
+
+	resp, err = client(testCert(t, "svc-billing", &ca, false)).Get(srv.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected 403 for a trusted cert outside allowed_subjects, got %d", resp.StatusCode)
+	}
+
+	if _, err := client(testCert(t, "svc-rogue", &otherCA, false)).Get(srv.URL); err == nil {
+		t.Fatal("expected a cert from an untrusted CA to fail the handshake")
+	}
+}
+
+func TestCheckConnectivity_ReportsEachProbe(t *testing.T) {
+	jwks := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		http.Error(w, "down", http.StatusServiceUnavailable)
+	}))
+	defer jwks.Close()
+
+	cfg := &config.Config{
+		Auth:      config.AuthConfig{Mode: "jwks", JWKS: config.JWKSAuthConfig{URL: jwks.URL}},
+		RateLimit: config.RateLimitBackend{Backend: "redis", Redis: config.RedisConfig{Addr: "127.0.0.1:1"}},
+		Routes: []config.RouteConfig{
+			{Name: "a", Upstream: "http://localhost:9001"},
+			{Name: "b", Upstream: "http://127.0.0.1:9002"}, // IP literal: nothing to resolve
+		},
+	}
+
+	got := map[string]error{}
+	for _, c := range checkConnectivity(cfg, 2*time.Second) {
+		got[c.Name] = c.Err
+	}
+	if len(got) != 3 {
+		t.Fatalf("expected jwks, redis and one dns check, got %v", got)
+	}
+	if got["jwks "+jwks.URL] == nil {
+		t.Fatal("expected the jwks check to fail on a 503")
+	}
+	if got["redis 127.0.0.1:1"] == nil {
+		t.Fatal("expected the redis check to fail on a closed port")
+	}
+	if err, ok := got["dns localhost"]; !ok || err != nil {
+		t.Fatalf("expected localhost to resolve, got %v (present=%v)", err, ok)
+	}
+}
+
+func TestListen_UnixSocketReplacesStaleSocket(t *testing.T) {
+	sock := filepath.Join(t.TempDir(), "admin.sock")
+	lc := config.ListenerConfig{Network: "unix", Addr: sock}
+
+	// A listener that is closed without unlinking leaves a stale socket behind.
+	stale, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Skipf("unix sockets unavailable: %v", err)
+	}
+	stale.(*net.UnixListener).SetUnlinkOnClose(false)
+	stale.Close()
+
+	ln, err := listen(lc)
+	if err != nil {
+		t.Fatalf("expected the stale socket to be replaced, got %v", err)
+	}
+	srv := &http.Server{Handler: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_, _ = io.WriteString(w, "ok")
+	})}
+	go func() { _ = srv.Serve(ln) }()
+	defer srv.Close()
+
+	client := &http.Client{Transport: &http.Transport{
+		DialContext: func(ctx context.Context, _, _ string) (net.Conn, error) {
+			var d net.Dialer
+			return d.DialContext(ctx, "unix", sock)
+		},
+	}}
+	resp, err := client.Get("http://localhost/")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if string(body) != "ok" {
+		t.Fatalf("expected ok over the socket, got %q", body)
+	}
+
+	file := filepath.Join(t.TempDir(), "not-a-socket")
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := listen(config.ListenerConfig{Network: "unix", Addr: file}); err == nil {
+		t.Fatal("expected a regular file at the socket path to be refused")
+	}
+}
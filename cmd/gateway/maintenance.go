@@ -0,0 +1,83 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/3xpluto/go-api-gateway/internal/mw"
+)
+
+// maintenanceMode is the state set by POST /-/maintenance. It lives only in
+// memory, so a restart always comes back serving traffic.
+type maintenanceMode struct {
+	On         bool       `json:"on"`
+	RetryAfter int        `json:"retry_after"` // seconds; 0 sends no Retry-After
+	Message    string     `json:"message,omitempty"`
+	Since      *time.Time `json:"since,omitempty"`
+}
+
+// maintenanceState answers GET /-/maintenance.
+func (g *gateway) maintenanceState(w http.ResponseWriter, _ *http.Request) {
+	m := maintenanceMode{}
+	if cur := g.maintenance.Load(); cur != nil {
+		m = *cur
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(m)
+}
+
+// setMaintenance turns maintenance mode on or off:
+// POST /-/maintenance {"on": true, "retry_after": 120, "message": "..."}.
+func (g *gateway) setMaintenance(w http.ResponseWriter, r *http.Request) {
+	var m maintenanceMode
+	b, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<16))
+	if err == nil {
+		err = json.Unmarshal(b, &m)
+	}
+	if err == nil && m.RetryAfter < 0 {
+		err = errNegativeRetryAfter
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_maintenance", map[string]any{"reason": err.Error()})
+		return
+	}
+
+	event := "admin_maintenance_off"
+	if m.On {
+		event = "admin_maintenance_on"
+		now := time.Now().UTC()
+		m.Since = &now
+		g.maintenance.Store(&m)
+	} else {
+		m = maintenanceMode{}
+		g.maintenance.Store(nil)
+	}
+	g.Log.Warn(event,
+		slog.String("rid", mw.RID(r.Context())),
+		slog.Int("retry_after", m.RetryAfter),
+	)
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(m)
+}
+
+var errNegativeRetryAfter = errors.New("retry_after cannot be negative")
+
+// maintenanceResponse is what proxy traffic gets while maintenance is on.
+func maintenanceResponse(m *maintenanceMode) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		fields := map[string]any{}
+		if m.Message != "" {
+			fields["message"] = m.Message
+		}
+		if m.RetryAfter > 0 {
+			w.Header().Set("Retry-After", strconv.Itoa(m.RetryAfter))
+			fields["retry_after_seconds"] = m.RetryAfter
+		}
+		writeError(w, http.StatusServiceUnavailable, "maintenance", fields)
+	})
+}
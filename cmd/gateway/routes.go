@@ -0,0 +1,736 @@
+package main
+
+import (
+	"cmp"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"reflect"
+	"slices"
+	"strings"
+	"time"
+
+	"golang.org/x/sync/singleflight"
+	"gopkg.in/yaml.v3"
+
+	"github.com/3xpluto/go-api-gateway/internal/config"
+	"github.com/3xpluto/go-api-gateway/internal/mw"
+	"github.com/3xpluto/go-api-gateway/internal/proxy"
+)
+
+// routeTable is everything derived from the route list. The gateway swaps
+// it as a whole, so a request sees one consistent router and per-route state.
+type routeTable struct {
+	configs     []config.RouteConfig
+	rtr         *proxy.Router
+	sems        map[string]*mw.Semaphore
+	subjectSems map[string]*mw.SubjectSemaphore // nil entries when per_subject_max is unset
+	breakers    map[string]*mw.CircuitBreaker
+	flights     map[string]*singleflight.Group // nil entries when single_flight is off
+
+	// Rate-limit tiers and per-method limits by route, nil when unset.
+	rateTiers   map[string]map[string]mw.RateLimitTier
+	rateMethods map[string]map[string]mw.RateLimitTier
+
+	auth map[string]mw.AuthHandler // routes with their own auth block; others use the global handler
+}
+
+// config returns the named route's config; t may be nil.
+func (t *routeTable) config(name string) (config.RouteConfig, bool) {
+	if t == nil {
+		return config.RouteConfig{}, false
+	}
+	for _, rc := range t.configs {
+		if rc.Name == name {
+			return rc, true
+		}
+	}
+	return config.RouteConfig{}, false
+}
+
+// table returns the current route table.
+func (g *gateway) table() *routeTable { return g.routes.Load() }
+
+// buildRoutes builds a route table for rcs, reusing prev's semaphores and
+// breakers for routes whose config is unchanged. prev may be nil.
+func (g *gateway) buildRoutes(rcs []config.RouteConfig, prev *routeTable) (*routeTable, error) {
+	t := &routeTable{
+		configs:     rcs,
+		sems:        map[string]*mw.Semaphore{},
+		subjectSems: map[string]*mw.SubjectSemaphore{},
+		breakers:    map[string]*mw.CircuitBreaker{},
+		flights:     map[string]*singleflight.Group{},
+		rateTiers:   map[string]map[string]mw.RateLimitTier{},
+		rateMethods: map[string]map[string]mw.RateLimitTier{},
+		auth:        map[string]mw.AuthHandler{},
+	}
+	routes := make([]proxy.Route, 0, len(rcs))
+
+	for _, rc := range rcs {
+		u, err := url.Parse(rc.Upstream)
+		if err != nil {
+			return nil, fmt.Errorf("invalid upstream url for route %s: %w", rc.Name, err)
+		}
+
+		// Hedging wraps each route's transport so extra attempts are counted per route.
+		name := rc.Name
+		wrap := func(transport http.RoundTripper) http.RoundTripper {
+			// Per attempt, so it sits inside hedging.
+			transport = proxy.UpstreamTimeout(transport, time.Duration(rc.UpstreamTimeoutSeconds)*time.Second)
+			if rc.Hedge.MaxAttempts > 1 {
+				transport = proxy.Hedge(transport, proxy.HedgeConfig{
+					Delay:       time.Duration(rc.Hedge.DelayMs) * time.Millisecond,
+					MaxAttempts: rc.Hedge.MaxAttempts,
+					OnHedge:     func() { g.metrics.HedgedRequests.WithLabelValues(name).Inc() },
+					OnAttempt: func(req *http.Request, attempt int) {
+						mw.RecordUpstreamAttempt(req.Context(), attempt)
+						if attempt > 1 {
+							g.Log.Debug("upstream_attempt",
+								slog.String("rid", mw.RID(req.Context())),
+								slog.String("route", name),
+								slog.Int("attempt", attempt),
+							)
+						}
+					},
+				})
+			}
+			if rc.HeadAsGet {
+				transport = proxy.HeadAsGet(transport)
+			}
+			return transport
+		}
+		proxyOpts := proxy.ProxyOptions{
+			Errors:               g.proxyErrors,
+			StripResponseHeaders: append(slices.Clone(g.cfg.Upstream.StripResponseHeaders), rc.StripResponseHeaders...),
+			TrustedProxies:       g.ipr.Trusted,
+			Identity:             g.identity,
+			RequestStart:         g.cfg.Upstream.Timing.RequestStart,
+			ServerTiming:         g.cfg.Upstream.Timing.ServerTiming,
+		}
+		if len(rc.ForwardHeaders) > 0 {
+			// The request ID is the gateway's own and always goes through.
+			proxyOpts.ForwardHeaders = append(slices.Clone(rc.ForwardHeaders),
+				cmp.Or(g.cfg.Server.RequestID.Header, mw.DefaultRequestIDHeader))
+		}
+		if rc.MaxResponseBytes > 0 {
+			proxyOpts.ResponseLimit = proxy.ResponseLimit{
+				MaxBytes:      rc.MaxResponseBytes,
+				ExemptStreams: rc.MaxResponseExemptStreams,
+				OnExceeded:    func() { g.metrics.ResponseTooLarge.WithLabelValues(name).Inc() },
+			}
+		}
+		grpc := rc.Protocol == "grpc"
+		if grpc {
+			proxyOpts.FlushInterval = -1
+		}
+
+		r := proxy.Route{
+			Name:         rc.Name,
+			Host:         rc.Match.Host,
+			PathPrefix:   rc.Match.PathPrefix,
+			PathExact:    rc.Match.PathExact,
+			Query:        rc.Match.Query,
+			Upstream:     u,
+			StripPrefix:  rc.StripPrefix,
+			AddPrefix:    rc.AddPrefix,
+			AuthRequired: rc.AuthRequired,
+			RateLimit: proxy.RouteRateLimit{
+				Enabled: rc.RateLimit.Enabled,
+				RPS:     rc.RateLimit.RPS,
+				Burst:   rc.RateLimit.Burst,
+				Scope:   rc.RateLimit.Scope,
+				SoftRPS: rc.RateLimit.SoftRPS,
+				DryRun:  rc.RateLimit.DryRun,
+
+				DefaultTier: rc.RateLimit.DefaultTier,
+				PerMethod:   rc.RateLimit.PerMethod,
+			},
+			QuotaDaily: rc.Quota.Daily,
+			MaxWait:    time.Duration(rc.Concurrency.MaxWaitMs) * time.Millisecond,
+			BusyRetry:  time.Duration(rc.Concurrency.RetryAfterSeconds) * time.Second,
+			Proxy:      g.upstreamProxy(u, grpc, wrap, proxyOpts),
+
+			RejectInvalidToken: rc.RejectInvalidOptionalToken,
+			RequireRequestID:   rc.RequireRequestID,
+			AccessLogSample:    rc.AccessLog.SampleEvery,
+
+			ClientCertAuth: rc.ClientCert.Auth,
+			ClientSubjects: rc.ClientCert.AllowedSubjects,
+
+			HeadAsGet: rc.HeadAsGet,
+			Hedged:    rc.Hedge.MaxAttempts > 1,
+			Priority:  rc.Priority,
+			Disabled:  rc.Disabled,
+
+			ConcurrencyMode:    rc.Concurrency.Mode,
+			QueueIgnoresCancel: rc.Concurrency.QueueIgnoresCancel,
+		}
+		if !grpc {
+			r.MaxBodyBytes = g.cfg.Server.MaxBodyBytes
+		}
+		for _, m := range rc.Match.Methods {
+			r.Methods = append(r.Methods, strings.ToUpper(m))
+		}
+		if g.cfg.Server.ChaosEnabled {
+			r.Chaos = proxy.RouteChaos{
+				Delay:        time.Duration(rc.Chaos.DelayMs) * time.Millisecond,
+				ErrorPercent: rc.Chaos.ErrorPercent,
+				ErrorStatus:  rc.Chaos.ErrorStatus,
+			}
+		}
+		if rc.Canary.Percent > 0 {
+			cu, err := url.Parse(rc.Canary.Upstream)
+			if err != nil {
+				return nil, fmt.Errorf("invalid canary upstream url for route %s: %w", rc.Name, err)
+			}
+			r.Canary = &proxy.Canary{
+				Upstream: cu,
+				Percent:  rc.Canary.Percent,
+				Sticky:   rc.Canary.Sticky,
+				Header:   rc.Canary.Header,
+				Proxy:    g.upstreamProxy(cu, grpc, wrap, proxyOpts),
+			}
+		}
+		t.rateTiers[rc.Name] = rateLimitTiers(rc.RateLimit.Tiers)
+		t.rateMethods[rc.Name] = rateLimitTiers(rc.RateLimit.Methods)
+		for _, rh := range rc.RequiredHeaders {
+			r.RequiredHeaders = append(r.RequiredHeaders, proxy.RequiredHeader{Name: rh.Name, Values: rh.Values})
+		}
+		routes = append(routes, r)
+
+		// Unchanged routes keep their in-flight counts and breaker state across admin edits.
+		if old, ok := prev.config(rc.Name); ok && reflect.DeepEqual(old, rc) {
+			t.sems[rc.Name] = prev.sems[rc.Name]
+			t.subjectSems[rc.Name] = prev.subjectSems[rc.Name]
+			t.breakers[rc.Name] = prev.breakers[rc.Name]
+			if f := prev.flights[rc.Name]; f != nil {
+				t.flights[rc.Name] = f
+			}
+			if a := prev.auth[rc.Name]; a != nil {
+				t.auth[rc.Name] = a
+			}
+			continue
+		}
+
+		ac, ok := g.cfg.RouteAuth(rc)
+		if ok {
+			a, err := g.routeAuthHandler(ac)
+			if err != nil {
+				return nil, fmt.Errorf("route %s auth: %w", rc.Name, err)
+			}
+			t.auth[rc.Name] = a
+		}
+		if len(rc.Auth.Audiences) > 0 || len(rc.Auth.Issuers) > 0 {
+			a := t.auth[rc.Name]
+			if a == nil {
+				a = g.Auth
+			}
+			ja, isJWKS := a.(jwksAuthAdapter)
+			if !isJWKS {
+				return nil, fmt.Errorf("route %s auth: audiences and issuers need jwks auth", rc.Name)
+			}
+			ja.claims = mw.NewClaimRequirements(
+				firstNonEmpty(rc.Auth.Issuers, ac.JWKS.Issuers),
+				firstNonEmpty(rc.Auth.Audiences, ac.JWKS.Audiences),
+			)
+			t.auth[rc.Name] = ja
+		}
+
+		// Concurrency per route
+		t.sems[rc.Name] = mw.NewSemaphore(rc.Concurrency.MaxInFlight)
+		t.subjectSems[rc.Name] = mw.NewSubjectSemaphore(rc.Concurrency.PerSubjectMax)
+		if rc.SingleFlight {
+			t.flights[rc.Name] = &singleflight.Group{}
+		}
+
+		// Circuit breaker per route
+		onChange := func(from, to mw.BreakerState, failures int) {
+			g.Log.Warn("circuit_breaker_state",
+				slog.String("route", name),
+				slog.String("from", string(from)),
+				slog.String("to", string(to)),
+				slog.Int("failures", failures),
+			)
+		}
+		if rc.CircuitBreaker.OnChangeURL != "" {
+			logChange, wh := onChange, mw.NewBreakerWebhook(rc.CircuitBreaker.OnChangeURL, rc.Name, g.Log)
+			onChange = func(from, to mw.BreakerState, failures int) {
+				logChange(from, to, failures)
+				wh.OnChange(from, to, failures)
+			}
+		}
+		fallback, err := g.breakerFallback(rc, grpc, wrap, proxyOpts)
+		if err != nil {
+			return nil, err
+		}
+		t.breakers[rc.Name] = mw.NewCircuitBreaker(mw.BreakerConfig{
+			Enabled:             rc.CircuitBreaker.Enabled,
+			FailureThreshold:    rc.CircuitBreaker.FailureThreshold,
+			OpenDuration:        time.Duration(rc.CircuitBreaker.OpenSeconds) * time.Second,
+			HalfOpenMaxInFlight: rc.CircuitBreaker.HalfOpenMaxInFlight,
+			OpenMethods:         rc.CircuitBreaker.OpenMethods,
+			IgnoreMethods:       rc.CircuitBreaker.IgnoreMethods,
+			IgnorePaths:         rc.CircuitBreaker.IgnorePaths,
+			OnChange:            onChange,
+			Fallback:            fallback,
+
+			HalfOpenSuccessThreshold: rc.CircuitBreaker.HalfOpenSuccessThreshold,
+			IgnoreStatuses:           rc.CircuitBreaker.IgnoreStatuses,
+			FailureStatuses:          rc.CircuitBreaker.FailureStatuses,
+		})
+	}
+
+	rtr, err := proxy.NewWithOptions(routes, proxy.Options{TrailingSlash: g.cfg.Server.TrailingSlash})
+	if err != nil {
+		return nil, fmt.Errorf("failed to create router: %w", err)
+	}
+	t.rtr = rtr
+	return t, nil
+}
+
+// rateLimitTiers converts configured rps/burst pairs for mw.RateLimit.
+func rateLimitTiers(in map[string]config.RateLimitTierConfig) map[string]mw.RateLimitTier {
+	if len(in) == 0 {
+		return nil
+	}
+	out := make(map[string]mw.RateLimitTier, len(in))
+	for k, t := range in {
+		out[k] = mw.RateLimitTier{RPS: t.RPS, Burst: t.Burst}
+	}
+	return out
+}
+
+// routeAuth is a route-level auth handler, shared by every route with the
+// same auth block across route tables.
+type routeAuth struct {
+	h    mw.AuthHandler
+	stop context.CancelFunc // ends a background JWKS key retry
+	pins int                // admin writes between prepareRouteAuth and their swap
+}
+
+// authBlockKey identifies an auth block without keeping its secrets around.
+func authBlockKey(ac config.AuthConfig) string {
+	sum := sha256.Sum256([]byte(fmt.Sprintf("%+v", ac)))
+	return hex.EncodeToString(sum[:])
+}
+
+// routeAuthHandler returns the shared handler for a route-level auth block,
+// building it on first use. Building may wait up to the startup timeout for
+// JWKS keys, so admin writes call it before taking routesMu.
+func (g *gateway) routeAuthHandler(ac config.AuthConfig) (mw.AuthHandler, error) {
+	return g.routeAuthEntry(ac, false)
+}
+
+// routeAuthEntry is routeAuthHandler, pinning the handler against pruning
+// when pin is set.
+func (g *gateway) routeAuthEntry(ac config.AuthConfig, pin bool) (mw.AuthHandler, error) {
+	block := authBlockKey(ac)
+	g.authMu.Lock()
+	if ra := g.routeAuth[block]; ra != nil {
+		if pin {
+			ra.pins++
+		}
+		g.authMu.Unlock()
+		return ra.h, nil
+	}
+	g.authMu.Unlock()
+
+	ctx, stop := context.WithCancel(context.Background())
+	startup := time.Duration(g.cfg.Server.StartupTimeoutSeconds) * time.Second
+	h, _, err := newAuthHandler(ctx, g.Log, ac, startup)
+	if err != nil {
+		stop()
+		return nil, err
+	}
+	g.authMu.Lock()
+	defer g.authMu.Unlock()
+	ra := g.routeAuth[block]
+	if ra != nil {
+		// A concurrent admin write built the same block first.
+		stop()
+	} else {
+		ra = &routeAuth{h: h, stop: stop}
+		g.routeAuth[block] = ra
+	}
+	if pin {
+		ra.pins++
+	}
+	return ra.h, nil
+}
+
+// pruneRouteAuth stops and forgets the route-level auth handlers t no
+// longer uses, except those pinned for an admin write still under way.
+func (g *gateway) pruneRouteAuth(t *routeTable) {
+	used := map[string]bool{}
+	for _, rc := range t.configs {
+		if ac, ok := g.cfg.RouteAuth(rc); ok {
+			used[authBlockKey(ac)] = true
+		}
+	}
+	g.authMu.Lock()
+	defer g.authMu.Unlock()
+	for block, ra := range g.routeAuth {
+		if !used[block] && ra.pins == 0 {
+			ra.stop()
+			delete(g.routeAuth, block)
+		}
+	}
+}
+
+// upstreamProxy builds the reverse proxy for u through wrap's per-route
+// transport layers. unix:// upstreams get their own socket transport, and
+// plain-HTTP gRPC upstreams an h2c one; both are shared across rebuilds so
+// admin route edits don't strand idle connections.
+func (g *gateway) upstreamProxy(u *url.URL, grpc bool, wrap func(http.RoundTripper) http.RoundTripper, opts proxy.ProxyOptions) *httputil.ReverseProxy {
+	socket, unix := proxy.UnixSocket(u)
+	if unix {
+		u = proxy.UnixTarget()
+	}
+	switch {
+	case grpc && u.Scheme == "http":
+		rt := g.h2cTransports[socket]
+		if rt == nil {
+			rt = proxy.NewH2CTransport(transportConfig(g.cfg.Upstream), socket)
+			g.h2cTransports[socket] = rt
+		}
+		return proxy.BuildProxyWith(u, wrap(rt), opts)
+	case unix:
+		rt := g.unixTransports[socket]
+		if rt == nil {
+			rt = upstreamTransport(g.cfg.Upstream, socket)
+			g.unixTransports[socket] = rt
+		}
+		return proxy.BuildProxyWith(u, wrap(rt), opts)
+	default:
+		return proxy.BuildProxyWith(u, wrap(g.Transport), opts)
+	}
+}
+
+// breakerFallback builds the handler for circuit_breaker.fallback, or nil
+// when none is configured. It sits where the breaker does, before the
+// route's path rewrite, so an upstream fallback applies that itself.
+func (g *gateway) breakerFallback(rc config.RouteConfig, grpc bool, wrap func(http.RoundTripper) http.RoundTripper, opts proxy.ProxyOptions) (http.Handler, error) {
+	fb := rc.CircuitBreaker.Fallback
+	switch {
+	case fb.Upstream != "":
+		u, err := url.Parse(fb.Upstream)
+		if err != nil {
+			return nil, fmt.Errorf("invalid fallback upstream url for route %s: %w", rc.Name, err)
+		}
+		rp := g.upstreamProxy(u, grpc, wrap, opts)
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			r.URL.Path = proxy.AddPath(proxy.StripPath(r.URL.Path, rc.StripPrefix), rc.AddPrefix)
+			rp.ServeHTTP(w, mw.TraceUpstream(r))
+		}), nil
+	case fb.Enabled():
+		status := cmp.Or(fb.Status, http.StatusOK)
+		contentType := cmp.Or(fb.ContentType, "application/json")
+		return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.Header().Set("Content-Type", contentType)
+			w.WriteHeader(status)
+			_, _ = io.WriteString(w, fb.Body)
+		}), nil
+	default:
+		return nil, nil
+	}
+}
+
+// firstNonEmpty returns override unless it is empty.
+func firstNonEmpty(override, fallback []string) []string {
+	if len(override) > 0 {
+		return override
+	}
+	return fallback
+}
+
+// listRoutes reports the active route table: GET /-/routes
+func (g *gateway) listRoutes(w http.ResponseWriter, _ *http.Request) {
+	g.writeRoutes(w, http.StatusOK, g.table())
+}
+
+// createRoute adds a route at runtime: POST /-/routes with one route as
+// JSON (or YAML), using the config file's field names.
+func (g *gateway) createRoute(w http.ResponseWriter, r *http.Request) {
+	rc, ok := readRouteBody(w, r)
+	if !ok {
+		return
+	}
+	release, ok := g.prepareRouteAuth(w, rc)
+	if !ok {
+		return
+	}
+	g.routesMu.Lock()
+	defer g.routesMu.Unlock()
+	defer release()
+
+	cur := g.table()
+	if _, exists := cur.config(rc.Name); exists {
+		writeError(w, http.StatusConflict, "route_exists", map[string]any{"route": rc.Name})
+		return
+	}
+	rcs := append(append([]config.RouteConfig(nil), cur.configs...), rc)
+	g.swapRoutes(w, r, "admin_route_created", rc.Name, rcs, cur, http.StatusCreated)
+}
+
+// updateRoute replaces a route in place, keeping its position in the table:
+// PUT /-/routes/{name}
+func (g *gateway) updateRoute(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	rc, ok := readRouteBody(w, r)
+	if !ok {
+		return
+	}
+	if rc.Name == "" {
+		rc.Name = name
+	}
+	if rc.Name != name {
+		writeError(w, http.StatusBadRequest, "route_name_mismatch", map[string]any{"route": name, "body_name": rc.Name})
+		return
+	}
+	release, ok := g.prepareRouteAuth(w, rc)
+	if !ok {
+		return
+	}
+	g.routesMu.Lock()
+	defer g.routesMu.Unlock()
+	defer release()
+
+	cur := g.table()
+	rcs := append([]config.RouteConfig(nil), cur.configs...)
+	i := slices.IndexFunc(rcs, func(c config.RouteConfig) bool { return c.Name == name })
+	if i < 0 {
+		writeError(w, http.StatusNotFound, "unknown_route", map[string]any{"route": name})
+		return
+	}
+	rcs[i] = rc
+	g.swapRoutes(w, r, "admin_route_updated", name, rcs, cur, http.StatusOK)
+}
+
+// deleteRoute removes a route: DELETE /-/routes/{name}
+func (g *gateway) deleteRoute(w http.ResponseWriter, r *http.Request) {
+	name := r.PathValue("name")
+	g.routesMu.Lock()
+	defer g.routesMu.Unlock()
+
+	cur := g.table()
+	rcs := slices.DeleteFunc(append([]config.RouteConfig(nil), cur.configs...), func(c config.RouteConfig) bool {
+		return c.Name == name
+	})
+	if len(rcs) == len(cur.configs) {
+		writeError(w, http.StatusNotFound, "unknown_route", map[string]any{"route": name})
+		return
+	}
+	g.swapRoutes(w, r, "admin_route_deleted", name, rcs, cur, http.StatusOK)
+}
+
+// swapRoutes validates rcs against the running config, builds and installs
+// the new table, and answers with it. Callers hold routesMu. Nothing is
+// persisted: a restart goes back to the config file's routes.
+func (g *gateway) swapRoutes(w http.ResponseWriter, r *http.Request, event, name string, rcs []config.RouteConfig, cur *routeTable, status int) {
+	candidate := *g.cfg
+	candidate.Routes = rcs
+	if err := config.Validate(&candidate); err != nil {
+		g.pruneRouteAuth(cur)
+		writeError(w, http.StatusBadRequest, "invalid_route", map[string]any{"reason": err.Error()})
+		return
+	}
+	next, err := g.buildRoutes(rcs, cur)
+	if err != nil {
+		g.pruneRouteAuth(cur)
+		writeError(w, http.StatusBadRequest, "invalid_route", map[string]any{"reason": err.Error()})
+		return
+	}
+	g.routes.Store(next)
+	g.pruneRouteAuth(next)
+
+	g.Log.Info(event,
+		slog.String("rid", mw.RID(r.Context())),
+		slog.String("route", name),
+		slog.Int("routes", len(rcs)),
+	)
+	g.writeRoutes(w, status, next)
+}
+
+// prepareRouteAuth builds rc's own JWKS auth handler, if it has one, before
+// the caller takes routesMu, so a slow key fetch doesn't hold up other route
+// writes. The handler stays pinned, so another write's prune can't drop it,
+// until the caller runs release while still holding routesMu after its
+// swap. It writes a 400 on failure.
+func (g *gateway) prepareRouteAuth(w http.ResponseWriter, rc config.RouteConfig) (release func(), ok bool) {
+	ac, ok := g.cfg.RouteAuth(rc)
+	if !ok || !strings.EqualFold(ac.Mode, "jwks") || ac.JWKS.URL == "" {
+		return func() {}, true
+	}
+	if _, err := g.routeAuthEntry(ac, true); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_route", map[string]any{"reason": fmt.Sprintf("route %s auth: %v", rc.Name, err)})
+		return nil, false
+	}
+	block := authBlockKey(ac)
+	return func() {
+		g.authMu.Lock()
+		g.routeAuth[block].pins--
+		g.authMu.Unlock()
+		g.pruneRouteAuth(g.table())
+	}, true
+}
+
+// readRouteBody decodes one route from the request body, writing a 400 on failure.
+func readRouteBody(w http.ResponseWriter, r *http.Request) (config.RouteConfig, bool) {
+	var rc config.RouteConfig
+	b, err := io.ReadAll(http.MaxBytesReader(w, r.Body, 1<<20))
+	if err == nil {
+		// JSON is valid YAML, and RouteConfig only carries yaml tags.
+		err = yaml.Unmarshal(b, &rc)
+	}
+	if err != nil {
+		writeError(w, http.StatusBadRequest, "invalid_route", map[string]any{"reason": err.Error()})
+		return rc, false
+	}
+	return rc, true
+}
+
+// writeRoutes writes t's routes as JSON.
+func (g *gateway) writeRoutes(w http.ResponseWriter, status int, t *routeTable) {
+	type outRoute struct {
+		Name           string `json:"name"`
+		Host           string `json:"host,omitempty"`
+		PathPrefix     string `json:"path_prefix,omitempty"`
+		PathExact      string `json:"path_exact,omitempty"`
+		Query          any    `json:"query,omitempty"`
+		Methods        any    `json:"methods,omitempty"`
+		HeadAsGet      bool   `json:"head_as_get,omitempty"`
+		Protocol       string `json:"protocol,omitempty"`
+		UpstreamTO     int    `json:"upstream_timeout_seconds,omitempty"`
+		MaxResponse    int64  `json:"max_response_bytes,omitempty"`
+		Priority       int    `json:"priority,omitempty"`
+		Disabled       bool   `json:"disabled,omitempty"`
+		SingleFlight   bool   `json:"single_flight,omitempty"`
+		Upstream       string `json:"upstream"`
+		StripPrefix    string `json:"strip_prefix"`
+		AddPrefix      string `json:"add_prefix,omitempty"`
+		AuthRequired   bool   `json:"auth_required"`
+		RejectInvalid  bool   `json:"reject_invalid_optional_token"`
+		RateLimit      any    `json:"rate_limit"`
+		Concurrency    any    `json:"concurrency"`
+		CircuitBreaker any    `json:"circuit_breaker"`
+		Quota          any    `json:"quota"`
+		RequiredHdrs   any    `json:"required_headers"`
+		Canary         any    `json:"canary,omitempty"`
+		Hedge          any    `json:"hedge"`
+		RequireRID     bool   `json:"require_request_id"`
+		AccessLog      any    `json:"access_log"`
+		ClientCert     any    `json:"client_cert"`
+		Chaos          any    `json:"chaos"`
+		Auth           any    `json:"auth,omitempty"`
+	}
+
+	out := make([]outRoute, 0, len(t.configs))
+	for _, rc := range t.configs {
+		reqHdrs := make([]map[string]any, 0, len(rc.RequiredHeaders))
+		for _, rh := range rc.RequiredHeaders {
+			reqHdrs = append(reqHdrs, map[string]any{"name": rh.Name, "values": rh.Values})
+		}
+		var auth any
+		if rc.Auth.Mode != "" {
+			// Never the hmac_secret.
+			auth = map[string]any{"mode": rc.Auth.Mode, "jwks_url": rc.Auth.JWKS.URL}
+		}
+		var canary any
+		if rc.Canary.Percent > 0 {
+			canary = map[string]any{
+				"upstream": rc.Canary.Upstream,
+				"percent":  rc.Canary.Percent,
+				"sticky":   rc.Canary.Sticky,
+			}
+		}
+		out = append(out, outRoute{
+			Name:         rc.Name,
+			Host:         rc.Match.Host,
+			PathPrefix:   rc.Match.PathPrefix,
+			PathExact:    rc.Match.PathExact,
+			Query:        rc.Match.Query,
+			Methods:      rc.Match.Methods,
+			HeadAsGet:    rc.HeadAsGet,
+			Protocol:     rc.Protocol,
+			UpstreamTO:   rc.UpstreamTimeoutSeconds,
+			MaxResponse:  rc.MaxResponseBytes,
+			Priority:     rc.Priority,
+			Disabled:     rc.Disabled,
+			SingleFlight: rc.SingleFlight,
+			Upstream:     rc.Upstream,
+			StripPrefix:  rc.StripPrefix,
+			AddPrefix:    rc.AddPrefix,
+			AuthRequired: rc.AuthRequired,
+			Auth:         auth,
+			RateLimit: map[string]any{
+				"enabled":  rc.RateLimit.Enabled,
+				"rps":      rc.RateLimit.RPS,
+				"burst":    rc.RateLimit.Burst,
+				"scope":    rc.RateLimit.Scope,
+				"soft_rps": rc.RateLimit.SoftRPS,
+				"dry_run":  rc.RateLimit.DryRun,
+
+				"tiers":        rc.RateLimit.Tiers,
+				"default_tier": rc.RateLimit.DefaultTier,
+				"per_method":   rc.RateLimit.PerMethod,
+				"methods":      rc.RateLimit.Methods,
+			},
+			Concurrency: map[string]any{
+				"max_in_flight":       rc.Concurrency.MaxInFlight,
+				"max_wait_ms":         rc.Concurrency.MaxWaitMs,
+				"retry_after_seconds": rc.Concurrency.RetryAfterSeconds,
+				"per_subject_max":     rc.Concurrency.PerSubjectMax,
+				"mode":                rc.Concurrency.Mode,
+			},
+			Quota: map[string]any{
+				"daily": rc.Quota.Daily,
+			},
+			RequiredHdrs:  reqHdrs,
+			RejectInvalid: rc.RejectInvalidOptionalToken,
+			RequireRID:    rc.RequireRequestID,
+			Canary:        canary,
+			Hedge: map[string]any{
+				"delay_ms":     rc.Hedge.DelayMs,
+				"max_attempts": rc.Hedge.MaxAttempts,
+			},
+			AccessLog: map[string]any{
+				"sample_every": rc.AccessLog.SampleEvery,
+			},
+			ClientCert: map[string]any{
+				"auth":             rc.ClientCert.Auth,
+				"allowed_subjects": rc.ClientCert.AllowedSubjects,
+			},
+			Chaos: map[string]any{
+				"active":        g.cfg.Server.ChaosEnabled,
+				"delay_ms":      rc.Chaos.DelayMs,
+				"error_percent": rc.Chaos.ErrorPercent,
+				"error_status":  rc.Chaos.ErrorStatus,
+			},
+			CircuitBreaker: map[string]any{
+				"enabled":                     rc.CircuitBreaker.Enabled,
+				"failure_threshold":           rc.CircuitBreaker.FailureThreshold,
+				"open_seconds":                rc.CircuitBreaker.OpenSeconds,
+				"half_open_max_in_flight":     rc.CircuitBreaker.HalfOpenMaxInFlight,
+				"half_open_success_threshold": rc.CircuitBreaker.HalfOpenSuccessThreshold,
+				"open_methods":                rc.CircuitBreaker.OpenMethods,
+				"ignore_methods":              rc.CircuitBreaker.IgnoreMethods,
+				"ignore_paths":                rc.CircuitBreaker.IgnorePaths,
+				"ignore_statuses":             rc.CircuitBreaker.IgnoreStatuses,
+				"failure_statuses":            rc.CircuitBreaker.FailureStatuses,
+				"on_change_webhook":           rc.CircuitBreaker.OnChangeURL != "", // URL may embed a secret
+				"fallback":                    rc.CircuitBreaker.Fallback.Enabled(),
+			},
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(out)
+}
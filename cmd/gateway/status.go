@@ -0,0 +1,83 @@
+package main
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Dependency checks behind /-/status are cached this long, so frequent
+// polling doesn't turn into a Redis ping per request.
+const (
+	statusCacheTTL     = 5 * time.Second
+	statusCheckTimeout = time.Second
+)
+
+type redisStatus struct {
+	Reachable bool    `json:"reachable"`
+	LatencyMs float64 `json:"latency_ms"`
+	Error     string  `json:"error,omitempty"`
+}
+
+type jwksStatus struct {
+	LastFetch time.Time `json:"last_fetch"`
+	KeyCount  int       `json:"key_count"`
+	LastError string    `json:"last_error,omitempty"`
+}
+
+// redisCheck caches the last Redis ping.
+type redisCheck struct {
+	mu      sync.Mutex
+	checked time.Time
+	result  redisStatus
+}
+
+// redisStatus pings Redis at most once per statusCacheTTL; nil when the
+// rate limiter isn't configured for Redis.
+func (g *gateway) redisStatus(ctx context.Context) *redisStatus {
+	if g.RedisPing == nil {
+		return nil
+	}
+	c := &g.redisCheck
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if time.Since(c.checked) < statusCacheTTL {
+		r := c.result
+		return &r
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, statusCheckTimeout)
+	defer cancel()
+	start := time.Now()
+	err := g.RedisPing(ctx)
+	c.result = redisStatus{
+		Reachable: err == nil,
+		LatencyMs: float64(time.Since(start).Microseconds()) / 1000,
+	}
+	if err != nil {
+		c.result.Error = err.Error()
+	}
+	c.checked = time.Now()
+	r := c.result
+	return &r
+}
+
+// dependencyStatus reports Redis and JWKS health for /-/status. healthy is
+// false when a configured Redis is unreachable or a JWKS validator has no
+// keys yet.
+func (g *gateway) dependencyStatus(ctx context.Context) (healthy bool, redis *redisStatus, jwks *jwksStatus) {
+	healthy = true
+	if redis = g.redisStatus(ctx); redis != nil && !redis.Reachable {
+		healthy = false
+	}
+	for _, v := range g.jwksValidators() {
+		if !v.Ready() {
+			healthy = false
+		}
+	}
+	if g.JWKS != nil {
+		st := g.JWKS.Stats()
+		jwks = &jwksStatus{LastFetch: st.FetchedAt, KeyCount: st.KeyCount, LastError: st.LastError}
+	}
+	return healthy, redis, jwks
+}
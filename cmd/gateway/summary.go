@@ -0,0 +1,89 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/3xpluto/go-api-gateway/internal/mw"
+)
+
+// metricsSummary is the /-/metrics-summary body: the handful of numbers
+// people look for first during an incident, without a Prometheus server.
+type metricsSummary struct {
+	Requests    int64                    `json:"requests_total"`
+	ByClass     map[string]int64         `json:"requests_by_class"` // "2xx", "4xx", ...
+	RateLimited int64                    `json:"rate_limit_blocked_total"`
+	Routes      map[string]*routeSummary `json:"routes"`
+}
+
+type routeSummary struct {
+	Requests    int64            `json:"requests"`
+	ByClass     map[string]int64 `json:"requests_by_class"`
+	RateLimited int64            `json:"rate_limit_blocked,omitempty"`
+	Breaker     mw.BreakerState  `json:"breaker,omitempty"` // only for routes with circuit_breaker.enabled
+}
+
+// metricsSummaryHandler serves GET /-/metrics-summary from the Prometheus
+// registry's current values and the live breaker states.
+func (g *gateway) metricsSummaryHandler(w http.ResponseWriter, _ *http.Request) {
+	families, err := g.reg.Gather()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, "metrics_unavailable", map[string]any{"message": err.Error()})
+		return
+	}
+
+	out := metricsSummary{ByClass: map[string]int64{}, Routes: map[string]*routeSummary{}}
+	route := func(name string) *routeSummary {
+		rs := out.Routes[name]
+		if rs == nil {
+			rs = &routeSummary{ByClass: map[string]int64{}}
+			out.Routes[name] = rs
+		}
+		return rs
+	}
+	for _, mf := range families {
+		switch mf.GetName() {
+		case "apigw_http_requests_total":
+			for _, m := range mf.GetMetric() {
+				var name, class string
+				for _, lp := range m.GetLabel() {
+					switch lp.GetName() {
+					case "route":
+						name = lp.GetValue()
+					case "code":
+						code, _ := strconv.Atoi(lp.GetValue()) // "unknown" reads as 0
+						class = mw.StatusClass(code)
+					case "class": // metrics.status_label class or both
+						class = lp.GetValue()
+					}
+				}
+				n := int64(m.GetCounter().GetValue())
+				rs := route(name)
+				out.Requests += n
+				out.ByClass[class] += n
+				rs.Requests += n
+				rs.ByClass[class] += n
+			}
+		case "apigw_rate_limit_blocked_total":
+			for _, m := range mf.GetMetric() {
+				n := int64(m.GetCounter().GetValue())
+				out.RateLimited += n
+				for _, lp := range m.GetLabel() {
+					if lp.GetName() == "route" {
+						route(lp.GetValue()).RateLimited += n
+					}
+				}
+			}
+		}
+	}
+
+	t := g.table()
+	for _, rc := range t.configs {
+		if br := t.breakers[rc.Name]; br != nil && rc.CircuitBreaker.Enabled {
+			route(rc.Name).Breaker = br.Stats().State
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(out)
+}
@@ -151,7 +151,7 @@ func TestGateway_JWKS_Auth_And_RateLimit(t *testing.T) {
 	mux.HandleFunc("/healthz", func(w http.ResponseWriter, _ *http.Request) { _, _ = w.Write([]byte("ok")) })
 
 	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		route := rtr.Match(r.URL.Path)
+		route := rtr.Match(r.Host, r.URL.Path, r.URL.Query())
 		if route == nil {
 			http.NotFound(w, r)
 			return
@@ -305,7 +305,7 @@ func TestGateway_ConcurrencyLimit_TooBusy(t *testing.T) {
 
 	mux := http.NewServeMux()
 	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		route := rtr.Match(r.URL.Path)
+		route := rtr.Match(r.Host, r.URL.Path, r.URL.Query())
 		if route == nil {
 			http.NotFound(w, r)
 			return
@@ -438,7 +438,7 @@ func TestGateway_CircuitBreaker_Opens_And_Closes(t *testing.T) {
 
 	mux := http.NewServeMux()
 	mux.Handle("/", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		route := rtr.Match(r.URL.Path)
+		route := rtr.Match(r.Host, r.URL.Path, r.URL.Query())
 		if route == nil {
 			http.NotFound(w, r)
 			return
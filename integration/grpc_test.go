@@ -0,0 +1,97 @@
+package integration_test
+
+import (
+	"context"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"golang.org/x/net/http2"
+	"golang.org/x/net/http2/h2c"
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/health"
+	healthpb "google.golang.org/grpc/health/grpc_health_v1"
+	"google.golang.org/grpc/status"
+
+	"github.com/3xpluto/go-api-gateway/internal/mw"
+	"github.com/3xpluto/go-api-gateway/internal/proxy"
+)
+
+// The gRPC health service stands in for an echo server: it has unary and
+// server-streaming methods and reports errors through the grpc-status trailer.
+func TestGateway_GRPCPassthrough(t *testing.T) {
+	// --- gRPC upstream on a plain port (h2c)
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	hs := health.NewServer()
+	hs.SetServingStatus("echo", healthpb.HealthCheckResponse_SERVING)
+	gs := grpc.NewServer()
+	healthpb.RegisterHealthServer(gs, hs)
+	go func() { _ = gs.Serve(ln) }()
+	defer gs.Stop()
+
+	// --- Gateway: protocol grpc route, h2c on both sides
+	upURL, _ := url.Parse("http://" + ln.Addr().String())
+	rp := proxy.BuildProxyWith(upURL, proxy.NewH2CTransport(proxy.TransportConfig{}, ""), proxy.ProxyOptions{FlushInterval: -1})
+
+	log := slog.New(slog.NewJSONHandler(io.Discard, nil))
+	metrics := mw.NewMetrics(prometheus.NewRegistry())
+	var h http.Handler = rp
+	h = mw.AccessLog(log, h)
+	h = mw.Instrument(metrics, h)
+	h = mw.WithRoute(h, "grpc")
+
+	gw := httptest.NewServer(h2c.NewHandler(h, &http2.Server{}))
+	defer gw.Close()
+
+	conn, err := grpc.NewClient(strings.TrimPrefix(gw.URL, "http://"), grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	client := healthpb.NewHealthClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Unary call.
+	resp, err := client.Check(ctx, &healthpb.HealthCheckRequest{Service: "echo"})
+	if err != nil {
+		t.Fatalf("unary call through the gateway failed: %v", err)
+	}
+	if resp.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("expected SERVING, got %v", resp.Status)
+	}
+
+	// Errors arrive in trailers; the status code must survive the proxy.
+	_, err = client.Check(ctx, &healthpb.HealthCheckRequest{Service: "missing"})
+	if status.Code(err) != codes.NotFound {
+		t.Fatalf("expected NotFound from the upstream trailer, got %v", err)
+	}
+
+	// Server streaming: each message must be flushed as it is sent.
+	stream, err := client.Watch(ctx, &healthpb.HealthCheckRequest{Service: "echo"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	first, err := stream.Recv()
+	if err != nil || first.Status != healthpb.HealthCheckResponse_SERVING {
+		t.Fatalf("expected a first SERVING message, got %v %v", first, err)
+	}
+	hs.SetServingStatus("echo", healthpb.HealthCheckResponse_NOT_SERVING)
+	second, err := stream.Recv()
+	if err != nil || second.Status != healthpb.HealthCheckResponse_NOT_SERVING {
+		t.Fatalf("expected a streamed NOT_SERVING update, got %v %v", second, err)
+	}
+}
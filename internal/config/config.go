@@ -4,10 +4,12 @@ import (
 	"errors"
 	"fmt"
 	"net/url"
-	"os"
+	"slices"
 	"strings"
 
-	"gopkg.in/yaml.v3"
+	"golang.org/x/net/http/httpguts"
+
+	"github.com/3xpluto/go-api-gateway/internal/netx"
 )
 
 type Config struct {
@@ -15,9 +17,77 @@ type Config struct {
 	Upstream  UpstreamConfig   `yaml:"upstream"`
 	Auth      AuthConfig       `yaml:"auth"`
 	RateLimit RateLimitBackend `yaml:"rate_limit"`
+	Logging   LoggingConfig    `yaml:"logging"`
+	Metrics   MetricsConfig    `yaml:"metrics"`
+	Admin     AdminConfig      `yaml:"admin"`
+	Errors    ErrorsConfig     `yaml:"errors"`
 	Routes    []RouteConfig    `yaml:"routes"`
 }
 
+// ErrorsConfig shapes gateway-generated JSON error bodies.
+type ErrorsConfig struct {
+	// FieldMap renames body fields, e.g. {error: code}; unmapped fields keep their names.
+	FieldMap map[string]string `yaml:"field_map"`
+}
+
+// AdminConfig moves /metrics and the /-/* admin endpoints off the public
+// listeners onto their own, e.g. a localhost-only port. Empty Addr keeps
+// them on server.addr.
+type AdminConfig struct {
+	Network string `yaml:"network"` // "tcp" (default) or "unix"
+	Addr    string `yaml:"addr"`
+}
+
+type MetricsConfig struct {
+	// DisablePrometheus stops serving /metrics (e.g. when OTLP is the only sink).
+	DisablePrometheus bool              `yaml:"disable_prometheus"`
+	OTLP              OTLPMetricsConfig `yaml:"otlp"`
+
+	// StatusLabel labels request counts by exact "code" (default), status
+	// "class" (2xx, 4xx, ...) to bound cardinality, or "both".
+	StatusLabel string `yaml:"status_label"`
+}
+
+type OTLPMetricsConfig struct {
+	Enabled         bool              `yaml:"enabled"`
+	Endpoint        string            `yaml:"endpoint"` // host:port of the OTLP/HTTP collector
+	URLPath         string            `yaml:"url_path"` // default /v1/metrics
+	Insecure        bool              `yaml:"insecure"` // plain HTTP instead of HTTPS
+	Headers         map[string]string `yaml:"headers"`
+	IntervalSeconds int               `yaml:"interval_seconds"` // export interval
+}
+
+type LoggingConfig struct {
+	Output     string `yaml:"output"`    // "stdout" | "file"
+	FilePath   string `yaml:"file_path"` // required for file output
+	MaxSizeMB  int    `yaml:"max_size_mb"`
+	MaxAgeDays int    `yaml:"max_age_days"`
+	MaxBackups int    `yaml:"max_backups"`
+	Compress   bool   `yaml:"compress"`
+
+	Access AccessLogConfig `yaml:"access"`
+}
+
+// AccessLogConfig adds optional fields to access log lines. Authorization,
+// Cookie, X-API-Key and X-Admin-Key values are always redacted.
+type AccessLogConfig struct {
+	Headers           []string `yaml:"headers"`             // request headers to log
+	RedactHeaders     []string `yaml:"redact_headers"`      // extra headers whose values are replaced with ***
+	Query             bool     `yaml:"query"`               // log the query string (sensitive params scrubbed)
+	RedactQueryParams []string `yaml:"redact_query_params"` // extra params scrubbed besides access_token, token, api_key
+
+	// SampleEvery logs about 1 in N 2xx/3xx requests; 4xx/5xx are always logged. 0 or 1 logs all.
+	SampleEvery int `yaml:"sample_every"`
+
+	// Format is "json" (default), "logfmt" or "combined" (Apache combined log format).
+	Format string `yaml:"format"`
+}
+
+// RouteAccessLogConfig overrides logging.access for one route.
+type RouteAccessLogConfig struct {
+	SampleEvery int `yaml:"sample_every"` // 0 uses logging.access.sample_every; 1 logs every request
+}
+
 type ServerConfig struct {
 	Addr                     string   `yaml:"addr"`
 	TrustedProxies           []string `yaml:"trusted_proxies"`
@@ -27,8 +97,91 @@ type ServerConfig struct {
 	WriteTimeoutSeconds      int      `yaml:"write_timeout_seconds"`
 	IdleTimeoutSeconds       int      `yaml:"idle_timeout_seconds"`
 	ReadHeaderTimeoutSeconds int      `yaml:"read_header_timeout_seconds"`
+
+	// StartupTimeoutSeconds bounds each startup dependency check (Redis ping, JWKS prefetch).
+	StartupTimeoutSeconds int `yaml:"startup_timeout_seconds"`
+
+	// TrailingSlash controls whether "/x" and "/x/" match the same route:
+	// "" (strict), "normalize" or "redirect" (308 to the configured form).
+	TrailingSlash string `yaml:"trailing_slash"`
+
+	// Precedence orders the reorderable outer stages, first runs first.
+	// Must be a permutation of DefaultPrecedence.
+	Precedence []string `yaml:"precedence"`
+
+	// MinHTTPVersion ("1.0", "1.1", "2") answers older requests with 505; "" allows all.
+	MinHTTPVersion string `yaml:"min_http_version"`
+	// HTTP10Behavior is "accept" (default), "close" or "reject" (505) for HTTP/1.0 requests.
+	HTTP10Behavior string `yaml:"http10_behavior"`
+
+	// DefaultHostUpstream receives requests that match no route and whose
+	// host matches no host-constrained route; "" answers them 404.
+	DefaultHostUpstream string `yaml:"default_host_upstream"`
+
+	// DefaultUpstream receives every other request that matches no route,
+	// through the normal middleware chain as route "default"; "" answers 404.
+	DefaultUpstream string `yaml:"default_upstream"`
+
+	RequestID RequestIDConfig `yaml:"request_id"`
+
+	TLS ServerTLSConfig `yaml:"tls"`
+
+	// ChaosEnabled turns on per-route chaos blocks; off, they are ignored.
+	ChaosEnabled bool `yaml:"chaos_enabled"`
+
+	TimingDebug TimingDebugConfig `yaml:"timing_debug"`
+
+	// Listeners are served alongside Addr with the same handler.
+	Listeners []ListenerConfig `yaml:"listeners"`
+
+	// H2C accepts HTTP/2 without TLS (prior knowledge or Upgrade) on plain
+	// listeners, which gRPC clients need when the gateway has no TLS.
+	H2C bool `yaml:"h2c"`
+}
+
+// ListenerConfig is an extra address the gateway listens on. server.tls
+// applies to tcp listeners; unix sockets always serve plain HTTP.
+type ListenerConfig struct {
+	Network string `yaml:"network"` // "tcp" (default) or "unix"
+	Addr    string `yaml:"addr"`    // host:port, or the socket path for unix
+}
+
+// TimingDebugConfig logs a per-middleware timing breakdown for every request.
+// It costs a log line per request; meant for latency investigations only.
+type TimingDebugConfig struct {
+	Enabled bool `yaml:"enabled"`
+	Header  bool `yaml:"header"` // also send a Server-Timing response header
+}
+
+// ServerTLSConfig serves HTTPS when CertFile is set, optionally requiring
+// client certificates (mTLS).
+type ServerTLSConfig struct {
+	CertFile     string `yaml:"cert_file"`
+	KeyFile      string `yaml:"key_file"`
+	ClientCAFile string `yaml:"client_ca_file"` // PEM bundle client certs are verified against
+	ClientAuth   string `yaml:"client_auth"`    // "" / "none", "verify_if_given", "require_and_verify"
 }
 
+// RequestIDConfig names the correlation header set on upstream requests and
+// client responses.
+type RequestIDConfig struct {
+	Header          string   `yaml:"header"`           // default X-Request-Id
+	FallbackHeaders []string `yaml:"fallback_headers"` // also accepted on input; unset = X-Request-Id, X-Correlation-Id
+}
+
+// Reorderable request stages. Everything else in the chain has a fixed position:
+// route match -> [precedence stages] -> quota -> concurrency -> circuit breaker -> proxy.
+const (
+	StageAuth      = "auth"
+	StageRateLimit = "rate_limit"
+)
+
+// DefaultRouteName labels requests served by server.default_upstream.
+const DefaultRouteName = "default"
+
+// DefaultPrecedence authenticates before rate limiting so "user" scope can key on the subject.
+var DefaultPrecedence = []string{StageAuth, StageRateLimit}
+
 type UpstreamConfig struct {
 	DialTimeoutSeconds           int `yaml:"dial_timeout_seconds"`
 	TLSHandshakeTimeoutSeconds   int `yaml:"tls_handshake_timeout_seconds"`
@@ -36,21 +189,89 @@ type UpstreamConfig struct {
 	IdleConnTimeoutSeconds       int `yaml:"idle_conn_timeout_seconds"`
 	MaxIdleConns                 int `yaml:"max_idle_conns"`
 	MaxIdleConnsPerHost          int `yaml:"max_idle_conns_per_host"`
+	TotalTimeoutSeconds          int `yaml:"total_timeout_seconds"` // whole round trip incl. body; 0 disables
+
+	// CloseOn5xx drops the keep-alive connection after a 5xx response so the
+	// next request dials afresh instead of reusing a possibly half-broken one.
+	CloseOn5xx bool `yaml:"close_on_5xx"`
+
+	Errors UpstreamErrorsConfig `yaml:"errors"`
+
+	// StripResponseHeaders are removed from every upstream response, e.g.
+	// Server or X-Powered-By; routes can add more.
+	StripResponseHeaders []string `yaml:"strip_response_headers"`
+
+	Identity UpstreamIdentityConfig `yaml:"identity"`
+
+	Timing UpstreamTimingConfig `yaml:"timing"`
+}
+
+// UpstreamTimingConfig attributes latency between the gateway and upstreams.
+type UpstreamTimingConfig struct {
+	RequestStart bool `yaml:"request_start"` // X-Request-Start: Unix ms the gateway received the request
+	ServerTiming bool `yaml:"server_timing"` // Server-Timing: upstream;dur=<ms> on client responses
+}
+
+// UpstreamIdentityConfig tags proxied requests so upstream logs can tell
+// they came through the gateway, and through which instance.
+type UpstreamIdentityConfig struct {
+	DisableVia      bool   `yaml:"disable_via"`       // no "Via: 1.1 <via_name>"
+	ViaName         string `yaml:"via_name"`          // default "apigw"
+	UserAgentSuffix string `yaml:"user_agent_suffix"` // appended to the client's User-Agent; empty leaves it alone
+	InstanceHeader  bool   `yaml:"instance_header"`   // send X-Gateway-Instance
+	InstanceID      string `yaml:"instance_id"`       // X-Gateway-Instance value; default the hostname
+}
+
+// UpstreamErrorsConfig shapes the response when an upstream cannot be
+// reached or does not answer in time.
+type UpstreamErrorsConfig struct {
+	Detailed      bool `yaml:"detailed"`       // raw error in the body; debug only, leaks upstream addresses
+	TimeoutStatus int  `yaml:"timeout_status"` // default 504
+	DialStatus    int  `yaml:"dial_status"`    // connection refused, DNS failure, unreachable; default 502
 }
 
 type AuthConfig struct {
-	Mode       string         `yaml:"mode"`        // "hmac" | "jwks"
-	HMACSecret string         `yaml:"hmac_secret"` // shared secret for HS256 (hmac mode)
-	JWKS       JWKSAuthConfig `yaml:"jwks"`        // jwks mode settings
+	Mode         string             `yaml:"mode"`          // "hmac" | "jwks"
+	HMACSecret   string             `yaml:"hmac_secret"`   // shared secret for HS256 (hmac mode)
+	JWKS         JWKSAuthConfig     `yaml:"jwks"`          // jwks mode settings
+	TokenSources TokenSourcesConfig `yaml:"token_sources"` // fallbacks when Authorization is absent
+	TierClaim    string             `yaml:"tier_claim"`    // token claim naming the rate-limit tier
+
+	HMACAlgs []string `yaml:"hmac_algs"` // accepted HMAC algorithms (HS256, HS384, HS512); default [HS256]
+
+	// HMACSecrets are accepted alongside hmac_secret, so a secret can be
+	// rotated without invalidating tokens signed with the previous one.
+	HMACSecrets []string `yaml:"hmac_secrets"`
+
+	MTLS MTLSAuthConfig `yaml:"mtls"` // mtls mode settings
+}
+
+// MTLSAuthConfig authenticates callers by their verified TLS client
+// certificate. It needs server.tls with client_ca_file.
+type MTLSAuthConfig struct {
+	Subject         string   `yaml:"subject"`          // "cn" (default) or "san"
+	AllowedSubjects []string `yaml:"allowed_subjects"` // 401 unless the subject is listed; empty allows all
+}
+
+// TokenSourcesConfig enables reading the bearer token from a cookie or query
+// parameter when the Authorization header is absent. Empty means header-only.
+type TokenSourcesConfig struct {
+	Cookie     string `yaml:"cookie"`
+	QueryParam string `yaml:"query_param"`
 }
 
 type JWKSAuthConfig struct {
-	URL                string   `yaml:"url"`
-	CacheTTLSeconds    int      `yaml:"cache_ttl_seconds"`
-	HTTPTimeoutSeconds int      `yaml:"http_timeout_seconds"`
-	LeewaySeconds      int      `yaml:"leeway_seconds"`
-	Issuers            []string `yaml:"issuers"`
-	Audiences          []string `yaml:"audiences"`
+	URL                 string   `yaml:"url"`
+	CacheTTLSeconds     int      `yaml:"cache_ttl_seconds"`
+	HTTPTimeoutSeconds  int      `yaml:"http_timeout_seconds"`
+	LeewaySeconds       int      `yaml:"leeway_seconds"`
+	Issuers             []string `yaml:"issuers"`
+	Audiences           []string `yaml:"audiences"`
+	ValidationCacheSize int      `yaml:"validation_cache_size"` // validated-token LRU entries; 0 disables
+
+	// FailFast exits at startup when the first key fetch fails; otherwise
+	// the gateway starts not ready and keeps retrying in the background.
+	FailFast bool `yaml:"fail_fast"`
 }
 
 type RateLimitBackend struct {
@@ -68,17 +289,65 @@ type RedisConfig struct {
 type MemoryRLConfig struct {
 	CleanupSeconds int `yaml:"cleanup_seconds"`
 	TTLSeconds     int `yaml:"ttl_seconds"`
+
+	// StateFile, when set, is restored at startup and written on shutdown
+	// so short restarts keep everyone's remaining tokens.
+	StateFile string `yaml:"state_file"`
 }
 
 type RouteConcurrency struct {
 	MaxInFlight int `yaml:"max_in_flight"`
+	MaxWaitMs   int `yaml:"max_wait_ms"` // queue for a slot this long before 503; 0 rejects immediately
+
+	RetryAfterSeconds int `yaml:"retry_after_seconds"` // Retry-After on 503 too_busy; 0 sends 1
+
+	// PerSubjectMax caps in-flight requests per authenticated subject; 0 disables.
+	PerSubjectMax int `yaml:"per_subject_max"`
+
+	// Mode is "reject" (503 when full) or "queue" (wait up to max_wait_ms,
+	// first come first served). Empty queues only when max_wait_ms is set.
+	Mode string `yaml:"mode"`
+
+	// QueueIgnoresCancel keeps a queued request waiting after its client
+	// disconnects; by default it leaves the queue at once.
+	QueueIgnoresCancel bool `yaml:"queue_ignores_cancel"`
 }
 
 type RouteCircuitBreaker struct {
-	Enabled             bool `yaml:"enabled"`
-	FailureThreshold    int  `yaml:"failure_threshold"`
-	OpenSeconds         int  `yaml:"open_seconds"`
-	HalfOpenMaxInFlight int  `yaml:"half_open_max_in_flight"`
+	Enabled             bool     `yaml:"enabled"`
+	FailureThreshold    int      `yaml:"failure_threshold"`
+	OpenSeconds         int      `yaml:"open_seconds"`
+	HalfOpenMaxInFlight int      `yaml:"half_open_max_in_flight"`
+	OpenMethods         []string `yaml:"open_methods"`   // methods fast-failed while open; empty = all
+	IgnoreMethods       []string `yaml:"ignore_methods"` // bypass the breaker entirely
+	IgnorePaths         []string `yaml:"ignore_paths"`   // client path prefixes that bypass the breaker
+
+	// HalfOpenSuccessThreshold is how many consecutive trial successes close
+	// the breaker; 0 means 1.
+	HalfOpenSuccessThreshold int `yaml:"half_open_success_threshold"`
+
+	// Statuses that override the ">= 500 is a failure" rule either way.
+	IgnoreStatuses  []int `yaml:"ignore_statuses"`  // e.g. [501] never trips the breaker
+	FailureStatuses []int `yaml:"failure_statuses"` // e.g. [429] counts as a failure
+
+	OnChangeURL string `yaml:"on_change_url"` // optional webhook POSTed on state transitions
+
+	Fallback BreakerFallbackConfig `yaml:"fallback"` // served instead of 503 circuit_open
+}
+
+// BreakerFallbackConfig answers requests the breaker rejects, either with a
+// static response or from a secondary upstream. Empty keeps the 503.
+type BreakerFallbackConfig struct {
+	Status      int    `yaml:"status"`       // static; default 200
+	ContentType string `yaml:"content_type"` // static; default application/json
+	Body        string `yaml:"body"`
+
+	Upstream string `yaml:"upstream"` // proxy here instead of a static response
+}
+
+// Enabled reports whether any fallback is configured.
+func (f BreakerFallbackConfig) Enabled() bool {
+	return f.Upstream != "" || f.Status != 0 || f.ContentType != "" || f.Body != ""
 }
 
 type RouteConfig struct {
@@ -86,30 +355,198 @@ type RouteConfig struct {
 	Match          MatchConfig         `yaml:"match"`
 	Upstream       string              `yaml:"upstream"`
 	StripPrefix    string              `yaml:"strip_prefix"`
+	AddPrefix      string              `yaml:"add_prefix"` // prepended after strip_prefix
 	AuthRequired   bool                `yaml:"auth_required"`
 	RateLimit      RouteRLConfig       `yaml:"rate_limit"`
 	Concurrency    RouteConcurrency    `yaml:"concurrency"`
 	CircuitBreaker RouteCircuitBreaker `yaml:"circuit_breaker"`
+	Quota          RouteQuotaConfig    `yaml:"quota"`
+
+	RequiredHeaders []RequiredHeaderConfig `yaml:"required_headers"`
+	Canary          RouteCanaryConfig      `yaml:"canary"`
+	Hedge           RouteHedgeConfig       `yaml:"hedge"`
+
+	// RejectInvalidOptionalToken validates tokens on routes without auth_required:
+	// no token passes anonymously, a present-but-invalid one gets 401.
+	RejectInvalidOptionalToken bool `yaml:"reject_invalid_optional_token"`
+
+	// RequireRequestID answers 400 to requests without a valid X-Request-Id instead of generating one.
+	RequireRequestID bool `yaml:"require_request_id"`
+
+	AccessLog RouteAccessLogConfig `yaml:"access_log"`
+
+	ClientCert RouteClientCertConfig `yaml:"client_cert"`
+
+	Chaos RouteChaosConfig `yaml:"chaos"` // only applied when server.chaos_enabled is true
+
+	Auth RouteAuthConfig `yaml:"auth"` // overrides the global auth block for this route
+
+	// HeadAsGet answers HEAD by sending GET upstream and dropping the body,
+	// for upstreams that do not implement HEAD.
+	HeadAsGet bool `yaml:"head_as_get"`
+
+	// StripResponseHeaders are removed from this route's upstream responses,
+	// in addition to upstream.strip_response_headers.
+	StripResponseHeaders []string `yaml:"strip_response_headers"`
+
+	// UpstreamTimeoutSeconds caps the wait for the upstream's response
+	// headers on this route (504 upstream_timeout); 0 leaves only
+	// upstream.response_header_timeout_seconds.
+	UpstreamTimeoutSeconds int `yaml:"upstream_timeout_seconds"`
+
+	// MaxResponseBytes caps upstream response bodies (502
+	// upstream_response_too_large); 0 disables. SSE and gRPC responses are
+	// capped too unless MaxResponseExemptStreams is set.
+	MaxResponseBytes         int64 `yaml:"max_response_bytes"`
+	MaxResponseExemptStreams bool  `yaml:"max_response_exempt_streams"`
+
+	// ForwardHeaders, when set, is the allow-list of request headers sent
+	// upstream; everything else is dropped. Unset forwards all headers.
+	ForwardHeaders []string `yaml:"forward_headers"`
+
+	// Protocol "grpc" proxies over HTTP/2 end to end (h2c for http://
+	// upstreams) and flushes every write; "" or "http" is plain proxying.
+	Protocol string `yaml:"protocol"`
+
+	// Priority orders matching ahead of host and path length: higher wins,
+	// ties fall back to the usual ordering. Default 0.
+	Priority int `yaml:"priority"`
+
+	// Disabled keeps the route matching but answers 503 route_disabled
+	// without calling the upstream: a kill switch that leaves config intact.
+	Disabled bool `yaml:"disabled"`
+
+	// SingleFlight coalesces concurrent identical GET/HEAD requests into one
+	// upstream call and shares its response (see mw.SingleFlight).
+	SingleFlight bool `yaml:"single_flight"`
+}
+
+// RouteAuthConfig overrides the global auth mode and its settings for one
+// route. Token sources and tier_claim still come from the global auth block,
+// and zero JWKS timeouts/TTLs inherit the global values.
+type RouteAuthConfig struct {
+	Mode       string         `yaml:"mode"` // "" uses the global auth block
+	HMACSecret string         `yaml:"hmac_secret"`
+	JWKS       JWKSAuthConfig `yaml:"jwks"`
+
+	HMACAlgs    []string `yaml:"hmac_algs"` // empty inherits auth.hmac_algs
+	HMACSecrets []string `yaml:"hmac_secrets"`
+
+	MTLS MTLSAuthConfig `yaml:"mtls"`
+
+	// Audiences and Issuers replace the JWKS audiences/issuers for this
+	// route only, keeping the JWKS key cache shared. They apply with or
+	// without a mode override; empty keeps the effective jwks values.
+	Audiences []string `yaml:"audiences"`
+	Issuers   []string `yaml:"issuers"`
+}
+
+// RouteAuth returns the auth settings in effect for rc and whether rc
+// overrides the global ones.
+func (c *Config) RouteAuth(rc RouteConfig) (AuthConfig, bool) {
+	ac := c.Auth
+	if rc.Auth.Mode == "" {
+		return ac, false
+	}
+	ac.Mode = rc.Auth.Mode
+	ac.HMACSecret = rc.Auth.HMACSecret
+	ac.HMACSecrets = rc.Auth.HMACSecrets
+	ac.MTLS = rc.Auth.MTLS
+	if len(rc.Auth.HMACAlgs) > 0 {
+		ac.HMACAlgs = rc.Auth.HMACAlgs
+	}
+	global := c.Auth.JWKS
+	ac.JWKS = rc.Auth.JWKS
+	if ac.JWKS.CacheTTLSeconds == 0 {
+		ac.JWKS.CacheTTLSeconds = global.CacheTTLSeconds
+	}
+	if ac.JWKS.HTTPTimeoutSeconds == 0 {
+		ac.JWKS.HTTPTimeoutSeconds = global.HTTPTimeoutSeconds
+	}
+	if ac.JWKS.LeewaySeconds == 0 {
+		ac.JWKS.LeewaySeconds = global.LeewaySeconds
+	}
+	return ac, true
+}
+
+// RouteChaosConfig injects latency and errors for resilience testing.
+type RouteChaosConfig struct {
+	DelayMs      int     `yaml:"delay_ms"`      // added to every request
+	ErrorPercent float64 `yaml:"error_percent"` // 0-100 share of requests failed
+	ErrorStatus  int     `yaml:"error_status"`  // default 503
+}
+
+// RouteClientCertConfig uses verified TLS client certificates (server.tls.client_auth).
+type RouteClientCertConfig struct {
+	Auth            bool     `yaml:"auth"`             // a verified cert's CN is the auth subject; others fall back to bearer auth
+	AllowedSubjects []string `yaml:"allowed_subjects"` // 403 unless the cert CN is listed; empty allows all
+}
+
+type RouteHedgeConfig struct {
+	DelayMs     int `yaml:"delay_ms"`     // send another attempt if no response after this long
+	MaxAttempts int `yaml:"max_attempts"` // total attempts including the first; <= 1 disables
+}
+
+type RouteCanaryConfig struct {
+	Upstream string  `yaml:"upstream"`
+	Percent  float64 `yaml:"percent"` // share of traffic sent to the canary, 0-100; 0 disables
+	Sticky   bool    `yaml:"sticky"`  // pin each subject (or client IP) to one side
+	Header   bool    `yaml:"header"`  // add X-Canary: true to canary responses
+}
+
+type RequiredHeaderConfig struct {
+	Name   string   `yaml:"name"`
+	Values []string `yaml:"values"` // optional allow-list; empty means any non-empty value
+}
+
+type RouteQuotaConfig struct {
+	Daily int64 `yaml:"daily"` // requests per subject (or IP) per UTC day; 0 disables
 }
 
 type MatchConfig struct {
+	Host       string `yaml:"host"` // optional: "api.example.com" or "*.example.com"
 	PathPrefix string `yaml:"path_prefix"`
+	PathExact  string `yaml:"path_exact"` // mutually exclusive with path_prefix
+
+	// Query constrains query parameters: key -> required value, "" = key present.
+	Query map[string]string `yaml:"query"`
+
+	// Methods limits the route to these methods (GET implies HEAD); empty
+	// accepts all. Other methods on a matching path get 405 with Allow.
+	Methods []string `yaml:"methods"`
 }
 
 type RouteRLConfig struct {
 	Enabled bool    `yaml:"enabled"`
 	RPS     float64 `yaml:"rps"`
 	Burst   float64 `yaml:"burst"`
-	Scope   string  `yaml:"scope"` // "user" | "ip"
+	Scope   string  `yaml:"scope"`    // "user" | "ip"
+	SoftRPS float64 `yaml:"soft_rps"` // optional soft threshold (< rps); flags but never blocks
+	DryRun  bool    `yaml:"dry_run"`  // count/log would-be 429s but let requests through
+
+	// Tiers override rps/burst by the caller's auth.tier_claim value.
+	Tiers       map[string]RateLimitTierConfig `yaml:"tiers"`
+	DefaultTier string                         `yaml:"default_tier"` // tier for callers without a known one
+
+	// PerMethod keeps a separate bucket per HTTP method; Methods overrides rps/burst per method.
+	PerMethod bool                           `yaml:"per_method"`
+	Methods   map[string]RateLimitTierConfig `yaml:"methods"`
 }
 
+type RateLimitTierConfig struct {
+	RPS   float64 `yaml:"rps"`
+	Burst float64 `yaml:"burst"`
+}
+
+// Load reads a config file, or a directory / glob of a base file plus
+// route fragments (see loadFragments).
 func Load(path string) (*Config, error) {
-	b, err := os.ReadFile(path)
-	if err != nil {
-		return nil, err
-	}
 	var cfg Config
-	if err := yaml.Unmarshal(b, &cfg); err != nil {
+	if isMultiPath(path) {
+		if err := loadFragments(path, &cfg); err != nil {
+			return nil, err
+		}
+	} else if err := readConfigFile(path, &cfg); err != nil {
 		return nil, err
 	}
 
@@ -143,24 +580,42 @@ func applyDefaults(cfg *Config) {
 	if cfg.Server.IdleTimeoutSeconds == 0 {
 		cfg.Server.IdleTimeoutSeconds = 60
 	}
+	if cfg.Server.StartupTimeoutSeconds == 0 {
+		cfg.Server.StartupTimeoutSeconds = 2
+	}
+	if len(cfg.Server.Precedence) == 0 {
+		cfg.Server.Precedence = append([]string(nil), DefaultPrecedence...)
+	}
 
+	if cfg.Logging.Output == "" {
+		cfg.Logging.Output = "stdout"
+	}
+	if cfg.Logging.MaxSizeMB == 0 {
+		cfg.Logging.MaxSizeMB = 100
+	}
+
+	if cfg.Metrics.OTLP.IntervalSeconds == 0 {
+		cfg.Metrics.OTLP.IntervalSeconds = 15
+	}
+
+	// Upstream defaults mirror proxy.NewTransport's hardened fallbacks.
 	if cfg.Upstream.DialTimeoutSeconds == 0 {
-		cfg.Upstream.DialTimeoutSeconds = 5
+		cfg.Upstream.DialTimeoutSeconds = 3
 	}
 	if cfg.Upstream.TLSHandshakeTimeoutSeconds == 0 {
 		cfg.Upstream.TLSHandshakeTimeoutSeconds = 5
 	}
 	if cfg.Upstream.ResponseHeaderTimeoutSeconds == 0 {
-		cfg.Upstream.ResponseHeaderTimeoutSeconds = 15
+		cfg.Upstream.ResponseHeaderTimeoutSeconds = 10
 	}
 	if cfg.Upstream.IdleConnTimeoutSeconds == 0 {
 		cfg.Upstream.IdleConnTimeoutSeconds = 90
 	}
 	if cfg.Upstream.MaxIdleConns == 0 {
-		cfg.Upstream.MaxIdleConns = 100
+		cfg.Upstream.MaxIdleConns = 256
 	}
 	if cfg.Upstream.MaxIdleConnsPerHost == 0 {
-		cfg.Upstream.MaxIdleConnsPerHost = 20
+		cfg.Upstream.MaxIdleConnsPerHost = 64
 	}
 	// Auth defaults (jwks mode)
 	if cfg.Auth.JWKS.CacheTTLSeconds == 0 {
@@ -180,6 +635,172 @@ func Validate(cfg *Config) error {
 		return errors.New("no routes configured")
 	}
 
+	for name, v := range map[string]int{
+		"server.max_header_bytes":            cfg.Server.MaxHeaderBytes,
+		"server.read_header_timeout_seconds": cfg.Server.ReadHeaderTimeoutSeconds,
+		"server.read_timeout_seconds":        cfg.Server.ReadTimeoutSeconds,
+		"server.write_timeout_seconds":       cfg.Server.WriteTimeoutSeconds,
+		"server.idle_timeout_seconds":        cfg.Server.IdleTimeoutSeconds,
+		"server.startup_timeout_seconds":     cfg.Server.StartupTimeoutSeconds,
+	} {
+		if v < 0 {
+			return fmt.Errorf("%s cannot be negative (0 uses the default)", name)
+		}
+	}
+	switch strings.ToLower(strings.TrimSpace(cfg.Logging.Output)) {
+	case "", "stdout":
+	case "file":
+		if strings.TrimSpace(cfg.Logging.FilePath) == "" {
+			return fmt.Errorf("logging.file_path is required when logging.output is file")
+		}
+	default:
+		return fmt.Errorf("logging.output must be 'stdout' or 'file'")
+	}
+	if cfg.Logging.MaxSizeMB < 0 || cfg.Logging.MaxAgeDays < 0 || cfg.Logging.MaxBackups < 0 {
+		return fmt.Errorf("logging rotation settings cannot be negative")
+	}
+	for _, h := range append(cfg.Logging.Access.Headers, cfg.Logging.Access.RedactHeaders...) {
+		if strings.TrimSpace(h) == "" {
+			return fmt.Errorf("logging.access header names cannot be empty")
+		}
+	}
+	switch cfg.Logging.Access.Format {
+	case "", "json", "logfmt", "combined":
+	default:
+		return fmt.Errorf("logging.access.format must be 'json', 'logfmt' or 'combined'")
+	}
+	if cfg.Logging.Access.SampleEvery < 0 {
+		return fmt.Errorf("logging.access.sample_every cannot be negative")
+	}
+	for _, q := range cfg.Logging.Access.RedactQueryParams {
+		if strings.TrimSpace(q) == "" {
+			return fmt.Errorf("logging.access.redact_query_params cannot contain empty names")
+		}
+	}
+
+	if cfg.Metrics.OTLP.Enabled && strings.TrimSpace(cfg.Metrics.OTLP.Endpoint) == "" {
+		return fmt.Errorf("metrics.otlp.endpoint is required when metrics.otlp.enabled is true")
+	}
+	if cfg.Metrics.OTLP.IntervalSeconds < 0 {
+		return fmt.Errorf("metrics.otlp.interval_seconds cannot be negative")
+	}
+	switch cfg.Metrics.StatusLabel {
+	case "", "code", "class", "both":
+	default:
+		return fmt.Errorf("metrics.status_label must be 'code', 'class' or 'both'")
+	}
+
+	seen := map[string]string{}
+	for from, to := range cfg.Errors.FieldMap {
+		if strings.TrimSpace(from) == "" || strings.TrimSpace(to) == "" {
+			return fmt.Errorf("errors.field_map keys and values must be non-empty")
+		}
+		if other, ok := seen[to]; ok {
+			return fmt.Errorf("errors.field_map maps both %q and %q to %q", other, from, to)
+		}
+		seen[to] = from
+	}
+
+	switch cfg.Server.MinHTTPVersion {
+	case "", "1.0", "1.1", "2":
+	default:
+		return fmt.Errorf("server.min_http_version must be empty, '1.0', '1.1' or '2'")
+	}
+	switch cfg.Server.HTTP10Behavior {
+	case "", "accept", "close", "reject":
+	default:
+		return fmt.Errorf("server.http10_behavior must be 'accept', 'close' or 'reject'")
+	}
+
+	for _, h := range append([]string{cfg.Server.RequestID.Header}, cfg.Server.RequestID.FallbackHeaders...) {
+		if strings.ContainsAny(h, " \t:") {
+			return fmt.Errorf("server.request_id header names cannot contain spaces or ':'")
+		}
+	}
+	for _, h := range cfg.Server.RequestID.FallbackHeaders {
+		if h == "" {
+			return fmt.Errorf("server.request_id.fallback_headers cannot contain empty names")
+		}
+	}
+	tc := cfg.Server.TLS
+	if (tc.CertFile == "") != (tc.KeyFile == "") {
+		return fmt.Errorf("server.tls.cert_file and server.tls.key_file must be set together")
+	}
+	switch tc.ClientAuth {
+	case "", "none":
+	case "verify_if_given", "require_and_verify":
+		if tc.CertFile == "" || tc.ClientCAFile == "" {
+			return fmt.Errorf("server.tls.client_auth %q needs cert_file, key_file and client_ca_file", tc.ClientAuth)
+		}
+	default:
+		return fmt.Errorf("server.tls.client_auth must be 'none', 'verify_if_given' or 'require_and_verify'")
+	}
+	seenAddrs := map[string]bool{"tcp " + cfg.Server.Addr: true}
+	for i, lc := range cfg.Server.Listeners {
+		idx := fmt.Sprintf("server.listeners[%d]", i)
+		switch lc.Network {
+		case "", "tcp", "unix":
+		default:
+			return fmt.Errorf("%s.network must be 'tcp' or 'unix'", idx)
+		}
+		if lc.Addr == "" {
+			return fmt.Errorf("%s.addr is required", idx)
+		}
+		network := lc.Network
+		if network == "" {
+			network = "tcp"
+		}
+		key := network + " " + lc.Addr
+		if seenAddrs[key] {
+			return fmt.Errorf("%s.addr %q is already used", idx, lc.Addr)
+		}
+		seenAddrs[key] = true
+	}
+	if ac := cfg.Admin; ac.Addr != "" {
+		switch ac.Network {
+		case "", "tcp", "unix":
+		default:
+			return fmt.Errorf("admin.network must be 'tcp' or 'unix'")
+		}
+		network := ac.Network
+		if network == "" {
+			network = "tcp"
+		}
+		if seenAddrs[network+" "+ac.Addr] {
+			return fmt.Errorf("admin.addr %q is already a server listener", ac.Addr)
+		}
+	}
+	if u := cfg.Server.DefaultHostUpstream; u != "" {
+		pu, err := url.Parse(u)
+		if err != nil || (pu.Scheme != "http" && pu.Scheme != "https") || pu.Host == "" {
+			return fmt.Errorf("server.default_host_upstream must be an absolute http(s) URL")
+		}
+	}
+	if u := cfg.Server.DefaultUpstream; u != "" {
+		pu, err := url.Parse(u)
+		if err != nil || (pu.Scheme != "http" && pu.Scheme != "https") || pu.Host == "" {
+			return fmt.Errorf("server.default_upstream must be an absolute http(s) URL")
+		}
+		for _, r := range cfg.Routes {
+			if r.Name == DefaultRouteName {
+				return fmt.Errorf("route name %q is reserved when server.default_upstream is set", DefaultRouteName)
+			}
+		}
+	}
+
+	switch cfg.Server.TrailingSlash {
+	case "", "normalize", "redirect":
+	default:
+		return fmt.Errorf("server.trailing_slash must be empty, 'normalize' or 'redirect'")
+	}
+
+	if err := ValidatePrecedence(cfg.Server.Precedence); err != nil {
+		return err
+	}
+	if _, err := netx.ParseCIDRSet(cfg.Server.TrustedProxies); err != nil {
+		return fmt.Errorf("server.trusted_proxies: %v", err)
+	}
+
 	seenNames := map[string]struct{}{}
 	for i, r := range cfg.Routes {
 		idx := fmt.Sprintf("routes[%d]", i)
@@ -193,20 +814,77 @@ func Validate(cfg *Config) error {
 		seenNames[name] = struct{}{}
 
 		pp := strings.TrimSpace(r.Match.PathPrefix)
-		if pp == "" || !strings.HasPrefix(pp, "/") {
+		pe := strings.TrimSpace(r.Match.PathExact)
+		switch {
+		case pp != "" && pe != "":
+			return fmt.Errorf("%s.match: path_prefix and path_exact are mutually exclusive", idx)
+		case pe != "":
+			if !strings.HasPrefix(pe, "/") {
+				return fmt.Errorf("%s.match.path_exact must start with '/'", idx)
+			}
+		case pp == "" || !strings.HasPrefix(pp, "/"):
 			return fmt.Errorf("%s.match.path_prefix must start with '/'", idx)
 		}
 
+		if h := r.Match.Host; h != "" {
+			if strings.Contains(strings.TrimPrefix(h, "*."), "*") || strings.ContainsAny(h, ":/ ") {
+				return fmt.Errorf("%s.match.host must be a hostname or a leading wildcard like *.example.com", idx)
+			}
+		}
+
+		for k := range r.Match.Query {
+			if strings.TrimSpace(k) == "" {
+				return fmt.Errorf("%s.match.query keys cannot be empty", idx)
+			}
+		}
+		for _, m := range r.Match.Methods {
+			if m == "" || strings.ContainsAny(m, " \t/:,") {
+				return fmt.Errorf("%s.match.methods: invalid method %q", idx, m)
+			}
+		}
+
+		for j, rh := range r.RequiredHeaders {
+			if strings.TrimSpace(rh.Name) == "" {
+				return fmt.Errorf("%s.required_headers[%d].name is required", idx, j)
+			}
+		}
+
 		if r.Upstream == "" {
 			return fmt.Errorf("%s.upstream is required", idx)
 		}
-		if _, err := url.Parse(r.Upstream); err != nil {
+		if err := validateUpstreamURL(r.Upstream); err != nil {
 			return fmt.Errorf("%s.upstream invalid: %v", idx, err)
 		}
+		for _, h := range r.ForwardHeaders {
+			if strings.TrimSpace(h) == "" {
+				return fmt.Errorf("%s.forward_headers cannot contain empty names", idx)
+			}
+		}
+		if r.MaxResponseBytes < 0 {
+			return fmt.Errorf("%s.max_response_bytes must be >= 0", idx)
+		}
+		if r.UpstreamTimeoutSeconds < 0 {
+			return fmt.Errorf("%s.upstream_timeout_seconds must be >= 0", idx)
+		}
+		switch r.Protocol {
+		case "", "http":
+		case "grpc":
+			if r.HeadAsGet {
+				return fmt.Errorf("%s.head_as_get cannot be used with protocol grpc", idx)
+			}
+			if r.SingleFlight {
+				return fmt.Errorf("%s.single_flight cannot be used with protocol grpc", idx)
+			}
+		default:
+			return fmt.Errorf("%s.protocol must be 'http' or 'grpc'", idx)
+		}
 
 		if r.StripPrefix != "" && !strings.HasPrefix(r.StripPrefix, "/") {
 			return fmt.Errorf("%s.strip_prefix must start with '/' if set", idx)
 		}
+		if r.AddPrefix != "" && !strings.HasPrefix(r.AddPrefix, "/") {
+			return fmt.Errorf("%s.add_prefix must start with '/' if set", idx)
+		}
 
 		if r.RateLimit.Enabled {
 			if r.RateLimit.RPS <= 0 {
@@ -219,6 +897,157 @@ func Validate(cfg *Config) error {
 			if s != "ip" && s != "user" {
 				return fmt.Errorf("%s.rate_limit.scope must be 'ip' or 'user'", idx)
 			}
+			if r.RateLimit.SoftRPS < 0 || (r.RateLimit.SoftRPS > 0 && r.RateLimit.SoftRPS >= r.RateLimit.RPS) {
+				return fmt.Errorf("%s.rate_limit.soft_rps must be between 0 and rps", idx)
+			}
+			// The tier comes from the token, so auth must have run first.
+			if len(r.RateLimit.Tiers) > 0 && len(cfg.Server.Precedence) > 0 &&
+				slices.Index(cfg.Server.Precedence, StageRateLimit) < slices.Index(cfg.Server.Precedence, StageAuth) {
+				return fmt.Errorf("%s.rate_limit.tiers need server.precedence to run auth before rate_limit", idx)
+			}
+			for name, t := range r.RateLimit.Tiers {
+				if strings.TrimSpace(name) == "" {
+					return fmt.Errorf("%s.rate_limit.tiers cannot have an empty tier name", idx)
+				}
+				if t.RPS <= 0 || t.Burst <= 0 {
+					return fmt.Errorf("%s.rate_limit.tiers.%s rps and burst must be > 0", idx, name)
+				}
+			}
+			if len(r.RateLimit.Methods) > 0 && !r.RateLimit.PerMethod {
+				return fmt.Errorf("%s.rate_limit.methods requires per_method: true", idx)
+			}
+			for m, t := range r.RateLimit.Methods {
+				if m == "" || m != strings.ToUpper(m) {
+					return fmt.Errorf("%s.rate_limit.methods keys must be upper-case methods, got %q", idx, m)
+				}
+				if t.RPS <= 0 || t.Burst <= 0 {
+					return fmt.Errorf("%s.rate_limit.methods.%s rps and burst must be > 0", idx, m)
+				}
+			}
+			if r.RateLimit.DefaultTier != "" {
+				if _, ok := r.RateLimit.Tiers[r.RateLimit.DefaultTier]; !ok {
+					return fmt.Errorf("%s.rate_limit.default_tier %q is not in rate_limit.tiers", idx, r.RateLimit.DefaultTier)
+				}
+			}
+		}
+
+		if r.Canary.Percent < 0 || r.Canary.Percent > 100 {
+			return fmt.Errorf("%s.canary.percent must be between 0 and 100", idx)
+		}
+		if r.Canary.Percent > 0 {
+			if r.Canary.Upstream == "" {
+				return fmt.Errorf("%s.canary.upstream is required when canary.percent > 0", idx)
+			}
+			if err := validateUpstreamURL(r.Canary.Upstream); err != nil {
+				return fmt.Errorf("%s.canary.upstream invalid: %w", idx, err)
+			}
+		}
+
+		if r.Hedge.DelayMs < 0 || r.Hedge.MaxAttempts < 0 {
+			return fmt.Errorf("%s.hedge values cannot be negative", idx)
+		}
+		if r.Hedge.MaxAttempts > 1 && r.Hedge.DelayMs == 0 {
+			return fmt.Errorf("%s.hedge.delay_ms must be > 0 when hedge.max_attempts > 1", idx)
+		}
+
+		if r.Concurrency.MaxWaitMs < 0 {
+			return fmt.Errorf("%s.concurrency.max_wait_ms cannot be negative", idx)
+		}
+		switch r.Concurrency.Mode {
+		case "":
+		case "reject":
+			if r.Concurrency.MaxWaitMs > 0 {
+				return fmt.Errorf("%s.concurrency.max_wait_ms cannot be used with mode reject", idx)
+			}
+		case "queue":
+			if r.Concurrency.MaxWaitMs == 0 {
+				return fmt.Errorf("%s.concurrency.mode queue needs max_wait_ms", idx)
+			}
+		default:
+			return fmt.Errorf("%s.concurrency.mode must be 'reject' or 'queue'", idx)
+		}
+		if r.Concurrency.PerSubjectMax < 0 {
+			return fmt.Errorf("%s.concurrency.per_subject_max cannot be negative", idx)
+		}
+		if r.Concurrency.RetryAfterSeconds < 0 {
+			return fmt.Errorf("%s.concurrency.retry_after_seconds cannot be negative", idx)
+		}
+		if (r.ClientCert.Auth || len(r.ClientCert.AllowedSubjects) > 0) && cfg.Server.TLS.ClientCAFile == "" {
+			return fmt.Errorf("%s.client_cert needs server.tls.client_ca_file", idx)
+		}
+		ac, ok := cfg.RouteAuth(r)
+		if ok {
+			if err := validateAuth(idx+".auth", ac, cfg.Server.TLS); err != nil {
+				return err
+			}
+		}
+		if (len(r.Auth.Audiences) > 0 || len(r.Auth.Issuers) > 0) && !strings.EqualFold(ac.Mode, "jwks") {
+			return fmt.Errorf("%s.auth.audiences and issuers need jwks auth", idx)
+		}
+		if r.Chaos.DelayMs < 0 {
+			return fmt.Errorf("%s.chaos.delay_ms cannot be negative", idx)
+		}
+		if r.Chaos.ErrorPercent < 0 || r.Chaos.ErrorPercent > 100 {
+			return fmt.Errorf("%s.chaos.error_percent must be between 0 and 100", idx)
+		}
+		if s := r.Chaos.ErrorStatus; s != 0 && (s < 400 || s > 599) {
+			return fmt.Errorf("%s.chaos.error_status must be a 4xx or 5xx status", idx)
+		}
+		if r.AccessLog.SampleEvery < 0 {
+			return fmt.Errorf("%s.access_log.sample_every cannot be negative", idx)
+		}
+		if r.Quota.Daily < 0 {
+			return fmt.Errorf("%s.quota.daily cannot be negative", idx)
+		}
+
+		for _, m := range r.CircuitBreaker.OpenMethods {
+			if strings.TrimSpace(m) == "" {
+				return fmt.Errorf("%s.circuit_breaker.open_methods cannot contain empty entries", idx)
+			}
+		}
+		for _, m := range r.CircuitBreaker.IgnoreMethods {
+			if strings.TrimSpace(m) == "" {
+				return fmt.Errorf("%s.circuit_breaker.ignore_methods cannot contain empty entries", idx)
+			}
+		}
+		for _, p := range r.CircuitBreaker.IgnorePaths {
+			if !strings.HasPrefix(p, "/") {
+				return fmt.Errorf("%s.circuit_breaker.ignore_paths entries must start with '/'", idx)
+			}
+		}
+		if u := r.CircuitBreaker.OnChangeURL; u != "" {
+			pu, err := url.Parse(u)
+			if err != nil || (pu.Scheme != "http" && pu.Scheme != "https") || pu.Host == "" {
+				return fmt.Errorf("%s.circuit_breaker.on_change_url must be an absolute http(s) URL", idx)
+			}
+		}
+		if r.CircuitBreaker.HalfOpenSuccessThreshold < 0 {
+			return fmt.Errorf("%s.circuit_breaker.half_open_success_threshold cannot be negative", idx)
+		}
+		ignored := map[int]bool{}
+		for _, s := range r.CircuitBreaker.IgnoreStatuses {
+			if s < 100 || s > 599 {
+				return fmt.Errorf("%s.circuit_breaker.ignore_statuses entries must be HTTP statuses, got %d", idx, s)
+			}
+			ignored[s] = true
+		}
+		for _, s := range r.CircuitBreaker.FailureStatuses {
+			if s < 100 || s > 599 {
+				return fmt.Errorf("%s.circuit_breaker.failure_statuses entries must be HTTP statuses, got %d", idx, s)
+			}
+			if ignored[s] {
+				return fmt.Errorf("%s.circuit_breaker: status %d is in both ignore_statuses and failure_statuses", idx, s)
+			}
+		}
+		if fb := r.CircuitBreaker.Fallback; fb.Upstream != "" {
+			if fb.Status != 0 || fb.ContentType != "" || fb.Body != "" {
+				return fmt.Errorf("%s.circuit_breaker.fallback takes either upstream or a static status/body, not both", idx)
+			}
+			if err := validateUpstreamURL(fb.Upstream); err != nil {
+				return fmt.Errorf("%s.circuit_breaker.fallback.upstream invalid: %w", idx, err)
+			}
+		} else if fb.Status != 0 && (fb.Status < 200 || fb.Status > 599) {
+			return fmt.Errorf("%s.circuit_breaker.fallback.status must be between 200 and 599", idx)
 		}
 	}
 
@@ -229,23 +1058,122 @@ func Validate(cfg *Config) error {
 	if backend == "redis" && strings.TrimSpace(cfg.RateLimit.Redis.Addr) == "" {
 		return fmt.Errorf("rate_limit.redis.addr is required when backend is redis")
 	}
+	for name, v := range map[string]int{
+		"upstream.dial_timeout_seconds":            cfg.Upstream.DialTimeoutSeconds,
+		"upstream.tls_handshake_timeout_seconds":   cfg.Upstream.TLSHandshakeTimeoutSeconds,
+		"upstream.response_header_timeout_seconds": cfg.Upstream.ResponseHeaderTimeoutSeconds,
+		"upstream.idle_conn_timeout_seconds":       cfg.Upstream.IdleConnTimeoutSeconds,
+		"upstream.max_idle_conns":                  cfg.Upstream.MaxIdleConns,
+		"upstream.max_idle_conns_per_host":         cfg.Upstream.MaxIdleConnsPerHost,
+		"upstream.total_timeout_seconds":           cfg.Upstream.TotalTimeoutSeconds,
+	} {
+		if v < 0 {
+			return fmt.Errorf("%s cannot be negative", name)
+		}
+	}
+	for name, v := range map[string]int{
+		"upstream.errors.timeout_status": cfg.Upstream.Errors.TimeoutStatus,
+		"upstream.errors.dial_status":    cfg.Upstream.Errors.DialStatus,
+	} {
+		if v != 0 && (v < 500 || v > 599) {
+			return fmt.Errorf("%s must be a 5xx status", name)
+		}
+	}
+	id := cfg.Upstream.Identity
+	if strings.ContainsAny(id.ViaName, " \t,") {
+		return fmt.Errorf("upstream.identity.via_name cannot contain spaces or commas")
+	}
+	for name, v := range map[string]string{
+		"upstream.identity.via_name":          id.ViaName,
+		"upstream.identity.user_agent_suffix": id.UserAgentSuffix,
+		"upstream.identity.instance_id":       id.InstanceID,
+	} {
+		if !httpguts.ValidHeaderFieldValue(v) {
+			return fmt.Errorf("%s is not a valid header value", name)
+		}
+	}
 	if cfg.Auth.Mode != "" {
-		mode := strings.ToLower(strings.TrimSpace(cfg.Auth.Mode))
-		switch mode {
-		case "hmac":
-			if strings.TrimSpace(cfg.Auth.HMACSecret) == "" {
-				return fmt.Errorf("auth.hmac_secret is required when auth.mode is hmac")
-			}
-		case "jwks":
-			if strings.TrimSpace(cfg.Auth.JWKS.URL) == "" {
-				return fmt.Errorf("auth.jwks.url is required when auth.mode is jwks")
+		if err := validateAuth("auth", cfg.Auth, cfg.Server.TLS); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// validateUpstreamURL parses an upstream URL; unix:///path/to.sock names a
+// Unix domain socket and needs an absolute socket path.
+func validateUpstreamURL(raw string) error {
+	u, err := url.Parse(raw)
+	if err != nil {
+		return err
+	}
+	if u.Scheme == "unix" && (u.Host != "" || !strings.HasPrefix(u.Path, "/")) {
+		return fmt.Errorf("unix upstreams take the form unix:///path/to/app.sock")
+	}
+	return nil
+}
+
+// validateAuth checks an auth block's mode and the settings that mode needs.
+func validateAuth(prefix string, ac AuthConfig, tc ServerTLSConfig) error {
+	switch strings.ToLower(strings.TrimSpace(ac.Mode)) {
+	case "hmac":
+		if strings.TrimSpace(ac.HMACSecret) == "" && len(ac.HMACSecrets) == 0 {
+			return fmt.Errorf("%s.hmac_secret or %s.hmac_secrets is required when %s.mode is hmac", prefix, prefix, prefix)
+		}
+		for _, s := range ac.HMACSecrets {
+			if strings.TrimSpace(s) == "" {
+				return fmt.Errorf("%s.hmac_secrets cannot contain empty secrets", prefix)
 			}
-			if _, err := url.Parse(cfg.Auth.JWKS.URL); err != nil {
-				return fmt.Errorf("auth.jwks.url invalid: %v", err)
+		}
+		for _, alg := range ac.HMACAlgs {
+			switch alg {
+			case "HS256", "HS384", "HS512":
+			default:
+				return fmt.Errorf("%s.hmac_algs: %q is not one of HS256, HS384, HS512", prefix, alg)
 			}
+		}
+	case "jwks":
+		if strings.TrimSpace(ac.JWKS.URL) == "" {
+			return fmt.Errorf("%s.jwks.url is required when %s.mode is jwks", prefix, prefix)
+		}
+		if _, err := url.Parse(ac.JWKS.URL); err != nil {
+			return fmt.Errorf("%s.jwks.url invalid: %v", prefix, err)
+		}
+		if ac.JWKS.ValidationCacheSize < 0 {
+			return fmt.Errorf("%s.jwks.validation_cache_size cannot be negative", prefix)
+		}
+	case "mtls":
+		if tc.ClientCAFile == "" {
+			return fmt.Errorf("%s.mode mtls needs server.tls.client_ca_file", prefix)
+		}
+		switch ac.MTLS.Subject {
+		case "", "cn", "san":
 		default:
-			return fmt.Errorf("auth.mode must be 'hmac' or 'jwks'")
+			return fmt.Errorf("%s.mtls.subject must be 'cn' or 'san'", prefix)
 		}
+	default:
+		return fmt.Errorf("%s.mode must be 'hmac', 'jwks' or 'mtls'", prefix)
+	}
+	return nil
+}
+
+// ValidatePrecedence checks that p is empty (use the default) or a permutation of DefaultPrecedence.
+func ValidatePrecedence(p []string) error {
+	if len(p) == 0 {
+		return nil
+	}
+	seen := map[string]bool{}
+	for _, st := range p {
+		if st != StageAuth && st != StageRateLimit {
+			return fmt.Errorf("server.precedence: unknown stage %q (allowed: %s)", st, strings.Join(DefaultPrecedence, ", "))
+		}
+		if seen[st] {
+			return fmt.Errorf("server.precedence: duplicate stage %q", st)
+		}
+		seen[st] = true
+	}
+	if len(seen) != len(DefaultPrecedence) {
+		return fmt.Errorf("server.precedence must list each of: %s", strings.Join(DefaultPrecedence, ", "))
 	}
 	return nil
 }
@@ -0,0 +1,88 @@
+package config
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestLoadExampleConfig(t *testing.T) {
+	// The shipped example backs make run and the quickstart; it must load
+	// with no environment set up.
+	if _, err := Load("../../config/config.example.yaml"); err != nil {
+		t.Fatalf("config.example.yaml: %v", err)
+	}
+}
+
+func TestValidateRouteAuthOverride(t *testing.T) {
+	newCfg := func(ra RouteAuthConfig) *Config {
+		return &Config{
+			RateLimit: RateLimitBackend{Backend: "memory"},
+			Auth:      AuthConfig{Mode: "hmac", HMACSecret: "s", JWKS: JWKSAuthConfig{CacheTTLSeconds: 300}},
+			Routes: []RouteConfig{{
+				Name: "public", Match: MatchConfig{PathPrefix: "/p/"}, Upstream: "http://127.0.0.1:9001", Auth: ra,
+			}},
+		}
+	}
+
+	if err := Validate(newCfg(RouteAuthConfig{Mode: "jwks", JWKS: JWKSAuthConfig{URL: "https://idp.example.com/jwks"}})); err != nil {
+		t.Fatalf("expected a valid jwks override, got %v", err)
+	}
+	err := Validate(newCfg(RouteAuthConfig{Mode: "jwks"}))
+	if err == nil || !strings.Contains(err.Error(), "routes[0].auth.jwks.url is required") {
+		t.Fatalf("expected a route-scoped jwks.url error, got %v", err)
+	}
+	err = Validate(newCfg(RouteAuthConfig{Mode: "saml"}))
+	if err == nil || !strings.Contains(err.Error(), "routes[0].auth.mode") {
+		t.Fatalf("expected a route-scoped mode error, got %v", err)
+	}
+
+	cfg := newCfg(RouteAuthConfig{Mode: "jwks", JWKS: JWKSAuthConfig{URL: "https://idp.example.com/jwks"}})
+	ac, ok := cfg.RouteAuth(cfg.Routes[0])
+	if !ok || ac.JWKS.CacheTTLSeconds != 300 || ac.HMACSecret != "" {
+		t.Fatalf("expected the override to inherit global JWKS defaults only, got %+v", ac)
+	}
+}
+
+func TestValidateMTLSAuth(t *testing.T) {
+	cfg := &Config{
+		RateLimit: RateLimitBackend{Backend: "memory"},
+		Auth:      AuthConfig{Mode: "mtls", MTLS: MTLSAuthConfig{Subject: "san"}},
+		Routes: []RouteConfig{{
+			Name: "internal", Match: MatchConfig{PathPrefix: "/i/"}, Upstream: "http://127.0.0.1:9001",
+		}},
+	}
+	err := Validate(cfg)
+	if err == nil || !strings.Contains(err.Error(), "server.tls.client_ca_file") {
+		t.Fatalf("expected mtls to require a client CA, got %v", err)
+	}
+
+	cfg.Server.TLS = ServerTLSConfig{CertFile: "c.pem", KeyFile: "k.pem", ClientCAFile: "ca.pem", ClientAuth: "verify_if_given"}
+	if err := Validate(cfg); err != nil {
+		t.Fatalf("expected a valid mtls config, got %v", err)
+	}
+	cfg.Auth.MTLS.Subject = "ou"
+	if err := Validate(cfg); err == nil || !strings.Contains(err.Error(), "auth.mtls.subject") {
+		t.Fatalf("expected a subject error, got %v", err)
+	}
+}
+
+func TestValidateRateLimitTiersNeedAuthFirst(t *testing.T) {
+	cfg := &Config{
+		RateLimit: RateLimitBackend{Backend: "memory"},
+		Auth:      AuthConfig{Mode: "hmac", HMACSecret: "s", TierClaim: "tier"},
+		Routes: []RouteConfig{{
+			Name: "api", Match: MatchConfig{PathPrefix: "/api/"}, Upstream: "http://127.0.0.1:9001",
+			RateLimit: RouteRLConfig{
+				Enabled: true, RPS: 1, Burst: 1, Scope: "user",
+				Tiers: map[string]RateLimitTierConfig{"gold": {RPS: 10, Burst: 10}},
+			},
+		}},
+	}
+	if err := Validate(cfg); err != nil {
+		t.Fatalf("expected tiers under the default precedence to be valid, got %v", err)
+	}
+	cfg.Server.Precedence = []string{StageRateLimit, StageAuth}
+	if err := Validate(cfg); err == nil || !strings.Contains(err.Error(), "routes[0].rate_limit.tiers") {
+		t.Fatalf("expected tiers to be rejected when rate limiting runs before auth, got %v", err)
+	}
+}
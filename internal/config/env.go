@@ -0,0 +1,102 @@
+package config
+
+import (
+	"fmt"
+	"strings"
+)
+
+// expandEnv replaces ${NAME} and ${NAME:-default} with values from lookup;
+// the default is used when NAME is unset or empty. "$$" is a literal "$"
+// and any other "$" is left alone. Every referenced variable that is unset
+// without a default is reported in one error.
+//
+// YAML comments are copied untouched. Values are inserted verbatim, so a
+// reference whose value may hold YAML syntax (" #", ": ") must be quoted.
+func expandEnv(s string, lookup func(string) (string, bool)) (string, error) {
+	var b strings.Builder
+	var missing []string
+	var quote byte // open ' or " on the current line
+	comment := false
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		var prev byte = '\n'
+		if i > 0 {
+			prev = s[i-1]
+		}
+		switch {
+		case c == '\n':
+			quote, comment = 0, false
+		case comment:
+		case quote == '"' && c == '\\' && i+1 < len(s):
+			// Keep an escaped character, \" included, inside the string.
+			b.WriteByte(c)
+			i++
+			c = s[i]
+		case quote == '\'' && c == '\'' && i+1 < len(s) && s[i+1] == '\'':
+			// '' is an escaped quote inside a single-quoted string.
+			b.WriteByte(c)
+			i++
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			}
+		case c == '\'' || c == '"':
+			// ":" opens a value in compact JSON such as {"a":"b"}.
+			if strings.IndexByte(" \t\n[{,:", prev) >= 0 {
+				quote = c
+			}
+		case c == '#':
+			comment = strings.IndexByte(" \t\n", prev) >= 0
+		}
+		if comment || c != '$' || i+1 == len(s) {
+			b.WriteByte(c)
+			continue
+		}
+		switch s[i+1] {
+		case '$':
+			b.WriteByte('$')
+			i++
+		case '{':
+			end := strings.IndexByte(s[i+2:], '}')
+			if end < 0 {
+				return "", fmt.Errorf("unterminated ${ in config")
+			}
+			expr := s[i+2 : i+2+end]
+			name, def, hasDef := strings.Cut(expr, ":-")
+			if !validEnvName(name) {
+				return "", fmt.Errorf("invalid variable reference ${%s} in config", expr)
+			}
+			v, ok := lookup(name)
+			switch {
+			case ok && v != "":
+			case hasDef:
+				v = def
+			case !ok:
+				missing = append(missing, name)
+			}
+			b.WriteString(v)
+			i += 2 + end
+		default:
+			b.WriteByte('$')
+		}
+	}
+	if len(missing) > 0 {
+		return "", fmt.Errorf("config references unset environment variables without defaults: %s", strings.Join(missing, ", "))
+	}
+	return b.String(), nil
+}
+
+func validEnvName(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		switch {
+		case c == '_', c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z':
+		case c >= '0' && c <= '9' && i > 0:
+		default:
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,61 @@
+package config
+
+import (
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func TestExpandEnv(t *testing.T) {
+	env := map[string]string{"SECRET": "s3cr3t", "EMPTY": ""}
+	lookup := func(k string) (string, bool) {
+		v, ok := env[k]
+		return v, ok
+	}
+
+	cases := []struct{ in, want string }{
+		{`hmac_secret: "${SECRET}"`, `hmac_secret: "s3cr3t"`},
+		{`addr: "${REDIS_ADDR:-127.0.0.1:6379}"`, `addr: "127.0.0.1:6379"`},
+		{`password: "${EMPTY:-fallback}"`, `password: "fallback"`},
+		{`password: "${EMPTY}"`, `password: ""`},
+		{`price: "$$5 and $HOME"`, `price: "$5 and $HOME"`},
+		{`literal: "$${SECRET}"`, `literal: "${SECRET}"`},
+		{"# hmac_secret: \"${UNSET}\"\na: ${SECRET}", "# hmac_secret: \"${UNSET}\"\na: s3cr3t"},
+		{`a: "${SECRET}" # was ${UNSET}`, `a: "s3cr3t" # was ${UNSET}`},
+		{`a: "x # ${SECRET}"`, `a: "x # s3cr3t"`},
+		{`a: 'it''s # ${SECRET}'`, `a: 'it''s # s3cr3t'`},
+		{`a: "say \"hi\" # ${SECRET}"`, `a: "say \"hi\" # s3cr3t"`},
+		{`a: x#${SECRET}`, `a: x#s3cr3t`},
+		{`{"hmac_secret":"a #${SECRET}"}`, `{"hmac_secret":"a #s3cr3t"}`},
+	}
+	for _, c := range cases {
+		got, err := expandEnv(c.in, lookup)
+		if err != nil || got != c.want {
+			t.Errorf("expandEnv(%q) = %q, %v; want %q", c.in, got, err, c.want)
+		}
+	}
+
+	_, err := expandEnv(`a: ${MISSING_A}
+b: ${MISSING_B}`, lookup)
+	if err == nil || !strings.Contains(err.Error(), "MISSING_A, MISSING_B") {
+		t.Fatalf("expected both unset variables in the error, got %v", err)
+	}
+	if _, err := expandEnv(`a: ${SECRET`, lookup); err == nil {
+		t.Fatal("expected an error for an unterminated reference")
+	}
+}
+
+func TestExpandEnvQuotedValueKeepsYAMLSyntax(t *testing.T) {
+	lookup := func(string) (string, bool) { return "pa #ss: word", true }
+	for _, in := range []string{`secret: "${SECRET}"`, `secret: '${SECRET}'`} {
+		out, err := expandEnv(in, lookup)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var v struct{ Secret string }
+		if err := yaml.Unmarshal([]byte(out), &v); err != nil || v.Secret != "pa #ss: word" {
+			t.Fatalf("%s: expected the whole value to survive, got %q, %v", in, v.Secret, err)
+		}
+	}
+}
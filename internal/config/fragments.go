@@ -0,0 +1,167 @@
+package config
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+// Base file names looked up in a config directory or among glob matches.
+var baseConfigNames = []string{"config.yaml", "config.yml", "config.json"}
+
+// readConfigFile expands environment variables in path and unmarshals it
+// into v. Files ending in .json must be strict JSON; they are checked with
+// encoding/json (for line/column errors) and then decoded through yaml, of
+// which JSON is a subset, so the yaml tags on Config apply to both.
+func readConfigFile(path string, v any) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	expanded, err := expandEnv(string(b), os.LookupEnv)
+	if err != nil {
+		return err
+	}
+	if strings.EqualFold(filepath.Ext(path), ".json") {
+		if err := checkJSON([]byte(expanded)); err != nil {
+			return err
+		}
+	}
+	return yaml.Unmarshal([]byte(expanded), v)
+}
+
+// checkJSON reports the first JSON syntax error in b with its line and column.
+func checkJSON(b []byte) error {
+	var v any
+	err := json.Unmarshal(b, &v)
+	if err == nil {
+		return nil
+	}
+	var syn *json.SyntaxError
+	if !errors.As(err, &syn) {
+		return fmt.Errorf("json: %w", err)
+	}
+	// Offset counts the offending byte; point at it rather than past it.
+	line, col := lineCol(b, syn.Offset-1)
+	return fmt.Errorf("json: line %d, column %d: %w", line, col, err)
+}
+
+// lineCol converts a byte offset into 1-based line and column numbers.
+func lineCol(b []byte, offset int64) (line, col int) {
+	offset = max(0, min(offset, int64(len(b))))
+	line, col = 1, 1
+	for _, c := range b[:offset] {
+		if c == '\n' {
+			line++
+			col = 1
+		} else {
+			col++
+		}
+	}
+	return line, col
+}
+
+// isMultiPath reports whether path is a directory or a glob pattern.
+func isMultiPath(path string) bool {
+	if strings.ContainsAny(path, "*?[") {
+		return true
+	}
+	fi, err := os.Stat(path)
+	return err == nil && fi.IsDir()
+}
+
+// loadFragments merges a base config with route fragments into cfg.
+//
+// A directory holds the base as config.yaml (or config.yml, config.json) and fragments
+// as routes/*.yaml (or *.yml, *.json). A glob must match exactly one base file by
+// those names; every other match is a fragment. Fragments may only contain
+// a top-level routes list, which is appended in file-name order; everything
+// else comes from the base. Route names must be unique across all files.
+func loadFragments(path string, cfg *Config) error {
+	base, fragments, err := fragmentFiles(path)
+	if err != nil {
+		return err
+	}
+	if err := readConfigFile(base, cfg); err != nil {
+		return fmt.Errorf("%s: %w", base, err)
+	}
+
+	origin := map[string]string{}
+	for _, r := range cfg.Routes {
+		origin[r.Name] = base
+	}
+	for _, f := range fragments {
+		var keys map[string]yaml.Node
+		if err := readConfigFile(f, &keys); err != nil {
+			return fmt.Errorf("%s: %w", f, err)
+		}
+		for k := range keys {
+			if k != "routes" {
+				return fmt.Errorf("%s: route fragments may only contain 'routes', found %q", f, k)
+			}
+		}
+		var frag struct {
+			Routes []RouteConfig `yaml:"routes"`
+		}
+		if err := readConfigFile(f, &frag); err != nil {
+			return fmt.Errorf("%s: %w", f, err)
+		}
+		for _, r := range frag.Routes {
+			if prev, ok := origin[r.Name]; ok && r.Name != "" {
+				return fmt.Errorf("duplicate route name %q in %s (already defined in %s)", r.Name, f, prev)
+			}
+			origin[r.Name] = f
+		}
+		cfg.Routes = append(cfg.Routes, frag.Routes...)
+	}
+	return nil
+}
+
+// fragmentFiles resolves path into the base file and sorted fragment files.
+func fragmentFiles(path string) (base string, fragments []string, err error) {
+	var candidates []string
+	if fi, statErr := os.Stat(path); statErr == nil && fi.IsDir() {
+		for _, name := range baseConfigNames {
+			candidates = append(candidates, filepath.Join(path, name))
+		}
+		for _, ext := range []string{"*.yaml", "*.yml", "*.json"} {
+			m, _ := filepath.Glob(filepath.Join(path, "routes", ext))
+			candidates = append(candidates, m...)
+		}
+	} else {
+		if candidates, err = filepath.Glob(path); err != nil {
+			return "", nil, fmt.Errorf("config glob %q: %w", path, err)
+		}
+	}
+
+	for _, c := range candidates {
+		isBase := false
+		for _, name := range baseConfigNames {
+			isBase = isBase || filepath.Base(c) == name
+		}
+		switch {
+		case !isBase:
+			fragments = append(fragments, c)
+		case fileExists(c) && base != "":
+			return "", nil, fmt.Errorf("config %q: both %s and %s look like the base config", path, base, c)
+		case fileExists(c):
+			base = c
+		}
+	}
+	if base == "" {
+		return "", nil, fmt.Errorf("config %q: no base config (%s) found", path, strings.Join(baseConfigNames, " or "))
+	}
+	sort.Strings(fragments)
+	return base, fragments, nil
+}
+
+func fileExists(path string) bool {
+	fi, err := os.Stat(path)
+	return err == nil && !fi.IsDir()
+}
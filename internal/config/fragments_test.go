@@ -0,0 +1,107 @@
+package config
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func writeFile(t *testing.T, path, body string) {
+	t.Helper()
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(body), 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestLoadDirectoryMergesRouteFragments(t *testing.T) {
+	dir := t.TempDir()
+	writeFile(t, filepath.Join(dir, "config.yaml"), `
+server:
+  addr: ":9999"
+rate_limit:
+  backend: memory
+routes:
+  - name: base
+    match: { path_prefix: "/base" }
+    upstream: "http://127.0.0.1:9001"
+`)
+	writeFile(t, filepath.Join(dir, "routes", "b-billing.yaml"), `
+routes:
+  - name: billing
+    match: { path_prefix: "/billing" }
+    upstream: "http://127.0.0.1:9003"
+`)
+	writeFile(t, filepath.Join(dir, "routes", "a-users.yml"), `
+routes:
+  - name: users
+    match: { path_prefix: "/users" }
+    upstream: "http://127.0.0.1:9002"
+`)
+
+	cfg, err := Load(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Server.Addr != ":9999" {
+		t.Fatalf("server block should come from the base file, got addr %q", cfg.Server.Addr)
+	}
+	var names []string
+	for _, r := range cfg.Routes {
+		names = append(names, r.Name)
+	}
+	if got := strings.Join(names, ","); got != "base,users,billing" {
+		t.Fatalf("routes = %s, want base,users,billing", got)
+	}
+
+	glob, err := Load(filepath.Join(dir, "*", "*.y*ml"))
+	if err == nil || !strings.Contains(err.Error(), "no base config") {
+		t.Fatalf("glob without a base file should fail, got %v, %v", glob, err)
+	}
+
+	writeFile(t, filepath.Join(dir, "routes", "c-dup.yaml"), `
+routes:
+  - name: users
+    match: { path_prefix: "/users2" }
+    upstream: "http://127.0.0.1:9004"
+`)
+	_, err = Load(dir)
+	if err == nil || !strings.Contains(err.Error(), "c-dup.yaml") || !strings.Contains(err.Error(), "a-users.yml") {
+		t.Fatalf("duplicate error should name both files, got %v", err)
+	}
+	os.Remove(filepath.Join(dir, "routes", "c-dup.yaml"))
+
+	writeFile(t, filepath.Join(dir, "routes", "d-bad.yaml"), "server:\n  addr: \":1\"\n")
+	_, err = Load(dir)
+	if err == nil || !strings.Contains(err.Error(), "d-bad.yaml") {
+		t.Fatalf("non-route keys in a fragment should be rejected, got %v", err)
+	}
+}
+
+func TestLoadJSONConfig(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "gateway.json")
+	writeFile(t, path, `{
+  "server": {"addr": ":9998"},
+  "rate_limit": {"backend": "memory"},
+  "routes": [
+    {"name": "users", "match": {"path_prefix": "/users"}, "upstream": "http://127.0.0.1:9002"}
+  ]
+}`)
+	cfg, err := Load(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Server.Addr != ":9998" || len(cfg.Routes) != 1 || cfg.Routes[0].Name != "users" {
+		t.Fatalf("unexpected config: addr=%q routes=%+v", cfg.Server.Addr, cfg.Routes)
+	}
+
+	writeFile(t, path, "{\n  \"server\": {\"addr\": \":9998\",}\n}")
+	_, err = Load(path)
+	if err == nil || !strings.Contains(err.Error(), "line 2, column 30") {
+		t.Fatalf("expected a JSON syntax error with its position, got %v", err)
+	}
+}
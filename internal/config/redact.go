@@ -0,0 +1,59 @@
+package config
+
+import (
+	"maps"
+	"slices"
+)
+
+// RedactedValue replaces secrets in Redacted output.
+const RedactedValue = "***"
+
+// Redacted returns a copy of c that is safe to show, with every secret value
+// replaced by RedactedValue. New secret fields belong here, nowhere else.
+func (c Config) Redacted() Config {
+	c.Auth = c.Auth.redacted()
+	c.RateLimit.Redis.Password = redact(c.RateLimit.Redis.Password)
+
+	// Exporter headers usually carry an API key.
+	if c.Metrics.OTLP.Headers != nil {
+		h := maps.Clone(c.Metrics.OTLP.Headers)
+		for k, v := range h {
+			h[k] = redact(v)
+		}
+		c.Metrics.OTLP.Headers = h
+	}
+
+	c.Routes = slices.Clone(c.Routes)
+	for i := range c.Routes {
+		r := &c.Routes[i]
+		r.Auth.HMACSecret = redact(r.Auth.HMACSecret)
+		r.Auth.HMACSecrets = redactAll(r.Auth.HMACSecrets)
+		r.CircuitBreaker.OnChangeURL = redact(r.CircuitBreaker.OnChangeURL) // may embed a token
+	}
+	return c
+}
+
+func (a AuthConfig) redacted() AuthConfig {
+	a.HMACSecret = redact(a.HMACSecret)
+	a.HMACSecrets = redactAll(a.HMACSecrets)
+	return a
+}
+
+// redact hides s, keeping "" so unset fields still read as unset.
+func redact(s string) string {
+	if s == "" {
+		return ""
+	}
+	return RedactedValue
+}
+
+func redactAll(ss []string) []string {
+	if ss == nil {
+		return nil
+	}
+	out := make([]string, len(ss))
+	for i, s := range ss {
+		out[i] = redact(s)
+	}
+	return out
+}
@@ -0,0 +1,41 @@
+package config
+
+import "testing"
+
+func TestRedactedHidesSecretsWithoutTouchingTheOriginal(t *testing.T) {
+	cfg := Config{
+		Auth:      AuthConfig{Mode: "hmac", HMACSecret: "s1", HMACSecrets: []string{"s2"}},
+		RateLimit: RateLimitBackend{Redis: RedisConfig{Addr: "redis:6379", Password: "pw"}},
+		Metrics:   MetricsConfig{OTLP: OTLPMetricsConfig{Headers: map[string]string{"Authorization": "Bearer x"}}},
+		Routes: []RouteConfig{{
+			Name:           "r",
+			Auth:           RouteAuthConfig{HMACSecret: "s3"},
+			CircuitBreaker: RouteCircuitBreaker{OnChangeURL: "https://hooks.example.com/T0K3N"},
+		}},
+	}
+
+	got := cfg.Redacted()
+	for name, v := range map[string]string{
+		"auth.hmac_secret":                        got.Auth.HMACSecret,
+		"auth.hmac_secrets[0]":                    got.Auth.HMACSecrets[0],
+		"rate_limit.redis.password":               got.RateLimit.Redis.Password,
+		"metrics.otlp.headers.Authorization":      got.Metrics.OTLP.Headers["Authorization"],
+		"routes[0].auth.hmac_secret":              got.Routes[0].Auth.HMACSecret,
+		"routes[0].circuit_breaker.on_change_url": got.Routes[0].CircuitBreaker.OnChangeURL,
+	} {
+		if v != RedactedValue {
+			t.Errorf("%s: expected %q, got %q", name, RedactedValue, v)
+		}
+	}
+	if got.RateLimit.Redis.Addr != "redis:6379" || got.Auth.Mode != "hmac" {
+		t.Fatalf("expected non-secret fields kept, got %+v", got)
+	}
+	if got.Routes[0].Auth.HMACSecrets != nil {
+		t.Fatalf("expected unset secrets to stay unset, got %v", got.Routes[0].Auth.HMACSecrets)
+	}
+
+	if cfg.Auth.HMACSecret != "s1" || cfg.Auth.HMACSecrets[0] != "s2" || cfg.Routes[0].Auth.HMACSecret != "s3" ||
+		cfg.Metrics.OTLP.Headers["Authorization"] != "Bearer x" {
+		t.Fatal("Redacted modified the original config")
+	}
+}
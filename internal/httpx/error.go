@@ -0,0 +1,70 @@
+package httpx
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+)
+
+// errorFieldMap renames fields in gateway-generated error bodies; nil keeps them as-is.
+var errorFieldMap atomic.Pointer[map[string]string]
+
+// SetErrorFieldMap configures how WriteError names body fields, e.g.
+// {"error": "code"} to emit {"code": "rate_limited"}. Unmapped fields keep
+// their default name. A nil or empty map restores the defaults.
+func SetErrorFieldMap(m map[string]string) {
+	if len(m) == 0 {
+		errorFieldMap.Store(nil)
+		return
+	}
+	cp := make(map[string]string, len(m))
+	for k, v := range m {
+		cp[k] = v
+	}
+	errorFieldMap.Store(&cp)
+}
+
+// requestIDHeader is the response header WriteError copies into "request_id".
+var requestIDHeader atomic.Pointer[string]
+
+// SetRequestIDHeader names the header the request ID middleware sets on
+// responses; WriteError echoes its value as "request_id". "" uses X-Request-Id.
+func SetRequestIDHeader(name string) {
+	if name == "" {
+		requestIDHeader.Store(nil)
+		return
+	}
+	requestIDHeader.Store(&name)
+}
+
+// WriteError writes a JSON error body {"error": code, ...fields} with the
+// given status, applying the configured field map. When the response already
+// carries a request ID header, the body gets it as "request_id".
+func WriteError(w http.ResponseWriter, status int, code string, fields map[string]any) {
+	body := make(map[string]any, len(fields)+1)
+	fm := errorFieldMap.Load()
+	name := func(k string) string {
+		if fm != nil {
+			if n, ok := (*fm)[k]; ok {
+				return n
+			}
+		}
+		return k
+	}
+	for k, v := range fields {
+		body[name(k)] = v
+	}
+	body[name("error")] = code
+	if _, ok := fields["request_id"]; !ok {
+		hdr := "X-Request-Id"
+		if p := requestIDHeader.Load(); p != nil {
+			hdr = *p
+		}
+		if rid := w.Header().Get(hdr); rid != "" {
+			body[name("request_id")] = rid
+		}
+	}
+
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(body)
+}
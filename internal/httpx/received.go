@@ -0,0 +1,23 @@
+package httpx
+
+import (
+	"context"
+	"net/http"
+	"time"
+)
+
+type receivedKey struct{}
+
+// StampReceived records when each request reached the gateway, before any
+// other middleware runs. ReceivedAt reads it back.
+func StampReceived(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), receivedKey{}, time.Now())))
+	})
+}
+
+// ReceivedAt returns the time StampReceived recorded; false outside it.
+func ReceivedAt(ctx context.Context) (time.Time, bool) {
+	t, ok := ctx.Value(receivedKey{}).(time.Time)
+	return t, ok
+}
@@ -2,6 +2,10 @@ package httpx
 
 import "net/http"
 
+// StatusClientClosedRequest (nginx's 499) is recorded when the client went
+// away before the response was written. The client never sees it.
+const StatusClientClosedRequest = 499
+
 type StatusWriter struct {
 	http.ResponseWriter
 	Status int
@@ -21,3 +25,7 @@ func (w *StatusWriter) Write(p []byte) (int, error) {
 	w.Bytes += n
 	return n, err
 }
+
+// Unwrap lets http.ResponseController reach the underlying writer, so
+// flushes (gRPC and other streamed responses) get through.
+func (w *StatusWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
@@ -0,0 +1,152 @@
+package logging
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CombinedHandler writes access log records (remote, method, path, proto,
+// status and bytes attributes) as Apache combined log lines. Referer and
+// User-Agent come from a "headers" group when those headers are logged,
+// otherwise "-". Every other attribute is appended as logfmt key=value so
+// no field is lost. Records missing the access fields are written as logfmt.
+type CombinedHandler struct {
+	mu    *sync.Mutex
+	w     io.Writer
+	attrs []slog.Attr
+	group string
+}
+
+func NewCombinedHandler(w io.Writer) *CombinedHandler {
+	return &CombinedHandler{mu: &sync.Mutex{}, w: w}
+}
+
+func (h *CombinedHandler) Enabled(_ context.Context, l slog.Level) bool {
+	return l >= slog.LevelInfo
+}
+
+func (h *CombinedHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	h2 := *h
+	h2.attrs = append(append([]slog.Attr(nil), h.attrs...), h.prefixed(attrs)...)
+	return &h2
+}
+
+func (h *CombinedHandler) WithGroup(name string) slog.Handler {
+	h2 := *h
+	h2.group = h.group + name + "."
+	return &h2
+}
+
+func (h *CombinedHandler) prefixed(attrs []slog.Attr) []slog.Attr {
+	if h.group == "" {
+		return attrs
+	}
+	out := make([]slog.Attr, len(attrs))
+	for i, a := range attrs {
+		out[i] = slog.Attr{Key: h.group + a.Key, Value: a.Value}
+	}
+	return out
+}
+
+func (h *CombinedHandler) Handle(_ context.Context, r slog.Record) error {
+	var attrs []slog.Attr
+	attrs = append(attrs, h.attrs...)
+	var own []slog.Attr
+	r.Attrs(func(a slog.Attr) bool {
+		own = append(own, a)
+		return true
+	})
+	attrs = append(attrs, h.prefixed(own)...)
+
+	// Flatten groups into dotted keys.
+	fields := map[string]string{}
+	var order []string
+	var flatten func(prefix string, as []slog.Attr)
+	flatten = func(prefix string, as []slog.Attr) {
+		for _, a := range as {
+			v := a.Value.Resolve()
+			if v.Kind() == slog.KindGroup {
+				flatten(prefix+a.Key+".", v.Group())
+				continue
+			}
+			k := prefix + a.Key
+			if _, ok := fields[k]; !ok {
+				order = append(order, k)
+			}
+			fields[k] = v.String()
+		}
+	}
+	flatten("", attrs)
+
+	var b strings.Builder
+	used := map[string]bool{}
+	take := func(k, def string) string {
+		used[k] = true
+		if v, ok := fields[k]; ok && v != "" {
+			return v
+		}
+		return def
+	}
+	if _, ok := fields["method"]; ok {
+		remote := take("remote", "-")
+		if host, _, err := net.SplitHostPort(remote); err == nil {
+			remote = host
+		}
+		fmt.Fprintf(&b, "%s - - [%s] \"%s %s %s\" %s %s %s %s",
+			remote,
+			r.Time.Format("02/Jan/2006:15:04:05 -0700"),
+			escapeRequest(take("method", "-")), escapeRequest(take("path", "-")), escapeRequest(take("proto", "HTTP/1.1")),
+			take("status", "-"), take("bytes", "-"),
+			strconv.Quote(take("headers.Referer", "-")),
+			strconv.Quote(take("headers.User-Agent", "-")),
+		)
+	} else {
+		fmt.Fprintf(&b, "time=%s level=%s msg=%s", r.Time.Format("2006-01-02T15:04:05.000Z07:00"), r.Level, logfmtValue(r.Message))
+	}
+	for _, k := range order {
+		if !used[k] {
+			fmt.Fprintf(&b, " %s=%s", k, logfmtValue(fields[k]))
+		}
+	}
+	b.WriteByte('\n')
+
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	_, err := io.WriteString(h.w, b.String())
+	return err
+}
+
+// escapeRequest escapes quotes, backslashes and control characters the way
+// Apache does, so a decoded path can't end the quoted request field early
+// or forge a log line.
+func escapeRequest(s string) string {
+	if !strings.ContainsFunc(s, func(r rune) bool { return r == '"' || r == '\\' || r < 0x20 || r == 0x7f }) {
+		return s
+	}
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c < 0x20 || c == 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	return b.String()
+}
+
+func logfmtValue(s string) string {
+	if s == "" || strings.ContainsAny(s, " \"=\t\n") {
+		return strconv.Quote(s)
+	}
+	return s
+}
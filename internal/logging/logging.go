@@ -1,11 +1,76 @@
 package logging
 
 import (
+	"errors"
+	"io"
 	"log/slog"
 	"os"
+	"strings"
+
+	"gopkg.in/natefinch/lumberjack.v2"
 )
 
-func New() *slog.Logger {
-	h := slog.NewJSONHandler(os.Stdout, &slog.HandlerOptions{Level: slog.LevelInfo})
-	return slog.New(h)
+// Options selects where logs go. The zero value logs JSON to stdout.
+type Options struct {
+	Output   string // "stdout" (default) | "file"
+	FilePath string
+
+	// Rotation, file output only.
+	MaxSizeMB  int // rotate once the file reaches this size (default 100)
+	MaxAgeDays int // delete rotated files older than this; 0 keeps them
+	MaxBackups int // rotated files to keep; 0 keeps all
+	Compress   bool
+}
+
+// New returns a JSON logger and its output. Callers should close the
+// output on shutdown so a file output is flushed.
+func New(opts Options) (*slog.Logger, io.WriteCloser, error) {
+	var w io.WriteCloser
+	switch strings.ToLower(strings.TrimSpace(opts.Output)) {
+	case "", "stdout":
+		w = nopCloser{os.Stdout}
+	case "file":
+		if opts.FilePath == "" {
+			return nil, nil, errors.New("logging.file_path is required when logging.output is file")
+		}
+		w = &lumberjack.Logger{
+			Filename:   opts.FilePath,
+			MaxSize:    opts.MaxSizeMB,
+			MaxAge:     opts.MaxAgeDays,
+			MaxBackups: opts.MaxBackups,
+			Compress:   opts.Compress,
+		}
+	default:
+		return nil, nil, errors.New("logging.output must be 'stdout' or 'file'")
+	}
+
+	h := slog.NewJSONHandler(w, &slog.HandlerOptions{Level: slog.LevelInfo})
+	return slog.New(h), w, nil
 }
+
+// Log line formats accepted by NewFormat.
+const (
+	FormatJSON     = "json"
+	FormatLogfmt   = "logfmt"
+	FormatCombined = "combined"
+)
+
+// NewFormat returns a logger writing to w as JSON (the default), logfmt, or
+// Apache combined log lines (see CombinedHandler).
+func NewFormat(w io.Writer, format string) (*slog.Logger, error) {
+	opts := &slog.HandlerOptions{Level: slog.LevelInfo}
+	switch strings.ToLower(strings.TrimSpace(format)) {
+	case "", FormatJSON:
+		return slog.New(slog.NewJSONHandler(w, opts)), nil
+	case FormatLogfmt:
+		return slog.New(slog.NewTextHandler(w, opts)), nil
+	case FormatCombined:
+		return slog.New(NewCombinedHandler(w)), nil
+	default:
+		return nil, errors.New("log format must be 'json', 'logfmt' or 'combined'")
+	}
+}
+
+type nopCloser struct{ io.Writer }
+
+func (nopCloser) Close() error { return nil }
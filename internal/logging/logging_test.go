@@ -0,0 +1,106 @@
+package logging
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestNewFileOutputWritesAndRotates(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "apigw.log")
+
+	log, closer, err := New(Options{Output: "file", FilePath: path, MaxSizeMB: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	log.Info("hello")
+	b, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.Contains(string(b), `"msg":"hello"`) {
+		t.Fatalf("expected log line in file, got %q", b)
+	}
+
+	// Push well past the 1 MiB threshold.
+	pad := strings.Repeat("x", 1024)
+	for i := 0; i < 1200; i++ {
+		log.Info("fill", "pad", pad)
+	}
+	if err := closer.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(entries) < 2 {
+		t.Fatalf("expected a rotated backup next to %s, got %d files", path, len(entries))
+	}
+}
+
+func TestNewFileOutputRequiresPath(t *testing.T) {
+	if _, _, err := New(Options{Output: "file"}); err == nil {
+		t.Fatal("expected error without file_path")
+	}
+}
+
+func TestNewFormatAccessLine(t *testing.T) {
+	attrs := []any{
+		slog.String("rid", "rid-1"),
+		slog.String("route", "users"),
+		slog.String("method", "GET"),
+		slog.String("path", "/users/1"),
+		slog.String("proto", "HTTP/1.1"),
+		slog.String("remote", "10.0.0.1:5000"),
+		slog.Int("status", 200),
+		slog.Int("bytes", 42),
+		slog.String("duration", "1.5ms"),
+		slog.Group("headers", slog.String("User-Agent", "curl/8")),
+	}
+	want := map[string][]string{
+		FormatJSON:     {`"rid":"rid-1"`, `"route":"users"`, `"status":200`, `"duration":"1.5ms"`},
+		FormatLogfmt:   {`rid=rid-1`, `route=users`, `status=200`, `duration=1.5ms`, `headers.User-Agent=curl/8`},
+		FormatCombined: {`10.0.0.1 - - [`, `] "GET /users/1 HTTP/1.1" 200 42 "-" "curl/8" `, `rid=rid-1`, `route=users`, `duration=1.5ms`},
+	}
+	for format, parts := range want {
+		var buf bytes.Buffer
+		log, err := NewFormat(&buf, format)
+		if err != nil {
+			t.Fatal(err)
+		}
+		log.Info("http_request", attrs...)
+		for _, p := range parts {
+			if !strings.Contains(buf.String(), p) {
+				t.Errorf("%s: expected %q in %q", format, p, buf.String())
+			}
+		}
+	}
+
+	if _, err := NewFormat(&bytes.Buffer{}, "xml"); err == nil {
+		t.Fatal("expected error for an unknown format")
+	}
+}
+
+func TestCombinedEscapesThePath(t *testing.T) {
+	var buf bytes.Buffer
+	log, _ := NewFormat(&buf, FormatCombined)
+	log.Info("http_request",
+		slog.String("method", "GET"),
+		slog.String("path", "/a\" HTTP/1.1\" 200 0\n10.0.0.9 \\x"),
+		slog.Int("status", 404),
+	)
+	want := `"GET /a\" HTTP/1.1\" 200 0\x0a10.0.0.9 \\x HTTP/1.1" 404 `
+	if !strings.Contains(buf.String(), want) {
+		t.Fatalf("expected %q in %q", want, buf.String())
+	}
+	if strings.Count(buf.String(), "\n") != 1 {
+		t.Fatalf("expected a single log line, got %q", buf.String())
+	}
+}
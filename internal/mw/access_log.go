@@ -1,29 +1,149 @@
 package mw
 
 import (
+	"context"
 	"log/slog"
+	"math/rand/v2"
 	"net/http"
+	"net/url"
+	"strings"
+	"sync/atomic"
 	"time"
 
 	"github.com/3xpluto/go-api-gateway/internal/httpx"
 )
 
+// redacted replaces sensitive header and query values in the access log.
+const redacted = "***"
+
+// Always redacted, whatever AccessLogConfig says.
+var (
+	mandatoryRedactHeaders = []string{"Authorization", "Cookie", "X-API-Key", AdminKeyHeader}
+	mandatoryRedactQuery   = []string{"access_token", "token", "api_key"}
+)
+
+// AccessLogConfig adds optional fields to the access log. The zero value
+// logs the minimal fields only (no headers, path without query).
+type AccessLogConfig struct {
+	Headers       []string // request headers to log
+	RedactHeaders []string // redacted in addition to Authorization, Cookie, X-API-Key, X-Admin-Key
+	Query         bool     // log the query string, with sensitive params scrubbed
+	RedactQuery   []string // params scrubbed in addition to access_token, token, api_key
+
+	// SampleEvery logs about 1 in N 2xx/3xx responses; 4xx/5xx are always
+	// logged. 0 or 1 logs everything.
+	SampleEvery int
+
+	// HeadAsGet logs upstream_method GET for HEAD requests, for routes
+	// that send HEAD upstream as GET.
+	HeadAsGet bool
+
+	// UpstreamAttempts logs upstream_attempts, the number of upstream
+	// attempts RecordUpstreamAttempt saw, for hedged routes.
+	UpstreamAttempts bool
+}
+
+type upstreamAttemptsKey struct{}
+
+// RecordUpstreamAttempt notes that attempt n (1-based) was sent for the
+// request, for the access log line. A no-op unless the access log asked for it.
+func RecordUpstreamAttempt(ctx context.Context, n int) {
+	a, ok := ctx.Value(upstreamAttemptsKey{}).(*atomic.Int32)
+	if !ok {
+		return
+	}
+	for {
+		cur := a.Load()
+		if int32(n) <= cur || a.CompareAndSwap(cur, int32(n)) {
+			return
+		}
+	}
+}
+
 func AccessLog(log *slog.Logger, next http.Handler) http.Handler {
+	return AccessLogWith(log, AccessLogConfig{}, next)
+}
+
+// AccessLogWith is AccessLog with optional header and query logging.
+func AccessLogWith(log *slog.Logger, cfg AccessLogConfig, next http.Handler) http.Handler {
+	redactHeaders := map[string]bool{}
+	for _, h := range append(mandatoryRedactHeaders, cfg.RedactHeaders...) {
+		redactHeaders[http.CanonicalHeaderKey(h)] = true
+	}
+	redactQuery := map[string]bool{}
+	for _, q := range append(mandatoryRedactQuery, cfg.RedactQuery...) {
+		redactQuery[strings.ToLower(q)] = true
+	}
+
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		sw := &httpx.StatusWriter{ResponseWriter: w}
+		var attempts *atomic.Int32
+		if cfg.UpstreamAttempts {
+			attempts = new(atomic.Int32)
+			r = r.WithContext(context.WithValue(r.Context(), upstreamAttemptsKey{}, attempts))
+		}
 		start := time.Now()
 		next.ServeHTTP(sw, r)
 		d := time.Since(start)
 
-		log.Info("http_request",
+		sampled := cfg.SampleEvery > 1 && sw.Status < 400
+		if sampled && rand.IntN(cfg.SampleEvery) != 0 {
+			return
+		}
+
+		attrs := []any{
 			slog.String("rid", RID(r.Context())),
 			slog.String("route", RouteName(r.Context())),
 			slog.String("method", r.Method),
+			// Path only: the query string may carry access tokens and is logged separately, scrubbed.
 			slog.String("path", r.URL.Path),
+			slog.String("proto", r.Proto),
 			slog.String("remote", r.RemoteAddr),
 			slog.Int("status", sw.Status),
 			slog.Int("bytes", sw.Bytes),
 			slog.String("duration", d.String()),
-		)
+		}
+		if cfg.HeadAsGet && r.Method == http.MethodHead {
+			attrs = append(attrs, slog.String("upstream_method", http.MethodGet))
+		}
+		if attempts != nil && attempts.Load() > 0 {
+			attrs = append(attrs, slog.Int("upstream_attempts", int(attempts.Load())))
+		}
+		if cfg.Query && r.URL.RawQuery != "" {
+			attrs = append(attrs, slog.String("query", scrubQuery(r.URL.Query(), redactQuery)))
+		}
+		if len(cfg.Headers) > 0 {
+			hdrs := make([]any, 0, len(cfg.Headers))
+			for _, name := range cfg.Headers {
+				v := r.Header.Get(name)
+				if v == "" {
+					continue
+				}
+				if redactHeaders[http.CanonicalHeaderKey(name)] {
+					v = redacted
+				}
+				hdrs = append(hdrs, slog.String(name, v))
+			}
+			attrs = append(attrs, slog.Group("headers", hdrs...))
+		}
+
+		if sampled {
+			// Lets log consumers scale counts back up.
+			attrs = append(attrs, slog.Int("sample_every", cfg.SampleEvery))
+		}
+
+		log.Info("http_request", attrs...)
 	})
 }
+
+// scrubQuery encodes q with the values of sensitive params replaced.
+func scrubQuery(q url.Values, sensitive map[string]bool) string {
+	for k, vs := range q {
+		if sensitive[strings.ToLower(k)] {
+			for i := range vs {
+				vs[i] = redacted
+			}
+		}
+	}
+	return q.Encode()
+}
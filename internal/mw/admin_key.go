@@ -1,8 +1,9 @@
 package mw
 
 import (
-	"encoding/json"
 	"net/http"
+
+	"github.com/3xpluto/go-api-gateway/internal/httpx"
 )
 
 const AdminKeyHeader = "X-Admin-Key"
@@ -17,8 +18,7 @@ func RequireAdminKey(adminKey string, next http.Handler) http.Handler {
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		if r.Header.Get(AdminKeyHeader) != adminKey {
-			w.WriteHeader(http.StatusUnauthorized)
-			_ = json.NewEncoder(w).Encode(map[string]any{"error": "unauthorized"})
+			httpx.WriteError(w, http.StatusUnauthorized, "unauthorized", nil)
 			return
 		}
 		next.ServeHTTP(w, r)
@@ -4,60 +4,152 @@ import (
 	"context"
 	"errors"
 	"net/http"
+	"slices"
 	"strings"
 
 	"github.com/golang-jwt/jwt/v5"
 )
 
+// ErrNoToken is returned when the request carries no bearer token at all,
+// as opposed to one that fails validation.
+var ErrNoToken = errors.New("missing bearer token")
+
 type subjectKeyType string
 
-const subjectKey subjectKeyType = "sub"
+const (
+	subjectKey subjectKeyType = "sub"
+	tierKey    subjectKeyType = "tier"
+)
+
+// Principal is an authenticated caller.
+type Principal struct {
+	Subject string
+	Tier    string // rate-limit tier from the configured claim; "" when absent
+}
+
+// PrincipalAuthHandler is an AuthHandler that can also report the caller's
+// tier. RequireAuth and friends use it when available.
+type PrincipalAuthHandler interface {
+	AuthHandler
+	Authenticate(r *http.Request) (Principal, error)
+}
+
+// TokenSources controls where a bearer token is read from. The Authorization
+// header is always checked first; Cookie and Query are optional fallbacks for
+// clients that cannot set headers (EventSource, plain download links).
+// The zero value is header-only.
+type TokenSources struct {
+	Cookie string // cookie name, "" disables
+	Query  string // query parameter name, "" disables
+}
+
+// BearerToken returns the raw token from the header, cookie or query, in that order.
+func (s TokenSources) BearerToken(r *http.Request) (string, error) {
+	if authz := r.Header.Get("Authorization"); strings.HasPrefix(authz, "Bearer ") {
+		if tok := strings.TrimSpace(strings.TrimPrefix(authz, "Bearer ")); tok != "" {
+			return tok, nil
+		}
+	}
+	if s.Cookie != "" {
+		if c, err := r.Cookie(s.Cookie); err == nil && c.Value != "" {
+			return c.Value, nil
+		}
+	}
+	if s.Query != "" {
+		if tok := r.URL.Query().Get(s.Query); tok != "" {
+			return tok, nil
+		}
+	}
+	return "", ErrNoToken
+}
 
 type Authenticator struct {
 	Mode       string // "hmac" | "jwks"
 	HMACSecret []byte
 	JWKS       *JWKSValidator
+	Tokens     TokenSources
+	TierClaim  string // hmac mode; jwks mode uses JWKSValidatorOptions.TierClaim
+
+	// HMACAlgs lists the accepted HMAC algorithms (HS256, HS384, HS512); empty means HS256.
+	HMACAlgs []string
+
+	// HMACSecrets are tried after HMACSecret, so tokens signed with a
+	// previous secret keep validating while it is rotated out.
+	HMACSecrets [][]byte
 }
 
 func (a Authenticator) ValidateBearer(r *http.Request) (string, error) {
-	authz := r.Header.Get("Authorization")
-	if authz == "" || !strings.HasPrefix(authz, "Bearer ") {
-		return "", errors.New("missing bearer token")
+	p, err := a.Authenticate(r)
+	return p.Subject, err
+}
+
+func (a Authenticator) Authenticate(r *http.Request) (Principal, error) {
+	tokStr, err := a.Tokens.BearerToken(r)
+	if err != nil {
+		return Principal{}, err
 	}
-	tokStr := strings.TrimSpace(strings.TrimPrefix(authz, "Bearer "))
 
 	switch strings.ToLower(strings.TrimSpace(a.Mode)) {
 	case "jwks":
 		if a.JWKS == nil {
-			return "", errors.New("jwks validator not configured")
+			return Principal{}, errors.New("jwks validator not configured")
 		}
-		return a.JWKS.Validate(r.Context(), tokStr)
+		return a.JWKS.ValidatePrincipal(r.Context(), tokStr)
 	case "hmac", "":
 		return a.validateHMAC(tokStr)
 	default:
-		return "", errors.New("unsupported auth mode")
+		return Principal{}, errors.New("unsupported auth mode")
 	}
 }
 
-func (a Authenticator) validateHMAC(tokStr string) (string, error) {
+func (a Authenticator) validateHMAC(tokStr string) (Principal, error) {
+	algs := a.HMACAlgs
+	if len(algs) == 0 {
+		algs = []string{jwt.SigningMethodHS256.Alg()}
+	}
 	claims := jwt.MapClaims{}
 	parser := jwt.NewParser(
-		jwt.WithValidMethods([]string{jwt.SigningMethodHS256.Alg()}),
+		jwt.WithValidMethods(algs),
 	)
 	tok, err := parser.ParseWithClaims(tokStr, claims, func(token *jwt.Token) (any, error) {
-		if token.Method.Alg() != jwt.SigningMethodHS256.Alg() {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok || !slices.Contains(algs, token.Method.Alg()) {
 			return nil, errors.New("unexpected jwt alg")
 		}
-		return a.HMACSecret, nil
+		return a.hmacKeys(), nil
 	})
 	if err != nil || tok == nil || !tok.Valid {
-		return "", errors.New("invalid token")
+		return Principal{}, errors.New("invalid token")
 	}
 	sub, _ := claims["sub"].(string)
 	if sub == "" {
-		return "", errors.New("missing sub")
+		return Principal{}, errors.New("missing sub")
 	}
-	return sub, nil
+	return Principal{Subject: sub, Tier: claimString(claims, a.TierClaim)}, nil
+}
+
+// hmacKeys returns every accepted secret. jwt tries each in turn; each
+// comparison is constant-time, so only the index of the match can leak.
+func (a Authenticator) hmacKeys() any {
+	if len(a.HMACSecrets) == 0 {
+		return a.HMACSecret
+	}
+	set := jwt.VerificationKeySet{}
+	if len(a.HMACSecret) > 0 {
+		set.Keys = append(set.Keys, a.HMACSecret)
+	}
+	for _, s := range a.HMACSecrets {
+		set.Keys = append(set.Keys, s)
+	}
+	return set
+}
+
+// claimString returns a string claim, or "" when name is empty or the claim is absent.
+func claimString(claims jwt.MapClaims, name string) string {
+	if name == "" {
+		return ""
+	}
+	v, _ := claims[name].(string)
+	return v
 }
 
 func WithSubject(next http.Handler, sub string) http.Handler {
@@ -71,3 +163,19 @@ func Subject(ctx context.Context) (string, bool) {
 	v, ok := ctx.Value(subjectKey).(string)
 	return v, ok
 }
+
+// WithPrincipal is WithSubject that also records the caller's tier, if any.
+func WithPrincipal(next http.Handler, p Principal) http.Handler {
+	if p.Tier == "" {
+		return WithSubject(next, p.Subject)
+	}
+	return WithSubject(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		next.ServeHTTP(w, r.WithContext(context.WithValue(r.Context(), tierKey, p.Tier)))
+	}), p.Subject)
+}
+
+// Tier returns the authenticated caller's tier, if the auth handler reported one.
+func Tier(ctx context.Context) (string, bool) {
+	v, ok := ctx.Value(tierKey).(string)
+	return v, ok
+}
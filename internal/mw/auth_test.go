@@ -0,0 +1,137 @@
+package mw
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/golang-jwt/jwt/v5"
+)
+
+func TestTokenSourcesHeaderOnlyByDefault(t *testing.T) {
+	req := httptest.NewRequest(http.MethodGet, "/x?access_token=q", nil)
+	req.AddCookie(&http.Cookie{Name: "tok", Value: "c"})
+
+	if _, err := (TokenSources{}).BearerToken(req); err == nil {
+		t.Fatal("expected header-only default to ignore cookie and query")
+	}
+}
+
+func TestTokenSourcesPrecedence(t *testing.T) {
+	src := TokenSources{Cookie: "tok", Query: "access_token"}
+
+	req := httptest.NewRequest(http.MethodGet, "/x?access_token=q", nil)
+	req.AddCookie(&http.Cookie{Name: "tok", Value: "c"})
+	req.Header.Set("Authorization", "Bearer h")
+	if got, _ := src.BearerToken(req); got != "h" {
+		t.Fatalf("expected header token first, got %q", got)
+	}
+
+	req.Header.Del("Authorization")
+	if got, _ := src.BearerToken(req); got != "c" {
+		t.Fatalf("expected cookie token second, got %q", got)
+	}
+
+	req = httptest.NewRequest(http.MethodGet, "/x?access_token=q", nil)
+	if got, _ := src.BearerToken(req); got != "q" {
+		t.Fatalf("expected query token last, got %q", got)
+	}
+}
+
+func TestOptionalAuthRejectInvalid(t *testing.T) {
+	auth := Authenticator{Mode: "hmac", HMACSecret: []byte("secret")}
+	h := OptionalAuthRejectInvalid(auth, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := Subject(r.Context()); ok {
+			t.Error("expected anonymous request to carry no subject")
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	rr := httptest.NewRecorder()
+	h.ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rr.Code != http.StatusOK {
+		t.Fatalf("expected missing token to pass anonymously, got %d", rr.Code)
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer not-a-jwt")
+	rr = httptest.NewRecorder()
+	h.ServeHTTP(rr, req)
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected malformed token to get 401, got %d", rr.Code)
+	}
+
+	for _, authz := range []string{"Basic dXNlcjpwYXNz", "Bearer "} {
+		req = httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", authz)
+		rr = httptest.NewRecorder()
+		h.ServeHTTP(rr, req)
+		if rr.Code != http.StatusUnauthorized {
+			t.Fatalf("expected Authorization %q to get 401, got %d", authz, rr.Code)
+		}
+	}
+}
+
+func TestAuthenticatorHMACAlgs(t *testing.T) {
+	secret := []byte("secret")
+	sign := func(m jwt.SigningMethod) string {
+		s, err := jwt.NewWithClaims(m, jwt.MapClaims{"sub": "svc"}).SignedString(secret)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	check := func(a Authenticator, tok string) error {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+tok)
+		_, err := a.Authenticate(req)
+		return err
+	}
+
+	strong := Authenticator{Mode: "hmac", HMACSecret: secret, HMACAlgs: []string{"HS384", "HS512"}}
+	for _, m := range []jwt.SigningMethod{jwt.SigningMethodHS384, jwt.SigningMethodHS512} {
+		if err := check(strong, sign(m)); err != nil {
+			t.Fatalf("expected %s to be accepted, got %v", m.Alg(), err)
+		}
+	}
+	if err := check(strong, sign(jwt.SigningMethodHS256)); err == nil {
+		t.Fatal("expected HS256 to be rejected when not listed")
+	}
+
+	def := Authenticator{Mode: "hmac", HMACSecret: secret}
+	if err := check(def, sign(jwt.SigningMethodHS256)); err != nil {
+		t.Fatalf("expected HS256 by default, got %v", err)
+	}
+	if err := check(def, sign(jwt.SigningMethodHS512)); err == nil {
+		t.Fatal("expected HS512 to be rejected by default")
+	}
+}
+
+func TestAuthenticatorHMACSecretsRotation(t *testing.T) {
+	sign := func(secret string) string {
+		s, err := jwt.NewWithClaims(jwt.SigningMethodHS256, jwt.MapClaims{"sub": "svc"}).SignedString([]byte(secret))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	a := Authenticator{Mode: "hmac", HMACSecret: []byte("new"), HMACSecrets: [][]byte{[]byte("old")}}
+
+	for _, secret := range []string{"new", "old"} {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Header.Set("Authorization", "Bearer "+sign(secret))
+		p, err := a.Authenticate(req)
+		if err != nil {
+			t.Fatalf("token signed with %q: %v", secret, err)
+		}
+		if p.Subject != "svc" {
+			t.Fatalf("expected subject svc, got %q", p.Subject)
+		}
+	}
+
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.Header.Set("Authorization", "Bearer "+sign("unknown"))
+	if _, err := a.Authenticate(req); err == nil {
+		t.Fatal("expected a token signed with an unknown secret to be rejected")
+	}
+}
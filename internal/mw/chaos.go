@@ -0,0 +1,46 @@
+package mw
+
+import (
+	"math/rand/v2"
+	"net/http"
+	"time"
+
+	"github.com/3xpluto/go-api-gateway/internal/httpx"
+)
+
+// ChaosConfig injects latency and failures for resilience testing.
+type ChaosConfig struct {
+	Delay        time.Duration // added before every request
+	ErrorPercent float64       // 0-100 share of requests failed with ErrorStatus
+	ErrorStatus  int           // default 503
+}
+
+// Chaos delays every request by cfg.Delay and fails cfg.ErrorPercent of them
+// with a "chaos_injected" error instead of calling next. A cancelled client
+// stops the delay early.
+func Chaos(cfg ChaosConfig, next http.Handler) http.Handler {
+	if cfg.Delay <= 0 && cfg.ErrorPercent <= 0 {
+		return next
+	}
+	if cfg.ErrorStatus == 0 {
+		cfg.ErrorStatus = http.StatusServiceUnavailable
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if cfg.Delay > 0 {
+			t := time.NewTimer(cfg.Delay)
+			select {
+			case <-t.C:
+			case <-r.Context().Done():
+				t.Stop()
+				return
+			}
+		}
+		if cfg.ErrorPercent > 0 && rand.Float64()*100 < cfg.ErrorPercent {
+			httpx.WriteError(w, cfg.ErrorStatus, "chaos_injected", map[string]any{
+				"route": RouteName(r.Context()),
+			})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,48 @@
+package mw
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestChaosErrorFraction(t *testing.T) {
+	h := Chaos(ChaosConfig{ErrorPercent: 30, ErrorStatus: http.StatusBadGateway}, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	const n = 4000
+	failed := 0
+	for i := 0; i < n; i++ {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		switch rec.Code {
+		case http.StatusBadGateway:
+			failed++
+		case http.StatusOK:
+		default:
+			t.Fatalf("unexpected status %d", rec.Code)
+		}
+	}
+	// 30% of 4000 is 1200; 5 points either way is far outside random noise.
+	if failed < n*25/100 || failed > n*35/100 {
+		t.Fatalf("expected about 30%% failures, got %d/%d", failed, n)
+	}
+}
+
+func TestChaosDelay(t *testing.T) {
+	h := Chaos(ChaosConfig{Delay: 30 * time.Millisecond}, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	start := time.Now()
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if d := time.Since(start); d < 30*time.Millisecond {
+		t.Fatalf("expected at least 30ms delay, got %s", d)
+	}
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected 200 with no error_percent, got %d", rec.Code)
+	}
+}
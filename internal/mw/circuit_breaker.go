@@ -1,9 +1,11 @@
 package mw
 
 import (
-	"encoding/json"
+	"context"
+	"errors"
 	"net/http"
 	"strconv"
+	"strings"
 	"sync"
 	"time"
 
@@ -23,10 +25,42 @@ type BreakerConfig struct {
 	FailureThreshold    int           // consecutive failures to open
 	OpenDuration        time.Duration // how long to stay open
 	HalfOpenMaxInFlight int           // how many trial requests in half-open
+
+	// HalfOpenSuccessThreshold is how many consecutive half-open successes
+	// close the breaker; default 1. Any half-open failure reopens it.
+	HalfOpenSuccessThreshold int
+
+	// OpenMethods limits fast-failing to these HTTP methods while the breaker
+	// rejects; other methods pass through uncounted. Empty rejects every method.
+	OpenMethods []string
+
+	// IgnoreMethods and IgnorePaths (client path prefixes, matched by whole
+	// segments) bypass the breaker entirely: never fast-failed and never
+	// counted as success or failure.
+	IgnoreMethods []string
+	IgnorePaths   []string
+
+	// By default a response counts as a failure when its status is >= 500.
+	// IgnoreStatuses are never failures (e.g. 501); FailureStatuses always
+	// are (e.g. an upstream 429).
+	IgnoreStatuses  []int
+	FailureStatuses []int
+
+	// OnChange is optional and called outside the breaker lock after each state
+	// transition, exactly once per transition: only the request that made the
+	// transition reports it. It may call back into the breaker (e.g. Stats).
+	OnChange func(from, to BreakerState, failures int)
+
+	// Fallback, when set, answers rejected requests instead of 503
+	// circuit_open. Its responses are not counted by the breaker.
+	Fallback http.Handler
 }
 
 type CircuitBreaker struct {
-	cfg BreakerConfig
+	cfg           BreakerConfig
+	openMethods   map[string]struct{}
+	ignoreMethods map[string]struct{}
+	failures      map[int]bool // status -> counts as a failure, overriding >= 500
 
 	mu sync.Mutex
 
@@ -37,6 +71,7 @@ type CircuitBreaker struct {
 
 	// half-open throttling
 	halfInFlight int
+	halfSuccess  int // consecutive successful trials
 }
 
 func NewCircuitBreaker(cfg BreakerConfig) *CircuitBreaker {
@@ -49,10 +84,74 @@ func NewCircuitBreaker(cfg BreakerConfig) *CircuitBreaker {
 	if cfg.HalfOpenMaxInFlight <= 0 {
 		cfg.HalfOpenMaxInFlight = 1
 	}
+	if cfg.HalfOpenSuccessThreshold <= 0 {
+		cfg.HalfOpenSuccessThreshold = 1
+	}
+	failures := map[int]bool{}
+	for _, s := range cfg.IgnoreStatuses {
+		failures[s] = false
+	}
+	for _, s := range cfg.FailureStatuses {
+		failures[s] = true
+	}
 	return &CircuitBreaker{
-		cfg:   cfg,
-		state: BreakerClosed,
+		cfg:           cfg,
+		openMethods:   methodSet(cfg.OpenMethods),
+		ignoreMethods: methodSet(cfg.IgnoreMethods),
+		failures:      failures,
+		state:         BreakerClosed,
+	}
+}
+
+// failed reports whether an upstream status counts against the breaker.
+func (b *CircuitBreaker) failed(status int) bool {
+	if f, ok := b.failures[status]; ok {
+		return f
+	}
+	return status >= 500
+}
+
+// methodSet normalizes methods into a set; nil when empty.
+func methodSet(methods []string) map[string]struct{} {
+	if len(methods) == 0 {
+		return nil
+	}
+	set := make(map[string]struct{}, len(methods))
+	for _, m := range methods {
+		set[strings.ToUpper(strings.TrimSpace(m))] = struct{}{}
+	}
+	return set
+}
+
+// ignores reports whether r bypasses the breaker (health/metrics sub-paths etc.).
+func (b *CircuitBreaker) ignores(r *http.Request) bool {
+	if _, ok := b.ignoreMethods[r.Method]; ok {
+		return true
+	}
+	for _, p := range b.cfg.IgnorePaths {
+		if pathUnder(r.URL.Path, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// pathUnder reports whether path is prefix or below it, by whole segments:
+// "/health" covers "/health" and "/health/deep" but not "/healthcheck".
+func pathUnder(path, prefix string) bool {
+	if strings.HasSuffix(prefix, "/") {
+		return strings.HasPrefix(path, prefix)
 	}
+	return path == prefix || strings.HasPrefix(path, prefix+"/")
+}
+
+// rejects reports whether a request with this method is fast-failed while the breaker is not admitting.
+func (b *CircuitBreaker) rejects(method string) bool {
+	if b.openMethods == nil {
+		return true
+	}
+	_, ok := b.openMethods[method]
+	return ok
 }
 
 type BreakerStats struct {
@@ -61,6 +160,7 @@ type BreakerStats struct {
 	OpensAt       time.Time    `json:"opens_at"`
 	RetryAfterSec int          `json:"retry_after_seconds"`
 	HalfInFlight  int          `json:"half_open_in_flight"`
+	HalfSuccesses int          `json:"half_open_successes"`
 }
 
 func (b *CircuitBreaker) Stats() BreakerStats {
@@ -80,6 +180,7 @@ func (b *CircuitBreaker) Stats() BreakerStats {
 		OpensAt:       b.opensAt,
 		RetryAfterSec: retry,
 		HalfInFlight:  b.halfInFlight,
+		HalfSuccesses: b.halfSuccess,
 	}
 }
 
@@ -98,6 +199,7 @@ func (b *CircuitBreaker) allowLocked(now time.Time) (allowed bool, retryAfter ti
 			b.state = BreakerHalfOpen
 			b.fails = 0
 			b.halfInFlight = 0
+			b.halfSuccess = 0
 			return b.allowLocked(now)
 		}
 		rem := b.cfg.OpenDuration - now.Sub(b.opensAt)
@@ -139,12 +241,16 @@ func (b *CircuitBreaker) doneLocked(success bool) {
 			b.halfInFlight--
 		}
 		if success {
-			// one success closes the breaker (simple + safe default)
-			b.state = BreakerClosed
-			b.fails = 0
+			b.halfSuccess++
+			if b.halfSuccess >= b.cfg.HalfOpenSuccessThreshold {
+				b.state = BreakerClosed
+				b.fails = 0
+				b.halfSuccess = 0
+			}
 			return
 		}
 		// failed trial => reopen
+		b.halfSuccess = 0
 		b.state = BreakerOpen
 		b.opensAt = time.Now()
 		b.fails = b.cfg.FailureThreshold
@@ -154,26 +260,51 @@ func (b *CircuitBreaker) doneLocked(success bool) {
 	}
 }
 
+// abandonLocked releases a request's half-open slot without counting it.
+func (b *CircuitBreaker) abandonLocked() {
+	if b.state == BreakerHalfOpen && b.halfInFlight > 0 {
+		b.halfInFlight--
+	}
+}
+
 // CircuitBreak rejects requests when the breaker is open.
-// It counts failures when downstream returns >= 500.
+// It counts failures when downstream returns >= 500, adjusted by
+// IgnoreStatuses and FailureStatuses.
 func CircuitBreak(b *CircuitBreaker, next http.Handler) http.Handler {
 	if b == nil || !b.cfg.Enabled {
 		return next
 	}
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if b.ignores(r) {
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		now := time.Now()
 		b.mu.Lock()
+		from := b.state
 		allowed, retry := b.allowLocked(now)
+		to, fails := b.state, b.fails
 		b.mu.Unlock()
+		b.notify(from, to, fails)
 
+		if !allowed && !b.rejects(r.Method) {
+			// Degraded mode: this method is still served, but it is not a
+			// trial request and does not feed the breaker's accounting.
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		if !allowed && b.cfg.Fallback != nil {
+			b.cfg.Fallback.ServeHTTP(w, r)
+			return
+		}
 		if !allowed {
 			if retry > 0 {
 				w.Header().Set("Retry-After", strconv.Itoa(int((retry+999*time.Millisecond)/time.Second)))
 			}
-			w.WriteHeader(http.StatusServiceUnavailable)
-			_ = json.NewEncoder(w).Encode(map[string]any{
-				"error":   "circuit_open",
+			httpx.WriteError(w, http.StatusServiceUnavailable, "circuit_open", map[string]any{
 				"message": "upstream temporarily unavailable",
 				"route":   RouteName(r.Context()),
 			})
@@ -181,17 +312,47 @@ func CircuitBreak(b *CircuitBreaker, next http.Handler) http.Handler {
 		}
 
 		sw := &httpx.StatusWriter{ResponseWriter: w}
+		// A panic (http.ErrAbortHandler on a client abort or a response cap)
+		// skips the accounting below; release the half-open slot and let it
+		// carry on.
+		completed := false
+		defer func() {
+			if !completed {
+				b.mu.Lock()
+				b.abandonLocked()
+				b.mu.Unlock()
+			}
+		}()
 		next.ServeHTTP(sw, r)
+		completed = true
 
-		// Consider 5xx as failure; 4xx is not an upstream health failure.
+		// A client that went away says nothing about upstream health.
+		if errors.Is(r.Context().Err(), context.Canceled) {
+			b.mu.Lock()
+			b.abandonLocked()
+			b.mu.Unlock()
+			return
+		}
+
+		// 5xx is a failure and 4xx is not an upstream health failure,
+		// unless the status lists say otherwise.
 		status := sw.Status
 		if status == 0 {
 			status = http.StatusOK
 		}
-		success := status < 500
+		success := !b.failed(status)
 
 		b.mu.Lock()
+		from = b.state
 		b.doneLocked(success)
+		to, fails = b.state, b.fails
 		b.mu.Unlock()
+		b.notify(from, to, fails)
 	})
 }
+
+func (b *CircuitBreaker) notify(from, to BreakerState, failures int) {
+	if from != to && b.cfg.OnChange != nil {
+		b.cfg.OnChange(from, to, failures)
+	}
+}
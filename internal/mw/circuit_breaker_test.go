@@ -0,0 +1,362 @@
+package mw
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCircuitBreakOpenMethodsOnlyRejectsWrites(t *testing.T) {
+	br := NewCircuitBreaker(BreakerConfig{
+		Enabled:          true,
+		FailureThreshold: 1,
+		OpenDuration:     time.Minute,
+		OpenMethods:      []string{"POST", "PUT", "PATCH", "DELETE"},
+	})
+
+	fail := true
+	h := CircuitBreak(br, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	// One failure opens the breaker.
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if br.Stats().State != BreakerOpen {
+		t.Fatalf("expected breaker open, got %s", br.Stats().State)
+	}
+
+	fail = false
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected GET to pass while open, got %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected POST to be rejected while open, got %d", rec.Code)
+	}
+
+	if br.Stats().State != BreakerOpen {
+		t.Fatalf("passed-through reads must not close the breaker, got %s", br.Stats().State)
+	}
+}
+
+func TestCircuitBreakIgnoresClientCancellation(t *testing.T) {
+	br := NewCircuitBreaker(BreakerConfig{Enabled: true, FailureThreshold: 1, OpenDuration: time.Minute})
+	h := CircuitBreak(br, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+	if st := br.Stats(); st.State != BreakerClosed || st.Failures != 0 {
+		t.Fatalf("expected a client cancel not to count, got %+v", st)
+	}
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if br.Stats().State != BreakerOpen {
+		t.Fatalf("expected a real 502 to still open the breaker, got %s", br.Stats().State)
+	}
+}
+
+func TestCircuitBreakReleasesHalfOpenSlotOnAbort(t *testing.T) {
+	br := NewCircuitBreaker(BreakerConfig{Enabled: true, FailureThreshold: 1, OpenDuration: 10 * time.Millisecond})
+	abort := false
+	h := CircuitBreak(br, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if abort {
+			w.WriteHeader(http.StatusOK)
+			panic(http.ErrAbortHandler)
+		}
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	time.Sleep(20 * time.Millisecond)
+
+	abort = true
+	func() {
+		defer func() {
+			if p := recover(); p != http.ErrAbortHandler {
+				t.Fatalf("expected the abort to propagate, got %v", p)
+			}
+		}()
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}()
+	if st := br.Stats(); st.State != BreakerHalfOpen || st.HalfInFlight != 0 {
+		t.Fatalf("expected the aborted trial to free its slot, got %+v", st)
+	}
+
+	abort = false
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code == http.StatusServiceUnavailable {
+		t.Fatal("expected a new trial to be let through after the abort")
+	}
+}
+
+func TestCircuitBreakIgnoredPathsAreNotCounted(t *testing.T) {
+	br := NewCircuitBreaker(BreakerConfig{
+		Enabled:          true,
+		FailureThreshold: 1,
+		OpenDuration:     time.Minute,
+		IgnorePaths:      []string{"/api/health"},
+		IgnoreMethods:    []string{"options"},
+	})
+
+	h := CircuitBreak(br, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusInternalServerError)
+	}))
+
+	for _, req := range []*http.Request{
+		httptest.NewRequest(http.MethodGet, "/api/health", nil),
+		httptest.NewRequest(http.MethodGet, "/api/health/deep", nil),
+		httptest.NewRequest(http.MethodOptions, "/api/users", nil),
+	} {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+		if rec.Code != http.StatusInternalServerError {
+			t.Fatalf("%s %s: expected upstream 500 to pass through, got %d", req.Method, req.URL.Path, rec.Code)
+		}
+	}
+	if st := br.Stats(); st.State != BreakerClosed || st.Failures != 0 {
+		t.Fatalf("expected ignored requests to leave breaker untouched, got %+v", st)
+	}
+
+	// A non-ignored failure still opens it; prefixes match whole segments only.
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/api/healthcheck", nil))
+	if br.Stats().State != BreakerOpen {
+		t.Fatalf("expected breaker open, got %s", br.Stats().State)
+	}
+
+	// Ignored requests bypass an open breaker too.
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/api/health", nil))
+	if rec.Code != http.StatusInternalServerError {
+		t.Fatalf("expected ignored path to bypass open breaker, got %d", rec.Code)
+	}
+}
+
+func TestCircuitBreakWebhookPostsOnOpen(t *testing.T) {
+	got := make(chan BreakerChange, 4)
+	hook := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var c BreakerChange
+		if r.Method != http.MethodPost || json.NewDecoder(r.Body).Decode(&c) != nil {
+			t.Errorf("unexpected webhook request %s", r.Method)
+		}
+		got <- c
+	}))
+	defer hook.Close()
+
+	wh := NewBreakerWebhook(hook.URL, "users", nil)
+	br := NewCircuitBreaker(BreakerConfig{
+		Enabled:          true,
+		FailureThreshold: 2,
+		OpenDuration:     time.Minute,
+		OnChange:         wh.OnChange,
+	})
+	h := CircuitBreak(br, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	select {
+	case c := <-got:
+		t.Fatalf("unexpected webhook before the breaker opened: %+v", c)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	select {
+	case c := <-got:
+		if c.Route != "users" || c.OldState != BreakerClosed || c.NewState != BreakerOpen || c.Failures != 2 {
+			t.Fatalf("unexpected payload %+v", c)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected a webhook POST when the breaker opened")
+	}
+}
+
+func TestBreakerWebhookKeepsTheURLOutOfLogs(t *testing.T) {
+	hook := httptest.NewServer(http.NotFoundHandler())
+	url := hook.URL + "/hooks/s3cr3t-token"
+	hook.Close() // refuse the connection
+
+	var logs bytes.Buffer
+	wh := NewBreakerWebhook(url, "users", slog.New(slog.NewTextHandler(&logs, nil)))
+	wh.post([]byte("{}"))
+	if !strings.Contains(logs.String(), "breaker_webhook_failed") {
+		t.Fatalf("expected a failure to be logged, got %q", logs.String())
+	}
+	if strings.Contains(logs.String(), "s3cr3t-token") {
+		t.Fatalf("expected the webhook URL to stay out of the log, got %q", logs.String())
+	}
+}
+
+func TestCircuitBreakServesFallbackWhileOpen(t *testing.T) {
+	br := NewCircuitBreaker(BreakerConfig{
+		Enabled:          true,
+		FailureThreshold: 1,
+		OpenDuration:     time.Minute,
+		Fallback: http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError) // must not count against the breaker
+			_, _ = w.Write([]byte("fallback"))
+		}),
+	})
+	h := CircuitBreak(br, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if br.Stats().State != BreakerOpen {
+		t.Fatalf("expected breaker open, got %s", br.Stats().State)
+	}
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Body.String() != "fallback" || rec.Header().Get("Retry-After") != "" {
+		t.Fatalf("expected the fallback response, got %d %q %v", rec.Code, rec.Body.String(), rec.Header())
+	}
+	if st := br.Stats(); st.State != BreakerOpen || st.Failures != 1 {
+		t.Fatalf("expected the fallback to leave the breaker alone, got %+v", st)
+	}
+}
+
+func TestCircuitBreakHalfOpenSuccessThreshold(t *testing.T) {
+	br := NewCircuitBreaker(BreakerConfig{
+		Enabled:                  true,
+		FailureThreshold:         1,
+		OpenDuration:             10 * time.Millisecond,
+		HalfOpenSuccessThreshold: 3,
+	})
+	fail := true
+	h := CircuitBreak(br, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		if fail {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+	serve := func() { h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil)) }
+
+	serve()
+	time.Sleep(20 * time.Millisecond)
+
+	fail = false
+	serve()
+	serve()
+	if st := br.Stats(); st.State != BreakerHalfOpen || st.HalfSuccesses != 2 {
+		t.Fatalf("expected half-open after 2 of 3 successes, got %+v", st)
+	}
+
+	// One failed trial reopens and forgets the successes.
+	fail = true
+	serve()
+	if st := br.Stats(); st.State != BreakerOpen || st.HalfSuccesses != 0 {
+		t.Fatalf("expected a failed trial to reopen, got %+v", st)
+	}
+
+	time.Sleep(20 * time.Millisecond)
+	fail = false
+	for i := 0; i < 3; i++ {
+		serve()
+	}
+	if st := br.Stats(); st.State != BreakerClosed || st.HalfSuccesses != 0 {
+		t.Fatalf("expected 3 successes to close, got %+v", st)
+	}
+}
+
+func TestCircuitBreakStatusOverrides(t *testing.T) {
+	br := NewCircuitBreaker(BreakerConfig{
+		Enabled:          true,
+		FailureThreshold: 1,
+		OpenDuration:     time.Minute,
+		IgnoreStatuses:   []int{http.StatusNotImplemented},
+		FailureStatuses:  []int{http.StatusTooManyRequests},
+	})
+	status := http.StatusNotImplemented
+	h := CircuitBreak(br, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(status)
+	}))
+	serve := func() { h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil)) }
+
+	serve()
+	if st := br.Stats(); st.State != BreakerClosed || st.Failures != 0 {
+		t.Fatalf("expected an ignored 501 not to count, got %+v", st)
+	}
+
+	status = http.StatusNotFound
+	serve()
+	if br.Stats().State != BreakerClosed {
+		t.Fatal("expected an unlisted 404 not to count")
+	}
+
+	status = http.StatusTooManyRequests
+	serve()
+	if br.Stats().State != BreakerOpen {
+		t.Fatalf("expected a listed 429 to open the breaker, got %s", br.Stats().State)
+	}
+}
+
+func TestCircuitBreakOnChangeFiresOncePerTransition(t *testing.T) {
+	var mu sync.Mutex
+	var changes []string
+	var br *CircuitBreaker
+	br = NewCircuitBreaker(BreakerConfig{
+		Enabled:          true,
+		FailureThreshold: 1,
+		OpenDuration:     20 * time.Millisecond,
+		OnChange: func(from, to BreakerState, _ int) {
+			_ = br.Stats() // must not deadlock
+			mu.Lock()
+			changes = append(changes, string(from)+"->"+string(to))
+			mu.Unlock()
+		},
+	})
+	var fail atomic.Bool
+	fail.Store(true)
+	release := make(chan struct{})
+	h := CircuitBreak(br, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		<-release
+		if fail.Load() {
+			w.WriteHeader(http.StatusBadGateway)
+		}
+	}))
+
+	// Many failures finish together; only one of them opens the breaker.
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		}()
+	}
+	time.Sleep(20 * time.Millisecond) // let them all through the closed breaker
+	close(release)
+	wg.Wait()
+
+	time.Sleep(30 * time.Millisecond)
+	fail.Store(false)
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+
+	mu.Lock()
+	defer mu.Unlock()
+	want := []string{"closed->open", "open->half_open", "half_open->closed"}
+	if !slices.Equal(changes, want) {
+		t.Fatalf("expected %v, got %v", want, changes)
+	}
+}
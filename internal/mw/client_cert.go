@@ -0,0 +1,91 @@
+package mw
+
+import (
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"slices"
+
+	"github.com/3xpluto/go-api-gateway/internal/httpx"
+)
+
+// ClientSubject returns the common name of the caller's verified TLS client
+// certificate, or "" when the connection is not TLS or the certificate was
+// not verified against server.tls.client_ca_file.
+func ClientSubject(r *http.Request) string {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return ""
+	}
+	return r.TLS.VerifiedChains[0][0].Subject.CommonName
+}
+
+// ClientCertAuthenticator is an AuthHandler for the mtls auth mode: the
+// caller is identified by its verified TLS client certificate instead of a
+// token. Requests without one get ErrNoToken, so optional auth still works.
+type ClientCertAuthenticator struct {
+	SAN     bool     // use a subject alternative name instead of the common name
+	Allowed []string // reject subjects not listed; empty allows any verified cert
+}
+
+var errClientCertNotAllowed = errors.New("client certificate subject not allowed")
+
+func (a ClientCertAuthenticator) ValidateBearer(r *http.Request) (string, error) {
+	p, err := a.Authenticate(r)
+	return p.Subject, err
+}
+
+// Authenticate returns the certificate's common name, or with SAN set its
+// first DNS, URI or email SAN. With an allow-list, the first listed SAN wins.
+func (a ClientCertAuthenticator) Authenticate(r *http.Request) (Principal, error) {
+	if r.TLS == nil || len(r.TLS.VerifiedChains) == 0 || len(r.TLS.VerifiedChains[0]) == 0 {
+		return Principal{}, ErrNoToken
+	}
+	cert := r.TLS.VerifiedChains[0][0]
+	candidates := []string{cert.Subject.CommonName}
+	if a.SAN {
+		candidates = certSANs(cert)
+	}
+	for _, s := range candidates {
+		if s != "" && (len(a.Allowed) == 0 || slices.Contains(a.Allowed, s)) {
+			return Principal{Subject: s}, nil
+		}
+	}
+	return Principal{}, errClientCertNotAllowed
+}
+
+func certSANs(cert *x509.Certificate) []string {
+	out := append([]string(nil), cert.DNSNames...)
+	for _, u := range cert.URIs {
+		out = append(out, u.String())
+	}
+	return append(out, cert.EmailAddresses...)
+}
+
+// ClientCertAuth uses the verified client certificate subject as the
+// authenticated subject. Requests without one are handed to fallback
+// (e.g. RequireAuth for bearer tokens).
+func ClientCertAuth(fallback, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if sub := ClientSubject(r); sub != "" {
+			WithSubject(next, sub).ServeHTTP(w, r)
+			return
+		}
+		fallback.ServeHTTP(w, r)
+	})
+}
+
+// RequireClientSubject answers 403 unless the verified client certificate
+// subject is in allowed.
+func RequireClientSubject(allowed []string, next http.Handler) http.Handler {
+	set := make(map[string]struct{}, len(allowed))
+	for _, s := range allowed {
+		set[s] = struct{}{}
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if _, ok := set[ClientSubject(r)]; !ok {
+			httpx.WriteError(w, http.StatusForbidden, "client_cert_forbidden", nil)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,50 @@
+package mw
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestClientCertAuthenticator(t *testing.T) {
+	withCert := func(cert *x509.Certificate) *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.TLS = &tls.ConnectionState{VerifiedChains: [][]*x509.Certificate{{cert}}}
+		return req
+	}
+	cert := &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "svc-orders"},
+		DNSNames: []string{"orders.internal", "orders-v2.internal"},
+	}
+
+	p, err := ClientCertAuthenticator{}.Authenticate(withCert(cert))
+	if err != nil || p.Subject != "svc-orders" {
+		t.Fatalf("expected the CN as subject, got %q, %v", p.Subject, err)
+	}
+	p, err = ClientCertAuthenticator{SAN: true, Allowed: []string{"orders-v2.internal"}}.Authenticate(withCert(cert))
+	if err != nil || p.Subject != "orders-v2.internal" {
+		t.Fatalf("expected the allowed SAN as subject, got %q, %v", p.Subject, err)
+	}
+	if _, err := (ClientCertAuthenticator{Allowed: []string{"svc-billing"}}).Authenticate(withCert(cert)); err == nil {
+		t.Fatal("expected a subject outside the allow-list to be rejected")
+	}
+
+	// A peer certificate that did not verify is the same as none.
+	req := httptest.NewRequest(http.MethodGet, "/", nil)
+	req.TLS = &tls.ConnectionState{PeerCertificates: []*x509.Certificate{cert}}
+	if _, err := (ClientCertAuthenticator{}).Authenticate(req); !errors.Is(err, ErrNoToken) {
+		t.Fatalf("expected ErrNoToken without a verified cert, got %v", err)
+	}
+
+	rr := httptest.NewRecorder()
+	RequireAuth(ClientCertAuthenticator{}, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})).ServeHTTP(rr, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rr.Code != http.StatusUnauthorized {
+		t.Fatalf("expected 401 without a client cert, got %d", rr.Code)
+	}
+}
@@ -1,8 +1,13 @@
 package mw
 
 import (
-	"encoding/json"
+	"context"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/3xpluto/go-api-gateway/internal/httpx"
 )
 
 // Semaphore is a tiny counting semaphore for per-route in-flight limiting.
@@ -43,6 +48,26 @@ func (s *Semaphore) TryAcquire() bool {
 	}
 }
 
+// Acquire waits up to maxWait for a slot; maxWait <= 0 behaves like TryAcquire.
+func (s *Semaphore) Acquire(ctx context.Context, maxWait time.Duration) bool {
+	if s.TryAcquire() {
+		return true
+	}
+	if maxWait <= 0 {
+		return false
+	}
+	t := time.NewTimer(maxWait)
+	defer t.Stop()
+	select {
+	case s.ch <- struct{}{}:
+		return true
+	case <-t.C:
+		return false
+	case <-ctx.Done():
+		return false
+	}
+}
+
 func (s *Semaphore) Release() {
 	if s == nil || s.ch == nil {
 		return
@@ -55,17 +80,77 @@ func (s *Semaphore) Release() {
 
 // ConcurrencyLimit rejects requests when too many are already in-flight for a route.
 func ConcurrencyLimit(sem *Semaphore, next http.Handler) http.Handler {
+	return ConcurrencyLimitWait(sem, ConcurrencyConfig{}, next)
+}
+
+// ConcurrencyConfig.Mode values.
+const (
+	ConcurrencyReject = "reject" // 503 as soon as every slot is taken
+	ConcurrencyQueue  = "queue"  // wait up to MaxWait, first come first served
+)
+
+// ConcurrencyConfig tunes ConcurrencyLimitWait.
+type ConcurrencyConfig struct {
+	Mode       string        // ConcurrencyReject or ConcurrencyQueue; "" queues only when MaxWait > 0
+	MaxWait    time.Duration // queue for a slot this long before 503; 0 rejects immediately
+	RetryAfter time.Duration // Retry-After on 503 too_busy; 0 sends 1s
+	Metrics    *Metrics      // optional; records time queued and queue timeouts
+
+	// IgnoreCancel keeps a queued request waiting after its client went
+	// away. By default it leaves the queue at once and is recorded as 499.
+	IgnoreCancel bool
+}
+
+// ConcurrencyLimitWait is ConcurrencyLimit with queuing: a request waits up
+// to cfg.MaxWait for a slot before being rejected. Waiters get slots in
+// arrival order. It must sit outside the circuit breaker so queue timeouts
+// never count as upstream failures.
+func ConcurrencyLimitWait(sem *Semaphore, cfg ConcurrencyConfig, next http.Handler) http.Handler {
 	if sem == nil || !sem.Enabled() {
 		return next
 	}
+	maxWait, metrics := cfg.MaxWait, cfg.Metrics
+	if cfg.Mode == ConcurrencyReject {
+		maxWait = 0
+	}
+	retryAfter := int((cfg.RetryAfter + time.Second - 1) / time.Second)
+	if retryAfter <= 0 {
+		retryAfter = 1
+	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		if !sem.TryAcquire() {
-			w.WriteHeader(http.StatusServiceUnavailable)
-			_ = json.NewEncoder(w).Encode(map[string]any{
-				"error":         "too_busy",
-				"message":       "route is at max concurrency",
+		acquired := sem.TryAcquire()
+		if !acquired && maxWait > 0 {
+			ctx := r.Context()
+			if cfg.IgnoreCancel {
+				ctx = context.WithoutCancel(ctx)
+			}
+			start := time.Now()
+			acquired = sem.Acquire(ctx, maxWait)
+			cancelled := !acquired && ctx.Err() != nil
+			if metrics != nil {
+				route := RouteName(r.Context())
+				metrics.ConcurrencyQueueWait.WithLabelValues(route).Observe(time.Since(start).Seconds())
+				if !acquired && !cancelled {
+					metrics.ConcurrencyQueueTimeouts.WithLabelValues(route).Inc()
+				}
+			}
+			if cancelled {
+				// Nobody is listening; the status is for logs and metrics.
+				w.WriteHeader(httpx.StatusClientClosedRequest)
+				return
+			}
+		}
+		if !acquired {
+			msg := "route is at max concurrency"
+			if maxWait > 0 {
+				msg = "timed out waiting for a concurrency slot"
+			}
+			w.Header().Set("Retry-After", strconv.Itoa(retryAfter))
+			httpx.WriteError(w, http.StatusServiceUnavailable, "too_busy", map[string]any{
+				"message":       msg,
 				"route":         RouteName(r.Context()),
 				"max_in_flight": sem.Cap(),
+				"in_flight":     sem.InUse(),
 			})
 			return
 		}
@@ -73,3 +158,71 @@ func ConcurrencyLimit(sem *Semaphore, next http.Handler) http.Handler {
 		next.ServeHTTP(w, r)
 	})
 }
+
+// SubjectSemaphore caps in-flight requests per authenticated subject, so a
+// single token cannot take every route slot.
+type SubjectSemaphore struct {
+	max int
+
+	mu    sync.Mutex
+	inUse map[string]int
+}
+
+// NewSubjectSemaphore returns nil (no limit) when max <= 0.
+func NewSubjectSemaphore(max int) *SubjectSemaphore {
+	if max <= 0 {
+		return nil
+	}
+	return &SubjectSemaphore{max: max, inUse: map[string]int{}}
+}
+
+func (s *SubjectSemaphore) TryAcquire(sub string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inUse[sub] >= s.max {
+		return false
+	}
+	s.inUse[sub]++
+	return true
+}
+
+func (s *SubjectSemaphore) Release(sub string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.inUse[sub] <= 1 {
+		delete(s.inUse, sub)
+		return
+	}
+	s.inUse[sub]--
+}
+
+// ConcurrencyPerSubject answers 503 too_busy when the request's subject
+// already has the maximum in flight. Anonymous requests are not limited;
+// it must run after auth so the subject is known.
+func ConcurrencyPerSubject(s *SubjectSemaphore, retryAfter time.Duration, next http.Handler) http.Handler {
+	if s == nil {
+		return next
+	}
+	retry := int((retryAfter + time.Second - 1) / time.Second)
+	if retry <= 0 {
+		retry = 1
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		sub, ok := Subject(r.Context())
+		if !ok || sub == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if !s.TryAcquire(sub) {
+			w.Header().Set("Retry-After", strconv.Itoa(retry))
+			httpx.WriteError(w, http.StatusServiceUnavailable, "too_busy", map[string]any{
+				"message":         "subject is at max concurrency",
+				"route":           RouteName(r.Context()),
+				"per_subject_max": s.max,
+			})
+			return
+		}
+		defer s.Release(sub)
+		next.ServeHTTP(w, r)
+	})
+}
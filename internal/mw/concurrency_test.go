@@ -0,0 +1,196 @@
+package mw
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+)
+
+func TestSemaphoreAcquireWaitsForSlot(t *testing.T) {
+	sem := NewSemaphore(1)
+	if !sem.TryAcquire() {
+		t.Fatal("expected first acquire to succeed")
+	}
+
+	if sem.Acquire(context.Background(), 10*time.Millisecond) {
+		t.Fatal("expected acquire to time out while the slot is held")
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		sem.Release()
+	}()
+	if !sem.Acquire(context.Background(), time.Second) {
+		t.Fatal("expected acquire to succeed once the slot was released")
+	}
+}
+
+func TestConcurrencyLimitWaitRecordsQueueMetrics(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry())
+	sem := NewSemaphore(1)
+	h := WithRoute(ConcurrencyLimitWait(sem, ConcurrencyConfig{MaxWait: 10 * time.Millisecond, Metrics: metrics}, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})), "q")
+
+	// Uncontended requests are not queued.
+	h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	if n := testutil.CollectAndCount(metrics.ConcurrencyQueueWait); n != 0 {
+		t.Fatalf("expected no queue observations, got %d", n)
+	}
+
+	sem.TryAcquire() // hold the only slot
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503 after queue timeout, got %d", rec.Code)
+	}
+	if got := testutil.ToFloat64(metrics.ConcurrencyQueueTimeouts.WithLabelValues("q")); got != 1 {
+		t.Fatalf("expected 1 queue timeout, got %v", got)
+	}
+	if n := testutil.CollectAndCount(metrics.ConcurrencyQueueWait); n != 1 {
+		t.Fatalf("expected queue wait observed for the queued request, got %d series", n)
+	}
+}
+
+func TestConcurrencyLimitTooBusySetsRetryAfter(t *testing.T) {
+	sem := NewSemaphore(1)
+	sem.TryAcquire()
+	ok := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	h := ConcurrencyLimitWait(sem, ConcurrencyConfig{RetryAfter: 3 * time.Second}, ok)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusServiceUnavailable {
+		t.Fatalf("expected 503, got %d", rec.Code)
+	}
+	if got := rec.Header().Get("Retry-After"); got != "3" {
+		t.Fatalf("expected Retry-After 3, got %q", got)
+	}
+	var body map[string]any
+	if err := json.NewDecoder(rec.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if body["max_in_flight"] != float64(1) || body["in_flight"] != float64(1) {
+		t.Fatalf("expected max_in_flight and in_flight in body, got %v", body)
+	}
+
+	// Unset falls back to 1 second.
+	rec = httptest.NewRecorder()
+	ConcurrencyLimit(sem, ok).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if got := rec.Header().Get("Retry-After"); got != "1" {
+		t.Fatalf("expected default Retry-After 1, got %q", got)
+	}
+}
+
+func TestConcurrencyPerSubjectCapsOneSubject(t *testing.T) {
+	release := make(chan struct{})
+	entered := make(chan struct{}, 1)
+	h := ConcurrencyPerSubject(NewSubjectSemaphore(1), 0, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow" {
+			entered <- struct{}{}
+			<-release
+		}
+		w.WriteHeader(http.StatusOK)
+	}))
+	as := func(sub string, next http.Handler) http.Handler { return WithSubject(next, sub) }
+
+	done := make(chan int)
+	go func() {
+		rec := httptest.NewRecorder()
+		as("alice", h).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/slow", nil))
+		done <- rec.Code
+	}()
+	<-entered
+
+	rec := httptest.NewRecorder()
+	as("alice", h).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/fast", nil))
+	if rec.Code != http.StatusServiceUnavailable || rec.Header().Get("Retry-After") != "1" {
+		t.Fatalf("expected 503 with Retry-After for alice's second request, got %d %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	rec = httptest.NewRecorder()
+	as("bob", h).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/fast", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected bob to proceed while alice is capped, got %d", rec.Code)
+	}
+
+	close(release)
+	if code := <-done; code != http.StatusOK {
+		t.Fatalf("expected alice's first request to finish, got %d", code)
+	}
+	rec = httptest.NewRecorder()
+	as("alice", h).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/fast", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected alice's slot to be released, got %d", rec.Code)
+	}
+}
+
+func TestConcurrencyLimitQueueCancellation(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+
+	t.Run("leaves the queue", func(t *testing.T) {
+		metrics := NewMetrics(prometheus.NewRegistry())
+		sem := NewSemaphore(1)
+		sem.TryAcquire() // hold the only slot
+		h := WithRoute(ConcurrencyLimitWait(sem, ConcurrencyConfig{Mode: ConcurrencyQueue, MaxWait: 5 * time.Second, Metrics: metrics}, ok), "q")
+
+		ctx, cancel := context.WithCancel(context.Background())
+		time.AfterFunc(20*time.Millisecond, cancel)
+		rec := httptest.NewRecorder()
+		start := time.Now()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+		if elapsed := time.Since(start); elapsed > time.Second {
+			t.Fatalf("expected the cancelled request to stop waiting, waited %v", elapsed)
+		}
+		if rec.Code != 499 {
+			t.Fatalf("expected 499 for a cancelled waiter, got %d", rec.Code)
+		}
+		if got := testutil.ToFloat64(metrics.ConcurrencyQueueTimeouts.WithLabelValues("q")); got != 0 {
+			t.Fatalf("expected a cancellation not to count as a queue timeout, got %v", got)
+		}
+		if sem.InUse() != 1 {
+			t.Fatalf("expected the cancelled waiter not to take a slot, in use %d", sem.InUse())
+		}
+	})
+
+	t.Run("ignore cancel keeps waiting", func(t *testing.T) {
+		sem := NewSemaphore(1)
+		sem.TryAcquire()
+		h := ConcurrencyLimitWait(sem, ConcurrencyConfig{Mode: ConcurrencyQueue, MaxWait: 5 * time.Second, IgnoreCancel: true}, ok)
+
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		time.AfterFunc(50*time.Millisecond, sem.Release)
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil).WithContext(ctx))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected the request to get the freed slot despite cancellation, got %d", rec.Code)
+		}
+		if sem.InUse() != 0 {
+			t.Fatalf("expected the slot released after the request, in use %d", sem.InUse())
+		}
+	})
+
+	t.Run("reject mode never waits", func(t *testing.T) {
+		sem := NewSemaphore(1)
+		sem.TryAcquire()
+		h := ConcurrencyLimitWait(sem, ConcurrencyConfig{Mode: ConcurrencyReject, MaxWait: 5 * time.Second}, ok)
+
+		rec := httptest.NewRecorder()
+		start := time.Now()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rec.Code != http.StatusServiceUnavailable || time.Since(start) > time.Second {
+			t.Fatalf("expected an immediate 503, got %d after %v", rec.Code, time.Since(start))
+		}
+	})
+}
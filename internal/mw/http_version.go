@@ -0,0 +1,40 @@
+package mw
+
+import (
+	"net/http"
+
+	"github.com/3xpluto/go-api-gateway/internal/httpx"
+)
+
+// HTTP/1.0 handling modes for HTTPVersionConfig.HTTP10.
+const (
+	HTTP10Accept = "accept" // default
+	HTTP10Close  = "close"  // serve, then close the connection
+	HTTP10Reject = "reject" // 505
+)
+
+// HTTPVersionConfig controls which request protocol versions are served.
+type HTTPVersionConfig struct {
+	MinMajor, MinMinor int    // requests below this version get 505; zero allows all
+	HTTP10             string // one of the HTTP10* modes; "" accepts
+}
+
+// HTTPVersion rejects requests below the minimum protocol version with 505
+// and applies the configured HTTP/1.0 behavior.
+func HTTPVersion(cfg HTTPVersionConfig, next http.Handler) http.Handler {
+	if cfg.MinMajor == 0 && (cfg.HTTP10 == "" || cfg.HTTP10 == HTTP10Accept) {
+		return next
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !r.ProtoAtLeast(cfg.MinMajor, cfg.MinMinor) ||
+			(cfg.HTTP10 == HTTP10Reject && r.ProtoMajor == 1 && r.ProtoMinor == 0) {
+			w.Header().Set("Connection", "close")
+			httpx.WriteError(w, http.StatusHTTPVersionNotSupported, "http_version_not_supported", nil)
+			return
+		}
+		if cfg.HTTP10 == HTTP10Close && r.ProtoMajor == 1 && r.ProtoMinor == 0 {
+			w.Header().Set("Connection", "close")
+		}
+		next.ServeHTTP(w, r)
+	})
+}
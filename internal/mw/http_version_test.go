@@ -0,0 +1,49 @@
+package mw
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestHTTPVersionHTTP10Behaviors(t *testing.T) {
+	ok := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})
+	http10 := func() *http.Request {
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.Proto, req.ProtoMajor, req.ProtoMinor = "HTTP/1.0", 1, 0
+		return req
+	}
+
+	cases := []struct {
+		name      string
+		cfg       HTTPVersionConfig
+		wantCode  int
+		wantClose bool
+	}{
+		{"accept", HTTPVersionConfig{HTTP10: HTTP10Accept}, http.StatusOK, false},
+		{"close", HTTPVersionConfig{HTTP10: HTTP10Close}, http.StatusOK, true},
+		{"reject", HTTPVersionConfig{HTTP10: HTTP10Reject}, http.StatusHTTPVersionNotSupported, true},
+		{"min 1.1", HTTPVersionConfig{MinMajor: 1, MinMinor: 1}, http.StatusHTTPVersionNotSupported, true},
+	}
+	for _, tc := range cases {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := httptest.NewRecorder()
+			HTTPVersion(tc.cfg, ok).ServeHTTP(rec, http10())
+			if rec.Code != tc.wantCode {
+				t.Fatalf("expected %d, got %d", tc.wantCode, rec.Code)
+			}
+			if got := rec.Header().Get("Connection") == "close"; got != tc.wantClose {
+				t.Fatalf("expected Connection: close=%v, got %q", tc.wantClose, rec.Header().Get("Connection"))
+			}
+		})
+	}
+
+	// HTTP/1.1 is unaffected by the HTTP/1.0 behavior.
+	rec := httptest.NewRecorder()
+	HTTPVersion(HTTPVersionConfig{HTTP10: HTTP10Reject}, ok).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+	if rec.Code != http.StatusOK {
+		t.Fatalf("expected HTTP/1.1 to pass, got %d", rec.Code)
+	}
+}
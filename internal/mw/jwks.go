@@ -7,8 +7,10 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"log/slog"
 	"math/big"
 	"net/http"
+	"strings"
 	"sync"
 	"time"
 
@@ -27,6 +29,16 @@ type JWKSValidatorOptions struct {
 
 	// Allowed JWT algs (default ["RS256"])
 	ValidAlgs []string
+
+	// ValidationCacheSize bounds an LRU of already-validated tokens so repeat
+	// tokens skip signature verification until their exp. 0 disables it.
+	ValidationCacheSize int
+
+	// TierClaim names a string claim reported as Principal.Tier; "" disables.
+	TierClaim string
+
+	// Log, if set, gets a debug line for every JWKS entry skipped on refresh.
+	Log *slog.Logger
 }
 
 // JWKSValidator validates RS256 JWTs using a remote JWKS.
@@ -39,14 +51,18 @@ type JWKSValidator struct {
 	leeway    time.Duration
 	validAlgs []string
 
-	issuerSet map[string]struct{}
-	audSet    map[string]struct{}
+	claims *ClaimRequirements
 
 	mu        sync.RWMutex
 	keys      map[string]*rsa.PublicKey
 	fetchedAt time.Time
+	lastErr   error // of the latest fetch; nil once one succeeds
 
 	refreshMu sync.Mutex
+
+	cache     *validationCache
+	tierClaim string
+	log       *slog.Logger
 }
 
 type jwksDoc struct {
@@ -86,20 +102,6 @@ func NewJWKSValidator(url string, opts JWKSValidatorOptions) (*JWKSValidator, er
 		validAlgs = []string{"RS256"}
 	}
 
-	issuerSet := map[string]struct{}{}
-	for _, iss := range opts.Issuers {
-		if iss != "" {
-			issuerSet[iss] = struct{}{}
-		}
-	}
-
-	audSet := map[string]struct{}{}
-	for _, aud := range opts.Audiences {
-		if aud != "" {
-			audSet[aud] = struct{}{}
-		}
-	}
-
 	v := &JWKSValidator{
 		url: url,
 		client: &http.Client{
@@ -108,17 +110,84 @@ func NewJWKSValidator(url string, opts JWKSValidatorOptions) (*JWKSValidator, er
 		cacheTTL:  ttl,
 		leeway:    leeway,
 		validAlgs: validAlgs,
-		issuerSet: issuerSet,
-		audSet:    audSet,
+		claims:    NewClaimRequirements(opts.Issuers, opts.Audiences),
 		keys:      make(map[string]*rsa.PublicKey),
+		cache:     newValidationCache(opts.ValidationCacheSize),
+		tierClaim: opts.TierClaim,
+		log:       opts.Log,
 	}
 	return v, nil
 }
 
 // Validate validates the JWT string, returning the "sub" on success.
 func (j *JWKSValidator) Validate(ctx context.Context, tokenStr string) (string, error) {
+	p, err := j.ValidatePrincipal(ctx, tokenStr)
+	return p.Subject, err
+}
+
+// ValidatePrincipal is Validate, also reporting the configured tier claim.
+func (j *JWKSValidator) ValidatePrincipal(ctx context.Context, tokenStr string) (Principal, error) {
+	return j.ValidatePrincipalFor(ctx, tokenStr, nil)
+}
+
+// ClaimRequirements lists the accepted issuers and audiences of a token.
+// An empty list accepts any value, including none.
+type ClaimRequirements struct {
+	issuers   map[string]struct{}
+	audiences map[string]struct{}
+}
+
+func NewClaimRequirements(issuers, audiences []string) *ClaimRequirements {
+	set := func(ss []string) map[string]struct{} {
+		out := map[string]struct{}{}
+		for _, s := range ss {
+			if s != "" {
+				out[s] = struct{}{}
+			}
+		}
+		return out
+	}
+	return &ClaimRequirements{issuers: set(issuers), audiences: set(audiences)}
+}
+
+func (c *ClaimRequirements) check(iss string, auds []string) error {
+	if len(c.issuers) > 0 {
+		if iss == "" {
+			return errors.New("missing iss")
+		}
+		if _, ok := c.issuers[iss]; !ok {
+			return errors.New("invalid issuer")
+		}
+	}
+	if len(c.audiences) > 0 {
+		if len(auds) == 0 {
+			return errors.New("missing aud")
+		}
+		for _, a := range auds {
+			if _, hit := c.audiences[a]; hit {
+				return nil
+			}
+		}
+		return errors.New("invalid audience")
+	}
+	return nil
+}
+
+// ValidatePrincipalFor is ValidatePrincipal with req in place of the
+// validator's own issuers and audiences (nil keeps them), so routes sharing
+// one JWKS and key cache can require different audiences.
+func (j *JWKSValidator) ValidatePrincipalFor(ctx context.Context, tokenStr string, req *ClaimRequirements) (Principal, error) {
 	if tokenStr == "" {
-		return "", errors.New("missing token")
+		return Principal{}, errors.New("missing token")
+	}
+	if req == nil {
+		req = j.claims
+	}
+	if vt, ok := j.cache.get(tokenStr, time.Now()); ok {
+		if err := req.check(vt.iss, vt.auds); err != nil {
+			return Principal{}, err
+		}
+		return vt.p, nil
 	}
 
 	claims := jwt.MapClaims{}
@@ -135,53 +204,34 @@ func (j *JWKSValidator) Validate(ctx context.Context, tokenStr string) (string,
 		return j.getKey(ctx, kid)
 	})
 	if err != nil || tok == nil || !tok.Valid {
-		return "", errors.New("invalid token")
+		return Principal{}, errors.New("invalid token")
 	}
 
+	iss, _ := claims["iss"].(string)
+	auds := extractAudiences(claims["aud"])
+	if err := req.check(iss, auds); err != nil {
+		return Principal{}, err
+	}
 	if err := j.validateClaims(claims); err != nil {
-		return "", err
+		return Principal{}, err
 	}
 
 	sub, _ := claims["sub"].(string)
 	if sub == "" {
-		return "", errors.New("missing sub")
+		return Principal{}, errors.New("missing sub")
 	}
-	return sub, nil
+	p := Principal{Subject: sub, Tier: claimString(claims, j.tierClaim)}
+	if exp, ok := extractInt64(claims["exp"]); ok {
+		// Issuer and audience are cached too: they are checked per call.
+		j.cache.put(tokenStr, validatedToken{p: p, iss: iss, auds: auds}, time.Unix(exp, 0))
+	}
+	return p, nil
 }
 
 func (j *JWKSValidator) validateClaims(claims jwt.MapClaims) error {
 	now := time.Now().Unix()
 	leeway := int64(j.leeway.Seconds())
 
-	// iss
-	if len(j.issuerSet) > 0 {
-		iss, _ := claims["iss"].(string)
-		if iss == "" {
-			return errors.New("missing iss")
-		}
-		if _, ok := j.issuerSet[iss]; !ok {
-			return errors.New("invalid issuer")
-		}
-	}
-
-	// aud
-	if len(j.audSet) > 0 {
-		auds := extractAudiences(claims["aud"])
-		if len(auds) == 0 {
-			return errors.New("missing aud")
-		}
-		ok := false
-		for _, a := range auds {
-			if _, hit := j.audSet[a]; hit {
-				ok = true
-				break
-			}
-		}
-		if !ok {
-			return errors.New("invalid audience")
-		}
-	}
-
 	// exp (required)
 	exp, ok := extractInt64(claims["exp"])
 	if !ok {
@@ -245,6 +295,19 @@ func extractInt64(v any) (int64, bool) {
 	}
 }
 
+// Prefetch loads the key set ahead of the first request. Failure is not fatal
+// for validation: keys are fetched lazily on the next unknown kid.
+func (j *JWKSValidator) Prefetch(ctx context.Context) error {
+	return j.refresh(ctx)
+}
+
+// Ready reports whether a key set has been loaded, so tokens can be checked.
+func (j *JWKSValidator) Ready() bool {
+	j.mu.RLock()
+	defer j.mu.RUnlock()
+	return len(j.keys) > 0
+}
+
 func (j *JWKSValidator) getKey(ctx context.Context, kid string) (*rsa.PublicKey, error) {
 	j.mu.RLock()
 	key := j.keys[kid]
@@ -288,6 +351,17 @@ func (j *JWKSValidator) refresh(ctx context.Context) error {
 		return nil
 	}
 
+	err := j.fetch(ctx)
+	if err != nil {
+		j.mu.Lock()
+		j.lastErr = err
+		j.mu.Unlock()
+	}
+	return err
+}
+
+// fetch downloads the key set and swaps it in; refresh serializes it.
+func (j *JWKSValidator) fetch(ctx context.Context) error {
 	req, err := http.NewRequestWithContext(ctx, http.MethodGet, j.url, nil)
 	if err != nil {
 		return err
@@ -311,27 +385,42 @@ func (j *JWKSValidator) refresh(ctx context.Context) error {
 	}
 
 	next := make(map[string]*rsa.PublicKey, len(doc.Keys))
-	for _, k := range doc.Keys {
+	var skipped []string
+	skip := func(i int, k jwkKey, reason string) {
+		skipped = append(skipped, fmt.Sprintf("#%d kid=%q: %s", i, k.Kid, reason))
+		if j.log != nil {
+			j.log.Debug("jwks_key_skipped",
+				slog.Int("index", i),
+				slog.String("kid", k.Kid),
+				slog.String("kty", k.Kty),
+				slog.String("reason", reason))
+		}
+	}
+	for i, k := range doc.Keys {
 		if k.Kid == "" {
+			skip(i, k, "missing kid")
 			continue
 		}
 		if k.Kty != "RSA" {
+			skip(i, k, "unsupported kty")
 			continue
 		}
 		// If alg is provided in JWKS, you may optionally enforce it here. We still enforce via parser valid methods.
 		pub, err := jwkToRSAPublicKey(k)
 		if err != nil {
+			skip(i, k, "bad n/e: "+err.Error())
 			continue
 		}
 		next[k.Kid] = pub
 	}
 	if len(next) == 0 {
-		return errors.New("jwks: no usable rsa keys")
+		return fmt.Errorf("jwks: no usable rsa keys (skipped %s)", strings.Join(skipped, "; "))
 	}
 
 	j.mu.Lock()
 	j.keys = next
 	j.fetchedAt = time.Now()
+	j.lastErr = nil
 	j.mu.Unlock()
 	return nil
 }
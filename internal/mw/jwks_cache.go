@@ -0,0 +1,103 @@
+package mw
+
+import (
+	"container/list"
+	"crypto/sha256"
+	"sync"
+	"time"
+)
+
+// validationCache is a bounded LRU of successfully validated tokens, keyed by
+// the SHA-256 of the raw token. Entries never outlive the token's exp.
+type validationCache struct {
+	mu    sync.Mutex
+	max   int
+	ll    *list.List
+	items map[[sha256.Size]byte]*list.Element
+
+	hits   uint64
+	misses uint64
+}
+
+type validationEntry struct {
+	key [sha256.Size]byte
+	v   validatedToken
+	exp time.Time
+}
+
+// validatedToken is a token that passed signature and time checks. Issuer
+// and audience are kept so each caller can check its own requirements.
+type validatedToken struct {
+	p    Principal
+	iss  string
+	auds []string
+}
+
+func newValidationCache(max int) *validationCache {
+	if max <= 0 {
+		return nil
+	}
+	return &validationCache{
+		max:   max,
+		ll:    list.New(),
+		items: make(map[[sha256.Size]byte]*list.Element, max),
+	}
+}
+
+func (c *validationCache) get(token string, now time.Time) (validatedToken, bool) {
+	if c == nil {
+		return validatedToken{}, false
+	}
+	key := sha256.Sum256([]byte(token))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if !ok {
+		c.misses++
+		return validatedToken{}, false
+	}
+	e := el.Value.(*validationEntry)
+	if !now.Before(e.exp) {
+		c.ll.Remove(el)
+		delete(c.items, key)
+		c.misses++
+		return validatedToken{}, false
+	}
+	c.ll.MoveToFront(el)
+	c.hits++
+	return e.v, true
+}
+
+func (c *validationCache) put(token string, v validatedToken, exp time.Time) {
+	if c == nil {
+		return
+	}
+	key := sha256.Sum256([]byte(token))
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		e := el.Value.(*validationEntry)
+		e.v, e.exp = v, exp
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.ll.PushFront(&validationEntry{key: key, v: v, exp: exp})
+	for c.ll.Len() > c.max {
+		oldest := c.ll.Back()
+		c.ll.Remove(oldest)
+		delete(c.items, oldest.Value.(*validationEntry).key)
+	}
+}
+
+func (c *validationCache) stats() (hits, misses uint64, size int) {
+	if c == nil {
+		return 0, 0, 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses, c.ll.Len()
+}
@@ -0,0 +1,41 @@
+package mw
+
+import (
+	"testing"
+	"time"
+)
+
+func TestValidationCacheNeverServesPastExp(t *testing.T) {
+	c := newValidationCache(8)
+	now := time.Now()
+	c.put("tok", validatedToken{p: Principal{Subject: "user_1"}}, now.Add(time.Minute))
+
+	if v, ok := c.get("tok", now); !ok || v.p.Subject != "user_1" {
+		t.Fatalf("expected cache hit before exp, got %q %v", v.p.Subject, ok)
+	}
+	if _, ok := c.get("tok", now.Add(time.Minute)); ok {
+		t.Fatal("expected miss at exp")
+	}
+	if _, _, size := c.stats(); size != 0 {
+		t.Fatalf("expected expired entry to be evicted, size=%d", size)
+	}
+}
+
+func TestValidationCacheBounded(t *testing.T) {
+	c := newValidationCache(2)
+	exp := time.Now().Add(time.Hour)
+	c.put("a", validatedToken{p: Principal{Subject: "a"}}, exp)
+	c.put("b", validatedToken{p: Principal{Subject: "b"}}, exp)
+	_, _ = c.get("a", time.Now()) // a is now most recently used
+	c.put("c", validatedToken{p: Principal{Subject: "c"}}, exp)
+
+	if _, ok := c.get("b", time.Now()); ok {
+		t.Fatal("expected least recently used entry to be evicted")
+	}
+	if _, ok := c.get("a", time.Now()); !ok {
+		t.Fatal("expected recently used entry to survive")
+	}
+	if _, _, size := c.stats(); size != 2 {
+		t.Fatalf("expected size 2, got %d", size)
+	}
+}
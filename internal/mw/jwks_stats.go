@@ -6,17 +6,32 @@ type JWKSStats struct {
 	URL       string    `json:"url"`
 	KeyCount  int       `json:"key_count"`
 	FetchedAt time.Time `json:"fetched_at"`
+	LastError string    `json:"last_error,omitempty"` // of the latest failed fetch, until one succeeds
+
+	CacheHits   uint64 `json:"validation_cache_hits"`
+	CacheMisses uint64 `json:"validation_cache_misses"`
+	CacheSize   int    `json:"validation_cache_size"`
 }
 
 func (j *JWKSValidator) Stats() JWKSStats {
 	if j == nil {
 		return JWKSStats{}
 	}
+	hits, misses, size := j.cache.stats()
+
 	j.mu.RLock()
 	defer j.mu.RUnlock()
+	var lastErr string
+	if j.lastErr != nil {
+		lastErr = j.lastErr.Error()
+	}
 	return JWKSStats{
-		URL:       j.url,
-		KeyCount:  len(j.keys),
-		FetchedAt: j.fetchedAt,
+		URL:         j.url,
+		KeyCount:    len(j.keys),
+		FetchedAt:   j.fetchedAt,
+		LastError:   lastErr,
+		CacheHits:   hits,
+		CacheMisses: misses,
+		CacheSize:   size,
 	}
 }
@@ -1,13 +1,16 @@
 package mw
 
 import (
+	"bytes"
 	"context"
 	"crypto/rand"
 	"crypto/rsa"
 	"encoding/base64"
 	"encoding/json"
+	"log/slog"
 	"net/http"
 	"net/http/httptest"
+	"strings"
 	"testing"
 	"time"
 
@@ -145,3 +148,88 @@ func TestJWKSValidator_AudienceMismatch(t *testing.T) {
 		t.Fatalf("expected error")
 	}
 }
+
+func TestJWKSValidator_ValidationCacheHits(t *testing.T) {
+	priv, _ := rsa.GenerateKey(rand.Reader, 2048)
+	kid := "kid1"
+	jwks := map[string]any{
+		"keys": []any{
+			map[string]any{
+				"kty": "RSA",
+				"kid": kid,
+				"n":   base64.RawURLEncoding.EncodeToString(priv.PublicKey.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString([]byte{1, 0, 1}),
+			},
+		},
+	}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(jwks)
+	}))
+	defer s.Close()
+
+	v, _ := NewJWKSValidator(s.URL, JWKSValidatorOptions{ValidationCacheSize: 16})
+
+	claims := jwt.MapClaims{
+		"sub": "user_123",
+		"exp": time.Now().Add(1 * time.Hour).Unix(),
+	}
+	tok := jwt.NewWithClaims(jwt.SigningMethodRS256, claims)
+	tok.Header["kid"] = kid
+	tokStr, _ := tok.SignedString(priv)
+
+	for i := 0; i < 3; i++ {
+		sub, err := v.Validate(context.Background(), tokStr)
+		if err != nil || sub != "user_123" {
+			t.Fatalf("expected ok on call %d, got sub=%q err=%v", i, sub, err)
+		}
+	}
+
+	st := v.Stats()
+	if st.CacheMisses != 1 || st.CacheHits != 2 || st.CacheSize != 1 {
+		t.Fatalf("expected 1 miss, 2 hits, size 1; got %+v", st)
+	}
+}
+
+func TestJWKSValidator_SkipsAndLogsBadKeys(t *testing.T) {
+	priv, _ := rsa.GenerateKey(rand.Reader, 2048)
+	jwks := map[string]any{
+		"keys": []any{
+			map[string]any{"kty": "EC", "kid": "ec-1", "crv": "P-256"},
+			map[string]any{"kty": "RSA", "kid": "broken", "n": "!!!", "e": "AQAB"},
+			map[string]any{
+				"kty": "RSA",
+				"kid": "good",
+				"n":   base64.RawURLEncoding.EncodeToString(priv.PublicKey.N.Bytes()),
+				"e":   base64.RawURLEncoding.EncodeToString([]byte{1, 0, 1}),
+			},
+		},
+	}
+	s := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		_ = json.NewEncoder(w).Encode(jwks)
+	}))
+	defer s.Close()
+
+	var buf bytes.Buffer
+	log := slog.New(slog.NewTextHandler(&buf, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	v, _ := NewJWKSValidator(s.URL, JWKSValidatorOptions{Log: log})
+
+	tok := jwt.NewWithClaims(jwt.SigningMethodRS256, jwt.MapClaims{
+		"sub": "user_1",
+		"exp": time.Now().Add(time.Hour).Unix(),
+	})
+	tok.Header["kid"] = "good"
+	tokStr, _ := tok.SignedString(priv)
+	if sub, err := v.Validate(context.Background(), tokStr); err != nil || sub != "user_1" {
+		t.Fatalf("expected the good key to validate, got %q %v", sub, err)
+	}
+
+	out := buf.String()
+	for _, want := range []string{`kid=ec-1 kty=EC reason="unsupported kty"`, `kid=broken kty=RSA reason="bad n/e`} {
+		if !strings.Contains(out, want) {
+			t.Fatalf("expected %s in logs, got %s", want, out)
+		}
+	}
+	if strings.Contains(out, "kid=good") {
+		t.Fatalf("good key should not be logged as skipped: %s", out)
+	}
+}
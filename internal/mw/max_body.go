@@ -1,8 +1,9 @@
 package mw
 
 import (
-	"encoding/json"
 	"net/http"
+
+	"github.com/3xpluto/go-api-gateway/internal/httpx"
 )
 
 func MaxBodyBytes(limit int64, next http.Handler) http.Handler {
@@ -12,9 +13,7 @@ func MaxBodyBytes(limit int64, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		// Fast fail when Content-Length is known.
 		if r.ContentLength > limit && r.ContentLength != -1 {
-			w.WriteHeader(http.StatusRequestEntityTooLarge)
-			_ = json.NewEncoder(w).Encode(map[string]any{
-				"error":     "request_too_large",
+			httpx.WriteError(w, http.StatusRequestEntityTooLarge, "request_too_large", map[string]any{
 				"max_bytes": limit,
 			})
 			return
@@ -8,29 +8,168 @@ import (
 
 	"github.com/3xpluto/go-api-gateway/internal/httpx"
 	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/metric"
 )
 
 type Metrics struct {
 	Requests *prometheus.CounterVec
 	Latency  *prometheus.HistogramVec
+	InFlight *prometheus.GaugeVec
+
+	RateLimitSoftExceeded *prometheus.CounterVec
+	UpstreamTarget        *prometheus.CounterVec
+	HedgedRequests        *prometheus.CounterVec
+	ResponseTooLarge      *prometheus.CounterVec
+	RateLimitWouldBlock   *prometheus.CounterVec
+	RateLimitTier         *prometheus.CounterVec
+
+	ConcurrencyQueueWait     *prometheus.HistogramVec
+	ConcurrencyQueueTimeouts *prometheus.CounterVec
+
+	// Rate-limit decisions by route and scope ("ip" or "user"), never by key.
+	RateLimitAllowed *prometheus.CounterVec
+	RateLimitBlocked *prometheus.CounterVec
+	RateLimitErrors  *prometheus.CounterVec // limiter backend failures (requests fail open)
+
+	SingleFlightShared *prometheus.CounterVec // responses replayed to coalesced requests
+
+	otel *otelInstruments // nil unless EnableOTel was called
+
+	statusLabel string // MetricsOptions.StatusLabel
+}
+
+// MetricsOptions.StatusLabel values: how request counts are labelled by
+// response status.
+const (
+	StatusLabelCode  = "code"  // exact code, e.g. code="404" (default)
+	StatusLabelClass = "class" // class only, e.g. class="4xx"
+	StatusLabelBoth  = "both"  // code and class
+)
+
+// MetricsOptions tunes NewMetricsWith.
+type MetricsOptions struct {
+	// StatusLabel picks the status labels on apigw_http_requests_total.
+	// "class" caps them at five values however unusual the upstream's codes.
+	StatusLabel string
+}
+
+// otelInstruments mirror Requests/Latency/InFlight for OTLP export.
+type otelInstruments struct {
+	requests metric.Int64Counter
+	latency  metric.Float64Histogram
+	inFlight metric.Int64UpDownCounter
 }
 
 func NewMetrics(reg prometheus.Registerer) *Metrics {
+	return NewMetricsWith(reg, MetricsOptions{})
+}
+
+// NewMetricsWith is NewMetrics with options.
+func NewMetricsWith(reg prometheus.Registerer, opts MetricsOptions) *Metrics {
+	statusLabels := []string{"code"}
+	switch opts.StatusLabel {
+	case StatusLabelClass:
+		statusLabels = []string{"class"}
+	case StatusLabelBoth:
+		statusLabels = []string{"code", "class"}
+	default:
+		opts.StatusLabel = StatusLabelCode
+	}
 	m := &Metrics{
+		statusLabel: opts.StatusLabel,
 		Requests: prometheus.NewCounterVec(prometheus.CounterOpts{
 			Name: "apigw_http_requests_total",
 			Help: "Total HTTP requests processed by the gateway",
-		}, []string{"route", "method", "code"}),
+		}, append([]string{"route", "method"}, statusLabels...)),
 		Latency: prometheus.NewHistogramVec(prometheus.HistogramOpts{
 			Name:    "apigw_http_request_duration_seconds",
 			Help:    "HTTP request latency",
 			Buckets: prometheus.DefBuckets,
 		}, []string{"route", "method"}),
+		InFlight: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "apigw_http_in_flight_requests",
+			Help: "HTTP requests currently being served by the gateway",
+		}, []string{"route"}),
+		RateLimitSoftExceeded: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "apigw_rate_limit_soft_exceeded_total",
+			Help: "Requests allowed by the hard rate limit but over the soft threshold",
+		}, []string{"route"}),
+		UpstreamTarget: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "apigw_upstream_requests_total",
+			Help: "Proxied requests by route and chosen target (stable or canary)",
+		}, []string{"route", "target"}),
+		HedgedRequests: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "apigw_hedged_requests_total",
+			Help: "Extra upstream attempts sent by request hedging",
+		}, []string{"route"}),
+		ResponseTooLarge: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "apigw_upstream_response_too_large_total",
+			Help: "Upstream responses rejected or cut off by max_response_bytes",
+		}, []string{"route"}),
+		RateLimitWouldBlock: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "apigw_rate_limit_would_block_total",
+			Help: "Requests a dry-run rate limit would have rejected with 429",
+		}, []string{"route"}),
+		RateLimitTier: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "apigw_rate_limit_tier_requests_total",
+			Help: "Rate-limited requests on tiered routes by selected tier and outcome",
+		}, []string{"route", "tier", "result"}),
+		ConcurrencyQueueWait: prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    "apigw_concurrency_queue_wait_seconds",
+			Help:    "Time requests spent queued for a concurrency slot (queued requests only)",
+			Buckets: prometheus.DefBuckets,
+		}, []string{"route"}),
+		ConcurrencyQueueTimeouts: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "apigw_concurrency_queue_timeouts_total",
+			Help: "Requests rejected after waiting concurrency.max_wait_ms for a slot",
+		}, []string{"route"}),
+		RateLimitAllowed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "apigw_rate_limit_allowed_total",
+			Help: "Requests allowed by the rate limiter (dry-run would-blocks included)",
+		}, []string{"route", "scope"}),
+		RateLimitBlocked: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "apigw_rate_limit_blocked_total",
+			Help: "Requests rejected with 429 by the rate limiter",
+		}, []string{"route", "scope"}),
+		RateLimitErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "apigw_rate_limit_backend_errors_total",
+			Help: "Rate limiter backend errors; the request is let through (fail open)",
+		}, []string{"route"}),
+		SingleFlightShared: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "apigw_single_flight_shared_total",
+			Help: "Requests answered with another identical request's upstream response (single_flight)",
+		}, []string{"route"}),
 	}
-	reg.MustRegister(m.Requests, m.Latency)
+	reg.MustRegister(m.Requests, m.Latency, m.InFlight, m.RateLimitSoftExceeded, m.UpstreamTarget, m.HedgedRequests,
+		m.ResponseTooLarge,
+		m.RateLimitWouldBlock, m.RateLimitTier, m.ConcurrencyQueueWait, m.ConcurrencyQueueTimeouts,
+		m.RateLimitAllowed, m.RateLimitBlocked, m.RateLimitErrors, m.SingleFlightShared)
 	return m
 }
 
+// EnableOTel additionally records the request, latency and in-flight metrics
+// through meter, so they can be exported via OTLP alongside Prometheus.
+func (m *Metrics) EnableOTel(meter metric.Meter) error {
+	requests, err := meter.Int64Counter("apigw.http.requests",
+		metric.WithDescription("Total HTTP requests processed by the gateway"))
+	if err != nil {
+		return err
+	}
+	latency, err := meter.Float64Histogram("apigw.http.request.duration",
+		metric.WithDescription("HTTP request latency"), metric.WithUnit("s"))
+	if err != nil {
+		return err
+	}
+	inFlight, err := meter.Int64UpDownCounter("apigw.http.in_flight_requests",
+		metric.WithDescription("HTTP requests currently being served by the gateway"))
+	if err != nil {
+		return err
+	}
+	m.otel = &otelInstruments{requests: requests, latency: latency, inFlight: inFlight}
+	return nil
+}
+
 type routeKeyType string
 
 const routeKey routeKeyType = "route"
@@ -53,13 +192,83 @@ func Instrument(m *Metrics, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		sw := &httpx.StatusWriter{ResponseWriter: w}
 		start := time.Now()
-		next.ServeHTTP(sw, r)
 		route := RouteName(r.Context())
+
+		m.InFlight.WithLabelValues(route).Inc()
+		if m.otel != nil {
+			m.otel.inFlight.Add(r.Context(), 1, metric.WithAttributes(attribute.String("route", route)))
+		}
+		// Deferred: an aborted response (http.ErrAbortHandler) never returns normally.
+		defer func() {
+			m.InFlight.WithLabelValues(route).Dec()
+			if m.otel != nil {
+				m.otel.inFlight.Add(r.Context(), -1, metric.WithAttributes(attribute.String("route", route)))
+			}
+		}()
+
+		next.ServeHTTP(sw, r)
+
+		// Nothing written means net/http sent an implicit 200.
 		code := sw.Status
 		if code == 0 {
 			code = http.StatusOK
 		}
-		m.Requests.WithLabelValues(route, r.Method, strconv.Itoa(code)).Inc()
-		m.Latency.WithLabelValues(route, r.Method).Observe(time.Since(start).Seconds())
+		elapsed := time.Since(start).Seconds()
+		m.Requests.WithLabelValues(m.requestLabels(route, r.Method, code)...).Inc()
+		m.Latency.WithLabelValues(route, r.Method).Observe(elapsed)
+
+		if m.otel != nil {
+			ctx := r.Context()
+			attrs := []attribute.KeyValue{attribute.String("route", route), attribute.String("method", r.Method)}
+			if m.statusLabel != StatusLabelClass {
+				otelCode := code
+				if !validStatus(code) {
+					otelCode = 0
+				}
+				attrs = append(attrs, attribute.Int("code", otelCode))
+			}
+			if m.statusLabel != StatusLabelCode {
+				attrs = append(attrs, attribute.String("class", StatusClass(code)))
+			}
+			m.otel.requests.Add(ctx, 1, metric.WithAttributes(attrs...))
+			m.otel.latency.Record(ctx, elapsed, metric.WithAttributes(
+				attribute.String("route", route),
+				attribute.String("method", r.Method),
+			))
+		}
 	})
 }
+
+// requestLabels returns the apigw_http_requests_total label values.
+func (m *Metrics) requestLabels(route, method string, code int) []string {
+	switch m.statusLabel {
+	case StatusLabelClass:
+		return []string{route, method, StatusClass(code)}
+	case StatusLabelBoth:
+		return []string{route, method, StatusCode(code), StatusClass(code)}
+	default:
+		return []string{route, method, StatusCode(code)}
+	}
+}
+
+// StatusUnknown labels status codes outside 100-599, so an upstream writing
+// 0 or 999 can't add series.
+const StatusUnknown = "unknown"
+
+func validStatus(code int) bool { return code >= 100 && code <= 599 }
+
+// StatusCode is code's exact label, or StatusUnknown.
+func StatusCode(code int) string {
+	if !validStatus(code) {
+		return StatusUnknown
+	}
+	return strconv.Itoa(code)
+}
+
+// StatusClass is code's class label: "2xx", "4xx", ... or StatusUnknown.
+func StatusClass(code int) string {
+	if !validStatus(code) {
+		return StatusUnknown
+	}
+	return strconv.Itoa(code/100) + "xx"
+}
@@ -0,0 +1,130 @@
+package mw
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+)
+
+func TestInstrument_RecordsOTelRequests(t *testing.T) {
+	reader := sdkmetric.NewManualReader()
+	mp := sdkmetric.NewMeterProvider(sdkmetric.WithReader(reader))
+	defer func() { _ = mp.Shutdown(context.Background()) }()
+
+	m := NewMetrics(prometheus.NewRegistry())
+	if err := m.EnableOTel(mp.Meter("test")); err != nil {
+		t.Fatal(err)
+	}
+
+	h := WithRoute(Instrument(m, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})), "users")
+	for i := 0; i < 3; i++ {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}
+
+	var rm metricdata.ResourceMetrics
+	if err := reader.Collect(context.Background(), &rm); err != nil {
+		t.Fatal(err)
+	}
+
+	var got int64
+	found := false
+	for _, sm := range rm.ScopeMetrics {
+		for _, md := range sm.Metrics {
+			if md.Name != "apigw.http.requests" {
+				continue
+			}
+			found = true
+			for _, dp := range md.Data.(metricdata.Sum[int64]).DataPoints {
+				if v, _ := dp.Attributes.Value("route"); v.AsString() != "users" {
+					t.Fatalf("unexpected route attribute: %v", v)
+				}
+				if v, _ := dp.Attributes.Value("code"); v.AsInt64() != http.StatusTeapot {
+					t.Fatalf("unexpected code attribute: %v", v)
+				}
+				got += dp.Value
+			}
+		}
+	}
+	if !found || got != 3 {
+		t.Fatalf("expected apigw.http.requests=3, found=%v got=%d", found, got)
+	}
+}
+
+func TestInstrument_StatusLabel(t *testing.T) {
+	codes := []int{http.StatusOK, http.StatusNotFound, http.StatusTeapot, 599}
+	serve := func(m *Metrics) {
+		for _, code := range codes {
+			h := WithRoute(Instrument(m, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(code)
+			})), "users")
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		}
+	}
+
+	m := NewMetricsWith(prometheus.NewRegistry(), MetricsOptions{StatusLabel: StatusLabelClass})
+	serve(m)
+	if n := testutil.CollectAndCount(m.Requests); n != 3 {
+		t.Fatalf("expected 3 class series (2xx, 4xx, 5xx), got %d", n)
+	}
+	if got := testutil.ToFloat64(m.Requests.WithLabelValues("users", http.MethodGet, "4xx")); got != 2 {
+		t.Fatalf("expected 404 and 418 counted as 4xx, got %v", got)
+	}
+
+	m = NewMetricsWith(prometheus.NewRegistry(), MetricsOptions{StatusLabel: StatusLabelBoth})
+	serve(m)
+	if got := testutil.ToFloat64(m.Requests.WithLabelValues("users", http.MethodGet, "418", "4xx")); got != 1 {
+		t.Fatalf("expected code and class labels, got %v", got)
+	}
+
+	m = NewMetrics(prometheus.NewRegistry())
+	serve(m)
+	if n := testutil.CollectAndCount(m.Requests); n != len(codes) {
+		t.Fatalf("expected one series per exact code by default, got %d", n)
+	}
+}
+
+func TestInstrument_OutOfRangeStatusIsUnknown(t *testing.T) {
+	for _, opts := range []MetricsOptions{{}, {StatusLabel: StatusLabelClass}} {
+		m := NewMetricsWith(prometheus.NewRegistry(), opts)
+		for _, code := range []int{999, 600, http.StatusOK} {
+			h := WithRoute(Instrument(m, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				w.WriteHeader(code)
+			})), "users")
+			h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+		}
+		if got := testutil.ToFloat64(m.Requests.WithLabelValues("users", http.MethodGet, StatusUnknown)); got != 2 {
+			t.Fatalf("status_label %q: expected 999 and 600 counted as unknown, got %v", opts.StatusLabel, got)
+		}
+		if n := testutil.CollectAndCount(m.Requests); n != 2 {
+			t.Fatalf("status_label %q: expected only the unknown and 200 series, got %d", opts.StatusLabel, n)
+		}
+	}
+}
+
+func TestInstrument_InFlightReleasedOnAbort(t *testing.T) {
+	m := NewMetrics(prometheus.NewRegistry())
+	h := WithRoute(Instrument(m, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		panic(http.ErrAbortHandler) // what the proxy does when the client goes away mid-body
+	})), "users")
+
+	func() {
+		defer func() {
+			if p := recover(); p != http.ErrAbortHandler {
+				t.Fatalf("expected the abort to propagate, got %v", p)
+			}
+		}()
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/", nil))
+	}()
+	if got := testutil.ToFloat64(m.InFlight.WithLabelValues("users")); got != 0 {
+		t.Fatalf("expected the in-flight gauge back at 0 after an abort, got %v", got)
+	}
+}
@@ -0,0 +1,57 @@
+package mw
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/3xpluto/go-api-gateway/internal/httpx"
+	"github.com/3xpluto/go-api-gateway/internal/ratelimit"
+)
+
+type QuotaConfig struct {
+	Daily     int64 // requests per UTC day; 0 disables
+	RouteName string
+}
+
+// Quota enforces a daily request budget keyed by the authenticated subject,
+// falling back to client IP for anonymous requests. It must run inside auth
+// so the subject is available.
+func Quota(q ratelimit.QuotaLimiter, ipr IPResolver, cfg QuotaConfig, next http.Handler) http.Handler {
+	if q == nil || cfg.Daily <= 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := "quota:" + cfg.RouteName + ":"
+		if sub, ok := Subject(r.Context()); ok {
+			key += "u:" + sub
+		} else {
+			key += "ip:" + ipr.ClientIP(r)
+		}
+
+		dec, err := q.Consume(r.Context(), key, cfg.Daily, 1)
+		if err != nil {
+			// Fail-open, same as RateLimit: a quota backend outage must not take the route down.
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		w.Header().Set("X-Quota-Limit", strconv.FormatInt(dec.Limit, 10))
+		w.Header().Set("X-Quota-Remaining", strconv.FormatInt(dec.Remaining, 10))
+		w.Header().Set("X-Quota-Reset", strconv.FormatInt(dec.Reset.Unix(), 10))
+
+		if !dec.Allowed {
+			retry := int(time.Until(dec.Reset).Seconds()) + 1
+			w.Header().Set("Retry-After", strconv.Itoa(retry))
+			httpx.WriteError(w, http.StatusTooManyRequests, "quota_exceeded", map[string]any{
+				"route":    cfg.RouteName,
+				"limit":    dec.Limit,
+				"reset_at": dec.Reset.UTC().Format(time.RFC3339),
+			})
+			return
+		}
+
+		next.ServeHTTP(w, r)
+	})
+}
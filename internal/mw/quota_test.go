@@ -0,0 +1,42 @@
+package mw
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/3xpluto/go-api-gateway/internal/ratelimit"
+)
+
+func TestQuotaBlocksAfterDailyLimit(t *testing.T) {
+	h := Quota(ratelimit.NewMemoryQuota(), IPResolver{}, QuotaConfig{Daily: 3, RouteName: "partner"},
+		http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+			w.WriteHeader(http.StatusOK)
+		}))
+
+	do := func() *httptest.ResponseRecorder {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		h.ServeHTTP(rec, req.WithContext(context.WithValue(req.Context(), subjectKey, "partner-1")))
+		return rec
+	}
+
+	for i, want := range []string{"2", "1", "0"} {
+		rec := do()
+		if rec.Code != http.StatusOK {
+			t.Fatalf("request %d: expected 200, got %d", i, rec.Code)
+		}
+		if got := rec.Header().Get("X-Quota-Remaining"); got != want {
+			t.Fatalf("request %d: expected remaining %s, got %s", i, want, got)
+		}
+	}
+
+	rec := do()
+	if rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("expected 429 after quota, got %d", rec.Code)
+	}
+	if rec.Header().Get("X-Quota-Remaining") != "0" || rec.Header().Get("X-Quota-Reset") == "" {
+		t.Fatalf("expected quota headers on 429, got %v", rec.Header())
+	}
+}
@@ -1,13 +1,14 @@
 package mw
 
 import (
-	"encoding/json"
+	"log/slog"
 	"net"
 	"net/http"
 	"strconv"
 	"strings"
 	"time"
 
+	"github.com/3xpluto/go-api-gateway/internal/httpx"
 	"github.com/3xpluto/go-api-gateway/internal/netx"
 	"github.com/3xpluto/go-api-gateway/internal/ratelimit"
 )
@@ -18,6 +19,80 @@ type RateLimitConfig struct {
 	Burst     float64
 	Scope     string // "user" | "ip"
 	RouteName string
+
+	SoftRPS float64  // optional soft threshold below RPS; flags but never blocks
+	Metrics *Metrics // optional
+
+	// DryRun computes decisions and emits headers but never rejects; would-be
+	// 429s are counted and logged (to Log, if set) instead.
+	DryRun bool
+	Log    *slog.Logger
+
+	// Tiers override RPS/Burst by the caller's tier (see Tier). Callers with
+	// no or an unknown tier use DefaultTier, or RPS/Burst when that is empty.
+	Tiers       map[string]RateLimitTier
+	DefaultTier string
+
+	// PerMethod gives each HTTP method its own bucket; Methods optionally
+	// overrides rps/burst per method (over any tier).
+	PerMethod bool
+	Methods   map[string]RateLimitTier
+}
+
+// RateLimitTier is the rps/burst for one tier of a tiered route.
+type RateLimitTier struct {
+	RPS   float64
+	Burst float64
+}
+
+// limitsFor picks the tier and rps/burst/soft rps for a request.
+func (cfg RateLimitConfig) limitsFor(r *http.Request) (tier string, rps, burst, softRPS float64) {
+	rps, burst = cfg.RPS, cfg.Burst
+	if len(cfg.Tiers) > 0 {
+		tier, _ = Tier(r.Context())
+		t, ok := cfg.Tiers[tier]
+		if !ok {
+			tier = cfg.DefaultTier
+			t, ok = cfg.Tiers[tier]
+		}
+		if ok {
+			rps, burst = t.RPS, t.Burst
+		} else {
+			tier = ""
+		}
+	}
+	if m, ok := cfg.Methods[cfg.MethodBucket(r.Method)]; ok && cfg.PerMethod {
+		rps, burst = m.RPS, m.Burst
+	}
+	softRPS = cfg.SoftRPS
+	if softRPS > 0 && cfg.RPS > 0 {
+		softRPS = softRPS * rps / cfg.RPS // keep the soft threshold proportional
+	}
+	return tier, rps, burst, softRPS
+}
+
+// standardMethods get their own bucket on per-method routes along with any
+// method in Methods; the rest share the route's bucket, so a client can't
+// mint fresh budgets (and limiter keys) by inventing methods.
+var standardMethods = map[string]bool{
+	http.MethodGet:     true,
+	http.MethodPost:    true,
+	http.MethodPut:     true,
+	http.MethodPatch:   true,
+	http.MethodDelete:  true,
+	http.MethodOptions: true,
+}
+
+// MethodBucket is the per-method bucket a request with method counts
+// against, or "" for the route's shared bucket. HEAD counts as GET.
+func (cfg RateLimitConfig) MethodBucket(method string) string {
+	if method == http.MethodHead {
+		method = http.MethodGet
+	}
+	if _, ok := cfg.Methods[method]; ok || standardMethods[method] {
+		return method
+	}
+	return ""
 }
 
 type IPResolver struct {
@@ -25,8 +100,8 @@ type IPResolver struct {
 }
 
 func (r IPResolver) ClientIP(req *http.Request) string {
-	remoteIP := parseRemoteIP(req.RemoteAddr)
-	if remoteIP != nil && r.Trusted != nil && r.Trusted.Contains(remoteIP) {
+	remoteIP := netx.RemoteIP(req.RemoteAddr)
+	if r.Trusted.Contains(remoteIP) {
 		// Only trust forwarded headers from trusted proxies
 		if xff := req.Header.Get("X-Forwarded-For"); xff != "" {
 			// first IP is original client (left-most)
@@ -48,12 +123,19 @@ func (r IPResolver) ClientIP(req *http.Request) string {
 	return req.RemoteAddr
 }
 
-func parseRemoteIP(remoteAddr string) net.IP {
-	host, _, err := net.SplitHostPort(remoteAddr)
-	if err != nil {
-		return net.ParseIP(remoteAddr)
+// FromTrustedProxy reports whether the direct peer is in the trusted proxy set.
+func (r IPResolver) FromTrustedProxy(req *http.Request) bool {
+	return r.Trusted.Contains(netx.RemoteIP(req.RemoteAddr))
+}
+
+// RateLimitKey is the limiter key for a route and actor ("ip" or "user").
+// Per-method buckets pass route+":"+method as the route.
+// The soft bucket, if any, lives under the same key plus ":soft".
+func RateLimitKey(route, actor, id string) string {
+	if actor == "user" {
+		return "rl:" + route + ":u:" + id
 	}
-	return net.ParseIP(host)
+	return "rl:" + route + ":ip:" + id
 }
 
 func RateLimit(limiter ratelimit.Limiter, ipr IPResolver, cfg RateLimitConfig, next http.Handler) http.Handler {
@@ -63,43 +145,79 @@ func RateLimit(limiter ratelimit.Limiter, ipr IPResolver, cfg RateLimitConfig, n
 	scope := strings.ToLower(cfg.Scope)
 
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		key := "rl:" + cfg.RouteName + ":"
-		actor := ""
-		if scope == "user" {
-			if sub, ok := Subject(r.Context()); ok {
-				key += "u:" + sub
-				actor = "user"
-			} else {
-				key += "ip:" + ipr.ClientIP(r)
-				actor = "ip"
-			}
+		actor, id := "ip", ""
+		if sub, ok := Subject(r.Context()); ok && scope == "user" {
+			actor, id = "user", sub
 		} else {
-			key += "ip:" + ipr.ClientIP(r)
-			actor = "ip"
+			id = ipr.ClientIP(r)
+		}
+		bucket := cfg.RouteName
+		if m := cfg.MethodBucket(r.Method); m != "" && cfg.PerMethod {
+			bucket += ":" + m
 		}
+		key := RateLimitKey(bucket, actor, id)
 
-		dec, err := limiter.Allow(r.Context(), key, cfg.RPS, cfg.Burst, 1)
+		tier, rps, burst, softRPS := cfg.limitsFor(r)
+		dec, err := ratelimit.AllowSoft(r.Context(), limiter, key, rps, burst, softRPS, 1)
 		if err != nil {
 			// Fail-open in v1 to avoid a global outage if Redis is down.
+			if cfg.Metrics != nil {
+				cfg.Metrics.RateLimitErrors.WithLabelValues(cfg.RouteName).Inc()
+			}
 			next.ServeHTTP(w, r)
 			return
 		}
+		if cfg.Metrics != nil {
+			if dec.Allowed || cfg.DryRun {
+				cfg.Metrics.RateLimitAllowed.WithLabelValues(cfg.RouteName, actor).Inc()
+			} else {
+				cfg.Metrics.RateLimitBlocked.WithLabelValues(cfg.RouteName, actor).Inc()
+			}
+		}
 
 		w.Header().Set("X-RateLimit-Route", cfg.RouteName)
 		w.Header().Set("X-RateLimit-Scope", actor)
-		w.Header().Set("X-RateLimit-Limit-RPS", trimFloat(cfg.RPS))
-		w.Header().Set("X-RateLimit-Burst", trimFloat(cfg.Burst))
+		w.Header().Set("X-RateLimit-Limit-RPS", trimFloat(rps))
+		w.Header().Set("X-RateLimit-Burst", trimFloat(burst))
+		if len(cfg.Tiers) > 0 {
+			if tier != "" {
+				w.Header().Set("X-RateLimit-Tier", tier)
+			}
+			if cfg.Metrics != nil {
+				result := "allowed"
+				if !dec.Allowed {
+					result = "limited"
+				}
+				cfg.Metrics.RateLimitTier.WithLabelValues(cfg.RouteName, tier, result).Inc()
+			}
+		}
 		if dec.Remaining > 0 {
 			w.Header().Set("X-RateLimit-Remaining", trimFloat(dec.Remaining))
 		}
 
+		if !dec.Allowed && cfg.DryRun {
+			retry := dec.RetryAfterSeconds
+			w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(time.Duration(retry)*time.Second).Unix(), 10))
+			if cfg.Metrics != nil {
+				cfg.Metrics.RateLimitWouldBlock.WithLabelValues(cfg.RouteName).Inc()
+			}
+			if cfg.Log != nil {
+				cfg.Log.Info("rate_limit_would_block",
+					slog.String("rid", RID(r.Context())),
+					slog.String("route", cfg.RouteName),
+					slog.String("scope", actor),
+					slog.Int("retry_after_seconds", retry),
+				)
+			}
+			next.ServeHTTP(w, r)
+			return
+		}
+
 		if !dec.Allowed {
 			retry := dec.RetryAfterSeconds
 			w.Header().Set("Retry-After", strconv.Itoa(retry))
 			w.Header().Set("X-RateLimit-Reset", strconv.FormatInt(time.Now().Add(time.Duration(retry)*time.Second).Unix(), 10))
-			w.WriteHeader(http.StatusTooManyRequests)
-			_ = json.NewEncoder(w).Encode(map[string]any{
-				"error":               "rate_limited",
+			httpx.WriteError(w, http.StatusTooManyRequests, "rate_limited", map[string]any{
 				"route":               cfg.RouteName,
 				"scope":               actor,
 				"retry_after_seconds": retry,
@@ -107,6 +225,13 @@ func RateLimit(limiter ratelimit.Limiter, ipr IPResolver, cfg RateLimitConfig, n
 			return
 		}
 
+		if dec.SoftExceeded {
+			w.Header().Set("X-RateLimit-Soft-Exceeded", "true")
+			if cfg.Metrics != nil {
+				cfg.Metrics.RateLimitSoftExceeded.WithLabelValues(cfg.RouteName).Inc()
+			}
+		}
+
 		next.ServeHTTP(w, r)
 	})
 }
@@ -1,10 +1,19 @@
 package mw
 
 import (
+	"context"
+	"errors"
 	"net/http"
+	"net/http/httptest"
 	"testing"
+	"time"
+
+	"github.com/golang-jwt/jwt/v5"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
 
 	"github.com/3xpluto/go-api-gateway/internal/netx"
+	"github.com/3xpluto/go-api-gateway/internal/ratelimit"
 )
 
 func TestIPResolverTrustedProxyUsesXFF(t *testing.T) {
@@ -38,3 +47,247 @@ func TestIPResolverUntrustedIgnoresXFF(t *testing.T) {
 		t.Fatalf("expected remote ip, got %q", got)
 	}
 }
+
+func TestRateLimitSoftExceededBetweenThresholds(t *testing.T) {
+	limiter := ratelimit.NewMemoryLimiter(time.Minute, time.Minute)
+	defer limiter.Close()
+	metrics := NewMetrics(prometheus.NewRegistry())
+
+	h := RateLimit(limiter, IPResolver{}, RateLimitConfig{
+		Enabled:   true,
+		RPS:       10,
+		Burst:     10,
+		SoftRPS:   5, // soft burst scales to 5
+		Scope:     "ip",
+		RouteName: "soft",
+		Metrics:   metrics,
+	}, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	var soft, hard int
+	for i := 0; i < 11; i++ {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		h.ServeHTTP(rec, req)
+
+		switch {
+		case rec.Code == http.StatusTooManyRequests:
+			hard++
+		case rec.Header().Get("X-RateLimit-Soft-Exceeded") == "true":
+			soft++
+		}
+	}
+
+	if soft != 5 {
+		t.Fatalf("expected 5 soft-exceeded requests between thresholds, got %d", soft)
+	}
+	if hard != 1 {
+		t.Fatalf("expected 1 request over the hard limit, got %d", hard)
+	}
+	if got := testutil.ToFloat64(metrics.RateLimitSoftExceeded.WithLabelValues("soft")); got != 5 {
+		t.Fatalf("expected soft metric 5, got %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.RateLimitAllowed.WithLabelValues("soft", "ip")); got != 10 {
+		t.Fatalf("expected allowed metric 10, got %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.RateLimitBlocked.WithLabelValues("soft", "ip")); got != 1 {
+		t.Fatalf("expected blocked metric 1, got %v", got)
+	}
+}
+
+// downLimiter fails every Allow, like a Redis outage.
+type downLimiter struct{ ratelimit.Limiter }
+
+func (downLimiter) Allow(context.Context, string, float64, float64, float64) (ratelimit.Decision, error) {
+	return ratelimit.Decision{}, errors.New("connection refused")
+}
+
+func TestRateLimitBackendErrorsFailOpenAndCount(t *testing.T) {
+	metrics := NewMetrics(prometheus.NewRegistry())
+	h := RateLimit(downLimiter{}, IPResolver{}, RateLimitConfig{
+		Enabled:   true,
+		RPS:       1,
+		Burst:     1,
+		Scope:     "ip",
+		RouteName: "down",
+		Metrics:   metrics,
+	}, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for i := 0; i < 3; i++ {
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+		if rec.Code != http.StatusOK {
+			t.Fatalf("expected fail-open 200, got %d", rec.Code)
+		}
+	}
+	if got := testutil.ToFloat64(metrics.RateLimitErrors.WithLabelValues("down")); got != 3 {
+		t.Fatalf("expected 3 backend errors, got %v", got)
+	}
+	if got := testutil.CollectAndCount(metrics.RateLimitAllowed); got != 0 {
+		t.Fatalf("errors should not count as decisions, got %d allowed series", got)
+	}
+}
+
+func TestRateLimitDryRunNeverBlocks(t *testing.T) {
+	limiter := ratelimit.NewMemoryLimiter(time.Minute, time.Minute)
+	defer limiter.Close()
+	metrics := NewMetrics(prometheus.NewRegistry())
+
+	h := RateLimit(limiter, IPResolver{}, RateLimitConfig{
+		Enabled:   true,
+		RPS:       1,
+		Burst:     2,
+		Scope:     "ip",
+		RouteName: "dry",
+		Metrics:   metrics,
+		DryRun:    true,
+	}, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	for i := 0; i < 5; i++ {
+		rec := httptest.NewRecorder()
+		req := httptest.NewRequest(http.MethodGet, "/", nil)
+		req.RemoteAddr = "192.0.2.1:1234"
+		h.ServeHTTP(rec, req)
+
+		if rec.Code != http.StatusOK {
+			t.Fatalf("request %d: expected dry run to pass through, got %d", i, rec.Code)
+		}
+		if rec.Header().Get("X-RateLimit-Limit-RPS") != "1" {
+			t.Fatalf("request %d: expected rate-limit headers in dry run", i)
+		}
+		if i >= 2 && rec.Header().Get("Retry-After") != "" {
+			t.Fatalf("request %d: dry run should not set Retry-After", i)
+		}
+	}
+	if got := testutil.ToFloat64(metrics.RateLimitWouldBlock.WithLabelValues("dry")); got != 3 {
+		t.Fatalf("expected 3 would-block requests, got %v", got)
+	}
+}
+
+func TestRateLimitTiersByClaim(t *testing.T) {
+	limiter := ratelimit.NewMemoryLimiter(time.Minute, time.Minute)
+	defer limiter.Close()
+	metrics := NewMetrics(prometheus.NewRegistry())
+
+	auth := Authenticator{Mode: "hmac", HMACSecret: []byte("secret"), TierClaim: "tier"}
+	h := RequireAuth(auth, RateLimit(limiter, IPResolver{}, RateLimitConfig{
+		Enabled:   true,
+		RPS:       1,
+		Burst:     1,
+		Scope:     "user",
+		RouteName: "tiered",
+		Metrics:   metrics,
+		Tiers: map[string]RateLimitTier{
+			"free":    {RPS: 10, Burst: 2},
+			"premium": {RPS: 100, Burst: 5},
+		},
+		DefaultTier: "free",
+	}, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	})))
+
+	token := func(claims jwt.MapClaims) string {
+		s, err := jwt.NewWithClaims(jwt.SigningMethodHS256, claims).SignedString([]byte("secret"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return s
+	}
+	// allowed sends n requests with tok and returns how many passed, plus the last response.
+	allowed := func(tok string, n int) (int, *httptest.ResponseRecorder) {
+		var ok int
+		var rec *httptest.ResponseRecorder
+		for i := 0; i < n; i++ {
+			rec = httptest.NewRecorder()
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Authorization", "Bearer "+tok)
+			h.ServeHTTP(rec, req)
+			if rec.Code == http.StatusOK {
+				ok++
+			}
+		}
+		return ok, rec
+	}
+
+	ok, rec := allowed(token(jwt.MapClaims{"sub": "p", "tier": "premium"}), 6)
+	if ok != 5 {
+		t.Fatalf("expected premium burst of 5, got %d", ok)
+	}
+	if rec.Header().Get("X-RateLimit-Tier") != "premium" || rec.Header().Get("X-RateLimit-Limit-RPS") != "100" {
+		t.Fatalf("expected premium tier headers, got %v", rec.Header())
+	}
+
+	// No tier claim falls back to the default tier.
+	ok, rec = allowed(token(jwt.MapClaims{"sub": "f"}), 3)
+	if ok != 2 {
+		t.Fatalf("expected default (free) burst of 2, got %d", ok)
+	}
+	if rec.Header().Get("X-RateLimit-Tier") != "free" {
+		t.Fatalf("expected default tier header, got %q", rec.Header().Get("X-RateLimit-Tier"))
+	}
+
+	if got := testutil.ToFloat64(metrics.RateLimitTier.WithLabelValues("tiered", "premium", "limited")); got != 1 {
+		t.Fatalf("expected 1 limited premium request, got %v", got)
+	}
+	if got := testutil.ToFloat64(metrics.RateLimitTier.WithLabelValues("tiered", "free", "allowed")); got != 2 {
+		t.Fatalf("expected 2 allowed free requests, got %v", got)
+	}
+}
+
+func TestRateLimitPerMethodBuckets(t *testing.T) {
+	limiter := ratelimit.NewMemoryLimiter(time.Minute, time.Minute)
+	defer limiter.Close()
+
+	h := RateLimit(limiter, IPResolver{}, RateLimitConfig{
+		Enabled:   true,
+		RPS:       0.001,
+		Burst:     5,
+		Scope:     "ip",
+		RouteName: "pm",
+		PerMethod: true,
+		Methods:   map[string]RateLimitTier{http.MethodPost: {RPS: 0.001, Burst: 2}},
+	}, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.WriteHeader(http.StatusOK)
+	}))
+
+	send := func(method string, n int) (ok int) {
+		for i := 0; i < n; i++ {
+			rec := httptest.NewRecorder()
+			req := httptest.NewRequest(method, "/", nil)
+			req.RemoteAddr = "192.0.2.1:1234"
+			h.ServeHTTP(rec, req)
+			if rec.Code == http.StatusOK {
+				ok++
+			}
+		}
+		return ok
+	}
+
+	if got := send(http.MethodGet, 10); got != 5 {
+		t.Fatalf("expected GET burst of 5, got %d", got)
+	}
+	// Exhausting GET leaves the POST bucket (with its own burst) untouched.
+	if got := send(http.MethodPost, 3); got != 2 {
+		t.Fatalf("expected POST burst of 2 after GETs, got %d", got)
+	}
+	if _, found, _ := limiter.Peek(context.Background(), RateLimitKey("pm:GET", "ip", "192.0.2.1")); !found {
+		t.Fatal("expected GET bucket under the per-method key")
+	}
+	// HEAD draws on the GET budget rather than getting its own.
+	if got := send(http.MethodHead, 1); got != 0 {
+		t.Fatalf("expected HEAD to share the exhausted GET bucket, got %d allowed", got)
+	}
+	// Made-up methods share the route's bucket instead of each getting one.
+	if got := send("FOO", 3) + send("BAR", 3); got != 5 {
+		t.Fatalf("expected unknown methods to share one burst of 5, got %d", got)
+	}
+	if _, found, _ := limiter.Peek(context.Background(), RateLimitKey("pm:FOO", "ip", "192.0.2.1")); found {
+		t.Fatal("expected no bucket for an unknown method")
+	}
+}
@@ -1,18 +1,16 @@
 package mw
 
 import (
-	"encoding/json"
 	"net/http"
+
+	"github.com/3xpluto/go-api-gateway/internal/httpx"
 )
 
 func Recover(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		defer func() {
 			if rec := recover(); rec != nil {
-				w.WriteHeader(http.StatusInternalServerError)
-				_ = json.NewEncoder(w).Encode(map[string]any{
-					"error": "internal_error",
-				})
+				httpx.WriteError(w, http.StatusInternalServerError, "internal_error", nil)
 			}
 		}()
 		next.ServeHTTP(w, r)
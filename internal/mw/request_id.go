@@ -5,29 +5,126 @@ import (
 	"crypto/rand"
 	"encoding/hex"
 	"net/http"
+
+	"github.com/3xpluto/go-api-gateway/internal/httpx"
 )
 
 type ctxKey string
 
 const requestIDKey ctxKey = "rid"
 
+// DefaultRequestIDHeader is used when RequestIDConfig.Header is empty.
+const DefaultRequestIDHeader = "X-Request-Id"
+
+// DefaultRequestIDFallbacks are also read on input when RequestIDConfig.Fallbacks is nil.
+var DefaultRequestIDFallbacks = []string{"X-Request-Id", "X-Correlation-Id"}
+
+// RequestIDConfig names the request ID header. The zero value uses
+// X-Request-Id and accepts X-Correlation-Id on input.
+type RequestIDConfig struct {
+	Header    string   // set on the upstream request and the client response
+	Fallbacks []string // also read on input, in order, when Header is absent; nil uses the defaults
+}
+
+func (c RequestIDConfig) header() string {
+	if c.Header == "" {
+		return DefaultRequestIDHeader
+	}
+	return c.Header
+}
+
+// Headers lists every header a request ID is read from.
+func (c RequestIDConfig) Headers() []string {
+	fallbacks := c.Fallbacks
+	if fallbacks == nil {
+		fallbacks = DefaultRequestIDFallbacks
+	}
+	return append([]string{c.header()}, fallbacks...)
+}
+
+// incoming returns the caller's id and the header it came in, or "" when none was sent.
+func (c RequestIDConfig) incoming(r *http.Request) (rid, header string) {
+	if rid := r.Header.Get(c.header()); rid != "" {
+		return rid, c.header()
+	}
+	fallbacks := c.Fallbacks
+	if fallbacks == nil {
+		fallbacks = DefaultRequestIDFallbacks
+	}
+	for _, h := range fallbacks {
+		if rid := r.Header.Get(h); rid != "" {
+			return rid, h
+		}
+	}
+	return "", c.header()
+}
+
 func RequestID(next http.Handler) http.Handler {
+	return RequestIDWith(RequestIDConfig{}, next)
+}
+
+// RequestIDWith is RequestID with a configurable header name and input fallbacks.
+func RequestIDWith(cfg RequestIDConfig, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		rid := r.Header.Get("X-Request-Id")
+		rid, _ := cfg.incoming(r)
 		if rid == "" {
-			buf := make([]byte, 12)
-			_, _ = rand.Read(buf)
-			rid = hex.EncodeToString(buf)
+			rid = newRequestID()
 		}
-		// propagate to upstream + client
-		r.Header.Set("X-Request-Id", rid)
-		w.Header().Set("X-Request-Id", rid)
+		// propagate to upstream + client under the configured name
+		r.Header.Set(cfg.header(), rid)
+		w.Header().Set(cfg.header(), rid)
 
 		ctx := context.WithValue(r.Context(), requestIDKey, rid)
 		next.ServeHTTP(w, r.WithContext(ctx))
 	})
 }
 
+// newRequestID returns 96 random bits as hex, so ids collide with
+// negligible probability even across gateway instances.
+func newRequestID() string {
+	buf := make([]byte, 12)
+	_, _ = rand.Read(buf)
+	return hex.EncodeToString(buf)
+}
+
+// maxRequestIDLen bounds caller-supplied ids checked by RequireRequestID.
+const maxRequestIDLen = 128
+
+// ValidRequestID reports whether id is 1-128 characters of [A-Za-z0-9._:-].
+func ValidRequestID(id string) bool {
+	if id == "" || len(id) > maxRequestIDLen {
+		return false
+	}
+	for i := 0; i < len(id); i++ {
+		c := id[i]
+		switch {
+		case c >= 'a' && c <= 'z', c >= 'A' && c <= 'Z', c >= '0' && c <= '9':
+		case c == '.', c == '_', c == ':', c == '-':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// RequireRequestID rejects requests whose request ID (cfg's header or a
+// fallback) is missing or invalid with 400 instead of letting RequestID
+// generate one. Wrap it around RequestIDWith using the same cfg.
+func RequireRequestID(cfg RequestIDConfig, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		rid, header := cfg.incoming(r)
+		if rid == "" {
+			httpx.WriteError(w, http.StatusBadRequest, "missing_request_id", map[string]any{"header": header})
+			return
+		}
+		if !ValidRequestID(rid) {
+			httpx.WriteError(w, http.StatusBadRequest, "invalid_request_id", map[string]any{"header": header})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
 func RID(ctx context.Context) string {
 	v, _ := ctx.Value(requestIDKey).(string)
 	return v
@@ -0,0 +1,17 @@
+package mw
+
+import "testing"
+
+func TestNewRequestIDIsUniqueAndValid(t *testing.T) {
+	seen := make(map[string]bool, 100000)
+	for i := 0; i < 100000; i++ {
+		id := newRequestID()
+		if !ValidRequestID(id) {
+			t.Fatalf("generated id %q is not valid", id)
+		}
+		if seen[id] {
+			t.Fatalf("duplicate generated id %q after %d ids", id, i)
+		}
+		seen[id] = true
+	}
+}
@@ -1,35 +1,62 @@
 package mw
 
 import (
-	"encoding/json"
+	"errors"
 	"net/http"
+
+	"github.com/3xpluto/go-api-gateway/internal/httpx"
 )
 
 type AuthHandler interface {
 	ValidateBearer(r *http.Request) (string, error)
 }
 
+// authenticate prefers PrincipalAuthHandler so the caller's tier is kept.
+func authenticate(auth AuthHandler, r *http.Request) (Principal, error) {
+	if pa, ok := auth.(PrincipalAuthHandler); ok {
+		return pa.Authenticate(r)
+	}
+	sub, err := auth.ValidateBearer(r)
+	return Principal{Subject: sub}, err
+}
+
 func RequireAuth(auth AuthHandler, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		sub, err := auth.ValidateBearer(r)
+		p, err := authenticate(auth, r)
 		if err != nil {
-			w.WriteHeader(http.StatusUnauthorized)
-			_ = json.NewEncoder(w).Encode(map[string]any{
-				"error": "unauthorized",
-			})
+			httpx.WriteError(w, http.StatusUnauthorized, "unauthorized", nil)
 			return
 		}
-		WithSubject(next, sub).ServeHTTP(w, r)
+		WithPrincipal(next, p).ServeHTTP(w, r)
 	})
 }
 
 func OptionalAuth(auth AuthHandler, next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		sub, err := auth.ValidateBearer(r)
+		p, err := authenticate(auth, r)
 		if err != nil {
 			next.ServeHTTP(w, r)
 			return
 		}
-		WithSubject(next, sub).ServeHTTP(w, r)
+		WithPrincipal(next, p).ServeHTTP(w, r)
+	})
+}
+
+// OptionalAuthRejectInvalid is OptionalAuth, except credentials that are
+// present but fail validation get 401 instead of being treated as anonymous.
+// That includes an Authorization header in a scheme other than Bearer.
+// The AuthHandler must return ErrNoToken (possibly wrapped) when no token is sent.
+func OptionalAuthRejectInvalid(auth AuthHandler, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		p, err := authenticate(auth, r)
+		if errors.Is(err, ErrNoToken) && r.Header.Get("Authorization") == "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if err != nil {
+			httpx.WriteError(w, http.StatusUnauthorized, "unauthorized", nil)
+			return
+		}
+		WithPrincipal(next, p).ServeHTTP(w, r)
 	})
 }
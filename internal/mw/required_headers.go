@@ -0,0 +1,43 @@
+package mw
+
+import (
+	"net/http"
+	"slices"
+
+	"github.com/3xpluto/go-api-gateway/internal/httpx"
+)
+
+// HeaderRequirement names a header the client must send. When Values is
+// non-empty the header must also equal one of them.
+type HeaderRequirement struct {
+	Name   string
+	Values []string
+}
+
+// RequireHeaders rejects requests missing a required header (or carrying a
+// disallowed value) with 400 before they reach the upstream.
+func RequireHeaders(reqs []HeaderRequirement, next http.Handler) http.Handler {
+	if len(reqs) == 0 {
+		return next
+	}
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, hr := range reqs {
+			v := r.Header.Get(hr.Name)
+			if v == "" {
+				httpx.WriteError(w, http.StatusBadRequest, "missing_required_header", map[string]any{
+					"header": hr.Name,
+				})
+				return
+			}
+			if len(hr.Values) > 0 && !slices.Contains(hr.Values, v) {
+				httpx.WriteError(w, http.StatusBadRequest, "invalid_required_header", map[string]any{
+					"header":  hr.Name,
+					"allowed": hr.Values,
+				})
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
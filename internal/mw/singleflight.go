@@ -0,0 +1,319 @@
+package mw
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"golang.org/x/sync/singleflight"
+)
+
+// SingleFlightConfig coalesces concurrent identical requests on a route.
+type SingleFlightConfig struct {
+	Group   *singleflight.Group // one per route; nil disables
+	Metrics *Metrics            // optional; counts responses handed to waiters
+
+	// IgnoreHeaders are more request headers that never change the
+	// response, such as a custom request ID header.
+	IgnoreHeaders []string
+
+	// MaxBytes caps the responses that are buffered and shared; 0 means
+	// DefaultSingleFlightMaxBytes.
+	MaxBytes int64
+}
+
+// DefaultSingleFlightMaxBytes is the largest response shared by default.
+const DefaultSingleFlightMaxBytes = 1 << 20
+
+// flightKeyHeaders must match for two requests to share a response.
+var flightKeyHeaders = []string{"Accept", "Accept-Encoding", "Accept-Language", "Authorization", "Cookie", "Origin"}
+
+// flightIgnoredHeaders may differ between requests that share a response:
+// they don't pick what the upstream sends, unless its Vary says so.
+var flightIgnoredHeaders = []string{
+	"Cache-Control", "Connection", "Forwarded", "Keep-Alive", "Pragma", "Referer", "Te",
+	"Traceparent", "Tracestate", "User-Agent", "Via",
+	"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "X-Real-Ip", "X-Request-Id",
+}
+
+// SingleFlight sends one upstream request for concurrent identical GET and
+// HEAD requests and replays its response to every caller. Requests are
+// identical when method, host, path, query and flightKeyHeaders match. A
+// request with any header outside those and flightIgnoredHeaders (Range,
+// API keys, conditionals, ...) is never coalesced, so the upstream can't
+// answer one client with a response meant for another's headers.
+//
+// The shared call outlives the first caller's cancellation, and any caller
+// whose client goes away stops waiting for it. Responses are buffered up to
+// MaxBytes; a larger one, or one without a Content-Length, streams to the
+// request that made it. Those, and responses marked Cache-Control private
+// or no-store, setting cookies, or with a Vary on anything but
+// flightKeyHeaders, are only given to the request that made them; the
+// waiters then go upstream themselves. Upgrades and event streams are never
+// coalesced.
+func SingleFlight(cfg SingleFlightConfig, next http.Handler) http.Handler {
+	if cfg.Group == nil {
+		return next
+	}
+	maxBytes := cfg.MaxBytes
+	if maxBytes <= 0 {
+		maxBytes = DefaultSingleFlightMaxBytes
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !coalescable(r, cfg.IgnoreHeaders) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		led := false
+		handoff := make(chan *flightStream, 1)
+		ch := cfg.Group.DoChan(flightKey(r), func() (any, error) {
+			led = true
+			return recordFlight(next, r, maxBytes, handoff)
+		})
+		var res singleflight.Result
+		select {
+		case s := <-handoff:
+			s.writeTo(r.Context(), w)
+			return
+		case res = <-ch:
+		case <-r.Context().Done():
+			return // the flight carries on for the other callers
+		}
+		if res.Err != nil {
+			rethrow(res.Err)
+		}
+		resp := res.Val.(*flightResponse)
+		if led {
+			if resp.stream != nil {
+				resp.stream.writeTo(r.Context(), w)
+				return
+			}
+		} else {
+			if !resp.shareable() {
+				next.ServeHTTP(w, r)
+				return
+			}
+			if cfg.Metrics != nil {
+				cfg.Metrics.SingleFlightShared.WithLabelValues(RouteName(r.Context())).Inc()
+			}
+		}
+		resp.writeTo(w)
+	})
+}
+
+func coalescable(r *http.Request, ignore []string) bool {
+	if r.Method != http.MethodGet && r.Method != http.MethodHead {
+		return false
+	}
+	if strings.Contains(r.Header.Get("Accept"), "text/event-stream") {
+		return false
+	}
+	for name := range r.Header {
+		name = http.CanonicalHeaderKey(name)
+		if slices.Contains(flightKeyHeaders, name) || slices.Contains(flightIgnoredHeaders, name) {
+			continue
+		}
+		if !slices.ContainsFunc(ignore, func(h string) bool { return strings.EqualFold(h, name) }) {
+			return false
+		}
+	}
+	return true
+}
+
+func flightKey(r *http.Request) string {
+	var b strings.Builder
+	b.WriteString(r.Method)
+	b.WriteByte(' ')
+	b.WriteString(r.Host)
+	b.WriteString(r.URL.RequestURI())
+	for _, h := range flightKeyHeaders {
+		b.WriteByte(0)
+		b.WriteString(strings.Join(r.Header.Values(h), ","))
+	}
+	return b.String()
+}
+
+var errFlightAborted = errors.New("single-flight upstream response aborted")
+
+// flightPanic carries a panic out of the flight's goroutine, which has no
+// server to recover it, to be raised again in each caller's handler.
+type flightPanic struct{ v any }
+
+func (p flightPanic) Error() string { return fmt.Sprint("single-flight handler panicked: ", p.v) }
+
+// rethrow fails the calling handler the way the flight failed.
+func rethrow(err error) {
+	if p, ok := err.(flightPanic); ok {
+		panic(p.v)
+	}
+	// The upstream body broke off; abort this connection as the proxy would.
+	panic(http.ErrAbortHandler)
+}
+
+// recordFlight runs next for the request r that leads the flight, into a
+// buffer or, for a response too large to buffer, handed off to r's handler
+// through handoff. Panics, including the proxy's http.ErrAbortHandler,
+// become errors every caller can act on.
+func recordFlight(next http.Handler, r *http.Request, maxBytes int64, handoff chan<- *flightStream) (resp *flightResponse, err error) {
+	rec := &flightRecorder{
+		header:   http.Header{},
+		max:      maxBytes,
+		bodiless: r.Method == http.MethodHead,
+		leader:   r.Context(),
+		handoff:  handoff,
+	}
+	defer func() {
+		p := recover()
+		if s := rec.stream; s != nil {
+			// The leader has the response; the waiters go upstream.
+			if p == http.ErrAbortHandler {
+				s.err = errFlightAborted
+			} else if p != nil {
+				s.err = flightPanic{p}
+			}
+			close(s.chunks)
+			resp, err = &flightResponse{stream: s}, nil
+		} else if p == http.ErrAbortHandler {
+			resp, err = nil, errFlightAborted
+		} else if p != nil {
+			resp, err = nil, flightPanic{p}
+		}
+	}()
+	next.ServeHTTP(rec, r.WithContext(context.WithoutCancel(r.Context())))
+	if rec.status == 0 {
+		rec.status = http.StatusOK
+	}
+	return &flightResponse{status: rec.status, header: rec.header, body: rec.body.Bytes()}, nil
+}
+
+// flightResponse is one recorded response, replayed to every caller, or
+// the stream of one that was too large to record.
+type flightResponse struct {
+	status int
+	header http.Header
+	body   []byte
+	stream *flightStream
+}
+
+// shareable reports whether the response may go to clients other than the
+// one that made it.
+func (f *flightResponse) shareable() bool {
+	if f.stream != nil {
+		return false
+	}
+	if len(f.header.Values("Set-Cookie")) > 0 {
+		return false
+	}
+	for _, v := range f.header.Values("Vary") {
+		for _, h := range strings.Split(v, ",") {
+			if h = strings.TrimSpace(h); h != "" && !slices.Contains(flightKeyHeaders, http.CanonicalHeaderKey(h)) {
+				return false // includes "*"
+			}
+		}
+	}
+	for _, v := range f.header.Values("Cache-Control") {
+		for _, d := range strings.Split(v, ",") {
+			d, _, _ = strings.Cut(d, "=")
+			switch strings.ToLower(strings.TrimSpace(d)) {
+			case "private", "no-store":
+				return false
+			}
+		}
+	}
+	return true
+}
+
+func (f *flightResponse) writeTo(w http.ResponseWriter) {
+	h := w.Header()
+	for k, v := range f.header {
+		h[k] = slices.Clone(v)
+	}
+	w.WriteHeader(f.status)
+	_, _ = w.Write(f.body)
+}
+
+// flightStream is a response passed through to the leading request as it
+// arrives. err is set before chunks is closed.
+type flightStream struct {
+	status int
+	header http.Header
+	chunks chan []byte
+	err    error
+}
+
+func (s *flightStream) writeTo(ctx context.Context, w http.ResponseWriter) {
+	h := w.Header()
+	for k, v := range s.header {
+		h[k] = v
+	}
+	w.WriteHeader(s.status)
+	rc := http.NewResponseController(w)
+	for {
+		select {
+		case b, ok := <-s.chunks:
+			if !ok {
+				if s.err != nil {
+					rethrow(s.err)
+				}
+				return
+			}
+			if _, err := w.Write(b); err != nil {
+				return
+			}
+			_ = rc.Flush()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+type flightRecorder struct {
+	header http.Header
+	status int
+	body   bytes.Buffer
+
+	max      int64
+	bodiless bool            // HEAD: a Content-Length but no body
+	leader   context.Context // the leading request's own context
+	handoff  chan<- *flightStream
+	stream   *flightStream // set once the response is handed off
+}
+
+func (r *flightRecorder) Header() http.Header { return r.header }
+
+func (r *flightRecorder) WriteHeader(code int) {
+	// 1xx informational responses aren't replayed.
+	if r.status != 0 || code < 200 {
+		return
+	}
+	r.status = code
+	if r.bodiless || code == http.StatusNoContent || code == http.StatusNotModified {
+		return
+	}
+	if n, err := strconv.ParseInt(r.header.Get("Content-Length"), 10, 64); err == nil && n <= r.max {
+		return
+	}
+	// Too large to buffer, or of unknown length: the leader gets it alone.
+	r.stream = &flightStream{status: code, header: r.header.Clone(), chunks: make(chan []byte)}
+	r.handoff <- r.stream
+}
+
+func (r *flightRecorder) Write(p []byte) (int, error) {
+	if r.status == 0 {
+		r.WriteHeader(http.StatusOK)
+	}
+	if r.stream == nil {
+		return r.body.Write(p)
+	}
+	select {
+	case r.stream.chunks <- bytes.Clone(p):
+		return len(p), nil
+	case <-r.leader.Done():
+		return 0, r.leader.Err()
+	}
+}
@@ -0,0 +1,190 @@
+package mw
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"golang.org/x/sync/singleflight"
+)
+
+// fireConcurrently sends n copies of the request built by newReq while the
+// upstream holds the first one, and returns the recorded responses.
+func fireConcurrently(t *testing.T, h http.Handler, n int, entered <-chan struct{}, release chan struct{}, newReq func() *http.Request) []*httptest.ResponseRecorder {
+	t.Helper()
+	recs := make([]*httptest.ResponseRecorder, n)
+	var wg sync.WaitGroup
+	for i := range recs {
+		recs[i] = httptest.NewRecorder()
+		wg.Add(1)
+		go func(rec *httptest.ResponseRecorder) {
+			defer wg.Done()
+			h.ServeHTTP(rec, newReq())
+		}(recs[i])
+	}
+	<-entered
+	time.Sleep(50 * time.Millisecond) // let the rest join the flight
+	close(release)
+	wg.Wait()
+	return recs
+}
+
+func TestSingleFlightCoalescesIdenticalGets(t *testing.T) {
+	const n = 20
+	metrics := NewMetrics(prometheus.NewRegistry())
+	var calls atomic.Int32
+	entered, release := make(chan struct{}, n), make(chan struct{})
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		calls.Add(1)
+		entered <- struct{}{}
+		<-release
+		w.Header().Set("X-Upstream", "yes")
+		w.Header().Set("Content-Length", "11")
+		w.WriteHeader(http.StatusOK)
+		_, _ = w.Write([]byte("shared body"))
+	})
+	h := WithRoute(SingleFlight(SingleFlightConfig{Group: &singleflight.Group{}, Metrics: metrics, IgnoreHeaders: []string{"X-Trace-Id"}}, upstream), "sf")
+
+	// Headers that don't pick the response may differ between callers.
+	var i atomic.Int32
+	recs := fireConcurrently(t, h, n, entered, release, func() *http.Request {
+		r := httptest.NewRequest(http.MethodGet, "/items?page=1", nil)
+		id := strconv.Itoa(int(i.Add(1)))
+		r.Header.Set("User-Agent", "client/"+id)
+		r.Header.Set("X-Request-Id", "rid-"+id)
+		r.Header.Set("X-Trace-Id", "trace-"+id)
+		return r
+	})
+	if got := calls.Load(); got != 1 {
+		t.Fatalf("expected one upstream call for %d identical GETs, got %d", n, got)
+	}
+	for _, rec := range recs {
+		if rec.Code != http.StatusOK || rec.Body.String() != "shared body" || rec.Header().Get("X-Upstream") != "yes" {
+			t.Fatalf("expected every caller to get the upstream response, got %d %q %v", rec.Code, rec.Body.String(), rec.Header())
+		}
+	}
+	if got := testutil.ToFloat64(metrics.SingleFlightShared.WithLabelValues("sf")); got != n-1 {
+		t.Fatalf("expected %d shared responses, got %v", n-1, got)
+	}
+}
+
+func TestSingleFlightKeepsPrivateAndUnsafeRequestsApart(t *testing.T) {
+	const n = 5
+	for _, tc := range []struct {
+		name       string
+		method     string
+		respHeader [2]string             // set on the upstream response
+		reqHeader  func(i int) [2]string // set on the i'th request
+	}{
+		{name: "private response", method: http.MethodGet, respHeader: [2]string{"Cache-Control", "private, max-age=60"}},
+		{name: "post", method: http.MethodPost},
+		{name: "different credentials", method: http.MethodGet, reqHeader: func(i int) [2]string { return [2]string{"Authorization", "Bearer " + strconv.Itoa(i)} }},
+		{name: "unkeyed credentials", method: http.MethodGet, reqHeader: func(i int) [2]string { return [2]string{"X-Api-Key", strconv.Itoa(i)} }},
+		{name: "range", method: http.MethodGet, reqHeader: func(int) [2]string { return [2]string{"Range", "bytes=0-9"} }},
+		{name: "different language", method: http.MethodGet, reqHeader: func(i int) [2]string { return [2]string{"Accept-Language", "l" + strconv.Itoa(i)} }},
+		{name: "vary on an unkeyed header", method: http.MethodGet, respHeader: [2]string{"Vary", "Accept-Encoding, User-Agent"}},
+		{name: "vary star", method: http.MethodGet, respHeader: [2]string{"Vary", "*"}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var calls atomic.Int32
+			entered, release := make(chan struct{}, n), make(chan struct{})
+			h := SingleFlight(SingleFlightConfig{Group: &singleflight.Group{}}, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				if calls.Add(1) == 1 {
+					entered <- struct{}{}
+					<-release
+				}
+				if tc.respHeader[0] != "" {
+					w.Header().Set(tc.respHeader[0], tc.respHeader[1])
+				}
+				w.WriteHeader(http.StatusOK)
+			}))
+
+			var i atomic.Int32
+			fireConcurrently(t, h, n, entered, release, func() *http.Request {
+				r := httptest.NewRequest(tc.method, "/items", nil)
+				if tc.reqHeader != nil {
+					kv := tc.reqHeader(int(i.Add(1)))
+					r.Header.Set(kv[0], kv[1])
+				}
+				return r
+			})
+			if got := calls.Load(); got != n {
+				t.Fatalf("expected %d upstream calls, got %d", n, got)
+			}
+		})
+	}
+}
+
+func TestSingleFlightStreamsLargeAndUnsizedResponses(t *testing.T) {
+	const n = 5
+	for _, tc := range []struct {
+		name          string
+		contentLength string
+	}{
+		{name: "over the cap", contentLength: "11"},
+		{name: "unknown length"},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			var calls atomic.Int32
+			entered, release := make(chan struct{}, n), make(chan struct{})
+			h := SingleFlight(SingleFlightConfig{Group: &singleflight.Group{}, MaxBytes: 10}, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+				if calls.Add(1) == 1 {
+					entered <- struct{}{}
+					<-release
+				}
+				if tc.contentLength != "" {
+					w.Header().Set("Content-Length", tc.contentLength)
+				}
+				_, _ = w.Write([]byte("large body"))
+				_, _ = w.Write([]byte("!"))
+			}))
+
+			recs := fireConcurrently(t, h, n, entered, release, func() *http.Request {
+				return httptest.NewRequest(http.MethodGet, "/items", nil)
+			})
+			if got := calls.Load(); got != n {
+				t.Fatalf("expected every caller to go upstream, got %d calls", got)
+			}
+			for _, rec := range recs {
+				if rec.Code != http.StatusOK || rec.Body.String() != "large body!" {
+					t.Fatalf("expected the whole body, got %d %q", rec.Code, rec.Body.String())
+				}
+			}
+		})
+	}
+}
+
+func TestSingleFlightWaitersLeaveWithTheirClient(t *testing.T) {
+	entered, release := make(chan struct{}, 1), make(chan struct{})
+	defer close(release)
+	h := SingleFlight(SingleFlightConfig{Group: &singleflight.Group{}}, http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		entered <- struct{}{}
+		<-release
+	}))
+
+	ctx, cancel := context.WithCancel(context.Background())
+	go h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/items", nil).WithContext(ctx))
+	<-entered
+
+	waiterCtx, leave := context.WithCancel(context.Background())
+	done := make(chan struct{})
+	go func() {
+		h.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(http.MethodGet, "/items", nil).WithContext(waiterCtx))
+		close(done)
+	}()
+	time.Sleep(20 * time.Millisecond) // let it join the flight
+	leave()
+	cancel()
+	select {
+	case <-done:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected a waiter to stop waiting once its client left")
+	}
+}
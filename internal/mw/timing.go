@@ -0,0 +1,179 @@
+package mw
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"time"
+)
+
+const timingsKey ctxKey = "timings"
+
+// TimingPhase is the time spent in one middleware, excluding the phases it wraps.
+type TimingPhase struct {
+	Name     string
+	Duration time.Duration
+}
+
+// Timings accumulates per-phase durations for one request. Phases nest the
+// way the middleware chain does; each records its own (exclusive) time, so
+// the phases plus any unattributed time add up to the total.
+type Timings struct {
+	mu     sync.Mutex
+	start  time.Time
+	phases []TimingPhase   // in completion order: innermost first
+	nested []time.Duration // per open phase: total time of the phases inside it
+	ttfb   time.Duration   // upstream time to first byte, 0 if never reached
+}
+
+// TimingsFrom returns the request's accumulator, or nil when timing is off.
+func TimingsFrom(ctx context.Context) *Timings {
+	t, _ := ctx.Value(timingsKey).(*Timings)
+	return t
+}
+
+// Phases returns the completed phases, outermost first.
+func (t *Timings) Phases() []TimingPhase {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	out := make([]TimingPhase, len(t.phases))
+	for i, p := range t.phases {
+		out[len(out)-1-i] = p
+	}
+	return out
+}
+
+// UpstreamTTFB returns the time from sending the upstream request to its first response byte.
+func (t *Timings) UpstreamTTFB() time.Duration {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.ttfb
+}
+
+func (t *Timings) enter() {
+	t.mu.Lock()
+	t.nested = append(t.nested, 0)
+	t.mu.Unlock()
+}
+
+func (t *Timings) exit(name string, elapsed time.Duration) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	inner := t.nested[len(t.nested)-1]
+	t.nested = t.nested[:len(t.nested)-1]
+	if len(t.nested) > 0 {
+		t.nested[len(t.nested)-1] += elapsed
+	}
+	t.phases = append(t.phases, TimingPhase{Name: name, Duration: elapsed - inner})
+}
+
+// TimePhase records the time spent in next, minus any phases nested inside
+// it, as name. It is a pass-through when the request carries no Timings.
+func TimePhase(name string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := TimingsFrom(r.Context())
+		if t == nil {
+			next.ServeHTTP(w, r)
+			return
+		}
+		t.enter()
+		start := time.Now()
+		defer func() { t.exit(name, time.Since(start)) }()
+		next.ServeHTTP(w, r)
+	})
+}
+
+// TraceUpstream returns r with a client trace that records the upstream
+// time to first byte, or r itself when timing is off. Only the first
+// attempt to get a response counts when requests are hedged or retried.
+func TraceUpstream(r *http.Request) *http.Request {
+	t := TimingsFrom(r.Context())
+	if t == nil {
+		return r
+	}
+	start := time.Now()
+	trace := &httptrace.ClientTrace{
+		GotFirstResponseByte: func() {
+			t.mu.Lock()
+			defer t.mu.Unlock()
+			if t.ttfb == 0 {
+				t.ttfb = time.Since(start)
+			}
+		},
+	}
+	return r.WithContext(httptrace.WithClientTrace(r.Context(), trace))
+}
+
+// TimingConfig configures Timing.
+type TimingConfig struct {
+	Header bool // set a Server-Timing header with gateway, upstream_ttfb and total
+}
+
+// Timing attaches a Timings accumulator to each request and logs a
+// request_timing line with every phase when the request completes.
+// Debug use only: it adds allocations and a log line per request.
+func Timing(log *slog.Logger, cfg TimingConfig, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		t := &Timings{start: time.Now()}
+		r = r.WithContext(context.WithValue(r.Context(), timingsKey, t))
+		if cfg.Header {
+			w = &serverTimingWriter{ResponseWriter: w, t: t}
+		}
+		next.ServeHTTP(w, r)
+		total := time.Since(t.start)
+
+		phases := t.Phases()
+		attrs := make([]any, 0, len(phases))
+		for _, p := range phases {
+			attrs = append(attrs, slog.String(p.Name, p.Duration.String()))
+		}
+		log.Info("request_timing",
+			slog.String("rid", RID(r.Context())),
+			slog.String("route", RouteName(r.Context())),
+			slog.Group("phases", attrs...),
+			slog.String("upstream_ttfb", t.UpstreamTTFB().String()),
+			slog.String("total", total.String()),
+		)
+	})
+}
+
+// serverTimingWriter sets Server-Timing just before the headers go out.
+// Phases are still open at that point, so the header carries only the
+// time to headers, split into upstream time to first byte and the rest.
+type serverTimingWriter struct {
+	http.ResponseWriter
+	t           *Timings
+	wroteHeader bool
+}
+
+func (w *serverTimingWriter) WriteHeader(code int) {
+	if !w.wroteHeader {
+		w.wroteHeader = true
+		total := time.Since(w.t.start)
+		ttfb := w.t.UpstreamTTFB()
+		metrics := []string{fmt.Sprintf("gateway;dur=%s", ms(total-ttfb))}
+		if ttfb > 0 {
+			metrics = append(metrics, fmt.Sprintf("upstream_ttfb;dur=%s", ms(ttfb)))
+		}
+		metrics = append(metrics, fmt.Sprintf("total;dur=%s", ms(total)))
+		w.Header().Add("Server-Timing", strings.Join(metrics, ", "))
+	}
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *serverTimingWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	return w.ResponseWriter.Write(p)
+}
+
+func (w *serverTimingWriter) Unwrap() http.ResponseWriter { return w.ResponseWriter }
+
+func ms(d time.Duration) string {
+	return fmt.Sprintf("%.3f", float64(d)/float64(time.Millisecond))
+}
@@ -0,0 +1,85 @@
+package mw
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTimingPhasesSumToTotal(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		time.Sleep(20 * time.Millisecond)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer up.Close()
+
+	sleepy := func(d time.Duration, next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			time.Sleep(d)
+			next.ServeHTTP(w, r)
+		})
+	}
+	upstream := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		req, _ := http.NewRequestWithContext(TraceUpstream(r).Context(), http.MethodGet, up.URL, nil)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		resp.Body.Close()
+		w.WriteHeader(resp.StatusCode)
+	})
+	var h http.Handler = TimePhase("upstream", upstream)
+	h = TimePhase("auth", sleepy(10*time.Millisecond, h))
+	h = TimePhase("rate_limit", sleepy(5*time.Millisecond, h))
+
+	var buf bytes.Buffer
+	h = Timing(slog.New(slog.NewJSONHandler(&buf, nil)), TimingConfig{Header: true}, h)
+
+	rec := httptest.NewRecorder()
+	h.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+
+	st := rec.Header().Get("Server-Timing")
+	if !strings.Contains(st, "upstream_ttfb;dur=") || !strings.Contains(st, "total;dur=") {
+		t.Fatalf("unexpected Server-Timing %q", st)
+	}
+
+	var line struct {
+		Msg    string            `json:"msg"`
+		Phases map[string]string `json:"phases"`
+		TTFB   string            `json:"upstream_ttfb"`
+		Total  string            `json:"total"`
+	}
+	if err := json.Unmarshal(buf.Bytes(), &line); err != nil {
+		t.Fatalf("bad log line %q: %v", buf.String(), err)
+	}
+	if line.Msg != "request_timing" || len(line.Phases) != 3 {
+		t.Fatalf("expected a request_timing line with 3 phases, got %s", buf.String())
+	}
+	parse := func(s string) time.Duration {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return d
+	}
+	var sum time.Duration
+	for _, v := range line.Phases {
+		sum += parse(v)
+	}
+	total := parse(line.Total)
+	if sum > total || total-sum > 5*time.Millisecond {
+		t.Fatalf("phases sum to %s, total %s: %v", sum, total, line.Phases)
+	}
+	if d := parse(line.Phases["auth"]); d < 10*time.Millisecond || d >= parse(line.Phases["upstream"]) {
+		t.Fatalf("auth phase should exclude the upstream time, got %s: %v", d, line.Phases)
+	}
+	if ttfb := parse(line.TTFB); ttfb < 20*time.Millisecond || ttfb > parse(line.Phases["upstream"]) {
+		t.Fatalf("unexpected upstream ttfb %s (upstream phase %s)", ttfb, line.Phases["upstream"])
+	}
+}
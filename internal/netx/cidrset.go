@@ -38,6 +38,16 @@ func ParseCIDRSet(items []string) (*CIDRSet, error) {
 	return set, nil
 }
 
+// RemoteIP parses the IP out of an http.Request.RemoteAddr ("host:port" or
+// a bare IP). It returns nil for anything else, such as a unix socket path.
+func RemoteIP(remoteAddr string) net.IP {
+	host, _, err := net.SplitHostPort(remoteAddr)
+	if err != nil {
+		return net.ParseIP(remoteAddr)
+	}
+	return net.ParseIP(host)
+}
+
 func (s *CIDRSet) Contains(ip net.IP) bool {
 	if s == nil || len(s.nets) == 0 || ip == nil {
 		return false
@@ -0,0 +1,68 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"mime"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"golang.org/x/net/http2"
+)
+
+// NewH2CTransport builds an upstream transport that speaks HTTP/2 without
+// TLS (h2c), as gRPC servers do on plain ports. With a socket path every
+// connection is dialed there instead, like NewUnixTransport. https
+// upstreams don't need it: NewTransport already negotiates HTTP/2 via ALPN.
+func NewH2CTransport(cfg TransportConfig, socket string) http.RoundTripper {
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = defaultDialTimeout
+	}
+	if cfg.IdleConnTimeout <= 0 {
+		cfg.IdleConnTimeout = defaultIdleConnTimeout
+	}
+	dialer := &net.Dialer{
+		Timeout:   cfg.DialTimeout,
+		KeepAlive: 30 * time.Second,
+	}
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			if socket != "" {
+				return dialer.DialContext(ctx, "unix", socket)
+			}
+			return dialer.DialContext(ctx, network, addr)
+		},
+		IdleConnTimeout: cfg.IdleConnTimeout,
+		// Notice dead connections under long-lived streams.
+		ReadIdleTimeout: 30 * time.Second,
+		PingTimeout:     15 * time.Second,
+	}
+}
+
+// grpcStatusFields carry a gRPC call's status; a trailers-only response
+// sends them in its headers.
+var grpcStatusFields = []string{"Grpc-Status", "Grpc-Message", "Grpc-Status-Details-Bin"}
+
+// splitTrailersOnly moves a trailers-only gRPC response's status into
+// trailers. httputil.ReverseProxy may flush the headers before it sees the
+// empty body end, and a status in headers that didn't end the stream is
+// lost on the client ("server closed the stream without sending trailers").
+// Headers plus trailers is valid however the response is framed.
+func splitTrailersOnly(resp *http.Response) {
+	mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	if !strings.HasPrefix(mt, "application/grpc") || resp.Header.Get("Grpc-Status") == "" {
+		return
+	}
+	if resp.Trailer == nil {
+		resp.Trailer = http.Header{}
+	}
+	for _, k := range grpcStatusFields {
+		if v := resp.Header.Values(k); len(v) > 0 {
+			resp.Trailer[k] = v
+			resp.Header.Del(k)
+		}
+	}
+}
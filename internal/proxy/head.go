@@ -0,0 +1,31 @@
+package proxy
+
+import "net/http"
+
+// HeadAsGet wraps next so that HEAD requests are sent upstream as GET, for
+// upstreams that do not implement HEAD. The response headers, Content-Length
+// included, are passed through and the body is discarded unread, so the
+// upstream connection is not reused.
+func HeadAsGet(next http.RoundTripper) http.RoundTripper {
+	return &headAsGetTransport{next: next}
+}
+
+type headAsGetTransport struct {
+	next http.RoundTripper
+}
+
+func (t *headAsGetTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.Method != http.MethodHead {
+		return t.next.RoundTrip(req)
+	}
+	get := req.Clone(req.Context())
+	get.Method = http.MethodGet
+	resp, err := t.next.RoundTrip(get)
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	resp.Body = http.NoBody
+	resp.Request = req
+	return resp, nil
+}
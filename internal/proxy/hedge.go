@@ -0,0 +1,132 @@
+package proxy
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// AttemptHeader carries the 1-based attempt number on each hedged upstream request.
+const AttemptHeader = "X-Upstream-Attempt"
+
+// HedgeConfig configures request hedging for a route.
+type HedgeConfig struct {
+	Delay       time.Duration // wait this long for a response before sending another attempt
+	MaxAttempts int           // total attempts including the first; <= 1 disables
+	OnHedge     func()        // optional, called for each extra attempt sent
+
+	// OnAttempt is optional and called with each attempt (first included) as it is sent.
+	OnAttempt func(req *http.Request, attempt int)
+}
+
+// Hedge wraps next so that idempotent, bodiless requests that have not
+// received response headers within cfg.Delay are re-sent, up to
+// cfg.MaxAttempts in total. The first response wins; the other attempts'
+// contexts are cancelled so the upstream can stop working on them.
+// Requests with a body are never hedged since it cannot be replayed, nor
+// are protocol upgrades.
+func Hedge(next http.RoundTripper, cfg HedgeConfig) http.RoundTripper {
+	if cfg.MaxAttempts <= 1 || cfg.Delay <= 0 {
+		return next
+	}
+	return &hedgeTransport{next: next, cfg: cfg}
+}
+
+type hedgeTransport struct {
+	next http.RoundTripper
+	cfg  HedgeConfig
+}
+
+type hedgeResult struct {
+	idx  int
+	resp *http.Response
+	err  error
+}
+
+func hedgeable(req *http.Request) bool {
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+	default:
+		return false
+	}
+	// A duplicate handshake would open a second upgraded connection upstream.
+	if req.Header.Get("Upgrade") != "" {
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody
+}
+
+func (t *hedgeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if !hedgeable(req) {
+		return t.next.RoundTrip(req)
+	}
+
+	results := make(chan hedgeResult, t.cfg.MaxAttempts)
+	cancels := make([]context.CancelFunc, 0, t.cfg.MaxAttempts)
+	launch := func() {
+		ctx, cancel := context.WithCancel(req.Context())
+		idx := len(cancels)
+		cancels = append(cancels, cancel)
+		if idx > 0 && t.cfg.OnHedge != nil {
+			t.cfg.OnHedge()
+		}
+		attempt := req.Clone(ctx)
+		attempt.Header.Set(AttemptHeader, strconv.Itoa(idx+1))
+		if t.cfg.OnAttempt != nil {
+			t.cfg.OnAttempt(attempt, idx+1)
+		}
+		go func() {
+			resp, err := t.next.RoundTrip(attempt)
+			results <- hedgeResult{idx: idx, resp: resp, err: err}
+		}()
+	}
+
+	launch()
+	timer := time.NewTimer(t.cfg.Delay)
+	defer timer.Stop()
+
+	var lastErr error
+	received := 0
+	for {
+		select {
+		case <-timer.C:
+			if len(cancels) < t.cfg.MaxAttempts {
+				launch()
+				timer.Reset(t.cfg.Delay)
+			}
+
+		case res := <-results:
+			received++
+			if res.err == nil {
+				for i, cancel := range cancels {
+					if i != res.idx {
+						cancel()
+					}
+				}
+				go drainHedged(results, len(cancels)-received)
+				res.resp.Body = withCancelOnClose(res.resp.Body, cancels[res.idx])
+				return res.resp, nil
+			}
+			cancels[res.idx]()
+			lastErr = res.err
+			if received == len(cancels) {
+				if len(cancels) >= t.cfg.MaxAttempts || req.Context().Err() != nil {
+					return nil, lastErr
+				}
+				// Everything in flight failed; try the next attempt now.
+				launch()
+				timer.Reset(t.cfg.Delay)
+			}
+		}
+	}
+}
+
+// drainHedged closes the bodies of losing attempts that still complete.
+func drainHedged(results <-chan hedgeResult, n int) {
+	for i := 0; i < n; i++ {
+		if res := <-results; res.resp != nil {
+			res.resp.Body.Close()
+		}
+	}
+}
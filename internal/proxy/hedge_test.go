@@ -0,0 +1,99 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestHedge_FirstResponseWinsAndLoserIsCancelled(t *testing.T) {
+	var calls atomic.Int32
+	loserCancelled := make(chan struct{})
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if calls.Add(1) == 1 {
+			select {
+			case <-r.Context().Done():
+				close(loserCancelled)
+			case <-time.After(5 * time.Second):
+			}
+			return
+		}
+		_, _ = w.Write([]byte("fast"))
+	}))
+	defer up.Close()
+
+	var hedged atomic.Int32
+	client := &http.Client{Transport: Hedge(http.DefaultTransport, HedgeConfig{
+		Delay:       20 * time.Millisecond,
+		MaxAttempts: 2,
+		OnHedge:     func() { hedged.Add(1) },
+	})}
+
+	start := time.Now()
+	resp, err := client.Get(up.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+
+	if string(b) != "fast" {
+		t.Fatalf("expected hedged response, got %q", b)
+	}
+	if time.Since(start) > 2*time.Second {
+		t.Fatal("expected the hedge to beat the slow attempt")
+	}
+	if hedged.Load() != 1 {
+		t.Fatalf("expected 1 hedged attempt, got %d", hedged.Load())
+	}
+	select {
+	case <-loserCancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected the losing attempt's context to be cancelled")
+	}
+}
+
+func TestHedge_NeverHedgesUpgrades(t *testing.T) {
+	echo := echoUpgradeUpstream(t).Config.Handler
+	var calls atomic.Int32
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		calls.Add(1)
+		time.Sleep(60 * time.Millisecond) // past the hedge delay
+		echo.ServeHTTP(w, r)
+	}))
+	defer up.Close()
+
+	u, _ := url.Parse(up.URL)
+	assertUpgrade(t, BuildProxy(u, Hedge(http.DefaultTransport, HedgeConfig{Delay: 10 * time.Millisecond, MaxAttempts: 3})))
+	if n := calls.Load(); n != 1 {
+		t.Fatalf("expected one upstream handshake, got %d", n)
+	}
+}
+
+func TestHedge_NeverHedgesRequestsWithBody(t *testing.T) {
+	var calls atomic.Int32
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		calls.Add(1)
+		time.Sleep(50 * time.Millisecond)
+	}))
+	defer up.Close()
+
+	client := &http.Client{Transport: Hedge(http.DefaultTransport, HedgeConfig{
+		Delay:       5 * time.Millisecond,
+		MaxAttempts: 3,
+	})}
+
+	resp, err := client.Post(up.URL, "text/plain", strings.NewReader("payload"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if calls.Load() != 1 {
+		t.Fatalf("expected a single attempt for a POST, got %d", calls.Load())
+	}
+}
@@ -0,0 +1,48 @@
+package proxy
+
+import (
+	"net/http"
+	"strconv"
+)
+
+// InstanceHeader carries Identity.Instance upstream.
+const InstanceHeader = "X-Gateway-Instance"
+
+// Identity marks upstream requests as having come through the gateway, so
+// upstream logs can attribute traffic. Zero adds nothing.
+type Identity struct {
+	Via             string // received-by name, as in "Via: 1.1 apigw"; empty sends no Via
+	UserAgentSuffix string // appended to the client's User-Agent
+	Instance        string // InstanceHeader value; empty sends none
+}
+
+// apply adds the identity headers to the outgoing request. A client's Via
+// entries are kept ahead of ours; a client-sent InstanceHeader never is.
+func (id Identity) apply(req *http.Request) {
+	h := req.Header
+	h.Del(InstanceHeader)
+	if id.Via != "" {
+		h.Add("Via", viaProtocol(req)+" "+id.Via)
+	}
+	if id.UserAgentSuffix != "" {
+		ua := h.Get("User-Agent")
+		if ua != "" {
+			ua += " "
+		}
+		h.Set("User-Agent", ua+id.UserAgentSuffix)
+	}
+	if id.Instance != "" {
+		h.Set(InstanceHeader, id.Instance)
+	}
+}
+
+// viaProtocol is the received-protocol of req's inbound hop: "1.1", "2", ...
+func viaProtocol(req *http.Request) string {
+	if req.ProtoMajor >= 2 {
+		return strconv.Itoa(req.ProtoMajor)
+	}
+	if req.ProtoMajor == 0 {
+		return "1.1"
+	}
+	return strconv.Itoa(req.ProtoMajor) + "." + strconv.Itoa(req.ProtoMinor)
+}
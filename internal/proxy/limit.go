@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+	"strings"
+	"sync"
+)
+
+// ErrResponseTooLarge is returned when an upstream body exceeds
+// ResponseLimit.MaxBytes; the proxy answers it with 502
+// upstream_response_too_large.
+var ErrResponseTooLarge = errors.New("upstream response too large")
+
+// ResponseLimit caps upstream response bodies.
+type ResponseLimit struct {
+	MaxBytes int64 // <= 0 disables
+
+	// ExemptStreams leaves SSE (text/event-stream) and gRPC responses
+	// uncapped, since they are open-ended by design.
+	ExemptStreams bool
+
+	OnExceeded func() // optional, called once per capped response
+}
+
+// apply checks resp against the limit. A declared Content-Length over the
+// cap fails before anything reaches the client; otherwise the body is
+// wrapped so that reading past the cap fails and the proxy aborts the
+// response mid-stream.
+func (l ResponseLimit) apply(resp *http.Response) error {
+	if l.MaxBytes <= 0 || (l.ExemptStreams && isStream(resp)) {
+		return nil
+	}
+	// A HEAD response declares the GET body's length but carries none, and
+	// a 101's body is the upgraded connection, which must stay writable.
+	if resp.StatusCode == http.StatusSwitchingProtocols || (resp.Request != nil && resp.Request.Method == http.MethodHead) {
+		return nil
+	}
+	if resp.ContentLength > l.MaxBytes {
+		resp.Body.Close()
+		if l.OnExceeded != nil {
+			l.OnExceeded()
+		}
+		return ErrResponseTooLarge
+	}
+	resp.Body = &limitedBody{ReadCloser: resp.Body, remaining: l.MaxBytes, onExceeded: l.OnExceeded}
+	return nil
+}
+
+func isStream(resp *http.Response) bool {
+	mt, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return mt == "text/event-stream" || strings.HasPrefix(mt, "application/grpc")
+}
+
+type limitedBody struct {
+	io.ReadCloser
+	remaining  int64
+	onExceeded func()
+	once       sync.Once
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > b.remaining {
+		n = int(b.remaining)
+		b.remaining = 0
+		if b.onExceeded != nil {
+			b.once.Do(b.onExceeded)
+		}
+		return n, ErrResponseTooLarge
+	}
+	b.remaining -= int64(n)
+	return n, err
+}
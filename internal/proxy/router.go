@@ -1,22 +1,103 @@
 package proxy
 
 import (
-	"encoding/json"
+	"cmp"
+	"context"
+	"errors"
+	"hash/fnv"
+	"math/rand/v2"
+	"net"
 	"net/http"
 	"net/http/httputil"
 	"net/url"
+	"slices"
 	"sort"
 	"strings"
+	"time"
+
+	"github.com/3xpluto/go-api-gateway/internal/httpx"
+	"github.com/3xpluto/go-api-gateway/internal/netx"
 )
 
 type Route struct {
 	Name         string
+	Host         string // optional: exact ("api.example.com") or leading wildcard ("*.example.com")
 	PathPrefix   string
+	PathExact    string            // when set, the path must equal it; PathPrefix is ignored
+	Query        map[string]string // optional: key -> required value ("" = key present); tiebreaker among equal paths
 	Upstream     *url.URL
 	StripPrefix  string
+	AddPrefix    string // prepended to the upstream path after StripPrefix
 	AuthRequired bool
 	RateLimit    RouteRateLimit
+	QuotaDaily   int64
+	MaxWait      time.Duration // concurrency queue wait
+	BusyRetry    time.Duration // Retry-After on concurrency 503s
 	Proxy        *httputil.ReverseProxy
+
+	RequiredHeaders []RequiredHeader
+
+	Canary *Canary // optional second upstream for a share of traffic
+
+	RejectInvalidToken bool // optional auth: 401 a present-but-invalid token when !AuthRequired
+	RequireRequestID   bool // 400 when the caller sends no valid X-Request-Id
+	AccessLogSample    int  // log 1 in N 2xx/3xx; 0 uses the global setting
+
+	ClientCertAuth bool     // verified client cert CN is the auth subject
+	ClientSubjects []string // allowed client cert CNs; empty allows all
+
+	Chaos RouteChaos // zero unless server.chaos_enabled
+
+	Methods   []string // accepted methods, upper case; empty accepts all. GET implies HEAD
+	HeadAsGet bool     // HEAD is sent upstream as GET (see HeadAsGet)
+	Hedged    bool     // hedge.max_attempts > 1; the access log records the attempt count
+
+	Priority int // higher is tried first, before host and path ordering; default 0
+
+	ConcurrencyMode    string // "reject", "queue" or "" (queue when MaxWait > 0)
+	QueueIgnoresCancel bool   // queued requests keep waiting after the client goes away
+
+	Disabled bool // matched but answered 503 route_disabled by the gateway
+
+	MaxBodyBytes int64 // request body cap (413); 0 for gRPC routes, whose bodies are streams
+}
+
+// RouteChaos injects latency and errors in front of the upstream.
+type RouteChaos struct {
+	Delay        time.Duration
+	ErrorPercent float64
+	ErrorStatus  int
+}
+
+// Canary splits a percentage of a route's traffic to a second upstream.
+type Canary struct {
+	Upstream *url.URL
+	Percent  float64 // 0-100
+	Sticky   bool    // choose by hashing a stable key instead of randomly
+	Header   bool    // set X-Canary: true on canary responses
+	Proxy    *httputil.ReverseProxy
+}
+
+// Use reports whether a request goes to the canary. With Sticky, stickyKey
+// (subject or client IP) always lands on the same side for a given percent.
+func (c *Canary) Use(stickyKey string) bool {
+	if c == nil || c.Percent <= 0 {
+		return false
+	}
+	if c.Percent >= 100 {
+		return true
+	}
+	if c.Sticky {
+		h := fnv.New32a()
+		_, _ = h.Write([]byte(stickyKey))
+		return float64(h.Sum32()%10000) < c.Percent*100
+	}
+	return rand.Float64()*100 < c.Percent
+}
+
+type RequiredHeader struct {
+	Name   string
+	Values []string
 }
 
 type RouteRateLimit struct {
@@ -24,20 +105,146 @@ type RouteRateLimit struct {
 	RPS     float64
 	Burst   float64
 	Scope   string
+	SoftRPS float64
+	DryRun  bool
+
+	DefaultTier string
+	PerMethod   bool
+}
+
+// Trailing-slash handling modes for Options.TrailingSlash.
+const (
+	TrailingSlashStrict    = ""          // "/x" and "/x/" are different paths
+	TrailingSlashNormalize = "normalize" // match either form; the upstream path is left unchanged
+	TrailingSlashRedirect  = "redirect"  // 308 to the form the route was configured with
+)
+
+type Options struct {
+	TrailingSlash string
 }
 
 type Router struct {
 	routes []Route
+	opts   Options
 }
 
 func New(routes []Route) (*Router, error) {
+	return NewWithOptions(routes, Options{})
+}
+
+func NewWithOptions(routes []Route, opts Options) (*Router, error) {
 	if len(routes) == 0 {
 		return nil, ErrNoRoutes
 	}
-	sort.Slice(routes, func(i, j int) bool {
-		return len(routes[i].PathPrefix) > len(routes[j].PathPrefix)
+	switch opts.TrailingSlash {
+	case TrailingSlashStrict, TrailingSlashNormalize, TrailingSlashRedirect:
+	default:
+		return nil, &errString{s: "unknown trailing slash mode: " + opts.TrailingSlash}
+	}
+	for i := range routes {
+		routes[i].Host = strings.ToLower(routes[i].Host)
+	}
+	// An explicit Priority wins outright. Then host is the discriminator
+	// (exact > wildcard > any), then longest path; an exact path beats a
+	// prefix of equal length.
+	sort.SliceStable(routes, func(i, j int) bool {
+		if routes[i].Priority != routes[j].Priority {
+			return routes[i].Priority > routes[j].Priority
+		}
+		hi, hj := hostRank(routes[i].Host), hostRank(routes[j].Host)
+		if hi != hj {
+			return hi > hj
+		}
+		li, lj := len(routes[i].matchPath()), len(routes[j].matchPath())
+		if li != lj {
+			return li > lj
+		}
+		ei, ej := routes[i].PathExact != "", routes[j].PathExact != ""
+		if ei != ej {
+			return ei
+		}
+		qi, qj := len(routes[i].Query), len(routes[j].Query)
+		if qi != qj {
+			return qi > qj
+		}
+		return len(routes[i].Methods) > 0 && len(routes[j].Methods) == 0
 	})
-	return &Router{routes: routes}, nil
+	return &Router{routes: routes, opts: opts}, nil
+}
+
+func (rt *Route) matchPath() string {
+	if rt.PathExact != "" {
+		return rt.PathExact
+	}
+	return rt.PathPrefix
+}
+
+func (rt *Route) matchesPath(path string) bool {
+	if rt.PathExact != "" {
+		return path == rt.PathExact
+	}
+	return strings.HasPrefix(path, rt.PathPrefix)
+}
+
+func (rt *Route) matchesQuery(q url.Values) bool {
+	for k, want := range rt.Query {
+		vs, ok := q[k]
+		if !ok {
+			return false
+		}
+		if want != "" && !slices.Contains(vs, want) {
+			return false
+		}
+	}
+	return true
+}
+
+func (rt *Route) matchesMethod(method string) bool {
+	if method == "" || len(rt.Methods) == 0 || slices.Contains(rt.Methods, method) {
+		return true
+	}
+	return method == http.MethodHead && slices.Contains(rt.Methods, http.MethodGet)
+}
+
+// allowedMethods adds the methods rt accepts to set.
+func (rt *Route) allowedMethods(set map[string]bool) {
+	for _, m := range rt.Methods {
+		set[m] = true
+		if m == http.MethodGet {
+			set[http.MethodHead] = true
+		}
+	}
+}
+
+func hostRank(h string) int {
+	switch {
+	case h == "":
+		return 0
+	case strings.HasPrefix(h, "*."):
+		return 1
+	default:
+		return 2
+	}
+}
+
+// hostMatches reports whether the request host (port already stripped) satisfies pattern.
+// "*.example.com" matches any subdomain but not example.com itself.
+func hostMatches(pattern, host string) bool {
+	if pattern == "" {
+		return true
+	}
+	if suffix, ok := strings.CutPrefix(pattern, "*"); ok {
+		return strings.HasSuffix(host, suffix) && len(host) > len(suffix)
+	}
+	return host == pattern
+}
+
+// normalizeHost lowercases r.Host and drops any port.
+func normalizeHost(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	return strings.ToLower(strings.TrimSuffix(host, "."))
 }
 
 var ErrNoRoutes = &errString{s: "no routes"}
@@ -46,48 +253,314 @@ type errString struct{ s string }
 
 func (e *errString) Error() string { return e.s }
 
-func (r *Router) Match(path string) *Route {
+// Match returns the route for the request host, path and query, or nil.
+// Routes without a host constraint match any host; routes without query
+// constraints match any query.
+func (r *Router) Match(host, path string, query url.Values) *Route {
+	rt, _ := r.Lookup(host, path, query)
+	return rt
+}
+
+// Lookup is Match plus trailing-slash redirects: in redirect mode, when path
+// only matched after toggling its trailing slash, redirectTo is the path the
+// client should be sent to with a 308.
+func (r *Router) Lookup(host, path string, query url.Values) (rt *Route, redirectTo string) {
+	rt, redirectTo, _ = r.LookupMethod("", host, path, query)
+	return rt, redirectTo
+}
+
+// LookupMethod is Lookup restricted to routes accepting method ("" accepts
+// any). When no route matches but some matched everything except the
+// method, allow lists the methods they accept, sorted, for a 405.
+func (r *Router) LookupMethod(method, host, path string, query url.Values) (rt *Route, redirectTo string, allow []string) {
+	host = normalizeHost(host)
+	alt := ""
+	if r.opts.TrailingSlash != TrailingSlashStrict {
+		alt = toggleTrailingSlash(path)
+	}
+	var allowed map[string]bool
+	match := func(p string) (*Route, int) {
+		for i := range r.routes {
+			if !hostMatches(r.routes[i].Host, host) || !r.routes[i].matchesQuery(query) || !r.routes[i].matchesPath(p) {
+				continue
+			}
+			if !r.routes[i].matchesMethod(method) {
+				if allowed == nil {
+					allowed = map[string]bool{}
+				}
+				r.routes[i].allowedMethods(allowed)
+				continue
+			}
+			return &r.routes[i], i
+		}
+		return nil, 0
+	}
+	lit, litAt := match(path)
+	if alt != "" {
+		// The toggled path only wins when its route would outrank the literal
+		// match with the slash ignored, so "/api/users" still reaches a later
+		// "/api/users" route over an earlier exact "/api/users/".
+		if rt, at := match(alt); rt != nil && (lit == nil || at < litAt && outranksIgnoringSlash(rt, lit)) {
+			if r.opts.TrailingSlash == TrailingSlashRedirect {
+				return rt, alt, nil
+			}
+			return rt, "", nil
+		}
+	}
+	if lit != nil {
+		return lit, "", nil
+	}
+	for m := range allowed {
+		allow = append(allow, m)
+	}
+	sort.Strings(allow)
+	return nil, "", allow
+}
+
+// outranksIgnoringSlash reports whether a sorts before b for a reason other
+// than a trailing slash on its path.
+func outranksIgnoringSlash(a, b *Route) bool {
+	if a.Priority != b.Priority {
+		return a.Priority > b.Priority
+	}
+	if ha, hb := hostRank(a.Host), hostRank(b.Host); ha != hb {
+		return ha > hb
+	}
+	return len(strings.TrimSuffix(a.matchPath(), "/")) > len(strings.TrimSuffix(b.matchPath(), "/"))
+}
+
+// HostKnown reports whether any host-constrained route matches host.
+// Routes without a host constraint do not count.
+func (r *Router) HostKnown(host string) bool {
+	host = normalizeHost(host)
 	for i := range r.routes {
-		if strings.HasPrefix(path, r.routes[i].PathPrefix) {
-			return &r.routes[i]
+		if r.routes[i].Host != "" && hostMatches(r.routes[i].Host, host) {
+			return true
 		}
 	}
-	return nil
+	return false
+}
+
+func toggleTrailingSlash(path string) string {
+	if path == "/" || path == "" {
+		return ""
+	}
+	if strings.HasSuffix(path, "/") {
+		return strings.TrimSuffix(path, "/")
+	}
+	return path + "/"
+}
+
+// ErrorConfig controls the response when the upstream round trip fails.
+type ErrorConfig struct {
+	// Detailed puts the raw transport error in the body. Debug only: it
+	// leaks upstream addresses. Otherwise the body is a stable code.
+	Detailed bool
+
+	TimeoutStatus int // upstream timeouts; default 504
+	DialStatus    int // connection failures (refused, DNS, unreachable); default 502
+
+	// Log, if set, gets every failure with the status sent to the client.
+	Log func(r *http.Request, status int, err error)
+}
+
+// status maps err to the client status and a stable error code: a body over
+// max_response_bytes is upstream_response_too_large (502), a route's
+// upstream_timeout_seconds expiring is upstream_timeout (504), other
+// timeouts gateway_timeout (504), failures to connect upstream_unreachable
+// (502) and anything else, such as a reset mid-response, bad_gateway (502).
+func (c ErrorConfig) status(err error) (int, string) {
+	var ne net.Error
+	var oe *net.OpError
+	var de *net.DNSError
+	switch {
+	case errors.Is(err, ErrResponseTooLarge):
+		return http.StatusBadGateway, "upstream_response_too_large"
+	case errors.Is(err, ErrUpstreamTimeout):
+		return cmp.Or(c.TimeoutStatus, http.StatusGatewayTimeout), "upstream_timeout"
+	case errors.Is(err, context.DeadlineExceeded) || (errors.As(err, &ne) && ne.Timeout()):
+		return cmp.Or(c.TimeoutStatus, http.StatusGatewayTimeout), "gateway_timeout"
+	case errors.As(err, &de) || (errors.As(err, &oe) && oe.Op == "dial"):
+		return cmp.Or(c.DialStatus, http.StatusBadGateway), "upstream_unreachable"
+	default:
+		return http.StatusBadGateway, "bad_gateway"
+	}
+}
+
+// ProxyOptions configures BuildProxyWith.
+type ProxyOptions struct {
+	Errors ErrorConfig
+
+	// StripResponseHeaders are removed from upstream responses, e.g. Server
+	// or X-Powered-By, on top of the hop-by-hop headers.
+	StripResponseHeaders []string
+
+	// FlushInterval is httputil.ReverseProxy's; -1 flushes after every write,
+	// which gRPC streams need.
+	FlushInterval time.Duration
+
+	ResponseLimit ResponseLimit
+
+	// ForwardHeaders, when non-empty, is the only set of request headers
+	// sent upstream (Te is kept for trailers). Empty forwards everything.
+	ForwardHeaders []string
+
+	// TrustedProxies is the set IPResolver trusts (server.trusted_proxies).
+	// A direct peer in it has its X-Forwarded-* headers kept and extended;
+	// anyone else's are replaced with what the gateway saw. Nil trusts no one.
+	TrustedProxies *netx.CIDRSet
+
+	Identity Identity // Via, User-Agent suffix and instance headers sent upstream
+
+	// RequestStart sets RequestStartHeader on upstream requests.
+	RequestStart bool
+
+	// ServerTiming adds the gateway-measured upstream time (to response
+	// headers) to the client response as "Server-Timing: upstream;dur=<ms>".
+	ServerTiming bool
 }
 
+// spoofablePrefix marks identity headers only the gateway side may set;
+// client-sent ones are always dropped.
+const spoofablePrefix = "X-Auth-"
+
+// Connection-specific response headers httputil.ReverseProxy passes
+// through; they describe the upstream hop, not the gateway's.
+var hopResponseHeaders = []string{"Alt-Svc", "Proxy-Authentication-Info"}
+
+// BuildProxy is BuildProxyWith default options.
 func BuildProxy(up *url.URL, transport http.RoundTripper) *httputil.ReverseProxy {
+	return BuildProxyWith(up, transport, ProxyOptions{})
+}
+
+// BuildProxyWith returns a reverse proxy to up.
+func BuildProxyWith(up *url.URL, transport http.RoundTripper, opts ProxyOptions) *httputil.ReverseProxy {
 	p := httputil.NewSingleHostReverseProxy(up)
 	p.Transport = transport
+	if opts.ServerTiming {
+		if transport == nil {
+			transport = http.DefaultTransport
+		}
+		p.Transport = timedTransport{next: transport}
+	}
+	p.FlushInterval = opts.FlushInterval
+
+	var forward map[string]bool
+	if len(opts.ForwardHeaders) > 0 {
+		forward = map[string]bool{"Te": true}
+		for _, h := range opts.ForwardHeaders {
+			forward[http.CanonicalHeaderKey(h)] = true
+		}
+	}
 
 	orig := p.Director
 	p.Director = func(req *http.Request) {
+		trusted := opts.TrustedProxies.Contains(netx.RemoteIP(req.RemoteAddr))
+		fwd := forwardedFor(req, trusted)
 		orig(req)
 		req.Host = up.Host
+		for name := range req.Header {
+			if strings.HasPrefix(name, spoofablePrefix) || (forward != nil && !forward[name]) {
+				delete(req.Header, name)
+			}
+		}
+		fwd.apply(req.Header)
+		opts.Identity.apply(req)
+		if opts.RequestStart {
+			setRequestStart(req, trusted)
+		}
 	}
 
-	p.ErrorHandler = func(w http.ResponseWriter, _ *http.Request, err error) {
-		msg := ""
-		code := http.StatusBadGateway
-		if err != nil {
-			msg = err.Error()
-			if strings.Contains(msg, "request body too large") {
-				code = http.StatusRequestEntityTooLarge
-				msg = "request_too_large"
-			}
+	strip := append(slices.Clone(hopResponseHeaders), opts.StripResponseHeaders...)
+	p.ModifyResponse = func(resp *http.Response) error {
+		for _, h := range strip {
+			resp.Header.Del(h)
+		}
+		if opts.ServerTiming {
+			addServerTiming(resp)
+		}
+		splitTrailersOnly(resp)
+		return opts.ResponseLimit.apply(resp)
+	}
+
+	errs := opts.Errors
+
+	p.ErrorHandler = func(w http.ResponseWriter, r *http.Request, err error) {
+		// The client went away and the upstream request was cancelled with it;
+		// record that rather than blaming the upstream with a 502.
+		if errors.Is(r.Context().Err(), context.Canceled) {
+			w.WriteHeader(httpx.StatusClientClosedRequest)
+			return
+		}
+
+		// MaxBodyBytes' MaxBytesReader tripped mid-stream (chunked bodies).
+		var mbe *http.MaxBytesError
+		if errors.As(err, &mbe) {
+			httpx.WriteError(w, http.StatusRequestEntityTooLarge, "request_too_large", map[string]any{
+				"max_bytes": mbe.Limit,
+			})
+			return
+		}
+
+		status, code := errs.status(err)
+		if errs.Log != nil {
+			errs.Log(r, status, err)
+		}
+		if errs.Detailed && err != nil {
+			code = err.Error()
 		}
-		w.WriteHeader(code)
-		_ = json.NewEncoder(w).Encode(map[string]any{
-			"error": msg,
-		})
+		httpx.WriteError(w, status, code, nil)
 	}
 
 	return p
 }
 
+// forwarded holds the X-Forwarded-* values to send upstream.
+type forwarded struct {
+	trusted bool
+	chain   string // prior X-Forwarded-For; ReverseProxy appends the peer's IP
+	proto   string
+	host    string
+}
+
+// forwardedFor works out the forwarded headers for req before the director
+// rewrites it. A trusted peer's values are kept where present; anything an
+// untrusted client sent is discarded in favor of this hop's own view.
+func forwardedFor(req *http.Request, trusted bool) forwarded {
+	f := forwarded{trusted: trusted, proto: "http", host: req.Host}
+	if req.TLS != nil {
+		f.proto = "https"
+	}
+	if trusted {
+		f.chain = strings.Join(req.Header.Values("X-Forwarded-For"), ", ")
+		f.proto = cmp.Or(req.Header.Get("X-Forwarded-Proto"), f.proto)
+		f.host = cmp.Or(req.Header.Get("X-Forwarded-Host"), f.host)
+	}
+	return f
+}
+
+func (f forwarded) apply(h http.Header) {
+	h.Del("X-Forwarded-For")
+	if !f.trusted {
+		h.Del("Forwarded")
+		h.Del("X-Real-Ip")
+	}
+	if f.chain != "" {
+		h.Set("X-Forwarded-For", f.chain)
+	}
+	h.Set("X-Forwarded-Proto", f.proto)
+	h.Set("X-Forwarded-Host", f.host)
+}
+
+// StripPath removes strip from the front of path, returning "/" when nothing is left.
 func StripPath(path string, strip string) string {
 	if strip == "" {
 		return path
 	}
+	// "/api/users" against strip "/api/users/" (trailing-slash normalization).
+	if strings.HasSuffix(strip, "/") && path == strings.TrimSuffix(strip, "/") {
+		return "/"
+	}
 	if strings.HasPrefix(path, strip) {
 		p := strings.TrimPrefix(path, strip)
 		if p == "" {
@@ -97,3 +570,15 @@ func StripPath(path string, strip string) string {
 	}
 	return path
 }
+
+// AddPath prepends prefix to path with exactly one slash between them.
+// A path of "/" maps to the prefix itself, keeping any trailing slash it has.
+func AddPath(path string, prefix string) string {
+	if prefix == "" {
+		return path
+	}
+	if path == "/" || path == "" {
+		return prefix
+	}
+	return strings.TrimSuffix(prefix, "/") + "/" + strings.TrimPrefix(path, "/")
+}
@@ -1,6 +1,28 @@
 package proxy
 
-import "testing"
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/3xpluto/go-api-gateway/internal/httpx"
+	"github.com/3xpluto/go-api-gateway/internal/mw"
+	"github.com/3xpluto/go-api-gateway/internal/netx"
+)
 
 func TestMatchLongestPrefix(t *testing.T) {
 	r, err := New([]Route{
@@ -10,15 +32,714 @@ func TestMatchLongestPrefix(t *testing.T) {
 	if err != nil {
 		t.Fatal(err)
 	}
-	m := r.Match("/api/users/me")
+	m := r.Match("example.com", "/api/users/me", nil)
 	if m == nil || m.Name != "b" {
 		t.Fatalf("expected longest prefix route b, got %#v", m)
 	}
 }
 
+func TestMatchPriorityBeatsLongerPrefix(t *testing.T) {
+	r, err := New([]Route{
+		{Name: "users", PathPrefix: "/api/users/", Host: "api.example.com"},
+		{Name: "maintenance", PathPrefix: "/api/", Priority: 10},
+		{Name: "low", PathPrefix: "/api/users/me", Priority: -1},
+		{Name: "other", PathPrefix: "/other/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	cases := []struct {
+		path, want string
+	}{
+		{"/api/users/1", "maintenance"}, // beats a longer, host-specific prefix
+		{"/api/users/me", "maintenance"},
+		{"/other/x", "other"},
+	}
+	for _, c := range cases {
+		if m := r.Match("api.example.com", c.path, nil); m == nil || m.Name != c.want {
+			t.Fatalf("%s: expected %s, got %#v", c.path, c.want, m)
+		}
+	}
+
+	// Equal priority falls back to the longest prefix; negative sorts last.
+	r, err = New([]Route{
+		{Name: "short", PathPrefix: "/api/", Priority: 1},
+		{Name: "long", PathPrefix: "/api/users/", Priority: 1},
+		{Name: "longest", PathPrefix: "/api/users/me", Priority: -1},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := r.Match("", "/api/users/me", nil); m == nil || m.Name != "long" {
+		t.Fatalf("expected the longer prefix among equals, got %#v", m)
+	}
+}
+
+func TestMatchExactPath(t *testing.T) {
+	r, err := New([]Route{
+		{Name: "prefix", PathPrefix: "/health"},
+		{Name: "exact", PathExact: "/health"},
+		{Name: "root", PathPrefix: "/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		path, want string
+	}{
+		{"/health", "exact"},
+		{"/healthcheck", "prefix"},
+		{"/health/", "prefix"},
+		{"/other", "root"},
+	}
+	for _, c := range cases {
+		m := r.Match("example.com", c.path, nil)
+		if m == nil || m.Name != c.want {
+			t.Fatalf("%s: expected %s, got %#v", c.path, c.want, m)
+		}
+	}
+}
+
+func TestLookupTrailingSlash(t *testing.T) {
+	routes := func() []Route {
+		return []Route{
+			{Name: "users", PathPrefix: "/api/users/"},
+			{Name: "health", PathExact: "/health"},
+			{Name: "root", PathPrefix: "/"},
+		}
+	}
+
+	strict, err := New(routes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m := strict.Match("", "/api/users", nil); m == nil || m.Name != "root" {
+		t.Fatalf("strict: expected root, got %#v", m)
+	}
+
+	norm, err := NewWithOptions(routes(), Options{TrailingSlash: TrailingSlashNormalize})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for path, want := range map[string]string{"/api/users": "users", "/health/": "health", "/other": "root"} {
+		m, redirect := norm.Lookup("", path, nil)
+		if m == nil || m.Name != want || redirect != "" {
+			t.Fatalf("normalize %s: expected %s without redirect, got %#v %q", path, want, m, redirect)
+		}
+	}
+
+	redir, err := NewWithOptions(routes(), Options{TrailingSlash: TrailingSlashRedirect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, to := redir.Lookup("", "/api/users", nil); m == nil || m.Name != "users" || to != "/api/users/" {
+		t.Fatalf("redirect: expected users -> /api/users/, got %#v %q", m, to)
+	}
+	if _, to := redir.Lookup("", "/api/users/me", nil); to != "" {
+		t.Fatalf("redirect: expected no redirect for a direct match, got %q", to)
+	}
+
+	if _, err := NewWithOptions(routes(), Options{TrailingSlash: "bogus"}); err == nil {
+		t.Fatal("expected unknown mode to be rejected")
+	}
+
+	// A literal match isn't shadowed by an earlier route matching only with
+	// the slash toggled.
+	shadow, err := NewWithOptions([]Route{
+		{Name: "slash", PathExact: "/api/users/"},
+		{Name: "bare", PathPrefix: "/api/users"},
+	}, Options{TrailingSlash: TrailingSlashRedirect})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m, to := shadow.Lookup("", "/api/users", nil); m == nil || m.Name != "bare" || to != "" {
+		t.Fatalf("expected the literal match without redirect, got %#v %q", m, to)
+	}
+	if m, _ := shadow.Lookup("", "/api/users/", nil); m == nil || m.Name != "slash" {
+		t.Fatalf("expected the exact route for the slashed path, got %#v", m)
+	}
+}
+
+func TestMatchQuery(t *testing.T) {
+	r, err := New([]Route{
+		{Name: "v1", PathPrefix: "/api/"},
+		{Name: "v2", PathPrefix: "/api/", Query: map[string]string{"v": "2"}},
+		{Name: "debug", PathPrefix: "/api/", Query: map[string]string{"debug": ""}},
+		{Name: "users", PathPrefix: "/api/users/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		target, want string
+	}{
+		{"/api/x", "v1"},
+		{"/api/x?v=2", "v2"},
+		{"/api/x?v=3", "v1"},
+		{"/api/x?debug", "debug"},
+		// A longer path still wins; query only breaks ties between equal paths.
+		{"/api/users/me?v=2", "users"},
+	}
+	for _, c := range cases {
+		u, _ := url.Parse(c.target)
+		m := r.Match("", u.Path, u.Query())
+		if m == nil || m.Name != c.want {
+			t.Fatalf("%s: expected %s, got %#v", c.target, c.want, m)
+		}
+	}
+}
+
+func TestCanaryUse(t *testing.T) {
+	var nilCanary *Canary
+	if nilCanary.Use("x") || (&Canary{Percent: 0}).Use("x") {
+		t.Fatal("expected no canary at 0%")
+	}
+	if !(&Canary{Percent: 100}).Use("x") {
+		t.Fatal("expected canary at 100%")
+	}
+
+	sticky := &Canary{Percent: 30, Sticky: true}
+	hits := 0
+	for i := 0; i < 1000; i++ {
+		key := "u:" + strconv.Itoa(i)
+		first := sticky.Use(key)
+		for j := 0; j < 3; j++ {
+			if sticky.Use(key) != first {
+				t.Fatalf("sticky choice changed for %s", key)
+			}
+		}
+		if first {
+			hits++
+		}
+	}
+	if hits < 200 || hits > 400 {
+		t.Fatalf("expected roughly 30%% of keys on canary, got %d/1000", hits)
+	}
+}
+
 func TestStripPath(t *testing.T) {
 	got := StripPath("/api/users/me", "/api")
 	if got != "/users/me" {
 		t.Fatalf("expected /users/me, got %q", got)
 	}
+	if got := StripPath("/api/users", "/api/users/"); got != "/" {
+		t.Fatalf("expected slash-less path to strip to /, got %q", got)
+	}
+}
+
+func TestMatchHost(t *testing.T) {
+	r, err := New([]Route{
+		{Name: "any", PathPrefix: "/api/users/"},
+		{Name: "api", Host: "api.example.com", PathPrefix: "/"},
+		{Name: "wild", Host: "*.example.com", PathPrefix: "/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		host, path, want string
+	}{
+		// Host beats a longer host-less prefix.
+		{"api.example.com", "/api/users/me", "api"},
+		{"API.example.com:8443", "/x", "api"},
+		{"admin.example.com", "/x", "wild"},
+		{"example.com", "/api/users/me", "any"},
+		{"other.test", "/api/users/me", "any"},
+	}
+	for _, c := range cases {
+		m := r.Match(c.host, c.path, nil)
+		if m == nil || m.Name != c.want {
+			t.Fatalf("%s%s: expected %s, got %#v", c.host, c.path, c.want, m)
+		}
+	}
+	if m := r.Match("example.com", "/x", nil); m != nil {
+		t.Fatalf("expected wildcard not to match the apex host, got %s", m.Name)
+	}
+}
+
+func TestLookupMethod(t *testing.T) {
+	r, err := New([]Route{
+		{Name: "read", PathPrefix: "/items/", Methods: []string{"GET"}},
+		{Name: "write", PathPrefix: "/items/", Methods: []string{"POST", "PUT"}},
+		{Name: "any", PathPrefix: "/other/"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		method, path, want string
+	}{
+		{"GET", "/items/1", "read"},
+		{"HEAD", "/items/1", "read"},
+		{"PUT", "/items/1", "write"},
+		{"DELETE", "/other/1", "any"},
+	}
+	for _, c := range cases {
+		m, _, allow := r.LookupMethod(c.method, "", c.path, nil)
+		if m == nil || m.Name != c.want || allow != nil {
+			t.Fatalf("%s %s: expected %s, got %#v (allow %v)", c.method, c.path, c.want, m, allow)
+		}
+	}
+
+	m, _, allow := r.LookupMethod("DELETE", "", "/items/1", nil)
+	if m != nil || strings.Join(allow, ",") != "GET,HEAD,POST,PUT" {
+		t.Fatalf("expected no route and the allow list, got %#v %v", m, allow)
+	}
+	if m, _, allow := r.LookupMethod("DELETE", "", "/missing", nil); m != nil || allow != nil {
+		t.Fatalf("expected a plain miss for an unknown path, got %#v %v", m, allow)
+	}
+}
+
+func TestBuildProxy_MaxBytesErrorIs413(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		w.WriteHeader(http.StatusOK)
+	}))
+	defer up.Close()
+
+	u, _ := url.Parse(up.URL)
+	gw := httptest.NewServer(mw.MaxBodyBytes(16, BuildProxy(u, http.DefaultTransport)))
+	defer gw.Close()
+
+	// io.MultiReader hides the length, so the request is sent chunked and
+	// only the MaxBytesReader safety net can catch it.
+	body := io.MultiReader(strings.NewReader(strings.Repeat("x", 64)))
+	req, _ := http.NewRequest(http.MethodPost, gw.URL+"/upload", body)
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Fatalf("expected 413, got %d", resp.StatusCode)
+	}
+	var out map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		t.Fatal(err)
+	}
+	if out["error"] != "request_too_large" || out["max_bytes"] != float64(16) {
+		t.Fatalf("unexpected body: %v", out)
+	}
+}
+
+func TestBuildProxy_SanitizedUpstreamErrors(t *testing.T) {
+	// A listener that is closed at once gives a refused dial.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	deadAddr := ln.Addr().String()
+	ln.Close()
+
+	slow := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer slow.Close()
+	timeoutRT := &http.Transport{ResponseHeaderTimeout: 20 * time.Millisecond}
+
+	call := func(upstream string, rt http.RoundTripper, cfg ErrorConfig) (int, string) {
+		u, _ := url.Parse(upstream)
+		rec := httptest.NewRecorder()
+		BuildProxyWith(u, rt, ProxyOptions{Errors: cfg}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/x", nil))
+		var out map[string]any
+		if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil {
+			t.Fatal(err)
+		}
+		msg, _ := out["error"].(string)
+		return rec.Code, msg
+	}
+
+	var logged error
+	cfg := ErrorConfig{Log: func(_ *http.Request, _ int, err error) { logged = err }}
+	if code, msg := call("http://"+deadAddr, http.DefaultTransport, cfg); code != http.StatusBadGateway || msg != "upstream_unreachable" {
+		t.Fatalf("expected 502 upstream_unreachable for a refused dial, got %d %q", code, msg)
+	}
+	if logged == nil || !strings.Contains(logged.Error(), deadAddr) {
+		t.Fatalf("expected the detailed error to be logged, got %v", logged)
+	}
+	if code, msg := call(slow.URL, timeoutRT, ErrorConfig{}); code != http.StatusGatewayTimeout || msg != "gateway_timeout" {
+		t.Fatalf("expected 504 gateway_timeout, got %d %q", code, msg)
+	}
+	if code, _ := call(slow.URL, timeoutRT, ErrorConfig{TimeoutStatus: http.StatusBadGateway}); code != http.StatusBadGateway {
+		t.Fatalf("expected the configured timeout status, got %d", code)
+	}
+	if _, msg := call("http://"+deadAddr, http.DefaultTransport, ErrorConfig{Detailed: true}); !strings.Contains(msg, deadAddr) {
+		t.Fatalf("expected the raw error in detailed mode, got %q", msg)
+	}
+}
+
+// errTransport fails every round trip with err.
+type errTransport struct{ err error }
+
+func (t errTransport) RoundTrip(*http.Request) (*http.Response, error) { return nil, t.err }
+
+type timeoutErr struct{}
+
+func (timeoutErr) Error() string   { return "i/o timeout" }
+func (timeoutErr) Timeout() bool   { return true }
+func (timeoutErr) Temporary() bool { return true }
+
+func TestBuildProxy_ErrorClassification(t *testing.T) {
+	u, _ := url.Parse("http://upstream.internal")
+	cases := []struct {
+		name string
+		err  error
+		code int
+		msg  string
+	}{
+		{"route timeout", fmt.Errorf("%w: no response headers within 1s", ErrUpstreamTimeout), http.StatusGatewayTimeout, "upstream_timeout"},
+		{"deadline", context.DeadlineExceeded, http.StatusGatewayTimeout, "gateway_timeout"},
+		{"net timeout", &net.OpError{Op: "read", Net: "tcp", Err: timeoutErr{}}, http.StatusGatewayTimeout, "gateway_timeout"},
+		{"refused", &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}, http.StatusBadGateway, "upstream_unreachable"},
+		{"dns", &net.DNSError{Err: "no such host", Name: "upstream.internal", IsNotFound: true}, http.StatusBadGateway, "upstream_unreachable"},
+		{"reset", &net.OpError{Op: "read", Net: "tcp", Err: errors.New("connection reset by peer")}, http.StatusBadGateway, "bad_gateway"},
+	}
+	for _, c := range cases {
+		rec := httptest.NewRecorder()
+		BuildProxy(u, errTransport{err: c.err}).ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/x", nil))
+		var out map[string]any
+		if err := json.Unmarshal(rec.Body.Bytes(), &out); err != nil {
+			t.Fatal(err)
+		}
+		if rec.Code != c.code || out["error"] != c.msg {
+			t.Fatalf("%s: expected %d %q, got %d %v", c.name, c.code, c.msg, rec.Code, out["error"])
+		}
+	}
+}
+
+func TestBuildProxy_ResponseLimit(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/sized":
+			w.Header().Set("Content-Length", "100")
+			_, _ = w.Write(bytes.Repeat([]byte("a"), 100))
+		case "/events":
+			w.Header().Set("Content-Type", "text/event-stream")
+			w.(http.Flusher).Flush()
+			_, _ = w.Write(bytes.Repeat([]byte("e"), 100))
+		default: // chunked, no length declared up front
+			w.(http.Flusher).Flush()
+			_, _ = w.Write(bytes.Repeat([]byte("c"), 100))
+		}
+	}))
+	defer up.Close()
+	u, _ := url.Parse(up.URL)
+
+	var exceeded atomic.Int32
+	limit := ResponseLimit{MaxBytes: 10, ExemptStreams: true, OnExceeded: func() { exceeded.Add(1) }}
+	srv := httptest.NewServer(BuildProxyWith(u, http.DefaultTransport, ProxyOptions{ResponseLimit: limit}))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/sized")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var out map[string]any
+	_ = json.NewDecoder(resp.Body).Decode(&out)
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway || out["error"] != "upstream_response_too_large" {
+		t.Fatalf("expected 502 upstream_response_too_large, got %d %v", resp.StatusCode, out)
+	}
+
+	// Headers are already out for a chunked body, so the response is cut off.
+	resp, err = http.Get(srv.URL + "/chunked")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err == nil || len(body) > 10 {
+		t.Fatalf("expected a truncated, aborted body, got %d bytes, err %v", len(body), err)
+	}
+
+	resp, err = http.Get(srv.URL + "/events")
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err = io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || len(body) != 100 {
+		t.Fatalf("expected the exempt SSE stream in full, got %d bytes, err %v", len(body), err)
+	}
+
+	// HEAD declares the full length without a body.
+	resp, err = http.Head(srv.URL + "/sized")
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != 100 {
+		t.Fatalf("expected HEAD to pass with Content-Length 100, got %d %d", resp.StatusCode, resp.ContentLength)
+	}
+
+	if n := exceeded.Load(); n != 2 {
+		t.Fatalf("expected 2 capped responses, got %d", n)
+	}
+}
+
+func TestBuildProxy_ResponseLimitLeavesUpgradesAlone(t *testing.T) {
+	u, _ := url.Parse(echoUpgradeUpstream(t).URL)
+	assertUpgrade(t, BuildProxyWith(u, http.DefaultTransport, ProxyOptions{ResponseLimit: ResponseLimit{MaxBytes: 1}}))
+}
+
+// echoUpgradeUpstream accepts "Upgrade: echo" and echoes the upgraded
+// connection back.
+func echoUpgradeUpstream(t *testing.T) *httptest.Server {
+	t.Helper()
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		conn, brw, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		_, _ = brw.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		_ = brw.Flush()
+		_, _ = io.Copy(conn, brw)
+	}))
+	t.Cleanup(up.Close)
+	return up
+}
+
+// assertUpgrade upgrades a connection through h and checks that bytes
+// make the round trip to the upstream and back.
+func assertUpgrade(t *testing.T, h http.Handler) {
+	t.Helper()
+	gw := httptest.NewServer(h)
+	defer gw.Close()
+
+	conn, err := net.Dial("tcp", gw.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	_ = conn.SetDeadline(time.Now().Add(5 * time.Second))
+	_, _ = io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: gw\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected 101, got %d", resp.StatusCode)
+	}
+	_, _ = io.WriteString(conn, "ping")
+	got := make([]byte, 4)
+	if _, err := io.ReadFull(br, got); err != nil || string(got) != "ping" {
+		t.Fatalf("expected the upgraded connection to echo, got %q %v", got, err)
+	}
+}
+
+func TestBuildProxy_ForwardedHeaders(t *testing.T) {
+	seen := make(chan http.Header, 1)
+	up := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		seen <- r.Header.Clone()
+	}))
+	defer up.Close()
+	u, _ := url.Parse(up.URL)
+
+	rp := BuildProxy(u, http.DefaultTransport)
+	plain := httptest.NewServer(rp)
+	defer plain.Close()
+	secure := httptest.NewTLSServer(rp)
+	defer secure.Close()
+
+	// The test client connects from 127.0.0.1.
+	loopback, err := netx.ParseCIDRSet([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	trustedProxy := httptest.NewServer(BuildProxyWith(u, http.DefaultTransport, ProxyOptions{TrustedProxies: loopback}))
+	defer trustedProxy.Close()
+
+	send := func(client *http.Client, base string) http.Header {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, base+"/x", nil)
+		req.Host = "api.example.com"
+		req.Header.Set("X-Forwarded-For", "203.0.113.9")
+		req.Header.Set("X-Forwarded-Proto", "https")
+		req.Header.Set("X-Forwarded-Host", "evil.example")
+		req.Header.Set("X-Real-Ip", "203.0.113.9")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return <-seen
+	}
+
+	// Untrusted peer: everything it claimed is replaced with what the gateway saw.
+	h := send(http.DefaultClient, plain.URL)
+	if got := h.Get("X-Forwarded-For"); got != "127.0.0.1" {
+		t.Fatalf("X-Forwarded-For: expected only the peer, got %q", got)
+	}
+	if got := h.Get("X-Forwarded-Proto"); got != "http" {
+		t.Fatalf("X-Forwarded-Proto: expected http, got %q", got)
+	}
+	if got := h.Get("X-Forwarded-Host"); got != "api.example.com" {
+		t.Fatalf("X-Forwarded-Host: expected the original host, got %q", got)
+	}
+	if got := h.Get("X-Real-Ip"); got != "" {
+		t.Fatalf("X-Real-Ip: expected it dropped, got %q", got)
+	}
+
+	// TLS to the gateway is reported as https.
+	if got := send(secure.Client(), secure.URL).Get("X-Forwarded-Proto"); got != "https" {
+		t.Fatalf("X-Forwarded-Proto over TLS: expected https, got %q", got)
+	}
+
+	// Trusted peer: its values are kept and the chain extended.
+	h = send(http.DefaultClient, trustedProxy.URL)
+	if got := h.Get("X-Forwarded-For"); got != "203.0.113.9, 127.0.0.1" {
+		t.Fatalf("X-Forwarded-For: expected the chain extended, got %q", got)
+	}
+	if got := h.Get("X-Forwarded-Proto"); got != "https" {
+		t.Fatalf("X-Forwarded-Proto: expected the proxy's value, got %q", got)
+	}
+	if got := h.Get("X-Forwarded-Host"); got != "evil.example" {
+		t.Fatalf("X-Forwarded-Host: expected the proxy's value, got %q", got)
+	}
+}
+
+func TestBuildProxy_IdentityHeaders(t *testing.T) {
+	seen := make(chan http.Header, 1)
+	up := httptest.NewServer(http.HandlerFunc(func(_ http.ResponseWriter, r *http.Request) {
+		seen <- r.Header.Clone()
+	}))
+	defer up.Close()
+	u, _ := url.Parse(up.URL)
+
+	send := func(id Identity) http.Header {
+		t.Helper()
+		gw := httptest.NewServer(BuildProxyWith(u, http.DefaultTransport, ProxyOptions{Identity: id}))
+		defer gw.Close()
+		req, _ := http.NewRequest(http.MethodGet, gw.URL+"/x", nil)
+		req.Header.Set("User-Agent", "client/1.0")
+		req.Header.Set("Via", "1.0 edge")
+		req.Header.Set(InstanceHeader, "spoofed")
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return <-seen
+	}
+
+	h := send(Identity{Via: "apigw", UserAgentSuffix: "apigw/1.2", Instance: "gw-7"})
+	if got := h.Values("Via"); len(got) != 2 || got[0] != "1.0 edge" || got[1] != "1.1 apigw" {
+		t.Fatalf("expected our Via appended to the client's, got %q", got)
+	}
+	if got := h.Get("User-Agent"); got != "client/1.0 apigw/1.2" {
+		t.Fatalf("expected the User-Agent suffix, got %q", got)
+	}
+	if got := h.Get(InstanceHeader); got != "gw-7" {
+		t.Fatalf("expected %s gw-7, got %q", InstanceHeader, got)
+	}
+
+	// Each header is off when unset, and a client can't claim an instance.
+	h = send(Identity{})
+	if got := h.Values("Via"); len(got) != 1 || got[0] != "1.0 edge" {
+		t.Fatalf("expected only the client's Via, got %q", got)
+	}
+	if got := h.Get("User-Agent"); got != "client/1.0" {
+		t.Fatalf("expected the User-Agent untouched, got %q", got)
+	}
+	if got := h.Get(InstanceHeader); got != "" {
+		t.Fatalf("expected the client's %s dropped, got %q", InstanceHeader, got)
+	}
+}
+
+func TestBuildProxy_TimingHeaders(t *testing.T) {
+	seen := make(chan http.Header, 1)
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		seen <- r.Header.Clone()
+		time.Sleep(20 * time.Millisecond)
+		w.Header().Set("Server-Timing", "db;dur=5")
+	}))
+	defer up.Close()
+	u, _ := url.Parse(up.URL)
+
+	loopback, err := netx.ParseCIDRSet([]string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	send := func(opts ProxyOptions, clientStart string) (upstream, client http.Header) {
+		t.Helper()
+		gw := httptest.NewServer(httpx.StampReceived(BuildProxyWith(u, http.DefaultTransport, opts)))
+		defer gw.Close()
+		req, _ := http.NewRequest(http.MethodGet, gw.URL+"/x", nil)
+		if clientStart != "" {
+			req.Header.Set(RequestStartHeader, clientStart)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return <-seen, resp.Header
+	}
+
+	before := time.Now().UnixMilli()
+	upH, clientH := send(ProxyOptions{RequestStart: true, ServerTiming: true}, "1")
+	start, err := strconv.ParseInt(upH.Get(RequestStartHeader), 10, 64)
+	if err != nil || start < before || start > time.Now().UnixMilli() {
+		t.Fatalf("expected %s in epoch millis replacing the client's, got %q", RequestStartHeader, upH.Get(RequestStartHeader))
+	}
+	timing := clientH.Values("Server-Timing")
+	if len(timing) != 2 || timing[0] != "db;dur=5" {
+		t.Fatalf("expected ours after the upstream's Server-Timing, got %q", timing)
+	}
+	var dur float64
+	if n, err := fmt.Sscanf(timing[1], "upstream;dur=%f", &dur); n != 1 || err != nil || dur < 20 ||
+		!regexp.MustCompile(`^upstream;dur=\d+\.\d{3}$`).MatchString(timing[1]) {
+		t.Fatalf("expected upstream;dur=<ms> of at least 20ms, got %q", timing[1])
+	}
+
+	// A trusted proxy's stamp is kept.
+	upH, _ = send(ProxyOptions{RequestStart: true, TrustedProxies: loopback}, "1700000000123")
+	if got := upH.Get(RequestStartHeader); got != "1700000000123" {
+		t.Fatalf("expected the trusted stamp kept, got %q", got)
+	}
+
+	// Both are opt-in.
+	upH, clientH = send(ProxyOptions{}, "")
+	if upH.Get(RequestStartHeader) != "" || len(clientH.Values("Server-Timing")) != 1 {
+		t.Fatalf("expected no timing headers by default, got %q %q", upH.Get(RequestStartHeader), clientH.Values("Server-Timing"))
+	}
+}
+
+func TestBuildProxy_GRPCTrailersOnlyStatusMovesToTrailers(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		w.Header().Set("Content-Type", "application/grpc")
+		w.Header().Set("Grpc-Status", "5")
+		w.Header().Set("Grpc-Message", "unknown service")
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush() // no Content-Length, as over HTTP/2
+	}))
+	defer up.Close()
+
+	u, _ := url.Parse(up.URL)
+	gw := httptest.NewServer(BuildProxyWith(u, http.DefaultTransport, ProxyOptions{FlushInterval: -1}))
+	defer gw.Close()
+
+	resp, err := http.Post(gw.URL+"/grpc.health.v1.Health/Check", "application/grpc", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _ = io.Copy(io.Discard, resp.Body)
+	resp.Body.Close()
+	if resp.Header.Get("Grpc-Status") != "" {
+		t.Fatalf("expected no status in headers, got %v", resp.Header)
+	}
+	if resp.Trailer.Get("Grpc-Status") != "5" || resp.Trailer.Get("Grpc-Message") != "unknown service" {
+		t.Fatalf("expected the status in trailers, got %v", resp.Trailer)
+	}
 }
@@ -0,0 +1,62 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/3xpluto/go-api-gateway/internal/httpx"
+)
+
+// RequestStartHeader carries the time the gateway received the request, in
+// Unix milliseconds, when ProxyOptions.RequestStart is set.
+const RequestStartHeader = "X-Request-Start"
+
+// setRequestStart stamps req with when the gateway received it (now, outside
+// httpx.StampReceived). A trusted proxy's earlier stamp is kept, so upstreams
+// see the whole time since the edge.
+func setRequestStart(req *http.Request, trusted bool) {
+	if trusted && req.Header.Get(RequestStartHeader) != "" {
+		return
+	}
+	t, ok := httpx.ReceivedAt(req.Context())
+	if !ok {
+		t = time.Now()
+	}
+	req.Header.Set(RequestStartHeader, strconv.FormatInt(t.UnixMilli(), 10))
+}
+
+type upstreamDurationKey struct{}
+
+// timedTransport measures each upstream round trip, hedged attempts
+// included, up to the response headers, and hands it to ModifyResponse on
+// resp.Request's context.
+type timedTransport struct {
+	next http.RoundTripper
+}
+
+func (t timedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	if err != nil {
+		return resp, err
+	}
+	if resp.Request == nil {
+		resp.Request = req
+	}
+	resp.Request = resp.Request.WithContext(context.WithValue(resp.Request.Context(), upstreamDurationKey{}, time.Since(start)))
+	return resp, nil
+}
+
+// addServerTiming appends "upstream;dur=<ms>" to resp's Server-Timing,
+// after any entries the upstream sent.
+func addServerTiming(resp *http.Response) {
+	if resp.Request == nil {
+		return
+	}
+	if d, ok := resp.Request.Context().Value(upstreamDurationKey{}).(time.Duration); ok {
+		resp.Header.Add("Server-Timing", fmt.Sprintf("upstream;dur=%.3f", float64(d)/float64(time.Millisecond)))
+	}
+}
@@ -1,8 +1,13 @@
 package proxy
 
 import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
 	"net"
 	"net/http"
+	"sync"
 	"time"
 )
 
@@ -15,7 +20,38 @@ type TransportConfig struct {
 	MaxIdleConnsPerHost   int
 }
 
+// Hardened fallbacks for zero TransportConfig fields.
+const (
+	defaultDialTimeout           = 3 * time.Second
+	defaultTLSHandshakeTimeout   = 5 * time.Second
+	defaultResponseHeaderTimeout = 10 * time.Second
+	defaultIdleConnTimeout       = 90 * time.Second
+	defaultMaxIdleConns          = 256
+	defaultMaxIdleConnsPerHost   = 64
+)
+
+// NewTransport builds the upstream transport. Zero fields fall back to the
+// hardened defaults above.
 func NewTransport(cfg TransportConfig) *http.Transport {
+	if cfg.DialTimeout <= 0 {
+		cfg.DialTimeout = defaultDialTimeout
+	}
+	if cfg.TLSHandshakeTimeout <= 0 {
+		cfg.TLSHandshakeTimeout = defaultTLSHandshakeTimeout
+	}
+	if cfg.ResponseHeaderTimeout <= 0 {
+		cfg.ResponseHeaderTimeout = defaultResponseHeaderTimeout
+	}
+	if cfg.IdleConnTimeout <= 0 {
+		cfg.IdleConnTimeout = defaultIdleConnTimeout
+	}
+	if cfg.MaxIdleConns <= 0 {
+		cfg.MaxIdleConns = defaultMaxIdleConns
+	}
+	if cfg.MaxIdleConnsPerHost <= 0 {
+		cfg.MaxIdleConnsPerHost = defaultMaxIdleConnsPerHost
+	}
+
 	dialer := &net.Dialer{
 		Timeout:   cfg.DialTimeout,
 		KeepAlive: 30 * time.Second,
@@ -34,3 +70,175 @@ func NewTransport(cfg TransportConfig) *http.Transport {
 	}
 	return tr
 }
+
+// TotalTimeout wraps next so that a whole upstream round trip, including
+// reading the response body, must finish within d. Unlike
+// ResponseHeaderTimeout this also bounds slow, long-tail bodies. When the
+// deadline expires the upstream request context is cancelled. A zero or
+// negative d returns next unchanged.
+func TotalTimeout(next http.RoundTripper, d time.Duration) http.RoundTripper {
+	if d <= 0 {
+		return next
+	}
+	return &totalTimeoutTransport{next: next, timeout: d}
+}
+
+type totalTimeoutTransport struct {
+	next    http.RoundTripper
+	timeout time.Duration
+}
+
+func (t *totalTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithTimeout(req.Context(), t.timeout)
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	// Keep the deadline alive while the body streams; release it on Close.
+	resp.Body = withCancelOnClose(resp.Body, cancel)
+	return resp, nil
+}
+
+// ErrUpstreamTimeout is the error UpstreamTimeout returns when response
+// headers did not arrive in time; the proxy answers it with 504
+// upstream_timeout.
+var ErrUpstreamTimeout = errors.New("upstream timeout")
+
+// UpstreamTimeout wraps next so that each round trip must receive response
+// headers within d, independently of the transport's ResponseHeaderTimeout.
+// Once headers arrive the body may take as long as it needs. Inside Hedge,
+// each attempt gets its own deadline. A zero or negative d returns next
+// unchanged.
+func UpstreamTimeout(next http.RoundTripper, d time.Duration) http.RoundTripper {
+	if d <= 0 {
+		return next
+	}
+	return &upstreamTimeoutTransport{next: next, timeout: d}
+}
+
+type upstreamTimeoutTransport struct {
+	next    http.RoundTripper
+	timeout time.Duration
+}
+
+func (t *upstreamTimeoutTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	ctx, cancel := context.WithCancel(req.Context())
+	timer := time.AfterFunc(t.timeout, cancel)
+	resp, err := t.next.RoundTrip(req.WithContext(ctx))
+	if !timer.Stop() {
+		// The deadline won, even if a response slipped in just after it.
+		if resp != nil {
+			resp.Body.Close()
+		}
+		cancel()
+		return nil, fmt.Errorf("%w: no response headers within %s", ErrUpstreamTimeout, t.timeout)
+	}
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	resp.Body = withCancelOnClose(resp.Body, cancel)
+	return resp, nil
+}
+
+// withCancelOnClose wraps body so that closing it calls cancel. A writable
+// body (a 101's upgraded connection) stays writable, as
+// httputil.ReverseProxy needs an io.ReadWriteCloser to upgrade.
+func withCancelOnClose(body io.ReadCloser, cancel context.CancelFunc) io.ReadCloser {
+	c := &cancelOnClose{ReadCloser: body, cancel: cancel}
+	if w, ok := body.(io.Writer); ok {
+		return cancelOnCloseWriter{cancelOnClose: c, Writer: w}
+	}
+	return c
+}
+
+type cancelOnClose struct {
+	io.ReadCloser
+	cancel context.CancelFunc
+}
+
+type cancelOnCloseWriter struct {
+	*cancelOnClose
+	io.Writer
+}
+
+func (c *cancelOnClose) Close() error {
+	err := c.ReadCloser.Close()
+	c.cancel()
+	return err
+}
+
+// CloseOn5xx keeps one transport from newTransport per upstream host and,
+// once an HTTP/1 5xx response's body is read or closed, closes that host's
+// idle connections, so the one which carried the 5xx doesn't serve another
+// request. The next request dials afresh, possibly reaching a healthier
+// instance behind a load balancer. Only idle connections are closed, never
+// one another request is using, and HTTP/2 responses are left alone since
+// other streams share their connection.
+func CloseOn5xx(newTransport func() *http.Transport) http.RoundTripper {
+	return &closeOn5xxTransport{newTransport: newTransport, hosts: map[string]*http.Transport{}}
+}
+
+type closeOn5xxTransport struct {
+	newTransport func() *http.Transport
+
+	mu    sync.Mutex
+	hosts map[string]*http.Transport
+}
+
+func (t *closeOn5xxTransport) host(req *http.Request) *http.Transport {
+	key := req.URL.Scheme + "://" + req.URL.Host
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	tr, ok := t.hosts[key]
+	if !ok {
+		tr = t.newTransport()
+		t.hosts[key] = tr
+	}
+	return tr
+}
+
+func (t *closeOn5xxTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	tr := t.host(req)
+	resp, err := tr.RoundTrip(req)
+	if err != nil || resp.StatusCode < 500 || resp.ProtoMajor != 1 {
+		return resp, err
+	}
+	resp.Body = &closeIdleOnDone{ReadCloser: resp.Body, tr: tr}
+	return resp, nil
+}
+
+func (t *closeOn5xxTransport) CloseIdleConnections() {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	for _, tr := range t.hosts {
+		tr.CloseIdleConnections()
+	}
+}
+
+// closeIdleOnDone closes tr's idle connections at body EOF or Close. By the
+// time a read returns EOF, the transport has put the connection back in the
+// pool, where closing idle connections finds it. A body closed early is
+// either dropped by the transport or drained and then put back, which the
+// close also covers: the transport closes connections that become idle
+// afterwards until it's asked for another one.
+type closeIdleOnDone struct {
+	io.ReadCloser
+	tr   *http.Transport
+	once sync.Once
+}
+
+func (b *closeIdleOnDone) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err != nil {
+		b.once.Do(b.tr.CloseIdleConnections)
+	}
+	return n, err
+}
+
+func (b *closeIdleOnDone) Close() error {
+	err := b.ReadCloser.Close()
+	b.once.Do(b.tr.CloseIdleConnections)
+	return err
+}
@@ -0,0 +1,211 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestTotalTimeoutCancelsSlowBody(t *testing.T) {
+	upstreamCancelled := make(chan struct{})
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		for i := 0; i < 20; i++ {
+			select {
+			case <-r.Context().Done():
+				close(upstreamCancelled)
+				return
+			case <-time.After(50 * time.Millisecond):
+			}
+			_, _ = w.Write([]byte("chunk\n"))
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer up.Close()
+
+	rt := TotalTimeout(http.DefaultTransport, 150*time.Millisecond)
+	req, _ := http.NewRequest(http.MethodGet, up.URL, nil)
+
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatalf("expected headers before the deadline, got %v", err)
+	}
+	defer resp.Body.Close()
+
+	_, err = io.ReadAll(resp.Body)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected deadline exceeded while reading body, got %v", err)
+	}
+
+	select {
+	case <-upstreamCancelled:
+	case <-time.After(2 * time.Second):
+		t.Fatal("expected upstream request context to be cancelled")
+	}
+}
+
+func TestTotalTimeoutKeepsUpgradesWritable(t *testing.T) {
+	u, _ := url.Parse(echoUpgradeUpstream(t).URL)
+	assertUpgrade(t, BuildProxy(u, TotalTimeout(http.DefaultTransport, time.Second)))
+}
+
+func TestTotalTimeoutZeroIsPassthrough(t *testing.T) {
+	if rt := TotalTimeout(http.DefaultTransport, 0); rt != http.DefaultTransport {
+		t.Fatalf("expected zero timeout to return the wrapped transport")
+	}
+}
+
+func TestUpstreamTimeoutBoundsOnlyTheFirstByte(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/slow-headers" {
+			select {
+			case <-r.Context().Done():
+			case <-time.After(2 * time.Second):
+			}
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+		w.(http.Flusher).Flush()
+		time.Sleep(150 * time.Millisecond)
+		_, _ = w.Write([]byte("late body"))
+	}))
+	defer up.Close()
+
+	rt := UpstreamTimeout(http.DefaultTransport, 100*time.Millisecond)
+
+	start := time.Now()
+	req, _ := http.NewRequest(http.MethodGet, up.URL+"/slow-headers", nil)
+	if _, err := rt.RoundTrip(req); !errors.Is(err, ErrUpstreamTimeout) {
+		t.Fatalf("expected ErrUpstreamTimeout, got %v", err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected the timeout near 100ms, took %s", elapsed)
+	}
+
+	// Headers in time: the body may take longer than the timeout.
+	req, _ = http.NewRequest(http.MethodGet, up.URL+"/slow-body", nil)
+	resp, err := rt.RoundTrip(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, err := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if err != nil || string(body) != "late body" {
+		t.Fatalf("expected the slow body to be read in full, got %q %v", body, err)
+	}
+}
+
+func TestUpstreamTimeoutKeepsUpgradesWritable(t *testing.T) {
+	u, _ := url.Parse(echoUpgradeUpstream(t).URL)
+	assertUpgrade(t, BuildProxy(u, UpstreamTimeout(http.DefaultTransport, time.Second)))
+}
+
+func TestNewTransportZeroFieldsUseDefaults(t *testing.T) {
+	tr := NewTransport(TransportConfig{MaxIdleConnsPerHost: 7})
+	if tr.ResponseHeaderTimeout != defaultResponseHeaderTimeout || tr.MaxIdleConns != defaultMaxIdleConns {
+		t.Fatalf("expected hardened defaults for zero fields, got header=%v idle=%d", tr.ResponseHeaderTimeout, tr.MaxIdleConns)
+	}
+	if tr.MaxIdleConnsPerHost != 7 {
+		t.Fatalf("expected configured value to win, got %d", tr.MaxIdleConnsPerHost)
+	}
+}
+
+func TestCloseOn5xxDropsTheConnection(t *testing.T) {
+	var conns atomic.Int32
+	up := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/fail" {
+			http.Error(w, "boom", http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	up.Config.ConnState = func(_ net.Conn, s http.ConnState) {
+		if s == http.StateNew {
+			conns.Add(1)
+		}
+	}
+	up.Start()
+	defer up.Close()
+
+	get := func(rt http.RoundTripper, path string) {
+		req, _ := http.NewRequest(http.MethodGet, up.URL+path, nil)
+		resp, err := rt.RoundTrip(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, _ = io.Copy(io.Discard, resp.Body)
+		resp.Body.Close()
+	}
+
+	for _, c := range []struct {
+		name    string
+		wrap    func(func() *http.Transport) http.RoundTripper
+		wantNew int32
+	}{
+		{"disabled", func(newTransport func() *http.Transport) http.RoundTripper { return newTransport() }, 1},
+		{"enabled", CloseOn5xx, 2},
+	} {
+		rt := c.wrap(func() *http.Transport { return NewTransport(TransportConfig{}) })
+		conns.Store(0)
+		get(rt, "/ok")
+		get(rt, "/ok")
+		get(rt, "/fail")
+		get(rt, "/ok")
+		rt.(interface{ CloseIdleConnections() }).CloseIdleConnections()
+		if got := conns.Load(); got != c.wantNew {
+			t.Fatalf("%s: expected %d upstream connections, got %d", c.name, c.wantNew, got)
+		}
+	}
+}
+
+func TestCloseOn5xxSparesConcurrentRequests(t *testing.T) {
+	up := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.Copy(io.Discard, r.Body)
+		if r.URL.Path == "/fail" {
+			http.Error(w, "boom", http.StatusInternalServerError)
+			return
+		}
+		_, _ = w.Write([]byte("ok"))
+	}))
+	defer up.Close()
+
+	rt := CloseOn5xx(func() *http.Transport { return NewTransport(TransportConfig{}) })
+	var failed atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 200; j++ {
+				path := "/ok"
+				if (i+j)%3 == 0 {
+					path = "/fail"
+				}
+				// A streamed body can't be replayed, so the transport won't
+				// retry a request whose connection is closed under it.
+				req, _ := http.NewRequest(http.MethodPost, up.URL+path, io.NopCloser(strings.NewReader("payload")))
+				resp, err := rt.RoundTrip(req)
+				if err != nil {
+					failed.Add(1)
+					continue
+				}
+				_, _ = io.Copy(io.Discard, resp.Body)
+				resp.Body.Close()
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := failed.Load(); n != 0 {
+		t.Fatalf("expected no request to lose its connection to another's 5xx, got %d failures", n)
+	}
+}
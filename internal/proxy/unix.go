@@ -0,0 +1,34 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"net/url"
+)
+
+// UnixSocket returns the socket path of a unix:///var/run/app.sock upstream.
+func UnixSocket(u *url.URL) (string, bool) {
+	if u == nil || u.Scheme != "unix" || u.Path == "" {
+		return "", false
+	}
+	return u.Path, true
+}
+
+// UnixTarget is the URL requests to a Unix socket upstream are proxied to:
+// the transport ignores the host, and "localhost" makes a sensible Host header.
+func UnixTarget() *url.URL {
+	return &url.URL{Scheme: "http", Host: "localhost"}
+}
+
+// NewUnixTransport is NewTransport with every connection dialed to the
+// socket at path, whatever the request URL says.
+func NewUnixTransport(cfg TransportConfig, path string) *http.Transport {
+	tr := NewTransport(cfg)
+	dial := tr.DialContext
+	tr.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return dial(ctx, "unix", path)
+	}
+	tr.Proxy = nil
+	return tr
+}
@@ -2,6 +2,9 @@ package ratelimit
 
 import (
 	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
 	"sync"
 	"time"
 
@@ -58,6 +61,10 @@ func (m *MemoryLimiter) Allow(_ context.Context, key string, rps float64, burst
 	if e == nil {
 		e = &memEntry{lim: rate.NewLimiter(rate.Limit(rps), int(burst))}
 		m.m[key] = e
+	} else if e.lim.Limit() != rate.Limit(rps) || e.lim.Burst() != int(burst) {
+		// The caller's limits changed (e.g. a new rate-limit tier); keep the bucket, apply the new shape.
+		e.lim.SetLimit(rate.Limit(rps))
+		e.lim.SetBurst(int(burst))
 	}
 	e.lastSeen = time.Now()
 	lim := e.lim
@@ -78,6 +85,112 @@ func (m *MemoryLimiter) Allow(_ context.Context, key string, rps float64, burst
 	return dec, nil
 }
 
+func (m *MemoryLimiter) Reset(_ context.Context, key string) (bool, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.m[key]
+	delete(m.m, key)
+	return ok, nil
+}
+
+func (m *MemoryLimiter) Peek(_ context.Context, key string) (BucketState, bool, error) {
+	m.mu.Lock()
+	e := m.m[key]
+	m.mu.Unlock()
+	if e == nil {
+		return BucketState{}, false, nil
+	}
+	now := time.Now()
+	return newBucketState(now, e.lim.TokensAt(now), float64(e.lim.Limit()), float64(e.lim.Burst())), true, nil
+}
+
+// memSnapshot is the on-disk form written by Snapshot.
+type memSnapshot struct {
+	SavedAt time.Time                `json:"saved_at"`
+	Buckets map[string]memBucketSave `json:"buckets"`
+}
+
+type memBucketSave struct {
+	Tokens   float64   `json:"tokens"`
+	RPS      float64   `json:"rps"`
+	Burst    int       `json:"burst"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// Snapshot writes every bucket's token count to path (atomically, via a
+// temp file and rename) so Restore can pick them up after a restart.
+func (m *MemoryLimiter) Snapshot(path string) error {
+	now := time.Now()
+	snap := memSnapshot{SavedAt: now, Buckets: map[string]memBucketSave{}}
+	m.mu.Lock()
+	for k, e := range m.m {
+		snap.Buckets[k] = memBucketSave{
+			Tokens:   e.lim.TokensAt(now),
+			RPS:      float64(e.lim.Limit()),
+			Burst:    e.lim.Burst(),
+			LastSeen: e.lastSeen,
+		}
+	}
+	m.mu.Unlock()
+
+	b, err := json.Marshal(snap)
+	if err != nil {
+		return err
+	}
+	tmp, err := os.CreateTemp(filepath.Dir(path), filepath.Base(path)+".tmp*")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// Restore loads buckets saved by Snapshot. Tokens keep refilling for the
+// time the process was down, and buckets idle longer than the TTL are
+// skipped. A missing file returns an error matching fs.ErrNotExist.
+func (m *MemoryLimiter) Restore(path string) error {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	var snap memSnapshot
+	if err := json.Unmarshal(b, &snap); err != nil {
+		return err
+	}
+
+	now := time.Now()
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	for k, s := range snap.Buckets {
+		if now.Sub(s.LastSeen) > m.ttl {
+			continue
+		}
+		m.m[k] = &memEntry{lim: restoredLimiter(s, snap.SavedAt), lastSeen: s.LastSeen}
+	}
+	return nil
+}
+
+// restoredLimiter returns a limiter holding s.Tokens at savedAt. rate.Limiter
+// has no token setter, so it drains a full bucket at the instant it would
+// have been empty and lets the normal refill bring it back to s.Tokens.
+func restoredLimiter(s memBucketSave, savedAt time.Time) *rate.Limiter {
+	lim := rate.NewLimiter(rate.Limit(s.RPS), s.Burst)
+	if s.RPS <= 0 {
+		lim.AllowN(savedAt, s.Burst-int(s.Tokens))
+		return lim
+	}
+	emptyAt := savedAt.Add(-time.Duration(s.Tokens / s.RPS * float64(time.Second)))
+	lim.AllowN(emptyAt, s.Burst)
+	return lim
+}
+
 func (m *MemoryLimiter) Close() error {
 	close(m.stopCh)
 	return nil
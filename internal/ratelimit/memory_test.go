@@ -0,0 +1,53 @@
+package ratelimit
+
+import (
+	"context"
+	"errors"
+	"io/fs"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestMemoryLimiterSnapshotRestore(t *testing.T) {
+	ctx := context.Background()
+	path := filepath.Join(t.TempDir(), "limiter.json")
+
+	a := NewMemoryLimiter(time.Minute, time.Minute)
+	defer a.Close()
+	// 0.01 rps barely refills during the test: 10 - 7 leaves ~3 tokens.
+	for i := 0; i < 7; i++ {
+		if dec, _ := a.Allow(ctx, "k", 0.01, 10, 1); !dec.Allowed {
+			t.Fatalf("request %d should be allowed", i)
+		}
+	}
+	if err := a.Snapshot(path); err != nil {
+		t.Fatal(err)
+	}
+
+	b := NewMemoryLimiter(time.Minute, time.Minute)
+	defer b.Close()
+	if err := b.Restore(path); err != nil {
+		t.Fatal(err)
+	}
+	st, ok, err := b.Peek(ctx, "k")
+	if err != nil || !ok {
+		t.Fatalf("expected restored bucket, ok=%v err=%v", ok, err)
+	}
+	if st.Tokens < 2.9 || st.Tokens > 3.1 {
+		t.Fatalf("expected ~3 tokens after restore, got %v", st.Tokens)
+	}
+	allowed := 0
+	for i := 0; i < 5; i++ {
+		if dec, _ := b.Allow(ctx, "k", 0.01, 10, 1); dec.Allowed {
+			allowed++
+		}
+	}
+	if allowed != 3 {
+		t.Fatalf("expected the restored budget of 3, got %d", allowed)
+	}
+
+	if err := b.Restore(filepath.Join(t.TempDir(), "missing.json")); !errors.Is(err, fs.ErrNotExist) {
+		t.Fatalf("expected fs.ErrNotExist for a missing file, got %v", err)
+	}
+}
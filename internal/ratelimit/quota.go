@@ -0,0 +1,81 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// QuotaDecision is the outcome of consuming from a fixed-window quota.
+type QuotaDecision struct {
+	Allowed   bool
+	Limit     int64
+	Remaining int64
+	Reset     time.Time // when the current window ends
+}
+
+// QuotaLimiter enforces a request budget per key over a daily window that
+// resets at midnight UTC. It is independent of the token bucket Limiter.
+type QuotaLimiter interface {
+	Consume(ctx context.Context, key string, limit int64, cost int64) (QuotaDecision, error)
+	Close() error
+}
+
+// NextUTCMidnight returns the end of the daily quota window containing now.
+func NextUTCMidnight(now time.Time) time.Time {
+	y, m, d := now.UTC().Date()
+	return time.Date(y, m, d+1, 0, 0, 0, 0, time.UTC)
+}
+
+type quotaEntry struct {
+	used  int64
+	reset time.Time
+}
+
+// MemoryQuota is an in-process QuotaLimiter. Counts are lost on restart.
+type MemoryQuota struct {
+	mu        sync.Mutex
+	m         map[string]*quotaEntry
+	nextSweep time.Time
+	now       func() time.Time
+}
+
+func NewMemoryQuota() *MemoryQuota {
+	return &MemoryQuota{m: make(map[string]*quotaEntry), now: time.Now}
+}
+
+func (q *MemoryQuota) Consume(_ context.Context, key string, limit int64, cost int64) (QuotaDecision, error) {
+	now := q.now()
+	reset := NextUTCMidnight(now)
+
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	// Drop finished windows once per window instead of running a GC goroutine.
+	if !now.Before(q.nextSweep) {
+		for k, e := range q.m {
+			if !now.Before(e.reset) {
+				delete(q.m, k)
+			}
+		}
+		q.nextSweep = reset
+	}
+
+	e := q.m[key]
+	if e == nil || !now.Before(e.reset) {
+		e = &quotaEntry{reset: reset}
+		q.m[key] = e
+	}
+
+	dec := QuotaDecision{Limit: limit, Reset: e.reset}
+	if e.used+cost > limit {
+		dec.Remaining = max(limit-e.used, 0)
+		return dec, nil
+	}
+	e.used += cost
+	dec.Allowed = true
+	dec.Remaining = limit - e.used
+	return dec, nil
+}
+
+func (q *MemoryQuota) Close() error { return nil }
@@ -1,6 +1,9 @@
 package ratelimit
 
-import "context"
+import (
+	"context"
+	"time"
+)
 
 type Decision struct {
 	Allowed           bool
@@ -8,9 +11,57 @@ type Decision struct {
 	Remaining         float64
 	LimitRPS          float64
 	Burst             float64
+
+	// SoftExceeded is set when the request is allowed by the hard limit but
+	// is over the soft threshold (see AllowSoft).
+	SoftExceeded bool
 }
 
 type Limiter interface {
 	Allow(ctx context.Context, key string, rps float64, burst float64, cost float64) (Decision, error)
+	// Reset drops the bucket for key, reporting whether it existed.
+	Reset(ctx context.Context, key string) (bool, error)
+	// Peek reads the bucket for key without consuming a token, reporting
+	// whether it exists.
+	Peek(ctx context.Context, key string) (BucketState, bool, error)
 	Close() error
 }
+
+// BucketState is a point-in-time view of a token bucket.
+type BucketState struct {
+	Tokens   float64
+	LimitRPS float64
+	Burst    float64
+	ResetAt  time.Time // when the bucket will have refilled to Burst
+}
+
+func newBucketState(now time.Time, tokens, rps, burst float64) BucketState {
+	st := BucketState{Tokens: tokens, LimitRPS: rps, Burst: burst, ResetAt: now}
+	if missing := burst - tokens; missing > 0 && rps > 0 {
+		st.ResetAt = now.Add(time.Duration(missing / rps * float64(time.Second)))
+	}
+	return st
+}
+
+// AllowSoft enforces the hard rps/burst limit and, when softRPS > 0, also
+// tracks a soft bucket under key+":soft". The soft bucket never blocks; it
+// only sets Decision.SoftExceeded. Its burst is scaled by softRPS/rps so the
+// soft threshold trips proportionally before the hard one.
+func AllowSoft(ctx context.Context, l Limiter, key string, rps, burst, softRPS, cost float64) (Decision, error) {
+	dec, err := l.Allow(ctx, key, rps, burst, cost)
+	if err != nil || !dec.Allowed || softRPS <= 0 || rps <= 0 {
+		return dec, err
+	}
+
+	softBurst := burst * softRPS / rps
+	if softBurst < 1 {
+		softBurst = 1
+	}
+	soft, err := l.Allow(ctx, key+":soft", softRPS, softBurst, cost)
+	if err != nil {
+		// The hard decision stands; a soft-bucket failure is not worth failing the request.
+		return dec, nil
+	}
+	dec.SoftExceeded = !soft.Allowed
+	return dec, nil
+}
@@ -2,6 +2,7 @@ package ratelimit
 
 import (
 	"context"
+	"strconv"
 	"time"
 
 	"github.com/redis/go-redis/v9"
@@ -44,11 +45,32 @@ else
   end
 end
 
-redis.call("HMSET", key, "tokens", tokens, "ts", ts)
+redis.call("HMSET", key, "tokens", tokens, "ts", ts, "rate", rate, "burst", burst)
 redis.call("PEXPIRE", key, 300000)
 return {allowed, tokens, retry_ms}
 `
 
+// Read-only refill of the bucket written by tokenBucketLua. Floats are returned
+// as strings since Redis truncates Lua numbers to integers.
+const tokenPeekLua = `
+local key = KEYS[1]
+local now_ms = tonumber(ARGV[1])
+
+local data = redis.call("HMGET", key, "tokens", "ts", "rate", "burst")
+local tokens = tonumber(data[1])
+if tokens == nil then
+  return {0}
+end
+local ts = tonumber(data[2]) or now_ms
+local rate = tonumber(data[3]) or 0
+local burst = tonumber(data[4]) or tokens
+
+if rate > 0 then
+  tokens = math.min(burst, tokens + (math.max(0, now_ms - ts) / 1000.0) * rate)
+end
+return {1, tostring(tokens), tostring(rate), tostring(burst)}
+`
+
 type RedisLimiter struct {
 	rdb *redis.Client
 }
@@ -78,6 +100,33 @@ func (r *RedisLimiter) Allow(ctx context.Context, key string, rps float64, burst
 	return dec, nil
 }
 
+func (r *RedisLimiter) Reset(ctx context.Context, key string) (bool, error) {
+	n, err := r.rdb.Del(ctx, key).Result()
+	if err != nil {
+		return false, err
+	}
+	return n > 0, nil
+}
+
+func (r *RedisLimiter) Peek(ctx context.Context, key string) (BucketState, bool, error) {
+	now := time.Now()
+	res, err := r.rdb.Eval(ctx, tokenPeekLua, []string{key}, now.UnixMilli()).Result()
+	if err != nil {
+		return BucketState{}, false, err
+	}
+	arr, ok := res.([]any)
+	if !ok || len(arr) == 0 {
+		return BucketState{}, false, redis.Nil
+	}
+	if toInt(arr[0]) != 1 {
+		return BucketState{}, false, nil
+	}
+	if len(arr) != 4 {
+		return BucketState{}, false, redis.Nil
+	}
+	return newBucketState(now, parseFloat(arr[1]), parseFloat(arr[2]), parseFloat(arr[3])), true, nil
+}
+
 func (r *RedisLimiter) Close() error { return r.rdb.Close() }
 
 func toInt(v any) int64 {
@@ -93,6 +142,14 @@ func toInt(v any) int64 {
 	}
 }
 
+func parseFloat(v any) float64 {
+	if s, ok := v.(string); ok {
+		f, _ := strconv.ParseFloat(s, 64)
+		return f
+	}
+	return toFloat(v)
+}
+
 func toFloat(v any) float64 {
 	switch t := v.(type) {
 	case float64:
@@ -0,0 +1,61 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// Only increments when the cost fits, so rejected requests don't inflate the count.
+const quotaLua = `
+local key = KEYS[1]
+local limit = tonumber(ARGV[1])
+local cost = tonumber(ARGV[2])
+local reset_at = tonumber(ARGV[3])
+
+local used = tonumber(redis.call("GET", key) or "0")
+if used + cost > limit then
+  return {0, used}
+end
+
+used = redis.call("INCRBY", key, cost)
+if used == cost then
+  redis.call("EXPIREAT", key, reset_at)
+end
+return {1, used}
+`
+
+type RedisQuota struct {
+	rdb *redis.Client
+}
+
+func NewRedisQuota(rdb *redis.Client) *RedisQuota {
+	return &RedisQuota{rdb: rdb}
+}
+
+func (r *RedisQuota) Consume(ctx context.Context, key string, limit int64, cost int64) (QuotaDecision, error) {
+	reset := NextUTCMidnight(time.Now())
+	// The window is part of the key so a missed EXPIREAT can't leak usage into the next day.
+	k := key + ":" + reset.AddDate(0, 0, -1).Format("20060102")
+
+	res, err := r.rdb.Eval(ctx, quotaLua, []string{k}, limit, cost, reset.Unix()).Result()
+	if err != nil {
+		return QuotaDecision{}, err
+	}
+	arr, ok := res.([]any)
+	if !ok || len(arr) != 2 {
+		return QuotaDecision{}, redis.Nil
+	}
+	used := toInt(arr[1])
+
+	return QuotaDecision{
+		Allowed:   toInt(arr[0]) == 1,
+		Limit:     limit,
+		Remaining: max(limit-used, 0),
+		Reset:     reset,
+	}, nil
+}
+
+// Close is a no-op; the client is shared with RedisLimiter, which owns it.
+func (r *RedisQuota) Close() error { return nil }
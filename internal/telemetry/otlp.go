@@ -0,0 +1,53 @@
+package telemetry
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/resource"
+	semconv "go.opentelemetry.io/otel/semconv/v1.26.0"
+)
+
+// OTLPOptions configures the OTLP/HTTP metrics exporter.
+type OTLPOptions struct {
+	Endpoint string // host:port
+	URLPath  string // default /v1/metrics
+	Insecure bool
+	Headers  map[string]string
+	Interval time.Duration // default 15s
+}
+
+// NewOTLPMeterProvider returns a meter provider that periodically pushes to
+// an OTLP collector. Callers must Shutdown it to flush the last interval.
+func NewOTLPMeterProvider(ctx context.Context, opts OTLPOptions) (*sdkmetric.MeterProvider, error) {
+	if opts.Endpoint == "" {
+		return nil, errors.New("otlp endpoint is required")
+	}
+	if opts.Interval <= 0 {
+		opts.Interval = 15 * time.Second
+	}
+
+	expOpts := []otlpmetrichttp.Option{otlpmetrichttp.WithEndpoint(opts.Endpoint)}
+	if opts.URLPath != "" {
+		expOpts = append(expOpts, otlpmetrichttp.WithURLPath(opts.URLPath))
+	}
+	if opts.Insecure {
+		expOpts = append(expOpts, otlpmetrichttp.WithInsecure())
+	}
+	if len(opts.Headers) > 0 {
+		expOpts = append(expOpts, otlpmetrichttp.WithHeaders(opts.Headers))
+	}
+
+	exp, err := otlpmetrichttp.New(ctx, expOpts...)
+	if err != nil {
+		return nil, err
+	}
+
+	return sdkmetric.NewMeterProvider(
+		sdkmetric.WithReader(sdkmetric.NewPeriodicReader(exp, sdkmetric.WithInterval(opts.Interval))),
+		sdkmetric.WithResource(resource.NewSchemaless(semconv.ServiceName("apigw"))),
+	), nil
+}